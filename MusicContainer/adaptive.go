@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v4"
+)
+
+// Adaptive bitrate moves each listener between the quality tiers on its own.
+// Listener peer connections run pion's send-side bandwidth estimator (Google
+// congestion control, fed by the browser's transport-wide congestion control
+// reports), and every few seconds each listener is put on the highest tier
+// its estimate carries with the same headroom the probe uses. Listeners drop
+// a tier as soon as the estimate does, but only climb back after it has held
+// for adaptiveUpgradeAfter, so a noisy link doesn't flap between tiers.
+
+const (
+	adaptiveInterval     = 2 * time.Second
+	adaptiveUpgradeAfter = 10 * time.Second
+	adaptiveMinBitrate   = 10000 // floor for the estimator, in bps
+)
+
+var adaptiveSwitches = newCounter("radio_adaptive_switches_total", "Quality tier changes made by adaptive bitrate.")
+
+// adaptiveEnabled reports whether listeners get a bandwidth estimator, which
+// only pays off when there is more than one tier to pick from.
+func adaptiveEnabled() bool {
+	return cfg.Audio.Adaptive && len(stationBitrates()) > 1
+}
+
+// newBandwidthEstimator starts the estimate at what the top tier needs, so
+// listeners on a good link never get moved down while it settles.
+func newBandwidthEstimator() (cc.BandwidthEstimator, error) {
+	bitrates := stationBitrates()
+	top := int(neededKbps(bitrates[len(bitrates)-1]) * 1000)
+	return gcc.NewSendSideBWE(
+		gcc.SendSideBWEInitialBitrate(top),
+		gcc.SendSideBWEMinBitrate(adaptiveMinBitrate),
+		gcc.SendSideBWEMaxBitrate(2*top),
+	)
+}
+
+// adaptiveBitrate returns the highest bitrate that fits an estimate of
+// estimateBps, but no more than max when the listener picked one.
+func adaptiveBitrate(estimateBps, max int) int {
+	bitrates := stationBitrates()
+	best := bitrates[0]
+	for _, b := range bitrates {
+		if max > 0 && b > max {
+			break
+		}
+		if neededKbps(b)*1000 <= float64(estimateBps) {
+			best = b
+		}
+	}
+	return best
+}
+
+// chooseBitrate is setBitrate for the listener's own choice, which adaptive
+// bitrate then never goes above.
+func (s *session) chooseBitrate(bitrate int) int {
+	s.maxBitrate.Store(int64(bitrate))
+	return s.setBitrate(bitrate)
+}
+
+// adapt moves the session towards the tier its bandwidth estimate carries.
+func (s *session) adapt(now time.Time) {
+	estimate := s.estimator.GetTargetBitrate()
+	want := adaptiveBitrate(estimate, int(s.maxBitrate.Load()))
+	current := int(s.bitrate.Load())
+	if current == 0 {
+		current = effectiveEncoderConfig().Bitrate
+	}
+
+	switch {
+	case want < current:
+		s.upSince = time.Time{}
+		adaptiveSwitches.Inc("direction", "down")
+	case want > current && s.upSince.IsZero():
+		s.upSince = now
+		return
+	case want > current && now.Sub(s.upSince) >= adaptiveUpgradeAfter:
+		s.upSince = time.Time{}
+		adaptiveSwitches.Inc("direction", "up")
+	default:
+		if want == current {
+			s.upSince = time.Time{}
+		}
+		return
+	}
+	log.Printf("Moving session %s from %d to %d bps (estimate %d bps)", s.id, current, want, estimate)
+	s.bitrateSwitches.Add(1)
+	s.setBitrate(want)
+}
+
+func runAdaptive() {
+	for now := range time.Tick(adaptiveInterval) {
+		sessions.mu.Lock()
+		var adaptive []*session
+		for _, s := range sessions.sessions {
+			if s.estimator != nil && s.state == webrtc.PeerConnectionStateConnected {
+				adaptive = append(adaptive, s)
+			}
+		}
+		sessions.mu.Unlock()
+		for _, s := range adaptive {
+			s.adapt(now)
+		}
+	}
+}
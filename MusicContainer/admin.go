@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// isAdmin reports whether r carries the configured admin token. With no token
+// configured only requests made on the station's own host are admin ones.
+func isAdmin(r *http.Request) bool {
+	// Only the admin listener asks for client certificates
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	token := cfg.Admin.Token
+	if token == "" {
+		return localRequest(r)
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// localRequest reports whether r comes straight from the loopback interface.
+// A proxy on the same host forwards everyone's requests from there, so
+// anything carrying a forwarding header doesn't count.
+func localRequest(r *http.Request) bool {
+	if r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("Forwarded") != "" || r.Header.Get("X-Real-IP") != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminSecured reports whether admin endpoints are protected by more than
+// being on the station's host: an admin token or the admin listener.
+// Endpoints that hand out the station or its secrets need one of them.
+func adminSecured() bool {
+	return cfg.Admin.Token != "" || cfg.Admin.Listen != ""
+}
+
+// requireAdmin rejects requests to h that don't carry the admin token.
+// Preflights never get this far; withCORS answers them.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+var adminMux = http.NewServeMux()
+
+// serveAdmin runs the mutual-TLS admin listener.
+func serveAdmin() error {
+	c := cfg.Admin
+	if c.TLSCert == "" || c.TLSKey == "" || c.ClientCA == "" {
+		return fmt.Errorf("admin listener needs tls_cert, tls_key and client_ca")
+	}
+	pem, err := os.ReadFile(c.ClientCA)
+	if err != nil {
+		return fmt.Errorf("reading admin client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", c.ClientCA)
+	}
+
+	server := &http.Server{
+		Addr:    c.Listen,
+		Handler: adminMux,
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  pool,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	log.Printf("Admin API listening on %s (client certificates required)", c.Listen)
+	return server.ListenAndServeTLS(c.TLSCert, c.TLSKey)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// Every transport a listener can connect through (/offer, /ws, /poll and
+// /whep) lets a new listener in the same way, through admit: the offer rate
+// limit, then whether the server is shutting down or the station was handed
+// off, the listener token (which a handoff token stands in for), whether the
+// station is on air and the server has file descriptors to spare, and last
+// the station's quota and waitlist. Only how a refusal is sent differs, an
+// HTTP error or a message on the signaling socket.
+
+// admit reserves a session for the listener offering through r.
+// handoffToken is the token from a server that handed the station off,
+// ticket a waitlist ticket from an earlier attempt; either may be empty.
+// It returns the error code the listener was turned away with, or "" with
+// the new session in a.session, which the caller must remove if the offer
+// then fails.
+func admit(r *http.Request, handoffToken, ticket string) (a admission, code string) {
+	defer func() {
+		if code != "" {
+			log.Printf("Turned away %s: %s", r.RemoteAddr, code)
+		}
+	}()
+	if ok, retry := allowRequest("offer", r); !ok {
+		return admission{retry: retry}, "rate_limited"
+	}
+	if shuttingDown.Load() {
+		return a, "shutting_down"
+	}
+	// Send listeners on to the server the station was handed off to
+	if url, _ := handoff.moved(); url != "" {
+		return a, "station_moved"
+	}
+	handedOff := handoff.Valid(handoffToken)
+	if code := checkListenerToken(r, handedOff); code != "" {
+		return a, code
+	}
+	// Don't connect listeners to a station that is only producing silence
+	if !stationOnline.Load() {
+		return a, "station_offline"
+	}
+	if fds.Exhausted() {
+		return a, "server_busy"
+	}
+	a = sessions.Admit(r.RemoteAddr, ticket, handedOff)
+	if a.session == nil {
+		return a, "station_full"
+	}
+	a.session.listener = listenerID(r)
+	a.session.applyBitrateParam(r)
+	return a, ""
+}
+
+// writeAdmissionRejection answers an offer admit turned away with code.
+func writeAdmissionRejection(w http.ResponseWriter, a admission, code string) {
+	switch code {
+	case "rate_limited":
+		writeRateLimited(w, a.retry)
+	case "shutting_down":
+		writeShuttingDown(w)
+	case "station_moved":
+		writeStationMoved(w)
+	case "station_offline":
+		writeStationOffline(w)
+	case "server_busy":
+		writeServerBusy(w)
+	case "station_full":
+		writeQuotaRejection(w, a)
+	default:
+		writeTokenRejection(w, code)
+	}
+}
+
+// admissionRejection is the same refusal as a message, for the signaling
+// socket.
+func admissionRejection(a admission, code string) map[string]interface{} {
+	switch code {
+	case "rate_limited":
+		return map[string]interface{}{"error": code, "retry_after": a.retry}
+	case "shutting_down":
+		return serverShuttingDown()
+	case "station_moved":
+		return stationMoved()
+	case "station_offline":
+		return stationOffline()
+	case "server_busy":
+		return serverBusy()
+	case "station_full":
+		body, _ := quotaRejection(a)
+		return body
+	}
+	return map[string]interface{}{"error": code}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const notifyTimeout = 10 * time.Second
+
+var alertsSent = newCounter("radio_alerts_total", "Alerts delivered, by rule, notifier and result.")
+
+// runAlerts watches the status channel and fires the configured alert rules.
+func runAlerts(c AlertsConfig) error {
+	if len(c.Rules) == 0 {
+		return nil
+	}
+
+	notifiers := make(map[string]Notifier, len(c.Notifiers))
+	for name, nc := range c.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return fmt.Errorf("notifier %s: %w", name, err)
+		}
+		notifiers[name] = n
+	}
+	for _, rule := range c.Rules {
+		for _, name := range rule.Notifiers {
+			if notifiers[name] == nil {
+				return fmt.Errorf("alert rule %s uses unknown notifier %s", rule.Name, name)
+			}
+		}
+	}
+
+	events, _ := status.Subscribe()
+	go func() {
+		lastFired := make(map[string]time.Time)
+		for ev := range events {
+			for _, rule := range c.Rules {
+				if !rule.matches(ev) || time.Since(lastFired[rule.Name]) < time.Duration(rule.Cooldown) {
+					continue
+				}
+				lastFired[rule.Name] = time.Now()
+
+				a := Alert{
+					Rule:    rule.Name,
+					Station: cfg.Station.ID,
+					Event:   ev.Type,
+					Time:    ev.Time,
+					Message: rule.Message,
+					Data:    ev.Data,
+				}
+				if a.Message == "" {
+					data, _ := json.Marshal(ev.Data)
+					a.Message = fmt.Sprintf("%s %s", ev.Type, data)
+				}
+				for _, name := range rule.Notifiers {
+					go deliverAlert(name, notifiers[name], a)
+				}
+			}
+		}
+	}()
+	log.Printf("Watching %d alert rules", len(c.Rules))
+	return nil
+}
+
+func deliverAlert(name string, n Notifier, a Alert) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	if err := n.Notify(ctx, a); err != nil {
+		log.Printf("Error sending alert %s to %s: %v", a.Rule, name, err)
+		alertsSent.Inc("rule", a.Rule, "notifier", name, "result", "error")
+		return
+	}
+	alertsSent.Inc("rule", a.Rule, "notifier", name, "result", "ok")
+}
+
+// matches reports whether ev is the event the rule watches for and every
+// Match field has the expected value in the event's data.
+func (r AlertRule) matches(ev StatusEvent) bool {
+	if ev.Type != r.Event {
+		return false
+	}
+	if len(r.Match) == 0 {
+		return true
+	}
+	raw, err := json.Marshal(ev.Data)
+	if err != nil {
+		return false
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return false
+	}
+	for k, want := range r.Match {
+		if fmt.Sprint(fields[k]) != want {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Answers pass through a list of hooks before they are sent, each one
+// rewriting the SDP pion generated. Candidate pruning is the first; the
+// "answer" config section adds more:
+//
+//   - codecs strips every other codec from the audio sections, so a client
+//     can't pick something the station doesn't want to negotiate.
+//   - payload_types renumbers codecs, e.g. {"opus": 109}, for gateways that
+//     expect fixed numbers. RTP is still sent with the client's own numbers
+//     from its offer, as SDP requires.
+//   - bandwidth_kbps adds a b=AS line to the audio sections.
+
+// answerHook rewrites an answer's SDP.
+type answerHook struct {
+	name  string
+	apply func(sdp string) string
+}
+
+var answerHooks []answerHook
+
+func registerAnswerHook(name string, apply func(sdp string) string) {
+	answerHooks = append(answerHooks, answerHook{name: name, apply: apply})
+}
+
+func applyAnswerHooks(sdp string) string {
+	for _, h := range answerHooks {
+		sdp = h.apply(sdp)
+	}
+	return sdp
+}
+
+// setupAnswerHooks registers the hooks the config asks for.
+func setupAnswerHooks(c AnswerConfig) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	registerAnswerHook("prune_candidates", answerFilter.pruneCandidates)
+	if len(c.Codecs) > 0 {
+		keep := make(map[string]bool)
+		for _, name := range c.Codecs {
+			keep[strings.ToLower(name)] = true
+		}
+		registerAnswerHook("codecs", func(sdp string) string { return stripCodecs(sdp, keep) })
+	}
+	if len(c.PayloadTypes) > 0 {
+		registerAnswerHook("payload_types", func(sdp string) string { return renumberCodecs(sdp, c.PayloadTypes) })
+	}
+	if c.BandwidthKbps > 0 {
+		registerAnswerHook("bandwidth", func(sdp string) string { return setBandwidth(sdp, c.BandwidthKbps) })
+	}
+	if len(answerHooks) > 1 {
+		names := make([]string, len(answerHooks))
+		for i, h := range answerHooks {
+			names[i] = h.name
+		}
+		log.Printf("Answer hooks: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+func (c AnswerConfig) validate() error {
+	for name, pt := range c.PayloadTypes {
+		if pt < 96 || pt > 127 {
+			return fmt.Errorf("payload type for %s must be between 96 and 127, got %d", name, pt)
+		}
+	}
+	if c.BandwidthKbps < 0 {
+		return fmt.Errorf("bandwidth_kbps must not be negative")
+	}
+	if len(c.Codecs) > 0 {
+		for _, name := range c.Codecs {
+			if strings.EqualFold(name, "opus") {
+				return nil
+			}
+		}
+		return fmt.Errorf("codecs must include opus")
+	}
+	return nil
+}
+
+// sdpSection is the session part of an SDP, or one media section.
+type sdpSection struct {
+	lines []string
+}
+
+func (s *sdpSection) audio() bool {
+	return len(s.lines) > 0 && strings.HasPrefix(s.lines[0], "m=audio ")
+}
+
+func splitSDP(sdp string) []*sdpSection {
+	sections := []*sdpSection{{}}
+	for _, line := range strings.Split(strings.TrimRight(sdp, "\r\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, "m=") {
+			sections = append(sections, &sdpSection{})
+		}
+		cur := sections[len(sections)-1]
+		cur.lines = append(cur.lines, line)
+	}
+	return sections
+}
+
+func joinSDP(sections []*sdpSection) string {
+	var b strings.Builder
+	for _, s := range sections {
+		for _, line := range s.lines {
+			b.WriteString(line)
+			b.WriteString("\r\n")
+		}
+	}
+	return b.String()
+}
+
+// codecs maps each payload type in the section to its lower-case codec name.
+func (s *sdpSection) codecs() map[string]string {
+	names := make(map[string]string)
+	for _, line := range s.lines {
+		if rest, ok := strings.CutPrefix(line, "a=rtpmap:"); ok {
+			pt, encoding, _ := strings.Cut(rest, " ")
+			name, _, _ := strings.Cut(encoding, "/")
+			names[pt] = strings.ToLower(name)
+		}
+	}
+	return names
+}
+
+// payloadAttr returns the payload type a=rtpmap, a=fmtp and a=rtcp-fb lines
+// refer to.
+func payloadAttr(line string) (string, bool) {
+	for _, prefix := range []string{"a=rtpmap:", "a=fmtp:", "a=rtcp-fb:"} {
+		if rest, ok := strings.CutPrefix(line, prefix); ok {
+			pt, _, _ := strings.Cut(rest, " ")
+			return pt, true
+		}
+	}
+	return "", false
+}
+
+// rtxTarget returns the payload type an RTX fmtp line points at (apt=).
+func rtxTarget(line string) string {
+	_, params, _ := strings.Cut(line, " ")
+	for _, p := range strings.Split(params, ";") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(p), "apt="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// stripCodecs removes the codecs not in keep from the audio sections. RTX
+// goes with the codec it repairs.
+func stripCodecs(sdp string, keep map[string]bool) string {
+	sections := splitSDP(sdp)
+	for _, s := range sections {
+		if !s.audio() {
+			continue
+		}
+		names := s.codecs()
+		drop := make(map[string]bool)
+		for pt, name := range names {
+			if !keep[name] {
+				drop[pt] = true
+			}
+		}
+		for _, line := range s.lines {
+			if strings.HasPrefix(line, "a=fmtp:") && names[attrPT(line)] == "rtx" && drop[rtxTarget(line)] {
+				drop[attrPT(line)] = true
+			}
+		}
+		if len(drop) == 0 {
+			continue
+		}
+
+		fields := strings.Fields(s.lines[0])
+		kept := append([]string(nil), fields[:3]...)
+		for _, pt := range fields[3:] {
+			if !drop[pt] {
+				kept = append(kept, pt)
+			}
+		}
+		if len(kept) == 3 {
+			log.Printf("WARNING: no codec left in the answer after stripping, keeping it as is")
+			continue
+		}
+		lines := []string{strings.Join(kept, " ")}
+		for _, line := range s.lines[1:] {
+			if pt, ok := payloadAttr(line); ok && drop[pt] {
+				continue
+			}
+			lines = append(lines, line)
+		}
+		s.lines = lines
+	}
+	return joinSDP(sections)
+}
+
+// attrPT is payloadAttr for lines known to be attributes.
+func attrPT(line string) string {
+	pt, _ := payloadAttr(line)
+	return pt
+}
+
+// renumberCodecs gives the named codecs the payload types in want. A codec
+// already using a wanted number swaps with it.
+func renumberCodecs(sdp string, want map[string]int) string {
+	sections := splitSDP(sdp)
+	for _, s := range sections {
+		if !s.audio() {
+			continue
+		}
+		names := s.codecs()
+		mapping := make(map[string]string)
+		for pt, name := range names {
+			target, ok := want[name]
+			if !ok || strconv.Itoa(target) == pt {
+				continue
+			}
+			to := strconv.Itoa(target)
+			mapping[pt] = to
+			if _, taken := names[to]; taken {
+				if _, moving := mapping[to]; !moving {
+					mapping[to] = pt
+				}
+			}
+		}
+		if len(mapping) == 0 {
+			continue
+		}
+		rename := func(pt string) string {
+			if to, ok := mapping[pt]; ok {
+				return to
+			}
+			return pt
+		}
+
+		fields := strings.Fields(s.lines[0])
+		for i := 3; i < len(fields); i++ {
+			fields[i] = rename(fields[i])
+		}
+		s.lines[0] = strings.Join(fields, " ")
+		for i, line := range s.lines[1:] {
+			pt, ok := payloadAttr(line)
+			if !ok {
+				continue
+			}
+			prefix, rest, _ := strings.Cut(line, ":")
+			rest = rename(pt) + strings.TrimPrefix(rest, pt)
+			if apt := rtxTarget(line); apt != "" && strings.HasPrefix(line, "a=fmtp:") {
+				rest = strings.Replace(rest, "apt="+apt, "apt="+rename(apt), 1)
+			}
+			s.lines[i+1] = prefix + ":" + rest
+		}
+	}
+	return joinSDP(sections)
+}
+
+// setBandwidth sets b=AS in every audio section, after its c= line as SDP
+// orders them.
+func setBandwidth(sdp string, kbps int) string {
+	sections := splitSDP(sdp)
+	for _, s := range sections {
+		if !s.audio() {
+			continue
+		}
+		lines := make([]string, 0, len(s.lines)+1)
+		at := 1
+		for _, line := range s.lines {
+			if strings.HasPrefix(line, "b=AS:") {
+				continue
+			}
+			lines = append(lines, line)
+			if strings.HasPrefix(line, "i=") || strings.HasPrefix(line, "c=") {
+				at = len(lines)
+			}
+		}
+		lines = append(lines[:at], append([]string{"b=AS:" + strconv.Itoa(kbps)}, lines[at:]...)...)
+		s.lines = lines
+	}
+	return joinSDP(sections)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The original endpoints (/offer, /genre, /current-genre) are frozen as API
+// v1: their requests and responses no longer change, so players already in
+// the wild keep working. New clients use /api/v2, which wraps the same
+// handlers but answers every failure with a structured error, returns the
+// session it created, describes stations and reports what a token may do.
+//
+// Clients pick a version with the API-Version request header. A v1 route
+// asked for version 2 is served by its v2 successor; every response says
+// which version answered it. v1 responses carry Deprecation and a Link to
+// the successor, plus Sunset once api.v1_sunset is set.
+
+const apiV2Prefix = "/api/v2"
+
+// apiVersions are the versions this server speaks, oldest first.
+var apiVersions = []int{1, 2}
+
+var v1Requests = newCounter("radio_api_v1_requests_total", "Requests to the frozen v1 API, by route.")
+
+// apiError is the error body of every v2 endpoint:
+//
+//	{"error": {"code": "station_full", "message": "...", "retry_after": 30, "details": {...}}}
+type apiError struct {
+	Code       string                 `json:"code"`
+	Message    string                 `json:"message"`
+	RetryAfter int                    `json:"retry_after,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+// apiErrorMessages describes the error codes the v1 handlers answer with.
+var apiErrorMessages = map[string]string{
+	"station_offline":   "The station is not producing audio right now.",
+	"station_full":      "The station has no room for another listener.",
+	"station_moved":     "The station has moved to another server.",
+	"server_busy":       "The server is out of resources for new listeners right now.",
+	"shutting_down":     "The server is shutting down, try again shortly.",
+	"session_not_found": "No session with that ID.",
+	"token_required":    "A listener token from /api/token is required.",
+	"invalid_token":     "The listener token is not valid or has expired.",
+	"rate_limited":      "Too many requests from this address, slow down.",
+}
+
+func writeAPIError(w http.ResponseWriter, status int, e apiError) {
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="radio"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]apiError{"error": e})
+}
+
+// requestedVersion returns the API-Version the client asked for, or 0.
+func requestedVersion(r *http.Request) (int, bool) {
+	v := r.Header.Get("API-Version")
+	if v == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(v), "v"))
+	if err != nil {
+		return 0, false
+	}
+	for _, known := range apiVersions {
+		if n == known {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+func writeUnsupportedVersion(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusBadRequest, apiError{
+		Code:    "unsupported_version",
+		Message: "This server does not speak API version " + r.Header.Get("API-Version") + ".",
+		Details: map[string]interface{}{"supported": apiVersions},
+	})
+}
+
+// frozenV1 serves a v1 route, or its v2 successor for clients that ask for it.
+func frozenV1(pattern, successor string, v1, v2 http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, ok := requestedVersion(r)
+		switch {
+		case !ok:
+			writeUnsupportedVersion(w, r)
+			return
+		case v == 2:
+			v2(w, r)
+			return
+		}
+		v1Requests.Inc("route", pattern)
+		h := w.Header()
+		h.Set("API-Version", "1")
+		h.Set("Deprecation", "true")
+		h.Add("Link", "<"+successor+`>; rel="successor-version"`)
+		if sunset, err := time.Parse(time.DateOnly, cfg.API.V1Sunset); err == nil {
+			h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+		}
+		v1(w, r)
+	}
+}
+
+// apiV2 marks a response as v2 and turns away clients asking for another version.
+func apiV2(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if v, ok := requestedVersion(r); !ok || v == 1 {
+			writeUnsupportedVersion(w, r)
+			return
+		}
+		w.Header().Set("API-Version", "2")
+		h(w, r)
+	}
+}
+
+// capturedResponse holds a v1 handler's response so v2 can rework it.
+type capturedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *capturedResponse) Header() http.Header { return c.header }
+
+func (c *capturedResponse) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *capturedResponse) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	return c.body.Write(b)
+}
+
+// capture runs a v1 handler without writing its response.
+func capture(h http.HandlerFunc, r *http.Request) *capturedResponse {
+	c := &capturedResponse{header: make(http.Header)}
+	h(c, r)
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	return c
+}
+
+// relay writes a captured response, turning v1 errors into apiErrors.
+func (c *capturedResponse) relay(w http.ResponseWriter) {
+	if c.status < 400 {
+		for k, v := range c.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(c.status)
+		w.Write(c.body.Bytes())
+		return
+	}
+	writeAPIError(w, c.status, c.apiError())
+}
+
+func (c *capturedResponse) apiError() apiError {
+	var fields map[string]interface{}
+	if json.Unmarshal(c.body.Bytes(), &fields) == nil {
+		if code, ok := fields["error"].(string); ok {
+			delete(fields, "error")
+			e := apiError{Code: code, Message: apiErrorMessages[code]}
+			if retry, ok := fields["retry_after"].(float64); ok {
+				e.RetryAfter = int(retry)
+				delete(fields, "retry_after")
+			}
+			if e.Message == "" {
+				e.Message = http.StatusText(c.status)
+			}
+			if len(fields) > 0 {
+				e.Details = fields
+			}
+			return e
+		}
+	}
+	// http.Error's plain text
+	e := apiError{
+		Code:    strings.ReplaceAll(strings.ToLower(http.StatusText(c.status)), " ", "_"),
+		Message: strings.TrimSpace(c.body.String()),
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(c.status)
+	}
+	if retry, err := strconv.Atoi(c.header.Get("Retry-After")); err == nil {
+		e.RetryAfter = retry
+	}
+	return e
+}
+
+// handleOfferV2 is /offer with structured errors. A successful answer is
+// 201 Created with the session's URL in Location. The body may name the
+// station it is for.
+func handleOfferV2(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiError{Code: "bad_request", Message: err.Error()})
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var req struct {
+		Station string `json:"station"`
+	}
+	json.Unmarshal(body, &req)
+	if req.Station != "" && req.Station != cfg.Station.ID {
+		writeAPIError(w, http.StatusNotFound, apiError{Code: "station_not_found", Message: "This server does not run station " + req.Station + "."})
+		return
+	}
+
+	resp := capture(dedupeOffers(handleOffer), r)
+	if resp.status == http.StatusOK {
+		var a answer
+		if json.Unmarshal(resp.body.Bytes(), &a) == nil && a.Session != "" {
+			resp.header.Set("Location", apiV2Prefix+"/sessions/"+a.Session)
+			resp.status = http.StatusCreated
+		}
+	}
+	resp.relay(w)
+}
+
+// handleGenreV2 returns the current genre on GET and changes it on POST,
+// like /current-genre and /genre. A request queued behind a higher
+// priority one is 202 Accepted rather than v1's 409.
+func handleGenreV2(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		capture(handleCurrentGenre, r).relay(w)
+		return
+	}
+	resp := capture(handleGenreChange, r)
+	if resp.status == http.StatusUnauthorized {
+		writeAPIError(w, http.StatusUnauthorized, apiError{Code: "unauthorized", Message: "Only an admin token may change the genre for this source."})
+		return
+	}
+	if resp.status == http.StatusForbidden {
+		writeAPIError(w, http.StatusForbidden, apiError{Code: "genre_blocked", Message: "The station no longer plays this genre."})
+		return
+	}
+	if resp.status == http.StatusConflict {
+		resp.status = http.StatusAccepted
+	}
+	resp.relay(w)
+}
+
+// StationInfo describes a station in /api/v2/stations.
+type StationInfo struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	Timezone  string         `json:"timezone"`
+	Genre     string         `json:"genre"`
+	Online    bool           `json:"online"`
+	Listeners ListenerCounts `json:"listeners"`
+	// MovedTo is the server the station was handed off to, if any.
+	MovedTo string `json:"moved_to,omitempty"`
+}
+
+func currentStation() StationInfo {
+	moved, _ := handoff.moved()
+	return StationInfo{
+		ID:        cfg.Station.ID,
+		Name:      cfg.Station.Name,
+		Timezone:  cfg.Station.Timezone,
+		Genre:     getCurrentGenre(),
+		Online:    stationOnline.Load(),
+		Listeners: currentListeners(),
+		MovedTo:   moved,
+	}
+}
+
+// handleStationsV2 lists the stations on this server, or describes one.
+func handleStationsV2(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, apiV2Prefix+"/stations"), "/")
+	var resp interface{} = map[string][]StationInfo{"stations": {currentStation()}}
+	if id != "" {
+		if id != cfg.Station.ID {
+			writeAPIError(w, http.StatusNotFound, apiError{Code: "station_not_found", Message: "No station " + id + " on this server."})
+			return
+		}
+		resp = currentStation()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleSessionsV2 describes a session on GET and hangs it up on DELETE.
+// The session ID from the offer answer is what grants access to it.
+func handleSessionsV2(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, apiV2Prefix+"/sessions"), "/")
+	info, ok := sessions.Info(id)
+	if id == "" || !ok {
+		writeAPIError(w, http.StatusNotFound, apiError{Code: "session_not_found", Message: apiErrorMessages["session_not_found"]})
+		return
+	}
+	if r.Method == http.MethodDelete {
+		sessions.close(id, "hangup")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// handleAuthV2 tells a client what its token allows.
+func handleAuthV2(w http.ResponseWriter, r *http.Request) {
+	_, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	admin := isAdmin(r)
+	if bearer && !admin {
+		writeAPIError(w, http.StatusUnauthorized, apiError{Code: "invalid_token", Message: "The token is not valid on this server."})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"admin":          admin,
+		"token_required": cfg.Admin.Token != "",
+		"versions":       apiVersions,
+	})
+}
+
+// handleAPIVersions lists the API versions and where each one lives.
+func handleAPIVersions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"versions": []map[string]interface{}{
+			{"version": 1, "deprecated": true, "sunset": cfg.API.V1Sunset, "routes": []string{"/offer", "/genre", "/current-genre"}},
+			{"version": 2, "prefix": apiV2Prefix},
+		},
+	})
+}
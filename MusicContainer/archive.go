@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The archive records what the station broadcasts into WAV segments of
+// Archive.Segment length. Finished segments are listed on /archive and
+// downloaded from /archive/<name>, with Range requests and ETags so large
+// downloads can be resumed. Each segment gets a <name>.waveform.json sidecar
+// with downsampled peaks for drawing it. Segments can be encrypted at
+// rest, see archivecrypt.go.
+
+const (
+	archiveTimeFormat = "2006-01-02T15-04-05Z"
+	waveformSuffix    = ".waveform.json"
+
+	// One min/max pair per 100ms of audio
+	waveformSamplesPerPeak = 4800
+)
+
+type archiveRecorder struct {
+	dir        string
+	segment    time.Duration
+	sampleRate int
+	channels   int
+	frames     chan []int16
+	stop       chan struct{} // closed by Close
+	done       chan struct{} // closed once the open segment is finished
+
+	buf      []byte // encoding scratch space
+	file     segmentFile
+	name     string
+	started  time.Time
+	dataSize uint32
+	peaks    *peakBuilder
+}
+
+var archive *archiveRecorder
+
+// archiveKey encrypts segments, nil when they are stored in the clear.
+var archiveKey *archiveCipher
+
+func startArchive(c ArchiveConfig, sampleRate, channels int) error {
+	if c.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return err
+	}
+	key, err := loadArchiveKey(c.Encryption)
+	if err != nil {
+		return err
+	}
+	archiveKey = key
+	archive = &archiveRecorder{
+		dir:        c.Dir,
+		segment:    time.Duration(c.Segment),
+		sampleRate: sampleRate,
+		channels:   channels,
+		frames:     make(chan []int16, 256),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go archive.run()
+	log.Printf("Archiving the broadcast to %s in %v segments", c.Dir, archive.segment)
+	if archiveKey != nil {
+		log.Printf("Archive segments are encrypted")
+	}
+	if c.Retention > 0 {
+		hour, minute, err := parseClock(c.CleanupAt)
+		if err != nil {
+			return fmt.Errorf("archive cleanup_at: %w", err)
+		}
+		schedule.Daily("archive_cleanup", hour, minute, func() error {
+			return cleanArchive(c.Dir, time.Duration(c.Retention))
+		})
+	}
+	return nil
+}
+
+// cleanArchive deletes finished segments, and their waveforms, that started
+// longer than retention ago.
+func cleanArchive(dir string, retention time.Duration) error {
+	entries, err := listArchive()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retention)
+	removed := 0
+	for _, e := range entries {
+		if e.Start.After(cutoff) {
+			continue
+		}
+		path := filepath.Join(dir, e.Name)
+		if err := os.Remove(filepath.Join(dir, e.file)); err != nil {
+			return err
+		}
+		os.Remove(path + waveformSuffix)
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d archive segments older than %v", removed, retention)
+	}
+	return nil
+}
+
+// Record queues a frame for the archive. It never blocks the pacing loop; if
+// the disk can't keep up, frames are dropped.
+func (a *archiveRecorder) Record(pcm []int16) {
+	if a == nil {
+		return
+	}
+	frame := pcmSamples.clone(pcm)
+	select {
+	case a.frames <- frame:
+	default:
+		pcmSamples.put(frame)
+	}
+}
+
+// Close writes out the queued frames and finishes the open segment, waiting
+// until that is done or ctx ends.
+func (a *archiveRecorder) Close(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	close(a.stop)
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *archiveRecorder) run() {
+	defer close(a.done)
+	for {
+		select {
+		case pcm := <-a.frames:
+			a.write(pcm)
+		case <-a.stop:
+			// Record never blocks, so the queue can be emptied first
+			for len(a.frames) > 0 {
+				a.write(<-a.frames)
+			}
+			if a.file != nil {
+				a.finish()
+			}
+			return
+		}
+	}
+}
+
+func (a *archiveRecorder) write(pcm []int16) {
+	defer pcmSamples.put(pcm)
+	now := time.Now().UTC()
+	if a.file != nil && now.Sub(a.started) >= a.segment {
+		a.finish()
+	}
+	if a.file == nil {
+		if err := a.open(now); err != nil {
+			log.Printf("Error starting archive segment: %v", err)
+			return
+		}
+	}
+
+	a.buf = a.buf[:0]
+	for _, s := range pcm {
+		a.buf = binary.LittleEndian.AppendUint16(a.buf, uint16(s))
+	}
+	if _, err := a.file.Write(a.buf); err != nil {
+		log.Printf("Error writing archive segment: %v", err)
+		a.finish()
+		return
+	}
+	a.dataSize += uint32(len(a.buf))
+	a.peaks.add(pcm)
+}
+
+// diskName is the segment's file name, which has .enc added when it is
+// encrypted.
+func (a *archiveRecorder) diskName() string {
+	if archiveKey != nil {
+		return a.name + archiveEncSuffix
+	}
+	return a.name
+}
+
+func (a *archiveRecorder) open(now time.Time) error {
+	a.name = now.Format(archiveTimeFormat) + ".wav"
+	path := filepath.Join(a.dir, a.diskName()+".part")
+	if archiveKey != nil {
+		f, err := archiveKey.create(path)
+		if err != nil {
+			return err
+		}
+		a.file = f
+	} else {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		// Sizes are filled in when the segment is finished
+		if _, err := f.Write(wavHeader(a.sampleRate, a.channels, 0)); err != nil {
+			f.Close()
+			return err
+		}
+		a.file = plainSegment{f}
+	}
+	a.started = now
+	a.dataSize = 0
+	a.peaks = newPeakBuilder(a.sampleRate, a.channels)
+	return nil
+}
+
+func (a *archiveRecorder) finish() {
+	f := a.file
+	a.file = nil
+	if err := f.Finish(wavHeader(a.sampleRate, a.channels, a.dataSize)); err != nil {
+		log.Printf("Error finishing archive segment %s: %v", a.name, err)
+	}
+	path := filepath.Join(a.dir, a.diskName())
+	if err := os.Rename(path+".part", path); err != nil {
+		log.Printf("Error finishing archive segment %s: %v", a.name, err)
+		return
+	}
+	path = filepath.Join(a.dir, a.name)
+	if err := a.peaks.save(path + waveformSuffix); err != nil {
+		log.Printf("Error writing waveform for %s: %v", a.name, err)
+	}
+}
+
+func wavHeader(sampleRate, channels int, dataSize uint32) []byte {
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+dataSize)
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(sampleRate*channels*2))
+	binary.LittleEndian.PutUint16(h[32:], uint16(channels*2))
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], dataSize)
+	return h
+}
+
+// Waveform is the waveform preview JSON. Peaks holds a min and a max per
+// SamplesPerPeak samples, scaled to -127..127.
+type Waveform struct {
+	SampleRate     int    `json:"sample_rate"`
+	SamplesPerPeak int    `json:"samples_per_peak"`
+	Peaks          []int8 `json:"peaks"`
+}
+
+// peakBuilder accumulates waveform peaks as audio streams past.
+type peakBuilder struct {
+	wf       Waveform
+	channels int
+	n        int
+	min, max int16
+}
+
+func newPeakBuilder(sampleRate, channels int) *peakBuilder {
+	return &peakBuilder{
+		wf:       Waveform{SampleRate: sampleRate, SamplesPerPeak: waveformSamplesPerPeak},
+		channels: channels,
+	}
+}
+
+func (p *peakBuilder) add(pcm []int16) {
+	for i := 0; i+p.channels <= len(pcm); i += p.channels {
+		for _, s := range pcm[i : i+p.channels] {
+			if s < p.min {
+				p.min = s
+			}
+			if s > p.max {
+				p.max = s
+			}
+		}
+		p.n++
+		if p.n == p.wf.SamplesPerPeak {
+			p.wf.Peaks = append(p.wf.Peaks, int8(int(p.min)*127/32768), int8(int(p.max)*127/32768))
+			p.n, p.min, p.max = 0, 0, 0
+		}
+	}
+}
+
+func (p *peakBuilder) save(path string) error {
+	data, err := json.Marshal(p.wf)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// ArchiveEntry is one finished segment in the /archive listing.
+type ArchiveEntry struct {
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"`
+	Size     int64     `json:"size"`
+	URL      string    `json:"url"`
+	Waveform string    `json:"waveform,omitempty"`
+	// Encrypted segments are only served to admins.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	file string // the name on disk
+}
+
+func listArchive() ([]ArchiveEntry, error) {
+	dirEntries, err := os.ReadDir(cfg.Archive.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ArchiveEntry
+	for _, de := range dirEntries {
+		file := de.Name()
+		name, encrypted := strings.CutSuffix(file, archiveEncSuffix)
+		if !strings.HasSuffix(name, ".wav") {
+			continue
+		}
+		start, err := time.Parse(archiveTimeFormat, strings.TrimSuffix(name, ".wav"))
+		if err != nil {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		e := ArchiveEntry{Name: name, Start: start, Size: info.Size(), URL: "/archive/" + name, Encrypted: encrypted, file: file}
+		if encrypted {
+			e.Size = encryptedPlainSize(info.Size())
+		}
+		if _, err := os.Stat(filepath.Join(cfg.Archive.Dir, name+waveformSuffix)); err == nil {
+			e.Waveform = e.URL + waveformSuffix
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Start.After(entries[j].Start) })
+	return entries, nil
+}
+
+// handleArchive lists finished segments on /archive and serves a segment or
+// its waveform on /archive/<name>.
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	if cfg.Archive.Dir == "" {
+		http.Error(w, "Archive disabled", http.StatusNotFound)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/archive")
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		entries, err := listArchive()
+		if err != nil {
+			log.Printf("Error listing archive: %v", err)
+			http.Error(w, "Failed to list archive", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"segments": entries})
+		return
+	}
+
+	// Only finished segments and their waveforms, never anything else
+	if name != filepath.Base(name) || !(strings.HasSuffix(name, ".wav") || strings.HasSuffix(name, ".wav"+waveformSuffix)) {
+		http.NotFound(w, r)
+		return
+	}
+	path := filepath.Join(cfg.Archive.Dir, name)
+	encrypted := false
+	if _, err := os.Stat(path); os.IsNotExist(err) && strings.HasSuffix(name, ".wav") {
+		path, encrypted = path+archiveEncSuffix, true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var content io.ReadSeeker = f
+	if encrypted {
+		if !archiveAdmin(r) {
+			http.Error(w, "Encrypted segments need the admin token", http.StatusUnauthorized)
+			return
+		}
+		if archiveKey == nil {
+			http.Error(w, "No archive key configured", http.StatusServiceUnavailable)
+			return
+		}
+		d, err := archiveKey.open(f, info.Size())
+		if err != nil {
+			log.Printf("Error opening encrypted segment %s: %v", name, err)
+			http.Error(w, "Failed to decrypt segment", http.StatusInternalServerError)
+			return
+		}
+		content = d
+	}
+
+	// Finished files never change, so size and mtime make a stable ETag.
+	// http.ServeContent handles Range, If-Range and If-None-Match with it.
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	if strings.HasSuffix(name, waveformSuffix) {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "audio/wav")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// archiveAdmin reports whether r may download encrypted segments. Unlike
+// isAdmin it needs an admin token to be set up at all.
+func archiveAdmin(r *http.Request) bool {
+	return cfg.Admin.Token != "" && isAdmin(r)
+}
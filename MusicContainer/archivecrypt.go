@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// With archive.encryption set, segments are written encrypted with
+// AES-256-GCM and never touch the disk in the clear. /archive decrypts them
+// on the fly for admins, Range requests included; nobody else can download
+// them. Waveform sidecars stay readable.
+//
+// The key is 32 bytes, base64, given directly, in a file, or printed by a
+// command run once at startup so it can come from a KMS or secret store.
+// Every segment gets its own key, the HMAC-SHA256 of a random salt under
+// that key, so nonces never repeat across segments.
+//
+// An encrypted segment, <name>.wav.enc, is laid out as:
+//
+//	"IRAE", version 1, 32 byte salt, chunk size (uint32, big-endian)
+//	the 44 byte WAV header, sealed as chunk 0
+//	the audio in chunks of chunk size, sealed as chunks 1, 2, ...
+//
+// Chunk i is sealed with the nonce i (big-endian, zero padded to 12 bytes)
+// and the additional data 1 for the last audio chunk, 0 otherwise, so a
+// truncated file fails to decrypt instead of silently ending early.
+
+const (
+	archiveEncSuffix = ".enc"
+	archiveEncMagic  = "IRAE"
+	archiveChunkSize = 64 << 10
+	archivePrefixLen = 4 + 1 + 32 + 4
+	archiveHeaderLen = 44 // the WAV header
+	gcmOverhead      = 16
+)
+
+var errArchiveFormat = errors.New("not an encrypted archive segment")
+
+// archiveCipher holds the archive's master key.
+type archiveCipher struct {
+	key []byte
+}
+
+// loadArchiveKey gets the key from whichever of the settings is set.
+func loadArchiveKey(c ArchiveEncryptionConfig) (*archiveCipher, error) {
+	var encoded string
+	switch {
+	case c.Key != "":
+		encoded = c.Key
+	case c.KeyFile != "":
+		data, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading archive key: %w", err)
+		}
+		encoded = string(data)
+	case len(c.KeyCommand) > 0:
+		out, err := exec.Command(c.KeyCommand[0], c.KeyCommand[1:]...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("running archive key command: %w", err)
+		}
+		encoded = string(out)
+	default:
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("archive key must be 32 bytes, base64 encoded")
+	}
+	return &archiveCipher{key: key}, nil
+}
+
+func (c *archiveCipher) aead(salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(i uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], i)
+	return nonce
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// segmentFile is an archive segment being written. The WAV header is only
+// known once the segment is finished.
+type segmentFile interface {
+	io.Writer
+	Finish(header []byte) error
+}
+
+type plainSegment struct {
+	*os.File
+}
+
+func (s plainSegment) Finish(header []byte) error {
+	if _, err := s.WriteAt(header, 0); err != nil {
+		s.Close()
+		return err
+	}
+	return s.Close()
+}
+
+// encryptedSegment seals audio as chunks fill up. It always holds back the
+// last chunk, which is only sealed, as the last one, by Finish.
+type encryptedSegment struct {
+	f     *os.File
+	aead  cipher.AEAD
+	buf   []byte
+	chunk uint64 // the next audio chunk's index
+}
+
+func (c *archiveCipher) create(path string) (segmentFile, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 0, archivePrefixLen+archiveHeaderLen+gcmOverhead)
+	prefix = append(prefix, archiveEncMagic...)
+	prefix = append(prefix, 1)
+	prefix = append(prefix, salt...)
+	prefix = binary.BigEndian.AppendUint32(prefix, archiveChunkSize)
+	// Room for the sealed header
+	prefix = append(prefix, make([]byte, archiveHeaderLen+gcmOverhead)...)
+	if _, err := f.Write(prefix); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &encryptedSegment{f: f, aead: aead, chunk: 1}, nil
+}
+
+func (s *encryptedSegment) Write(b []byte) (int, error) {
+	s.buf = append(s.buf, b...)
+	for len(s.buf) > archiveChunkSize {
+		if err := s.seal(s.buf[:archiveChunkSize], false); err != nil {
+			return 0, err
+		}
+		s.buf = append(s.buf[:0], s.buf[archiveChunkSize:]...)
+	}
+	return len(b), nil
+}
+
+func (s *encryptedSegment) seal(plain []byte, last bool) error {
+	sealed := s.aead.Seal(nil, chunkNonce(s.chunk), plain, chunkAD(last))
+	s.chunk++
+	_, err := s.f.Write(sealed)
+	return err
+}
+
+func (s *encryptedSegment) Finish(header []byte) error {
+	if len(s.buf) > 0 {
+		if err := s.seal(s.buf, true); err != nil {
+			s.f.Close()
+			return err
+		}
+	}
+	sealed := s.aead.Seal(nil, chunkNonce(0), header, chunkAD(false))
+	if _, err := s.f.WriteAt(sealed, archivePrefixLen); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// decryptedSegment reads an encrypted segment as the plain WAV file, for
+// http.ServeContent.
+type decryptedSegment struct {
+	f         *os.File
+	aead      cipher.AEAD
+	chunkSize int64
+	dataSize  int64 // audio bytes, after the WAV header
+	pos       int64
+
+	cached int64 // index of the chunk in plain, -1 for none
+	plain  []byte
+}
+
+func (c *archiveCipher) open(f *os.File, fileSize int64) (*decryptedSegment, error) {
+	prefix := make([]byte, archivePrefixLen)
+	if _, err := f.ReadAt(prefix, 0); err != nil || string(prefix[:4]) != archiveEncMagic || prefix[4] != 1 {
+		return nil, errArchiveFormat
+	}
+	aead, err := c.aead(prefix[5:37])
+	if err != nil {
+		return nil, err
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(prefix[37:]))
+	if chunkSize == 0 || fileSize < archivePrefixLen+archiveHeaderLen+gcmOverhead {
+		return nil, errArchiveFormat
+	}
+	return &decryptedSegment{
+		f:         f,
+		aead:      aead,
+		chunkSize: chunkSize,
+		dataSize:  encryptedAudioSize(fileSize, chunkSize),
+		cached:    -1,
+	}, nil
+}
+
+// encryptedAudioSize is how many audio bytes an encrypted segment of
+// fileSize bytes holds.
+func encryptedAudioSize(fileSize, chunkSize int64) int64 {
+	sealed := fileSize - archivePrefixLen - archiveHeaderLen - gcmOverhead
+	if sealed <= 0 {
+		return 0
+	}
+	chunks := (sealed + chunkSize + gcmOverhead - 1) / (chunkSize + gcmOverhead)
+	return sealed - chunks*gcmOverhead
+}
+
+// encryptedPlainSize is the size of the WAV file an encrypted segment of
+// fileSize bytes decrypts to.
+func encryptedPlainSize(fileSize int64) int64 {
+	return archiveHeaderLen + encryptedAudioSize(fileSize, archiveChunkSize)
+}
+
+// Size is the size of the plain WAV file.
+func (d *decryptedSegment) Size() int64 {
+	return archiveHeaderLen + d.dataSize
+}
+
+// load decrypts chunk i: 0 is the WAV header, the audio starts at 1.
+func (d *decryptedSegment) load(i int64) error {
+	if d.cached == i {
+		return nil
+	}
+	var off, n int64
+	last := false
+	if i == 0 {
+		off, n = archivePrefixLen, archiveHeaderLen
+	} else {
+		start := (i - 1) * d.chunkSize
+		off = archivePrefixLen + archiveHeaderLen + gcmOverhead + (i-1)*(d.chunkSize+gcmOverhead)
+		n = min(d.chunkSize, d.dataSize-start)
+		last = start+n == d.dataSize
+	}
+	sealed := make([]byte, n+gcmOverhead)
+	if _, err := d.f.ReadAt(sealed, off); err != nil {
+		return err
+	}
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(uint64(i)), sealed, chunkAD(last))
+	if err != nil {
+		d.cached = -1
+		return fmt.Errorf("decrypting archive chunk %d: %w", i, err)
+	}
+	d.plain, d.cached = plain, i
+	return nil
+}
+
+func (d *decryptedSegment) Read(p []byte) (int, error) {
+	if d.pos >= d.Size() {
+		return 0, io.EOF
+	}
+	chunk, within := int64(0), d.pos
+	if d.pos >= archiveHeaderLen {
+		o := d.pos - archiveHeaderLen
+		chunk, within = o/d.chunkSize+1, o%d.chunkSize
+	}
+	if err := d.load(chunk); err != nil {
+		return 0, err
+	}
+	n := copy(p, d.plain[within:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptedSegment) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the segment")
+	}
+	d.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The beat clock gives interactive clients and light integrations a tempo
+// and beat grid to sync effects to. It estimates the tempo from the
+// broadcast itself: an onset envelope (the rise in energy every 5ms),
+// autocorrelated over the last 8 seconds to find the beat period, and
+// combed against that period to find where the beats fall. A generator
+// that knows its tempo can say so on POST /beat, which takes over from the
+// estimate for beatHintTTL. Either way a "beat" notification goes out every
+// second to control channels subscribed with beat.subscribe.
+
+const (
+	beatHopsPerSecond = 200
+	beatWindow        = 8 * beatHopsPerSecond // hops
+	beatMinHistory    = 4 * beatHopsPerSecond
+	beatMinBPM        = 60
+	beatMaxBPM        = 180
+	beatInterval      = time.Second // between notifications
+	beatHintTTL       = 30 * time.Second
+)
+
+var beatHub = &statusHub{
+	subs: make(map[chan StatusEvent]struct{}),
+	last: make(map[string]StatusEvent),
+}
+
+// BeatClock is one "beat" notification. BeatAt is when a beat went out, in
+// Unix milliseconds; the next ones follow every PeriodMS. Listeners hear it
+// later by however much their jitter buffer holds.
+type BeatClock struct {
+	BPM        float64 `json:"bpm"`
+	PeriodMS   float64 `json:"period_ms"`
+	BeatAt     int64   `json:"beat_at"`
+	Confidence float64 `json:"confidence"`
+	Source     string  `json:"source"` // audio or generator
+}
+
+var beatHint struct {
+	sync.Mutex
+	clock BeatClock
+	until time.Time
+}
+
+type beatTracker struct {
+	channels int
+	hop      int // samples per channel in a hop
+	onset    []float64
+	next     int
+	filled   int
+	acc      float64 // energy of the hop being collected
+	accN     int
+	prevDB   float64
+	frames   int
+	interval int // frames between notifications
+}
+
+func newBeatTracker(sampleRate, channels int) *beatTracker {
+	return &beatTracker{
+		channels: channels,
+		hop:      sampleRate / beatHopsPerSecond,
+		onset:    make([]float64, beatWindow),
+		interval: framesIn(beatInterval),
+	}
+}
+
+// add feeds one frame of the broadcast to the tracker, and publishes the
+// beat clock once a second.
+func (b *beatTracker) add(pcm []int16) {
+	for i := 0; i+b.channels <= len(pcm); i += b.channels {
+		var mono float64
+		for ch := 0; ch < b.channels; ch++ {
+			mono += float64(pcm[i+ch])
+		}
+		mono /= float64(b.channels) * 32768
+		b.acc += mono * mono
+		if b.accN++; b.accN == b.hop {
+			db := 10 * math.Log10(b.acc/float64(b.hop)+1e-10)
+			b.onset[b.next] = math.Max(0, db-b.prevDB)
+			b.next = (b.next + 1) % len(b.onset)
+			if b.filled < len(b.onset) {
+				b.filled++
+			}
+			b.prevDB, b.acc, b.accN = db, 0, 0
+		}
+	}
+
+	if b.frames++; b.frames%b.interval != 0 {
+		return
+	}
+	if clock, ok := currentBeatHint(); ok {
+		beatHub.Publish("beat", clock)
+	} else if clock, ok := b.estimate(); ok {
+		beatHub.Publish("beat", clock)
+	}
+}
+
+// at returns the onset value ago hops back from the latest.
+func (b *beatTracker) at(ago int) float64 {
+	return b.onset[(b.next-1-ago+2*len(b.onset))%len(b.onset)]
+}
+
+// estimate finds the tempo and the latest beat in the onset history.
+func (b *beatTracker) estimate() (BeatClock, bool) {
+	if b.filled < beatMinHistory {
+		return BeatClock{}, false
+	}
+	n := b.filled
+	var mean float64
+	for i := 0; i < n; i++ {
+		mean += b.at(i)
+	}
+	mean /= float64(n)
+	acf := func(lag int) float64 {
+		var sum float64
+		for i := 0; i+lag < n; i++ {
+			sum += (b.at(i) - mean) * (b.at(i+lag) - mean)
+		}
+		return sum / float64(n-lag)
+	}
+	zero := acf(0)
+	if zero <= 0 {
+		return BeatClock{}, false // silence or a steady tone
+	}
+
+	// Autocorrelation, weighted towards tempos around 120 BPM so the
+	// estimate doesn't jump between half and double time
+	minLag := beatHopsPerSecond * 60 / beatMaxBPM
+	maxLag := beatHopsPerSecond * 60 / beatMinBPM
+	scores := make([]float64, maxLag+2)
+	best := 0
+	for lag := minLag - 1; lag <= maxLag+1; lag++ {
+		bpm := 60 * beatHopsPerSecond / float64(lag)
+		prior := math.Exp(-0.5 * math.Pow(math.Log2(bpm/120)/0.7, 2))
+		scores[lag] = acf(lag) * prior
+		if lag >= minLag && lag <= maxLag && (best == 0 || scores[lag] > scores[best]) {
+			best = lag
+		}
+	}
+	if scores[best] <= 0 {
+		return BeatClock{}, false
+	}
+	period := float64(best)
+	if l, c, r := scores[best-1], scores[best], scores[best+1]; l-2*c+r != 0 {
+		period += 0.5 * (l - r) / (l - 2*c + r)
+	}
+
+	// Phase: the offset whose comb of beats lines up with the most onsets
+	phase, phaseScore := 0, -1.0
+	for o := 0; o < best; o++ {
+		var sum float64
+		for k := 0.0; ; k++ {
+			i := o + int(k*period+0.5)
+			if i >= n {
+				break
+			}
+			sum += b.at(i)
+		}
+		if sum > phaseScore {
+			phase, phaseScore = o, sum
+		}
+	}
+
+	hop := time.Second / beatHopsPerSecond
+	bpm := 60 * beatHopsPerSecond / period
+	return BeatClock{
+		BPM:        math.Round(bpm*10) / 10,
+		PeriodMS:   math.Round(60000/bpm*10) / 10,
+		BeatAt:     time.Now().Add(-time.Duration(phase) * hop).UnixMilli(),
+		Confidence: math.Round(math.Max(0, math.Min(1, acf(best)/zero))*100) / 100,
+		Source:     "audio",
+	}, true
+}
+
+// currentBeatHint returns the generator's beat clock while it is fresh,
+// with BeatAt moved up to the latest beat.
+func currentBeatHint() (BeatClock, bool) {
+	beatHint.Lock()
+	defer beatHint.Unlock()
+	if time.Now().After(beatHint.until) {
+		return BeatClock{}, false
+	}
+	c := beatHint.clock
+	if since := time.Now().UnixMilli() - c.BeatAt; since > 0 {
+		c.BeatAt += int64(float64(int64(float64(since)/c.PeriodMS)) * c.PeriodMS)
+	}
+	return c, true
+}
+
+// handleBeat returns the latest beat clock on GET. On POST the generator
+// gives its own tempo, and optionally when a beat played:
+//
+//	curl -X POST /beat -d '{"bpm": 92, "beat_at": 1760000000000}'
+func handleBeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !isAdmin(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			BPM    float64 `json:"bpm"`
+			BeatAt int64   `json:"beat_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.BPM < 20 || req.BPM > 300 {
+			http.Error(w, "bpm must be between 20 and 300", http.StatusBadRequest)
+			return
+		}
+		if req.BeatAt == 0 {
+			req.BeatAt = time.Now().UnixMilli()
+		}
+		clock := BeatClock{BPM: req.BPM, PeriodMS: 60000 / req.BPM, BeatAt: req.BeatAt, Confidence: 1, Source: "generator"}
+		beatHint.Lock()
+		beatHint.clock, beatHint.until = clock, time.Now().Add(beatHintTTL)
+		beatHint.Unlock()
+		clock, _ = currentBeatHint()
+		beatHub.Publish("beat", clock)
+	}
+
+	ev, ok := beatHub.Snapshot()["beat"]
+	if !ok {
+		http.Error(w, "No beat yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ev.Data)
+}
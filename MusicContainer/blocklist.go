@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The blocklist holds genres (or free-form prompts) the station never
+// plays again. Admins block and unblock them on /genres/blocklist; listeners
+// with a listener ID (see listenerid.go) and a listener token (tokens.go)
+// can vote on /genres/blocklist/vote, and once genre.blocklist.votes
+// distinct listeners have voted against a genre within one rotation period
+// it is blocked. Blocked genres are refused by
+// the genre arbiter whatever their source, so the auto DJ, the programming
+// guide and listeners alike move on to something else. Genres blocked at
+// runtime are kept in genre.blocklist.file across restarts.
+
+var errGenreBlocked = errors.New("genre is blocklisted")
+
+var blocklistVotes = newCounter("radio_blocklist_votes_total", "Listener votes to blocklist a genre, by outcome.")
+
+// BlockedGenre is one entry of the blocklist.
+type BlockedGenre struct {
+	Genre  string    `json:"genre"`
+	Source string    `json:"source"` // config, admin or vote
+	Since  time.Time `json:"since"`
+	Votes  int       `json:"votes,omitempty"`
+}
+
+type genreBlocklist struct {
+	mu      sync.Mutex
+	blocked map[string]*BlockedGenre        // by normalizeGenre
+	votes   map[string]map[string]time.Time // voter to when they voted, by genre
+	file    string
+}
+
+var blocklist = &genreBlocklist{blocked: make(map[string]*BlockedGenre), votes: make(map[string]map[string]time.Time)}
+
+// Blocked reports whether genre is on the blocklist.
+func (b *genreBlocklist) Blocked(genre string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.blocked[normalizeGenre(genre)] != nil
+}
+
+// List returns the blocklist, most recently blocked first.
+func (b *genreBlocklist) List() []BlockedGenre {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]BlockedGenre, 0, len(b.blocked))
+	for _, g := range b.blocked {
+		list = append(list, *g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Since.After(list[j].Since) })
+	return list
+}
+
+// Block adds genre to the blocklist and takes it off air if it is playing.
+func (b *genreBlocklist) Block(genre, source string, votes int) {
+	genre = taxonomy.Canonical(genre)
+	b.mu.Lock()
+	key := normalizeGenre(genre)
+	if b.blocked[key] != nil {
+		b.mu.Unlock()
+		return
+	}
+	b.blocked[key] = &BlockedGenre{Genre: genre, Source: source, Since: time.Now(), Votes: votes}
+	delete(b.votes, key)
+	b.mu.Unlock()
+
+	log.Printf("Genre %q blocklisted by %s", genre, source)
+	status.Publish("genre_blocked", map[string]string{"genre": genre, "source": source})
+	b.save()
+	arbiter.DropBlocked()
+}
+
+// Unblock takes genre off the blocklist. Genres blocked in the config can't
+// be unblocked at runtime.
+func (b *genreBlocklist) Unblock(genre string) bool {
+	b.mu.Lock()
+	key := normalizeGenre(genre)
+	g := b.blocked[key]
+	if g == nil || g.Source == "config" {
+		b.mu.Unlock()
+		return false
+	}
+	delete(b.blocked, key)
+	b.mu.Unlock()
+
+	log.Printf("Genre %q taken off the blocklist", g.Genre)
+	b.save()
+	return true
+}
+
+// Vote records voter's vote against genre, and blocks it once enough
+// listeners have voted within a rotation period. It returns how many have
+// voted so far.
+func (b *genreBlocklist) Vote(genre, voter string, needed int) int {
+	genre = taxonomy.Canonical(genre)
+	now := time.Now()
+	b.mu.Lock()
+	key := normalizeGenre(genre)
+	if b.blocked[key] != nil {
+		b.mu.Unlock()
+		return needed
+	}
+	if b.votes[key] == nil {
+		b.votes[key] = make(map[string]time.Time)
+	}
+	for v, at := range b.votes[key] {
+		if now.Sub(at) > listenerRotation() {
+			delete(b.votes[key], v)
+		}
+	}
+	b.votes[key][voter] = now
+	n := len(b.votes[key])
+	b.mu.Unlock()
+
+	blocklistVotes.Inc("outcome", "counted")
+	if n >= needed {
+		b.Block(genre, "vote", n)
+	}
+	return n
+}
+
+func (b *genreBlocklist) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []BlockedGenre
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range list {
+		g := list[i]
+		g.Genre = taxonomy.Canonical(g.Genre)
+		if b.blocked[normalizeGenre(g.Genre)] == nil {
+			b.blocked[normalizeGenre(g.Genre)] = &g
+		}
+	}
+	return nil
+}
+
+// save writes the genres blocked at runtime to the blocklist file.
+func (b *genreBlocklist) save() {
+	if b.file == "" {
+		return
+	}
+	var list []BlockedGenre
+	for _, g := range b.List() {
+		if g.Source != "config" {
+			list = append(list, g)
+		}
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(b.file), 0o755)
+	}
+	if err == nil {
+		tmp := b.file + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, b.file)
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving genre blocklist to %s: %v", b.file, err)
+	}
+}
+
+// startBlocklist loads the configured and saved blocklist.
+func startBlocklist(c BlocklistConfig) {
+	blocklist.file = c.File
+	for _, genre := range c.Genres {
+		genre = taxonomy.Canonical(genre)
+		blocklist.blocked[normalizeGenre(genre)] = &BlockedGenre{Genre: genre, Source: "config", Since: streamStarted}
+	}
+	if c.File != "" {
+		if err := blocklist.load(c.File); err != nil {
+			log.Printf("Error loading genre blocklist from %s: %v", c.File, err)
+		}
+	}
+	if n := len(blocklist.blocked); n > 0 {
+		log.Printf("%d genres are blocklisted", n)
+	}
+}
+
+// handleBlocklist lists the blocklist on GET, blocks a genre on POST and
+// unblocks one on DELETE /genres/blocklist/<genre>:
+//
+//	curl -X POST /genres/blocklist -d '{"genre": "polka"}'
+func handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Genre string `json:"genre"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Genre) == "" {
+			http.Error(w, "genre is required", http.StatusBadRequest)
+			return
+		}
+		blocklist.Block(strings.TrimSpace(req.Genre), sourceAdmin, 0)
+	case http.MethodDelete:
+		genre := strings.TrimPrefix(r.URL.Path, "/genres/blocklist/")
+		if genre == r.URL.Path || genre == "" {
+			http.Error(w, "Name the genre to unblock", http.StatusBadRequest)
+			return
+		}
+		if !blocklist.Unblock(genre) {
+			http.Error(w, "Genre is not blocklisted at runtime", http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocklist.List())
+}
+
+// handleBlocklistVote takes a listener's "never play this again" for the
+// genre in the body, or the one on air. An admin's vote blocks at once.
+func handleBlocklistVote(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Genre string `json:"genre"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.Genre = strings.TrimSpace(req.Genre); req.Genre == "" {
+		req.Genre = getCurrentGenre()
+	}
+	if req.Genre == "" {
+		http.Error(w, "Nothing is on air to vote against", http.StatusBadRequest)
+		return
+	}
+
+	needed := cfg.Genre.Blocklist.Votes
+	votes := 0
+	switch voter := voterID(r); {
+	case isAdmin(r):
+		blocklist.Block(req.Genre, sourceAdmin, 0)
+	case needed <= 0:
+		blocklistVotes.Inc("outcome", "disabled")
+		http.Error(w, "Listener votes are turned off", http.StatusForbidden)
+		return
+	case !listenerTokens.Valid(listenerToken(r)):
+		blocklistVotes.Inc("outcome", "unauthenticated")
+		http.Error(w, "Voting needs a listener token", http.StatusUnauthorized)
+		return
+	case voter == "":
+		blocklistVotes.Inc("outcome", "anonymous")
+		http.Error(w, "Voting needs a listener ID", http.StatusUnauthorized)
+		return
+	default:
+		votes = blocklist.Vote(req.Genre, voter, needed)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"genre":   taxonomy.Canonical(req.Genre),
+		"votes":   votes,
+		"needed":  needed,
+		"blocked": blocklist.Blocked(req.Genre),
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// bootstrapLoop plays a short PCM clip on repeat while the generator warms
+// up, then crossfades into the first live frames.
+type bootstrapLoop struct {
+	samples    []int16 // interleaved, at the stream's rate and channel count
+	pos        int
+	fadeFrames int
+	fadeLeft   int
+	scratch    []int16
+}
+
+func loadBootstrap(path string, sampleRate, channels, samplesPerFrame int) (*bootstrapLoop, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	wav, err := readWAV(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	samples, err := wav.fit(sampleRate, channels)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	frameLen := samplesPerFrame * channels
+	if len(samples) < frameLen {
+		return nil, fmt.Errorf("%s: shorter than one frame", path)
+	}
+
+	fade := time.Duration(cfg.Audio.BootstrapFade)
+	frameDuration := time.Duration(samplesPerFrame) * time.Second / time.Duration(sampleRate)
+	fadeFrames := int(fade / frameDuration)
+
+	return &bootstrapLoop{
+		samples:    samples,
+		fadeFrames: fadeFrames,
+		fadeLeft:   fadeFrames,
+		scratch:    make([]int16, frameLen),
+	}, nil
+}
+
+// next fills dst with the next stretch of the loop.
+func (b *bootstrapLoop) next(dst []int16) {
+	for i := range dst {
+		dst[i] = b.samples[b.pos]
+		b.pos++
+		if b.pos == len(b.samples) {
+			b.pos = 0
+		}
+	}
+}
+
+// blend crossfades a live frame in place from the loop towards the live
+// audio. It returns false once the fade is complete and the loop can be
+// dropped.
+func (b *bootstrapLoop) blend(live []int16) bool {
+	if b.fadeLeft <= 0 {
+		return false
+	}
+
+	b.next(b.scratch[:len(live)])
+	step := 1 / float64(b.fadeFrames*len(live))
+	t := float64(b.fadeFrames-b.fadeLeft) / float64(b.fadeFrames)
+	for i := range live {
+		live[i] = int16(float64(b.scratch[i])*(1-t) + float64(live[i])*t)
+		t += step
+	}
+
+	b.fadeLeft--
+	return b.fadeLeft > 0
+}
+
+type wavData struct {
+	sampleRate int
+	channels   int
+	samples    []int16
+}
+
+// fit returns the samples in the stream's format, mixing mono to stereo or
+// stereo to mono, and trimmed to whole sample frames so channels never swap.
+func (w *wavData) fit(sampleRate, channels int) ([]int16, error) {
+	if w.sampleRate != sampleRate {
+		return nil, fmt.Errorf("sample rate is %d Hz, expected %d Hz", w.sampleRate, sampleRate)
+	}
+	samples := w.samples
+	switch {
+	case w.channels == channels:
+	case w.channels == 1 && channels == 2:
+		samples = make([]int16, len(w.samples)*2)
+		for i, s := range w.samples {
+			samples[2*i] = s
+			samples[2*i+1] = s
+		}
+	case w.channels == 2 && channels == 1:
+		samples = make([]int16, len(w.samples)/2)
+		for i := range samples {
+			samples[i] = int16((int32(w.samples[2*i]) + int32(w.samples[2*i+1])) / 2)
+		}
+	default:
+		return nil, fmt.Errorf("has %d channels, expected %d", w.channels, channels)
+	}
+	return samples[:len(samples)-len(samples)%channels], nil
+}
+
+// readWAV decodes a 16-bit PCM RIFF/WAVE file.
+func readWAV(r io.Reader) (*wavData, error) {
+	wav, size, err := readWAVHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	wav.samples = make([]int16, len(data)/2)
+	for i := range wav.samples {
+		wav.samples[i] = int16(binary.LittleEndian.Uint16(data[i*2:]))
+	}
+	return wav, nil
+}
+
+// readWAVHeader reads a 16-bit PCM RIFF/WAVE file up to the start of its
+// samples and returns the format and the size of the data in bytes.
+func readWAVHeader(r io.Reader) (*wavData, int64, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return nil, 0, errors.New("not a WAV file")
+	}
+
+	var wav wavData
+	haveFormat := false
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, 0, errors.New("no data chunk")
+			}
+			return nil, 0, err
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+		switch id {
+		case "fmt ":
+			var fmtChunk [16]byte
+			if size < 16 {
+				return nil, 0, errors.New("short fmt chunk")
+			}
+			if _, err := io.ReadFull(r, fmtChunk[:]); err != nil {
+				return nil, 0, err
+			}
+			if _, err := io.CopyN(io.Discard, r, size-16+size%2); err != nil {
+				return nil, 0, err
+			}
+			format := binary.LittleEndian.Uint16(fmtChunk[0:2])
+			bits := binary.LittleEndian.Uint16(fmtChunk[14:16])
+			if format != 1 || bits != 16 {
+				return nil, 0, fmt.Errorf("unsupported encoding (format %d, %d bits), need 16-bit PCM", format, bits)
+			}
+			wav.channels = int(binary.LittleEndian.Uint16(fmtChunk[2:4]))
+			wav.sampleRate = int(binary.LittleEndian.Uint32(fmtChunk[4:8]))
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return nil, 0, errors.New("data chunk before fmt chunk")
+			}
+			return &wav, size, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+}
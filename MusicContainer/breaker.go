@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The offer circuit breaker stops /offer from negotiating connections that
+// would only stream silence. Once the pipeline hasn't produced a frame for
+// Audio.OfflineAfter the station counts as offline and offers are answered
+// with 503 and a retry hint; it flips back on its own as soon as frames
+// flow again.
+
+const offlineRetry = 10 * time.Second
+
+var (
+	lastFrameAt   atomic.Int64 // unix nanoseconds of the last frame sent
+	stationOnline atomic.Bool
+
+	_ = newGaugeFunc("radio_station_online", "1 while the audio pipeline is producing frames.", func() float64 {
+		if stationOnline.Load() {
+			return 1
+		}
+		return 0
+	})
+)
+
+// markFrame records that the pipeline produced a frame.
+func markFrame() {
+	lastFrameAt.Store(time.Now().UnixNano())
+}
+
+// pipelineDownFor returns how long the pipeline has gone without a frame.
+func pipelineDownFor() time.Duration {
+	return time.Since(time.Unix(0, lastFrameAt.Load()))
+}
+
+// runBreaker watches the pipeline and publishes online/offline transitions.
+// The pipeline gets the threshold from startup to produce its first frame.
+func runBreaker() {
+	markFrame()
+	stationOnline.Store(true)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		down := pipelineDownFor()
+		online := down < time.Duration(cfg.Audio.OfflineAfter)
+		if online == stationOnline.Load() {
+			continue
+		}
+		stationOnline.Store(online)
+		if online {
+			log.Println("Audio pipeline recovered, accepting listeners again")
+		} else {
+			log.Printf("No audio for %v, refusing new listeners until it recovers", down.Round(time.Second))
+		}
+		status.Publish("station_state", map[string]interface{}{"online": online})
+	}
+}
+
+// writeStationOffline answers an offer while the station is offline.
+func writeStationOffline(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(offlineRetry.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(stationOffline())
+}
+
+func stationOffline() map[string]interface{} {
+	return map[string]interface{}{
+		"error":          "station_offline",
+		"offline_for_ms": pipelineDownFor().Milliseconds(),
+		"retry_after":    int(offlineRetry.Seconds()),
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runCA implements the "ca" command, a small certificate authority for the
+// admin listener:
+//
+//	webrtc_server ca init  -dir certs
+//	webrtc_server ca issue -dir certs -name alice
+//	webrtc_server ca issue -dir certs -name admin.example.com -server -hosts admin.example.com,10.0.0.5
+//
+// init creates ca.crt and ca.key; issue writes <name>.crt and <name>.key
+// signed by that CA, as a client certificate for an operator or, with
+// -server, as the admin listener's own certificate.
+func runCA(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: webrtc_server ca init|issue [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("ca "+args[0], flag.ExitOnError)
+	dir := fs.String("dir", "certs", "directory holding the CA and issued certificates")
+	name := fs.String("name", "", "common name of the certificate to issue")
+	server := fs.Bool("server", false, "issue a server certificate instead of a client one")
+	hosts := fs.String("hosts", "", "comma-separated DNS names and IPs for a server certificate")
+	days := fs.Int("days", 365, "validity of the issued certificate in days")
+	fs.Parse(args[1:])
+
+	var err error
+	switch args[0] {
+	case "init":
+		err = caInit(*dir)
+	case "issue":
+		if *name == "" {
+			err = fmt.Errorf("-name is required")
+			break
+		}
+		err = caIssue(*dir, *name, *server, *hosts, *days)
+	default:
+		err = fmt.Errorf("unknown ca command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func caInit(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, "ca.key")); err == nil {
+		return fmt.Errorf("%s already holds a CA", dir)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "Infinite Radio admin CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyPair(dir, "ca", der, key); err != nil {
+		return err
+	}
+	fmt.Printf("Created CA in %s\n", dir)
+	return nil
+}
+
+func caIssue(dir, name string, server bool, hosts string, days int) error {
+	caCert, caKey, err := loadCA(dir)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, days),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, h := range strings.Split(hosts, ",") {
+			h = strings.TrimSpace(h)
+			if ip := net.ParseIP(h); ip != nil {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+			} else if h != "" {
+				tmpl.DNSNames = append(tmpl.DNSNames, h)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyPair(dir, name, der, key); err != nil {
+		return err
+	}
+	kind := "client"
+	if server {
+		kind = "server"
+	}
+	fmt.Printf("Issued %s certificate %s.crt in %s\n", kind, name, dir)
+	return nil
+}
+
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading CA certificate (run \"ca init\" first): %w", err)
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, "ca.key"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading CA key: %w", err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("ca.crt is not PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("ca.key is not PEM")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func writeKeyPair(dir, name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certOut := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyOut := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certOut, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+".key"), keyOut, 0o600)
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
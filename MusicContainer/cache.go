@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache keeps the results of expensive lookups for a while. It holds at
+// most max entries; when full, expired entries are dropped first and then
+// arbitrary ones. Hits and misses are counted per cache in
+// radio_cache_requests_total.
+type ttlCache[K comparable, V any] struct {
+	name string
+	ttl  time.Duration
+	max  int
+
+	mu      sync.Mutex
+	entries map[K]cacheEntry[V]
+}
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+var (
+	cacheRequests = newCounter("radio_cache_requests_total", "Cache lookups, by cache and result (hit or miss).")
+	cacheEntries  = newGauge("radio_cache_entries", "Entries held, by cache.")
+)
+
+func newTTLCache[K comparable, V any](name string, ttl time.Duration, max int) *ttlCache[K, V] {
+	return &ttlCache[K, V]{name: name, ttl: ttl, max: max, entries: make(map[K]cacheEntry[V])}
+}
+
+func (c *ttlCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		cacheRequests.Inc("cache", c.name, "result", "miss")
+		var zero V
+		return zero, false
+	}
+	cacheRequests.Inc("cache", c.name, "result", "hit")
+	return e.value, true
+}
+
+func (c *ttlCache[K, V]) Set(key K, value V) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry[V]{value: value, expires: now.Add(c.ttl)}
+	cacheEntries.Set(float64(len(c.entries)), "cache", c.name)
+}
+
+// GetOrLoad returns the cached value for key, or loads and caches it. Errors
+// aren't cached. Concurrent misses on the same key each load it.
+func (c *ttlCache[K, V]) GetOrLoad(key K, load func() (V, error)) (V, error) {
+	if v, ok := c.Get(key); ok {
+		return v, nil
+	}
+	v, err := load()
+	if err != nil {
+		return v, err
+	}
+	c.Set(key, v)
+	return v, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Docker's default bridge, used when the bridge interfaces themselves aren't
+// visible (e.g. the server runs in its own network namespace).
+var defaultDockerBridge = mustParseCIDR("172.17.0.0/16")
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// candidateFilter decides which ICE candidate addresses are kept in answers.
+type candidateFilter struct {
+	linkLocal bool
+	ipv6      bool
+	nets      []*net.IPNet
+	types     *gatherPolicy // for the candidate types allowed
+}
+
+func newCandidateFilter(p CandidatePruneConfig, types *gatherPolicy) *candidateFilter {
+	f := &candidateFilter{linkLocal: p.LinkLocal, ipv6: p.IPv6, types: types}
+
+	for _, c := range p.CIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			log.Printf("Ignoring invalid prune CIDR %q: %v", c, err)
+			continue
+		}
+		f.nets = append(f.nets, n)
+	}
+
+	if p.DockerBridge {
+		f.nets = append(f.nets, defaultDockerBridge)
+		f.nets = append(f.nets, dockerBridgeNets()...)
+	}
+	return f
+}
+
+// dockerBridgeNets returns the networks of any docker0/br-*/veth interfaces
+// present on this host.
+func dockerBridgeNets() []*net.IPNet {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var nets []*net.IPNet
+	for _, iface := range ifaces {
+		if !strings.HasPrefix(iface.Name, "docker") &&
+			!strings.HasPrefix(iface.Name, "br-") &&
+			!strings.HasPrefix(iface.Name, "veth") {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok {
+				nets = append(nets, n)
+			}
+		}
+	}
+	return nets
+}
+
+func (f *candidateFilter) drop(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		// mDNS (.local) hostnames and anything else we can't parse are kept
+		return false
+	}
+	if f.ipv6 && ip.To4() == nil {
+		return true
+	}
+	if f.linkLocal && ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, n := range f.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropCandidate reports whether a trickled candidate is left out.
+func (f *candidateFilter) dropCandidate(c *webrtc.ICECandidate) bool {
+	return f.drop(c.Address) || !f.types.allowType(c.Typ.String())
+}
+
+// pruneCandidates removes the a=candidate lines of sdp whose connection
+// address is rejected by the filter.
+func (f *candidateFilter) pruneCandidates(sdp string) string {
+	lines := strings.Split(sdp, "\n")
+	kept := make([]string, 0, len(lines))
+	total, removed := 0, 0
+
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, "a=candidate:") {
+			total++
+			// a=candidate:<foundation> <component> <transport> <priority> <address> <port> typ <type> ...
+			fields := strings.Fields(line)
+			if len(fields) > 4 && f.drop(fields[4]) || len(fields) > 7 && !f.types.allowType(fields[7]) {
+				removed++
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+
+	if removed > 0 {
+		log.Printf("Pruned %d of %d ICE candidates from answer", removed, total)
+		if removed == total {
+			log.Printf("WARNING: every ICE candidate was pruned, clients will not be able to connect")
+		}
+	}
+	return strings.Join(kept, "\r\n")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	capacitySampleInterval = 10 * time.Second
+	capacityHistory        = 360 // one hour of samples
+)
+
+// capacitySample is one measurement window of what listeners cost.
+type capacitySample struct {
+	at           time.Time
+	listeners    int
+	egressBps    float64 // bits per second sent to listeners
+	fanoutCores  float64 // cores spent writing packets to listeners
+	processCores float64 // cores used by the whole process
+}
+
+// capacityEstimator samples listener costs in the background and turns them
+// into an estimate of how many listeners the configured resources allow.
+type capacityEstimator struct {
+	mu      sync.Mutex
+	samples []capacitySample
+}
+
+var capacity = &capacityEstimator{}
+
+func (c *capacityEstimator) run() {
+	lastAt := time.Now()
+	lastBytes := broadcast.bytesSent.Load()
+	lastWrite := broadcast.writeNanos.Load()
+	lastCPU := processCPUTime()
+
+	ticker := time.NewTicker(capacitySampleInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		bytes := broadcast.bytesSent.Load()
+		write := broadcast.writeNanos.Load()
+		cpu := processCPUTime()
+		elapsed := now.Sub(lastAt).Seconds()
+
+		s := capacitySample{
+			at:           now,
+			listeners:    broadcast.Count(),
+			egressBps:    float64(bytes-lastBytes) * 8 / elapsed,
+			fanoutCores:  float64(write-lastWrite) / 1e9 / elapsed,
+			processCores: (cpu - lastCPU).Seconds() / elapsed,
+		}
+
+		c.mu.Lock()
+		c.samples = append(c.samples, s)
+		if len(c.samples) > capacityHistory {
+			c.samples = c.samples[len(c.samples)-capacityHistory:]
+		}
+		c.mu.Unlock()
+
+		lastAt, lastBytes, lastWrite, lastCPU = now, bytes, write, cpu
+	}
+}
+
+// CapacityReport is the /capacity response.
+type CapacityReport struct {
+	Listeners          int     `json:"listeners"`
+	EgressBpsPerPeer   float64 `json:"egress_bps_per_peer"`
+	CPUCoresPerPeer    float64 `json:"cpu_cores_per_peer"`
+	BaseCPUCores       float64 `json:"base_cpu_cores"`
+	MaxByEgress        int     `json:"max_by_egress,omitempty"`
+	MaxByCPU           int     `json:"max_by_cpu,omitempty"`
+	MaxListeners       int     `json:"max_listeners"` // 0 when nothing limits it yet
+	LimitedBy          string  `json:"limited_by"`
+	TrendPerHour       float64 `json:"trend_per_hour"`
+	ProjectedListeners int     `json:"projected_listeners"`
+	ProjectionHorizon  string  `json:"projection_horizon"`
+	Warning            string  `json:"warning,omitempty"`
+}
+
+func (c *capacityEstimator) Report() CapacityReport {
+	c.mu.Lock()
+	samples := append([]capacitySample(nil), c.samples...)
+	c.mu.Unlock()
+
+	conf := cfg.Capacity
+	r := CapacityReport{
+		Listeners:         broadcast.Count(),
+		ProjectionHorizon: time.Duration(conf.Horizon).String(),
+	}
+
+	// Average the per-peer costs over the recent windows that had listeners.
+	// With nobody connected, fall back to what the encoder settings imply.
+	var egress, cores, base float64
+	n := 0
+	for i := len(samples) - 1; i >= 0 && n < 30; i-- {
+		s := samples[i]
+		if s.listeners == 0 {
+			continue
+		}
+		egress += s.egressBps / float64(s.listeners)
+		cores += s.fanoutCores / float64(s.listeners)
+		base += math.Max(s.processCores-s.fanoutCores, 0)
+		n++
+	}
+	if n > 0 {
+		r.EgressBpsPerPeer = egress / float64(n)
+		r.CPUCoresPerPeer = cores / float64(n)
+		r.BaseCPUCores = base / float64(n)
+	} else {
+		packetsPerSec := float64(time.Second / audioFrame())
+		r.EgressBpsPerPeer = float64(effectiveEncoderConfig().Bitrate) + packetsPerSec*packetOverhead*8
+	}
+
+	headroom := conf.Headroom
+	if headroom <= 0 || headroom > 1 {
+		headroom = 1
+	}
+
+	r.MaxListeners = math.MaxInt32
+	r.LimitedBy = "none"
+	if conf.EgressBitsPerSec > 0 && r.EgressBpsPerPeer > 0 {
+		r.MaxByEgress = int(float64(conf.EgressBitsPerSec) * headroom / r.EgressBpsPerPeer)
+		r.MaxListeners, r.LimitedBy = r.MaxByEgress, "egress"
+	}
+	if r.CPUCoresPerPeer > 0 {
+		cpuCores := conf.CPUCores
+		if cpuCores <= 0 {
+			cpuCores = float64(runtime.NumCPU())
+		}
+		r.MaxByCPU = int(math.Max(cpuCores*headroom-r.BaseCPUCores, 0) / r.CPUCoresPerPeer)
+		if r.MaxByCPU < r.MaxListeners {
+			r.MaxListeners, r.LimitedBy = r.MaxByCPU, "cpu"
+		}
+	}
+	if conf.MaxListeners > 0 && conf.MaxListeners < r.MaxListeners {
+		r.MaxListeners, r.LimitedBy = conf.MaxListeners, "max_listeners"
+	}
+
+	r.TrendPerHour = listenerTrend(samples) * 3600
+	horizon := time.Duration(conf.Horizon).Hours()
+	r.ProjectedListeners = r.Listeners + int(math.Round(r.TrendPerHour*horizon))
+	if r.ProjectedListeners < 0 {
+		r.ProjectedListeners = 0
+	}
+
+	switch {
+	case r.LimitedBy == "none":
+		// Nothing measured or configured to limit against yet
+		r.MaxListeners = 0
+	case r.Listeners >= r.MaxListeners:
+		r.Warning = "at or over estimated capacity"
+	case r.ProjectedListeners > r.MaxListeners:
+		r.Warning = "current listener trend exceeds estimated capacity within the projection horizon"
+	}
+	return r
+}
+
+// listenerTrend fits a least-squares line through the listener counts of the
+// last 30 minutes and returns its slope in listeners per second.
+func listenerTrend(samples []capacitySample) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	cutoff := samples[len(samples)-1].at.Add(-30 * time.Minute)
+	var sx, sy, sxx, sxy, n float64
+	t0 := samples[0].at
+	for _, s := range samples {
+		if s.at.Before(cutoff) {
+			continue
+		}
+		x := s.at.Sub(t0).Seconds()
+		y := float64(s.listeners)
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+		n++
+	}
+	den := n*sxx - sx*sx
+	if n < 2 || den == 0 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / den
+}
+
+func handleCapacity(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(capacity.Report())
+}
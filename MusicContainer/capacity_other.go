@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// processCPUTime is not measured on this platform, so capacity estimates
+// leave out the process's CPU use.
+func processCPUTime() time.Duration {
+	return 0
+}
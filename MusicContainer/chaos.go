@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// The fault injector breaks the server on purpose so the fallback, underrun
+// and reconnection paths can be exercised in staging. It only exists when
+// chaos.enabled is set; otherwise /chaos answers 404 like any unknown path.
+// Faults are armed through the admin API:
+//
+//	POST   /chaos   {"fault": "pipe_stall", "probability": 0.1, "delay": "3s",
+//	                 "count": 5, "duration": "10m"}
+//	GET    /chaos   lists the armed faults
+//	DELETE /chaos   disarms everything, or one fault with ?fault=
+//
+// probability is the chance each opportunity fires (default 1), count stops
+// the fault after that many firings (0 for no limit) and duration disarms it
+// after that long. {"fault": "ice_failure", "session": "<id>"} fails that one
+// session straight away.
+//
+//	pipe_stall     the pipe reader stops for delay (default 2s) before a frame
+//	partial_read   the pipe read ends mid-frame, as if the generator died
+//	encoder_error  the Opus encoder fails on a frame, which is skipped
+//	slow_write     each RTP write waits delay (default 50ms) first
+//	ice_failure    a random session's connection fails, once a second at most
+
+var chaosFaults = newCounter("radio_chaos_faults_total", "Faults injected by the chaos injector, by fault.")
+
+var errChaos = errors.New("injected by chaos")
+
+// chaosDefaultDelay is the delay for faults that take one, by fault.
+var chaosDefaultDelay = map[string]time.Duration{
+	"pipe_stall":    2 * time.Second,
+	"partial_read":  0,
+	"encoder_error": 0,
+	"slow_write":    50 * time.Millisecond,
+	"ice_failure":   0,
+}
+
+// ChaosFault is an armed fault.
+type ChaosFault struct {
+	Fault       string     `json:"fault"`
+	Probability float64    `json:"probability"`
+	Delay       Duration   `json:"delay,omitempty"`
+	Count       int        `json:"count,omitempty"` // firings left, 0 for no limit
+	Until       *time.Time `json:"until,omitempty"`
+	Fired       int        `json:"fired"`
+}
+
+type chaosInjector struct {
+	mu     sync.Mutex
+	armed  map[string]*ChaosFault
+	active atomic.Bool // len(armed) > 0, so the hot paths can skip the lock
+}
+
+var chaos = &chaosInjector{armed: make(map[string]*ChaosFault)}
+
+// fire reports whether the fault should happen now, and its delay.
+func (c *chaosInjector) fire(name string) (time.Duration, bool) {
+	if !c.active.Load() {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.armed[name]
+	if f == nil {
+		return 0, false
+	}
+	if f.Until != nil && time.Now().After(*f.Until) {
+		c.disarm(name)
+		return 0, false
+	}
+	if rand.Float64() >= f.Probability {
+		return 0, false
+	}
+	f.Fired++
+	if f.Count > 0 {
+		if f.Count--; f.Count == 0 {
+			c.disarm(name)
+		}
+	}
+	chaosFaults.Inc("fault", name)
+	return time.Duration(f.Delay), true
+}
+
+// disarm is called with c.mu held.
+func (c *chaosInjector) disarm(name string) {
+	delete(c.armed, name)
+	c.active.Store(len(c.armed) > 0)
+}
+
+func (c *chaosInjector) arm(f ChaosFault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.armed[f.Fault] = &f
+	c.active.Store(true)
+}
+
+func (c *chaosInjector) list() []ChaosFault {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]ChaosFault, 0, len(c.armed))
+	for _, f := range c.armed {
+		out = append(out, *f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Fault < out[j].Fault })
+	return out
+}
+
+// pipeRead runs after each full frame is read from the pipe.
+func (c *chaosInjector) pipeRead() error {
+	if delay, ok := c.fire("pipe_stall"); ok {
+		log.Printf("Chaos: stalling the pipe for %v", delay)
+		time.Sleep(delay)
+	}
+	if _, ok := c.fire("partial_read"); ok {
+		log.Printf("Chaos: cutting a pipe read short")
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// encode runs after each frame of the main mix is encoded.
+func (c *chaosInjector) encode() error {
+	if _, ok := c.fire("encoder_error"); ok {
+		return errChaos
+	}
+	return nil
+}
+
+// write runs before each RTP packet is written to a listener.
+func (c *chaosInjector) write() {
+	if delay, ok := c.fire("slow_write"); ok {
+		time.Sleep(delay)
+	}
+}
+
+// runICEFailures fails a random session whenever ice_failure fires.
+func (c *chaosInjector) runICEFailures() {
+	for range time.Tick(time.Second) {
+		if _, ok := c.fire("ice_failure"); !ok {
+			continue
+		}
+		list := sessions.List()
+		if len(list) == 0 {
+			continue
+		}
+		failSession(list[rand.Intn(len(list))].ID)
+	}
+}
+
+// failSession tears a session down as if its ICE connection had failed.
+func failSession(id string) bool {
+	s := sessions.Get(id)
+	if s == nil {
+		return false
+	}
+	log.Printf("Chaos: failing the connection of session %s", id)
+	sessions.SetState(id, webrtc.PeerConnectionStateFailed)
+	return true
+}
+
+func startChaos(c ChaosConfig) {
+	if !c.Enabled {
+		return
+	}
+	log.Printf("Chaos fault injector enabled, see /chaos")
+	go chaos.runICEFailures()
+}
+
+func handleChaos(w http.ResponseWriter, r *http.Request) {
+	if !cfg.Chaos.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			ChaosFault
+			Duration Duration `json:"duration"`
+			Session  string   `json:"session"`
+		}
+		req.Probability = 1
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		defaultDelay, known := chaosDefaultDelay[req.Fault]
+		if !known {
+			http.Error(w, "Unknown fault", http.StatusBadRequest)
+			return
+		}
+		if req.Probability <= 0 || req.Probability > 1 || req.Count < 0 || req.Delay < 0 {
+			http.Error(w, "probability must be in (0, 1], count and delay must not be negative", http.StatusBadRequest)
+			return
+		}
+		if req.Session != "" {
+			if req.Fault != "ice_failure" {
+				http.Error(w, "Only ice_failure takes a session", http.StatusBadRequest)
+				return
+			}
+			if !failSession(req.Session) {
+				http.Error(w, "Session not found", http.StatusNotFound)
+				return
+			}
+			chaosFaults.Inc("fault", req.Fault)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		f := req.ChaosFault
+		f.Fired = 0
+		if f.Delay == 0 {
+			f.Delay = Duration(defaultDelay)
+		}
+		f.Until = nil
+		if req.Duration > 0 {
+			until := time.Now().Add(time.Duration(req.Duration))
+			f.Until = &until
+		}
+		chaos.arm(f)
+		log.Printf("Chaos: armed %s with probability %v", f.Fault, f.Probability)
+		status.Publish("chaos_armed", f)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("fault")
+		chaos.mu.Lock()
+		for n := range chaos.armed {
+			if name == "" || n == name {
+				chaos.disarm(n)
+			}
+		}
+		chaos.mu.Unlock()
+		if name == "" {
+			log.Printf("Chaos: disarmed all faults")
+		} else {
+			log.Printf("Chaos: disarmed %s", name)
+		}
+		status.Publish("chaos_disarmed", map[string]string{"fault": name})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"faults": chaos.list()})
+}
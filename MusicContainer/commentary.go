@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Commentary is an optional second audio track offered to every listener:
+// spoken DJ links or an audio description, kept apart from the music so
+// listeners can switch it on and off on their own. It has its own bus, fed
+// by audio.commentary.pipe_path and/or ingest sources whose stem is
+// "commentary", and its own low-bitrate mono encoder. Listeners only receive
+// it after enabling it with commentary.set on the control channel.
+
+const commentaryFeed = "commentary"
+
+var commentaryCapability = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeOpus,
+	ClockRate:   opusClockRate,
+	Channels:    2, // Opus is always signalled as two channels
+	SDPFmtpLine: "minptime=10;useinbandfec=1;stereo=0",
+}
+
+// commentaryInput is the commentary bus, nil when commentary is off. It is
+// guarded by stemMu, as ingest finds it through stemInput.
+var commentaryInput chan []byte
+
+func commentaryEnabled() bool {
+	return cfg.Audio.Commentary.Enabled
+}
+
+func newCommentaryOutput() (*rtpOutput, error) {
+	// A stream of its own, so browsers hand it over separately
+	track, err := webrtc.NewTrackLocalStaticRTP(commentaryCapability, commentaryFeed, commentaryFeed)
+	if err != nil {
+		return nil, err
+	}
+	return outputForTrack(track, commentaryFeed), nil
+}
+
+// setCommentary starts or stops sending the commentary track to a session.
+func (s *session) setCommentary(on bool) {
+	if s.commentary == nil {
+		return
+	}
+	if on {
+		broadcast.Add(s.commentary)
+	} else {
+		broadcast.Remove(s.commentary)
+	}
+}
+
+// commentaryBus encodes the commentary one frame per tick of the main pacer.
+type commentaryBus struct {
+	encoder  *hotEncoder
+	channels int
+	pcm      []int16
+	frames   <-chan []byte
+}
+
+// startCommentary opens the commentary bus if it is configured.
+func startCommentary(sampleRate, channels, samplesPerFrame, bytesPerFrame int) *commentaryBus {
+	c := cfg.Audio.Commentary
+	if !c.Enabled {
+		return nil
+	}
+	if err := acquireEncoder(commentaryFeed); err != nil {
+		log.Printf("Error starting commentary: %v", err)
+		return nil
+	}
+	ec := effectiveEncoderConfig()
+	ec.Bitrate = c.Bitrate
+	ec.Application = "voip"
+	encoder, err := newHotEncoder(sampleRate, 1, ec)
+	if err != nil {
+		log.Printf("Error creating commentary encoder: %v", err)
+		return nil
+	}
+
+	// Up to a second of commentary may queue up before the writer blocks
+	frames := make(chan []byte, 50)
+	stemMu.Lock()
+	commentaryInput = frames
+	stemMu.Unlock()
+	if c.PipePath != "" {
+		if err := startAudioInput(c.PipePath, pcmFormat(sampleRate, channels), bytesPerFrame, frames); err != nil {
+			log.Fatalf("Error in commentary input: %v", err)
+		}
+	}
+	log.Printf("Serving commentary at %d bps", c.Bitrate)
+	return &commentaryBus{
+		encoder:  encoder,
+		channels: channels,
+		pcm:      make([]int16, samplesPerFrame),
+		frames:   frames,
+	}
+}
+
+// encode queues the next commentary frame in out, if there is one. When the
+// bus is quiet nothing is sent and the outputs mark a new talkspurt on
+// resume.
+func (b *commentaryBus) encode(out *encodedFrame) {
+	var frame []byte
+	select {
+	case frame = <-b.frames:
+	default:
+		return
+	}
+	// Downmix to mono
+	for i := range b.pcm {
+		var sum int
+		for ch := 0; ch < b.channels; ch++ {
+			sum += int(int16(binary.LittleEndian.Uint16(frame[(i*b.channels+ch)*2:])))
+		}
+		b.pcm[i] = int16(sum / b.channels)
+	}
+	pcmBytes.put(frame)
+	packet, err := out.encode(b.encoder, b.pcm, nil)
+	if err != nil {
+		log.Printf("Error encoding commentary: %v", err)
+		return
+	}
+	// Commentary isn't subject to the station's DTX
+	out.packets = append(out.packets, feedPacket{feed: commentaryFeed, packet: packet})
+}
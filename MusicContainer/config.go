@@ -0,0 +1,821 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Config holds the server settings. Everything has a working default so the
+// container still runs without a config file; a JSON file passed with
+// -config only needs to contain the fields it wants to override.
+type Config struct {
+	Station   StationConfig         `json:"station"`
+	Audio     AudioConfig           `json:"audio"`
+	ICE       ICEConfig             `json:"ice"`
+	Answer    AnswerConfig          `json:"answer"`
+	DTLS      DTLSConfig            `json:"dtls"`
+	NACK      NACKConfig            `json:"nack"`
+	Encoder   EncoderConfig         `json:"encoder"`
+	DSP       DSPConfig             `json:"dsp"`
+	Genre     GenreConfig           `json:"genre"`
+	Capacity  CapacityConfig        `json:"capacity"`
+	Admin     AdminConfig           `json:"admin"`
+	Auth      AuthConfig            `json:"auth"`
+	RateLimit RateLimitConfig       `json:"rate_limit"`
+	API       APIConfig             `json:"api"`
+	Archive   ArchiveConfig         `json:"archive"`
+	Alerts    AlertsConfig          `json:"alerts"`
+	Flags     map[string]FlagConfig `json:"flags"`
+	Sessions  SessionsConfig        `json:"sessions"`
+	Shutdown  ShutdownConfig        `json:"shutdown"`
+	Embed     EmbedConfig           `json:"embed"`
+	Telemetry TelemetryConfig       `json:"telemetry"`
+	Chaos     ChaosConfig           `json:"chaos"`
+	Update    UpdateConfig          `json:"update"`
+	Handoff   HandoffConfig         `json:"handoff"`
+	Quality   QualityConfig         `json:"quality"`
+	Lights    LightsConfig          `json:"lights"`
+	PresetDir string                `json:"preset_dir"`
+}
+
+// StationConfig describes the station this process broadcasts. Running
+// several stations means running several servers, each with its own file.
+type StationConfig struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Timezone is the IANA zone of the station's audience, e.g.
+	// "Europe/Berlin". Schedules and time-of-day stats use it.
+	Timezone string       `json:"timezone"`
+	Prompt   PromptConfig `json:"prompt"`
+	Quota    QuotaConfig  `json:"quota"`
+}
+
+// QuotaConfig caps what a station may consume. Zero leaves a resource
+// uncapped. OverQuota picks what happens to listeners beyond the caps:
+// "reject", "degrade" (lower the bitrate to fit the egress cap, never below
+// MinBitrate) or "waitlist".
+type QuotaConfig struct {
+	MaxListeners        int    `json:"max_listeners"`
+	MaxEgressBitsPerSec int64  `json:"max_egress_bits_per_sec"`
+	MaxEncoders         int    `json:"max_encoders"`
+	MinBitrate          int    `json:"min_bitrate"`
+	OverQuota           string `json:"over_quota"`
+}
+
+// PromptConfig shapes the prompt sent to the generator. Template placeholders
+// are written as {name}; {genre} is always the requested genre and the rest
+// come from the request or fall back to Vars. Overrides replace the template
+// for specific genres.
+type PromptConfig struct {
+	Template  string            `json:"template"`
+	Vars      map[string]string `json:"vars"`
+	Overrides map[string]string `json:"overrides"`
+}
+
+type AudioConfig struct {
+	// PipePath is where the generator's raw PCM comes from: a named pipe,
+	// "-" for stdin, or tcp:// or udp:// and an address to listen on, see
+	// source.go. The --input flag replaces it.
+	PipePath string `json:"pipe_path"`
+	// Framing is how the generator's audio is wrapped: "auto", "framed"
+	// or "raw", see source.go.
+	Framing string `json:"framing"`
+	// InputFormat is the sample format of raw PCM from the generator:
+	// "s16le" or "f32le", converted to 16-bit with samples beyond full
+	// scale clipped. Framed audio states its own. The --input-format flag
+	// replaces it.
+	InputFormat string `json:"input_format"`
+	// InputRate is the sample rate of raw PCM from the generator, resampled
+	// to the station's; 0 means it already matches. Framed audio states its
+	// own rate. The --input-rate flag replaces it.
+	InputRate int `json:"input_rate"`
+	// Channels is the station's channel count: 2 (stereo) or 1 (mono).
+	Channels int `json:"channels"`
+	// InputChannels is the channel count of raw PCM from the generator,
+	// mixed to Channels; 0 means it already matches. Framed audio states
+	// its own.
+	InputChannels int `json:"input_channels"`
+	// FrameDuration is the length of one Opus frame: 10ms, 20ms, 40ms or
+	// 60ms. Shorter frames cut latency at the cost of more packet overhead.
+	FrameDuration Duration `json:"frame_duration"`
+	// Standby is sent while the generator is missing, see standby.go.
+	Standby StandbyConfig `json:"standby"`
+	// BootstrapFile is an optional 48kHz 16-bit WAV looped from startup
+	// until the generator delivers its first frame, so early listeners
+	// don't connect to silence.
+	BootstrapFile string `json:"bootstrap_file"`
+	// BootstrapFade is how long the loop crossfades into the live stream.
+	BootstrapFade Duration `json:"bootstrap_fade"`
+	// Warmup is roughly how long the generator takes to deliver its first
+	// audio, so listeners who connect earlier can be told how long to
+	// wait, see readiness.go.
+	Warmup Duration `json:"warmup"`
+	// FadeIn fades each new listener in from silence over this long; 0
+	// turns it off. See fadein.go.
+	FadeIn Duration `json:"fade_in"`
+	// PacketValidation inspects every encoded packet before it is sent:
+	// "off", "log", "drop" or "repair" (replace with encoded silence).
+	PacketValidation string `json:"packet_validation"`
+	// LatencyBudget is the end-to-end delay the server may add between the
+	// pipe and the network. It sizes the ingest buffer, pre-roll and pacer
+	// slack; /status reports what is actually achieved.
+	LatencyBudget Duration `json:"latency_budget"`
+	// Prebuffer is how much audio the ring buffer between the pipe and the
+	// encoder fills before live audio starts, and again after an underrun.
+	// Zero takes half of what the latency budget leaves for buffering.
+	Prebuffer Duration `json:"prebuffer"`
+	// DriftCorrection adjusts the pacer to the generator's clock, see
+	// pacing.go.
+	DriftCorrection bool `json:"drift_correction"`
+	// OfflineAfter is how long the pipeline may go without a frame before
+	// /offer stops accepting listeners.
+	OfflineAfter Duration `json:"offline_after"`
+	// Stems, when set, replaces PipePath with one pipe per stem. The
+	// generator must write every stem in lockstep; the server mixes them
+	// with per-stem gains that can be changed at runtime.
+	Stems []StemConfig `json:"stems"`
+	// Mixes are extra stem mixes offered next to the main one.
+	Mixes []MixConfig `json:"mixes"`
+	// Tiers are lower bitrates the main mix is also served at, each with
+	// its own encoder. The encoder's bitrate is the top tier.
+	Tiers []int `json:"tiers"`
+	// Adaptive moves each listener between the tiers from a bandwidth
+	// estimate of its connection, see adaptive.go.
+	Adaptive bool `json:"adaptive"`
+	// Ingest accepts audio over the network in addition to the pipes.
+	Ingest IngestConfig `json:"ingest"`
+	// Commentary is an optional second track, see commentary.go.
+	Commentary CommentaryConfig `json:"commentary"`
+	// AutoResample resamples the input when the generator turns out to be
+	// sending at another sample rate than 48kHz, see drift.go.
+	AutoResample bool `json:"auto_resample"`
+	// Taps stream the audio to external processes, see taps.go.
+	Taps []TapConfig `json:"taps"`
+}
+
+// TapConfig connects one tap point to an external process.
+type TapConfig struct {
+	Name    string `json:"name"`
+	Point   string `json:"point"`   // post_ingest, post_dsp or post_encode
+	Address string `json:"address"` // unix:<path> or tcp:<host:port>
+	// Mode is "send" (the default) to only copy the audio out, or "insert"
+	// to replace it with what the process sends back.
+	Mode string `json:"mode"`
+	// Timeout is how long an insert tap may take to answer before the
+	// frame passes through unprocessed. Defaults to 10ms.
+	Timeout Duration `json:"timeout"`
+}
+
+// CommentaryConfig sets up the commentary track. Its audio comes from
+// PipePath, in the main pipe's format, and from ingest sources whose stem is
+// "commentary". It is encoded in mono at Bitrate.
+type CommentaryConfig struct {
+	Enabled  bool   `json:"enabled"`
+	PipePath string `json:"pipe_path"`
+	Bitrate  int    `json:"bitrate"`
+}
+
+// IngestConfig enables network ingest. Every source must authenticate with
+// at least one of a stream key, a pre-shared key or a client certificate,
+// and is bound to one station and stem.
+type IngestConfig struct {
+	Listen   string         `json:"listen"` // e.g. ":9000"; empty disables it
+	TLSCert  string         `json:"tls_cert"`
+	TLSKey   string         `json:"tls_key"`
+	ClientCA string         `json:"client_ca"` // verifies source certificates
+	Sources  []IngestSource `json:"sources"`
+}
+
+type IngestSource struct {
+	Name      string `json:"name"`
+	Station   string `json:"station"`
+	Stem      string `json:"stem"` // defaults to the first stem
+	StreamKey string `json:"stream_key"`
+	PSK       string `json:"psk"`
+	CertCN    string `json:"cert_cn"` // required client certificate common name
+}
+
+// MixConfig is an alternative stem mix listeners can switch to, such as an
+// instrumental mix. It either mutes the listed stems or, with Solo, keeps
+// only those. Each mix runs its own encoder.
+type MixConfig struct {
+	Name string   `json:"name"`
+	Mute []string `json:"mute"`
+	Solo []string `json:"solo"`
+}
+
+type StemConfig struct {
+	Name     string  `json:"name"`
+	PipePath string  `json:"pipe_path"`
+	GainDB   float64 `json:"gain_db"`
+	Muted    bool    `json:"muted"`
+}
+
+// EncoderConfig holds the Opus encoder parameters. All of them can be changed
+// while streaming.
+type EncoderConfig struct {
+	Bitrate        int    `json:"bitrate"`
+	Complexity     int    `json:"complexity"`
+	FEC            bool   `json:"fec"`
+	PacketLossPerc int    `json:"packet_loss_perc"`
+	Application    string `json:"application"` // "audio", "voip" or "lowdelay"
+	// RateControl is "vbr", "cvbr" (constrained VBR, libopus' default) or
+	// "cbr". CBR keeps every packet the same size, for networks that shape
+	// bursty traffic.
+	RateControl string `json:"rate_control"`
+	// DTX stops sending audio while the station is silent, see dtx.go.
+	DTX bool `json:"dtx"`
+	// Spare is the application a spare encoder is kept ready for, so
+	// switching to it doesn't create an encoder mid-frame. Empty keeps none.
+	Spare string `json:"spare"`
+}
+
+// DSPConfig holds the processing applied to the PCM before it is encoded.
+type DSPConfig struct {
+	GainDB float64 `json:"gain_db"`
+	// TargetLUFS turns on loudness normalization towards this level, e.g.
+	// -16; 0 leaves it off. See normalize.go.
+	TargetLUFS float64 `json:"target_lufs"`
+	// Compressor and Limiter keep hot audio from clipping, see dynamics.go.
+	Compressor CompressorConfig `json:"compressor"`
+	Limiter    LimiterConfig    `json:"limiter"`
+}
+
+// CompressorConfig turns down audio above ThresholdDB (dBFS) by Ratio.
+type CompressorConfig struct {
+	Enabled     bool     `json:"enabled"`
+	ThresholdDB float64  `json:"threshold_db"`
+	Ratio       float64  `json:"ratio"`
+	Attack      Duration `json:"attack"`
+	Release     Duration `json:"release"`
+	MakeupDB    float64  `json:"makeup_db"`
+}
+
+// LimiterConfig keeps peaks at or below CeilingDB (dBFS).
+type LimiterConfig struct {
+	Enabled   bool     `json:"enabled"`
+	CeilingDB float64  `json:"ceiling_db"`
+	Release   Duration `json:"release"`
+}
+
+// GenreConfig controls how competing genre requests are resolved. A request
+// holds the station for TTL; while it does, only requests from sources with
+// an equal or higher priority can replace it.
+type GenreConfig struct {
+	Default string `json:"default"`
+	// Taxonomy is a JSON file of the genres the station knows, replacing
+	// the built-in ones, see taxonomy.go.
+	Taxonomy   string         `json:"taxonomy"`
+	TTL        Duration       `json:"ttl"`
+	Priorities map[string]int `json:"priorities"`
+	// Schedule is the programming guide, see guide.go.
+	Schedule []GuideBlock `json:"schedule"`
+	// StatsFile keeps per-genre listener retention across restarts. Empty
+	// keeps it in memory only. A relative path is taken from the config
+	// file's directory.
+	StatsFile string       `json:"stats_file"`
+	AutoDJ    AutoDJConfig `json:"auto_dj"`
+	// LocalTime picks a genre by the listener's own clock when they are the
+	// station's only listener, see localtime.go.
+	LocalTime []GuideBlock `json:"local_time"`
+	// Transitions plays a sound effect on genre changes, see transitions.go.
+	Transitions TransitionsConfig `json:"transitions"`
+	// Blocklist holds genres the station never plays, see blocklist.go.
+	Blocklist BlocklistConfig `json:"blocklist"`
+}
+
+// BlocklistConfig blocks Genres for good. Votes is how many listeners must
+// vote against a genre for it to be blocked; 0 leaves it to admins. Genres
+// blocked at runtime are kept in File, relative to the config file's
+// directory, or forgotten on restart when File is empty.
+type BlocklistConfig struct {
+	Genres []string `json:"genres"`
+	Votes  int      `json:"votes"`
+	File   string   `json:"file"`
+}
+
+// StandbyConfig picks what listeners hear when the generator has sent
+// nothing for After: "silence", "loop" (File, or the bootstrap file when
+// File is empty) or "off".
+type StandbyConfig struct {
+	Mode  string   `json:"mode"`
+	File  string   `json:"file"`
+	After Duration `json:"after"`
+}
+
+// TransitionsConfig picks the transition sound effect. Sound names a WAV
+// file in Dir without its extension, "random" for any of them, or is empty
+// for none. Level scales the effect before it is mixed in.
+type TransitionsConfig struct {
+	Dir   string  `json:"dir"`
+	Sound string  `json:"sound"`
+	Level float64 `json:"level"`
+}
+
+// GuideBlock plays Genre from Start to End ("HH:MM", station time) on the
+// given Days ("mon".."sun"), or every day when Days is empty.
+type GuideBlock struct {
+	Genre string            `json:"genre"`
+	Vars  map[string]string `json:"vars"`
+	Start string            `json:"start"`
+	End   string            `json:"end"`
+	Days  []string          `json:"days"`
+}
+
+// AutoDJConfig lets the station pick genres itself when nobody has made a
+// request for Idle, choosing among the Top best-retaining genres that have
+// been played at least MinPlays times.
+type AutoDJConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Idle     Duration `json:"idle"`
+	Top      int      `json:"top"`
+	MinPlays int      `json:"min_plays"`
+}
+
+// CapacityConfig describes the resources available for serving listeners,
+// used by /capacity to estimate how many the station can support.
+type CapacityConfig struct {
+	EgressBitsPerSec int64   `json:"egress_bits_per_sec"` // 0 means unknown
+	CPUCores         float64 `json:"cpu_cores"`           // 0 means every core
+	MaxListeners     int     `json:"max_listeners"`       // 0 means no hard cap
+	// Headroom is the fraction of each resource the estimate may plan to use.
+	Headroom float64 `json:"headroom"`
+	// Horizon is how far ahead the listener trend is projected.
+	Horizon Duration `json:"horizon"`
+}
+
+// FlagConfig turns a feature flag on for Percent of sessions (all of them
+// when unset), optionally only on the listed stations.
+type FlagConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Percent  *int     `json:"percent,omitempty"`
+	Stations []string `json:"stations,omitempty"`
+}
+
+// AlertsConfig sends notifications when status events happen. Notifiers are
+// named so rules can pick which ones they go to.
+type AlertsConfig struct {
+	Notifiers map[string]NotifierConfig `json:"notifiers"`
+	Rules     []AlertRule               `json:"rules"`
+	// SLOs publish "slo" events when a route fails faster than its
+	// objective allows, see slo.go.
+	SLOs []SLOConfig `json:"slos"`
+}
+
+// SLOConfig is an objective for one route: Objective of its requests
+// (e.g. 0.99) succeed, over a sliding Window. It burns when the failure
+// rate is at least BurnRate (default 1) times what the objective allows,
+// once the window has MinRequests requests.
+type SLOConfig struct {
+	Name        string   `json:"name"`
+	Route       string   `json:"route"`
+	Objective   float64  `json:"objective"`
+	Window      Duration `json:"window"`
+	Latency     Duration `json:"latency"` // slower requests count as failed
+	BurnRate    float64  `json:"burn_rate"`
+	MinRequests int      `json:"min_requests"`
+}
+
+// NotifierConfig describes one destination: "webhook", "slack" or
+// "discord" post to URL, "smtp" sends email.
+type NotifierConfig struct {
+	Type     string   `json:"type"`
+	URL      string   `json:"url"`
+	SMTPAddr string   `json:"smtp_addr"` // host:port
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// AlertRule fires when a status event of type Event arrives whose data has
+// every field in Match, at most once per Cooldown.
+type AlertRule struct {
+	Name      string            `json:"name"`
+	Event     string            `json:"event"`
+	Match     map[string]string `json:"match"`
+	Message   string            `json:"message"`
+	Notifiers []string          `json:"notifiers"`
+	Cooldown  Duration          `json:"cooldown"`
+}
+
+// ArchiveConfig enables recording the broadcast. Leaving Dir empty turns
+// the archive off.
+type ArchiveConfig struct {
+	Dir     string   `json:"dir"`
+	Segment Duration `json:"segment"`
+	// LiveWindow is how much of the live broadcast /waveform/live covers.
+	LiveWindow Duration `json:"live_window"`
+	// Retention is how long finished segments are kept. Zero keeps them
+	// forever. Old segments are deleted daily at CleanupAt, station time.
+	Retention Duration `json:"retention"`
+	CleanupAt string   `json:"cleanup_at"`
+	// Encryption stores segments encrypted, see archivecrypt.go.
+	Encryption ArchiveEncryptionConfig `json:"encryption"`
+}
+
+// ArchiveEncryptionConfig gives the archive key, 32 bytes in base64: in the
+// config, in a file, or printed by a command such as a KMS client. Setting
+// none of them leaves the archive unencrypted.
+type ArchiveEncryptionConfig struct {
+	Key        string   `json:"key"`
+	KeyFile    string   `json:"key_file"`
+	KeyCommand []string `json:"key_command"`
+}
+
+// QualityConfig controls the connection quality grades, see quality.go.
+type QualityConfig struct {
+	// ASNFile is an iptoasn.com table (ip2asn-v4.tsv or ip2asn-combined.tsv)
+	// used to group listeners by autonomous system.
+	ASNFile string `json:"asn_file"`
+}
+
+// LightsConfig drives a light show from the music, see lights.go. It is off
+// unless Hue or ArtNet is set.
+type LightsConfig struct {
+	Hue    *HueConfig    `json:"hue"`
+	ArtNet *ArtNetConfig `json:"artnet"`
+	// Scenes maps a genre ID to its scene; "default" covers the others.
+	Scenes map[string]LightScene `json:"scenes"`
+}
+
+// HueConfig is a Philips Hue bridge and the lights on it to drive.
+type HueConfig struct {
+	Bridge   string   `json:"bridge"`   // host or host:port
+	Username string   `json:"username"` // the bridge's API user
+	Lights   []string `json:"lights"`   // light IDs
+}
+
+// ArtNetConfig sends DMX over Art-Net to one universe.
+type ArtNetConfig struct {
+	Address  string         `json:"address"` // host:port, port 6454 if left out
+	Universe int            `json:"universe"`
+	Fixtures []LightFixture `json:"fixtures"`
+}
+
+// LightFixture is a DMX fixture: a dimmer, or RGB or RGBW channels starting
+// at Channel (1 to 512).
+type LightFixture struct {
+	Name    string `json:"name"`
+	Channel int    `json:"channel"`
+	Type    string `json:"type"` // dimmer, rgb or rgbw
+}
+
+// LightScene is how the lights look for a genre: they cycle through Colors
+// ("#ff8800"), moving on every BeatsPerColor beats, and never go darker
+// than Floor (0 to 1).
+type LightScene struct {
+	Colors        []string `json:"colors"`
+	BeatsPerColor int      `json:"beats_per_color"`
+	Floor         float64  `json:"floor"`
+}
+
+// UpdateConfig is where self-updates come from, see update.go.
+type UpdateConfig struct {
+	URL       string `json:"url"`        // the release binary; its signed manifest is at URL + ".manifest"
+	PublicKey string `json:"public_key"` // base64 Ed25519 key releases are signed with
+}
+
+// HandoffConfig lists the servers this one may hand its station to, see
+// handoff.go. Peers are base URLs such as "https://new.example.com"; with
+// none, handoffs are refused.
+type HandoffConfig struct {
+	Peers []string `json:"peers"`
+}
+
+// APIConfig controls the versioned API, see apiv2.go.
+type APIConfig struct {
+	// V1Sunset is the date (YYYY-MM-DD) the frozen v1 routes are due to be
+	// removed, announced in their Sunset header. Empty announces none.
+	V1Sunset string `json:"v1_sunset"`
+}
+
+// RateLimitConfig limits offers and genre changes per client IP, see
+// ratelimit.go. A limit with PerMinute 0 is off.
+type RateLimitConfig struct {
+	Offer LimitConfig `json:"offer"`
+	Genre LimitConfig `json:"genre"`
+	// TrustedProxies are the CIDRs of reverse proxies whose
+	// X-Forwarded-For header is believed.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// PerListener limits requests that carry a listener ID per listener
+	// rather than per IP, see listenerid.go.
+	PerListener bool `json:"per_listener"`
+}
+
+type LimitConfig struct {
+	PerMinute float64 `json:"per_minute"`
+	Burst     int     `json:"burst"`
+}
+
+// AuthConfig makes listeners fetch a token from /api/token before they
+// connect, see tokens.go. Secret signs the tokens; servers sharing a secret
+// accept each other's. Origins are the pages allowed to fetch tokens, e.g.
+// "https://radio.example.com"; empty allows any.
+type AuthConfig struct {
+	Required bool     `json:"required"`
+	Secret   string   `json:"secret"`
+	TTL      Duration `json:"ttl"`
+	Origins  []string `json:"origins"`
+	// ListenerIDs gives browsers a pseudonymous ID, see listenerid.go.
+	ListenerIDs ListenerIDConfig `json:"listener_ids"`
+}
+
+// ListenerIDConfig turns on listener IDs. Pseudonyms change every
+// Rotation (default 24h).
+type ListenerIDConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Rotation Duration `json:"rotation"`
+}
+
+type AdminConfig struct {
+	// Token, when set, must be sent as "Authorization: Bearer <token>" on
+	// every admin endpoint. Leaving it empty limits them to requests from
+	// the station's own host.
+	Token string `json:"token"`
+	// Listen moves every admin endpoint to a separate HTTPS listener that
+	// only accepts clients with a certificate signed by ClientCA. Use the
+	// "ca" command to create the CA and issue operator certificates.
+	Listen   string `json:"listen"`
+	TLSCert  string `json:"tls_cert"`
+	TLSKey   string `json:"tls_key"`
+	ClientCA string `json:"client_ca"`
+}
+
+type ICEConfig struct {
+	// Servers are the STUN and TURN servers used by the server and handed
+	// to browsers. RADIO_ICE_SERVERS, a JSON array of the same shape,
+	// replaces them.
+	Servers []ICEServerConfig `json:"servers"`
+	// Prune controls which gathered candidates are stripped from the SDP
+	// answer before it is sent back to the browser.
+	Prune CandidatePruneConfig `json:"prune"`
+	// NetworkTypes are the candidate types gathered: udp4, udp6, tcp4 and
+	// tcp6. Empty gathers all four.
+	NetworkTypes []string `json:"network_types"`
+	// Interfaces limits gathering to interfaces matching these glob
+	// patterns, e.g. ["eth0"]; SkipInterfaces never gathers on the ones
+	// matching, e.g. ["docker*", "br-*", "veth*"].
+	Interfaces     []string `json:"interfaces"`
+	SkipInterfaces []string `json:"skip_interfaces"`
+	// Addresses limits gathering to local addresses within these CIDRs.
+	Addresses []string `json:"addresses"`
+	// CandidateTypes are the candidate types gathered and advertised: host,
+	// srflx and relay. Empty allows all three.
+	CandidateTypes []string `json:"candidate_types"`
+	// UDPPort, when set, carries all ICE traffic over this one UDP port
+	// instead of a port per peer connection.
+	UDPPort int `json:"udp_port"`
+}
+
+// AnswerConfig rewrites the SDP answers sent to clients, see answer.go.
+type AnswerConfig struct {
+	Codecs        []string       `json:"codecs"`        // codec names to keep, e.g. ["opus", "rtx"]
+	PayloadTypes  map[string]int `json:"payload_types"` // codec name -> payload type
+	BandwidthKbps int            `json:"bandwidth_kbps"`
+}
+
+// SessionsConfig sets when listener sessions are given up on: ConnectTimeout
+// after the offer if they never connect, DisconnectGrace after ICE reports
+// them disconnected, and IdleTimeout after the client last sent RTCP.
+// ResumeWindow is how long after that a listener may still resume the
+// session through /reconnect; 0 turns resuming off.
+type SessionsConfig struct {
+	ConnectTimeout  Duration `json:"connect_timeout"`
+	DisconnectGrace Duration `json:"disconnect_grace"`
+	IdleTimeout     Duration `json:"idle_timeout"`
+	ResumeWindow    Duration `json:"resume_window"`
+}
+
+// ShutdownConfig bounds how long a SIGTERM or SIGINT shutdown may take
+// before the process exits anyway, see shutdown.go. Report names the
+// alerts.notifiers the shutdown report is sent to, see report.go.
+type ShutdownConfig struct {
+	Drain  Duration `json:"drain"`
+	Report []string `json:"report"`
+}
+
+// EmbedConfig controls the /embed player. FrameAncestors lists the sites
+// allowed to frame it, as CSP sources such as "https://example.com". Empty
+// falls back to auth.origins, or lets any site when that is empty too.
+type EmbedConfig struct {
+	FrameAncestors []string `json:"frame_ancestors"`
+}
+
+// TelemetryConfig opts in to anonymous usage reports, see telemetry.go.
+// Nothing is sent unless Enabled is set and Endpoint is given.
+type TelemetryConfig struct {
+	Enabled  bool     `json:"enabled"`
+	Endpoint string   `json:"endpoint"`
+	Interval Duration `json:"interval"`
+}
+
+// ChaosConfig turns on the fault injector, see chaos.go. It is meant for
+// staging and should never be enabled on a public station.
+type ChaosConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ICEServerConfig is a STUN or TURN server. TURN servers take either a fixed
+// Username and Credential, or the Secret shared with a TURN server using the
+// TURN REST API (coturn's use-auth-secret), from which short-lived
+// credentials are made for every peer connection.
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+}
+
+// DTLSConfig pins the certificate every peer connection presents. CertFile
+// holds the key and certificate as PEM and is created if missing; it is
+// replaced every Rotate. Leave CertFile empty for per-connection certificates.
+type DTLSConfig struct {
+	CertFile string   `json:"cert_file"`
+	Rotate   Duration `json:"rotate"`
+}
+
+// NACKConfig sets up retransmission of lost packets, see nack.go. Buffer
+// is how many recent packets of each track are kept for resending; pion
+// needs a power of two.
+type NACKConfig struct {
+	Enabled bool `json:"enabled"`
+	Buffer  int  `json:"buffer"`
+}
+
+type CandidatePruneConfig struct {
+	LinkLocal    bool     `json:"link_local"`    // 169.254.0.0/16 and fe80::/10
+	IPv6         bool     `json:"ipv6"`          // every IPv6 candidate
+	DockerBridge bool     `json:"docker_bridge"` // docker0/br-* interface addresses
+	CIDRs        []string `json:"cidrs"`         // any extra networks to strip
+}
+
+var cfg = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Station: StationConfig{
+			ID:       "main",
+			Name:     "Infinite Radio",
+			Timezone: "UTC",
+			Quota: QuotaConfig{
+				MinBitrate: 32000,
+				OverQuota:  overQuotaReject,
+			},
+		},
+		Audio: AudioConfig{
+			PipePath:         "/tmp/audio_pipe",
+			Framing:          "auto",
+			InputFormat:      "s16le",
+			Channels:         2,
+			FrameDuration:    Duration(20 * time.Millisecond),
+			Standby:          StandbyConfig{Mode: "silence", After: Duration(200 * time.Millisecond)},
+			BootstrapFade:    Duration(500 * time.Millisecond),
+			PacketValidation: validateOff,
+			LatencyBudget:    Duration(180 * time.Millisecond),
+			OfflineAfter:     Duration(15 * time.Second),
+			Commentary: CommentaryConfig{
+				Bitrate: 24000,
+			},
+		},
+		Encoder: EncoderConfig{
+			Bitrate:        128000,
+			Complexity:     8,
+			FEC:            true,
+			PacketLossPerc: 5,
+			Application:    "audio",
+			RateControl:    "cvbr",
+		},
+		DSP: DSPConfig{
+			Compressor: CompressorConfig{
+				ThresholdDB: -12,
+				Ratio:       3,
+				Attack:      Duration(10 * time.Millisecond),
+				Release:     Duration(200 * time.Millisecond),
+			},
+			Limiter: LimiterConfig{
+				CeilingDB: -1,
+				Release:   Duration(50 * time.Millisecond),
+			},
+		},
+		Genre: GenreConfig{
+			Default: "lofi",
+			TTL:     Duration(10 * time.Minute),
+			Priorities: map[string]int{
+				"auto":       0,
+				"local_time": 5,
+				"listener":   10,
+				"vote":       30,
+				"schedule":   50,
+				"admin":      100,
+			},
+			AutoDJ: AutoDJConfig{
+				Idle:     Duration(30 * time.Minute),
+				Top:      3,
+				MinPlays: 2,
+			},
+			Transitions: TransitionsConfig{Level: 1},
+		},
+		ICE: ICEConfig{
+			Servers: []ICEServerConfig{
+				{URLs: []string{"stun:stun.l.google.com:19302"}},
+			},
+		},
+		DTLS: DTLSConfig{
+			Rotate: Duration(30 * 24 * time.Hour),
+		},
+		NACK: NACKConfig{
+			Buffer: 256,
+		},
+		Capacity: CapacityConfig{
+			Headroom: 0.8,
+			Horizon:  Duration(30 * time.Minute),
+		},
+		Archive: ArchiveConfig{
+			Segment:    Duration(time.Hour),
+			LiveWindow: Duration(10 * time.Minute),
+			CleanupAt:  "04:00",
+		},
+		RateLimit: RateLimitConfig{
+			Offer: LimitConfig{Burst: 10},
+			Genre: LimitConfig{Burst: 3},
+		},
+		Alerts: AlertsConfig{
+			SLOs: []SLOConfig{
+				{Name: "offer-success", Route: "/offer", Objective: 0.99, Window: Duration(5 * time.Minute), MinRequests: 20},
+			},
+		},
+		Sessions: SessionsConfig{
+			ConnectTimeout:  Duration(30 * time.Second),
+			DisconnectGrace: Duration(15 * time.Second),
+			IdleTimeout:     Duration(60 * time.Second),
+			ResumeWindow:    Duration(30 * time.Second),
+		},
+		Shutdown:  ShutdownConfig{Drain: Duration(8 * time.Second)},
+		Telemetry: TelemetryConfig{Interval: Duration(24 * time.Hour)},
+		PresetDir: "presets",
+	}
+}
+
+func loadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config: %w", err)
+		}
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("parsing config %s: %w", path, err)
+		}
+		c.resolveStatePaths(filepath.Dir(path))
+	}
+	if env := os.Getenv("RADIO_ICE_SERVERS"); env != "" {
+		c.ICE.Servers = nil
+		if err := json.Unmarshal([]byte(env), &c.ICE.Servers); err != nil {
+			return nil, fmt.Errorf("parsing RADIO_ICE_SERVERS: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// resolveStatePaths makes the relative paths of the files and directories
+// the server writes by itself relative to dir, the config file's
+// directory, so they don't depend on where the server was started from.
+func (c *Config) resolveStatePaths(dir string) {
+	for _, p := range []*string{
+		&c.Genre.StatsFile,
+		&c.Genre.Blocklist.File,
+		&c.Genre.Transitions.Dir,
+		&c.PresetDir,
+		&c.DTLS.CertFile,
+		&c.Archive.Dir,
+	} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+}
+
+// Duration is a time.Duration that reads and writes as a string like "90s"
+// in the config file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
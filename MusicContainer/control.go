@@ -0,0 +1,408 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// The control protocol runs over a DataChannel labelled "control" that the
+// client opens before making its offer. Messages are small JSON-RPC style
+// objects:
+//
+//	request:      {"id": 1, "method": "genre.set", "params": {"genre": "jazz"}}
+//	response:     {"id": 1, "result": {...}} or {"id": 1, "error": {"code": 403, "message": "..."}}
+//	notification: {"method": "status.event", "params": {...}}
+//
+// A client starts with "hello" to agree on a protocol version and learn the
+// server's capabilities. See README.md for the method list.
+const (
+	controlLabel           = "control"
+	controlProtocolVersion = 1
+)
+
+// Capability flags advertised in the hello result. Clients should only call
+// methods whose capability is listed. Capabilities behind a feature flag are
+// only offered to sessions the flag is on for.
+var controlCapabilities = []string{"status", "genre", "quality", "reactions", "mixes", "loudness", "commentary", "beat"}
+
+var capabilityFlags = map[string]string{
+	"reactions": flagReactions,
+	"mixes":     flagStemMixes,
+}
+
+// capabilities returns the capabilities this session gets.
+func (c *controlChannel) capabilities() []string {
+	var caps []string
+	for _, name := range controlCapabilities {
+		if flag, ok := capabilityFlags[name]; ok && !flagEnabled(flag, c.sess.id) {
+			continue
+		}
+		if name == "commentary" && c.sess.commentary == nil {
+			continue
+		}
+		caps = append(caps, name)
+	}
+	return caps
+}
+
+func (c *controlChannel) hasCapability(name string) bool {
+	for _, have := range c.capabilities() {
+		if have == name {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	controlErrBadRequest   = 400
+	controlErrUnauthorized = 403
+	controlErrNotFound     = 404
+	controlErrRateLimited  = 429
+	controlErrInternal     = 500
+)
+
+type controlMessage struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type controlError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type controlReply struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Result interface{}     `json:"result,omitempty"`
+	Error  *controlError   `json:"error,omitempty"`
+}
+
+type controlNotification struct {
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+// controlChannel is one listener's end of the control protocol.
+type controlChannel struct {
+	dc   *webrtc.DataChannel
+	sess *session
+
+	mu           sync.Mutex
+	version      int
+	admin        bool
+	subs         map[string]func() // topic -> cancel
+	lastReaction time.Time
+	wantBitrate  int // quality the listener asked for, 0 for no preference
+}
+
+func attachControlChannel(sess *session, dc *webrtc.DataChannel) *controlChannel {
+	c := &controlChannel{dc: dc, sess: sess, subs: make(map[string]func())}
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		c.handle(msg.Data)
+	})
+	dc.OnClose(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for topic, cancel := range c.subs {
+			cancel()
+			delete(c.subs, topic)
+		}
+	})
+	return c
+}
+
+func (c *controlChannel) send(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding control message: %v", err)
+		return
+	}
+	if err := c.dc.SendText(string(data)); err != nil {
+		// The channel is closing; the session teardown will clean up
+		return
+	}
+}
+
+// Notify pushes a notification to the client.
+func (c *controlChannel) Notify(method string, params interface{}) {
+	c.send(controlNotification{Method: method, Params: params})
+}
+
+func (c *controlChannel) handle(data []byte) {
+	var msg controlMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		c.send(controlReply{Error: &controlError{controlErrBadRequest, "invalid JSON"}})
+		return
+	}
+
+	result, cerr := c.dispatch(msg)
+	if msg.ID == nil {
+		// Notifications from the client get no reply
+		return
+	}
+	c.send(controlReply{ID: msg.ID, Result: result, Error: cerr})
+}
+
+func (c *controlChannel) dispatch(msg controlMessage) (interface{}, *controlError) {
+	if msg.Method != "hello" {
+		c.mu.Lock()
+		negotiated := c.version != 0
+		c.mu.Unlock()
+		if !negotiated {
+			return nil, &controlError{controlErrBadRequest, "call hello first"}
+		}
+	}
+
+	switch msg.Method {
+	case "hello":
+		return c.hello(msg.Params)
+	case "status.subscribe":
+		return c.subscribe("status", status, "status.event", true)
+	case "status.unsubscribe":
+		return c.unsubscribe("status")
+	case "loudness.subscribe":
+		return c.subscribe("loudness", loudnessHub, "loudness", false)
+	case "loudness.unsubscribe":
+		return c.unsubscribe("loudness")
+	case "beat.subscribe":
+		return c.subscribe("beat", beatHub, "beat", true)
+	case "beat.unsubscribe":
+		return c.unsubscribe("beat")
+	case "genre.set":
+		return c.setGenre(msg.Params)
+	case "quality.request":
+		return c.requestQuality(msg.Params)
+	case "reaction.send":
+		if !c.hasCapability("reactions") {
+			break
+		}
+		return c.sendReaction(msg.Params)
+	case "mix.list":
+		if !c.hasCapability("mixes") {
+			break
+		}
+		return c.listMixes()
+	case "mix.select":
+		if !c.hasCapability("mixes") {
+			break
+		}
+		return c.selectMix(msg.Params)
+	case "commentary.set":
+		if !c.hasCapability("commentary") {
+			break
+		}
+		return c.setCommentary(msg.Params)
+	}
+	return nil, &controlError{controlErrNotFound, "unknown method " + msg.Method}
+}
+
+func (c *controlChannel) hello(raw json.RawMessage) (interface{}, *controlError) {
+	var p struct {
+		Version int    `json:"version"`
+		Token   string `json:"token"`
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, &controlError{controlErrBadRequest, "invalid params"}
+		}
+	}
+
+	// Speak the highest version both sides understand
+	version := controlProtocolVersion
+	if p.Version > 0 && p.Version < version {
+		version = p.Version
+	}
+
+	admin := cfg.Admin.Token != "" &&
+		subtle.ConstantTimeCompare([]byte(p.Token), []byte(cfg.Admin.Token)) == 1
+
+	c.mu.Lock()
+	c.version = version
+	c.admin = admin
+	c.mu.Unlock()
+
+	return map[string]interface{}{
+		"version":      version,
+		"capabilities": c.capabilities(),
+		"station":      cfg.Station.ID,
+		"session":      c.sess.id,
+		"admin":        admin,
+		"receipt_url":  receiptURL(c.sess.id),
+	}, nil
+}
+
+// subscribe forwards events from hub to the client as method
+// notifications. With snapshot set the client first gets the latest event
+// of each type.
+func (c *controlChannel) subscribe(topic string, hub *statusHub, method string, snapshot bool) (interface{}, *controlError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subs[topic] != nil {
+		return map[string]bool{"subscribed": true}, nil
+	}
+
+	events, cancel := hub.Subscribe()
+	done := make(chan struct{})
+	c.subs[topic] = func() {
+		cancel()
+		close(done)
+	}
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case ev := <-events:
+				c.Notify(method, ev)
+			}
+		}
+	}()
+
+	if snapshot {
+		for _, ev := range hub.Snapshot() {
+			go c.Notify(method, ev)
+		}
+	}
+	return map[string]bool{"subscribed": true}, nil
+}
+
+func (c *controlChannel) unsubscribe(topic string) (interface{}, *controlError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cancel := c.subs[topic]; cancel != nil {
+		cancel()
+		delete(c.subs, topic)
+	}
+	return map[string]bool{"subscribed": false}, nil
+}
+
+func (c *controlChannel) setGenre(raw json.RawMessage) (interface{}, *controlError) {
+	var p struct {
+		Genre  string            `json:"genre"`
+		Vars   map[string]string `json:"vars"`
+		Source string            `json:"source"`
+	}
+	if err := json.Unmarshal(raw, &p); err != nil || p.Genre == "" {
+		return nil, &controlError{controlErrBadRequest, "genre is required"}
+	}
+	if p.Source == "" {
+		p.Source = sourceListener
+	}
+	if _, ok := cfg.Genre.Priorities[p.Source]; !ok {
+		return nil, &controlError{controlErrBadRequest, "unknown source"}
+	}
+
+	c.mu.Lock()
+	admin := c.admin
+	c.mu.Unlock()
+	if p.Source != sourceListener && !admin {
+		return nil, &controlError{controlErrUnauthorized, "only admins may use source " + p.Source}
+	}
+
+	log.Printf("Genre change requested over control channel: %s", p.Genre)
+	decision, err := arbiter.Submit(GenreRequest{Genre: p.Genre, Vars: p.Vars, Source: p.Source})
+	if err == errGenreBlocked {
+		return nil, &controlError{controlErrUnauthorized, "genre is blocklisted"}
+	}
+	if err != nil {
+		log.Printf("Error writing genre file: %v", err)
+		return nil, &controlError{controlErrInternal, "failed to change genre"}
+	}
+	return decision, nil
+}
+
+// requestQuality moves the listener to the quality tier closest to the
+// bitrate it asks for. On another mix the choice applies once it returns to
+// the main one. With adaptive bitrate on, it becomes the listener's ceiling.
+func (c *controlChannel) requestQuality(raw json.RawMessage) (interface{}, *controlError) {
+	var p struct {
+		Bitrate int `json:"bitrate"`
+	}
+	if err := json.Unmarshal(raw, &p); err != nil || p.Bitrate <= 0 {
+		return nil, &controlError{controlErrBadRequest, "bitrate is required"}
+	}
+
+	c.mu.Lock()
+	c.wantBitrate = p.Bitrate
+	c.mu.Unlock()
+
+	return map[string]interface{}{
+		"requested": p.Bitrate,
+		"bitrate":   c.sess.chooseBitrate(p.Bitrate),
+		"available": stationBitrates(),
+	}, nil
+}
+
+func (c *controlChannel) sendReaction(raw json.RawMessage) (interface{}, *controlError) {
+	var p struct {
+		Reaction string `json:"reaction"`
+	}
+	if err := json.Unmarshal(raw, &p); err != nil || p.Reaction == "" || utf8.RuneCountInString(p.Reaction) > 8 {
+		return nil, &controlError{controlErrBadRequest, "reaction must be 1 to 8 characters"}
+	}
+
+	c.mu.Lock()
+	if time.Since(c.lastReaction) < time.Second {
+		c.mu.Unlock()
+		return nil, &controlError{controlErrRateLimited, "one reaction per second"}
+	}
+	c.lastReaction = time.Now()
+	c.mu.Unlock()
+
+	status.Publish("reaction", map[string]string{
+		"reaction": p.Reaction,
+		"genre":    getCurrentGenre(),
+	})
+	return map[string]bool{"sent": true}, nil
+}
+
+func (c *controlChannel) listMixes() (interface{}, *controlError) {
+	current := c.sess.output.Feed()
+	if isQualityFeed(current) {
+		current = mainFeed
+	}
+	return map[string]interface{}{
+		"mixes":   availableMixes(),
+		"current": current,
+	}, nil
+}
+
+// selectMix switches the listener to another stem mix. The switch is
+// seamless: the listener's RTP stream carries on, see rtpOutput.
+func (c *controlChannel) selectMix(raw json.RawMessage) (interface{}, *controlError) {
+	var p struct {
+		Mix string `json:"mix"`
+	}
+	if err := json.Unmarshal(raw, &p); err != nil || p.Mix == "" {
+		return nil, &controlError{controlErrBadRequest, "mix is required"}
+	}
+	if !mixAvailable(p.Mix) {
+		return nil, &controlError{controlErrNotFound, "unknown mix " + p.Mix}
+	}
+	feed := p.Mix
+	if feed == mainFeed {
+		// Back to the main mix at the listener's quality
+		feed = qualityFeed(int(c.sess.bitrate.Load()))
+	}
+	c.sess.output.SetFeed(feed)
+	return map[string]string{"current": p.Mix}, nil
+}
+
+func (c *controlChannel) setCommentary(raw json.RawMessage) (interface{}, *controlError) {
+	var p struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, &controlError{controlErrBadRequest, "enabled is required"}
+	}
+	c.sess.setCommentary(p.Enabled)
+	return map[string]bool{"enabled": p.Enabled}, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every API route is cross-origin readable. withCORS answers preflights and
+// method checks for a route from its method list in apiRoutes, so handlers
+// only ever see the methods they serve.
+
+// corsMaxAge is how long browsers may cache a preflight answer.
+const corsMaxAge = 10 * time.Minute
+
+const (
+	corsAllowHeaders  = "API-Version, Authorization, Content-Type, If-Match, If-None-Match, If-Range, Range"
+	corsExposeHeaders = "Accept-Ranges, API-Version, Content-Range, Deprecation, ETag, Link, Location, Retry-After, Sunset"
+)
+
+// withCORS wraps h with the CORS headers and the route's method list. GET
+// implies HEAD. OPTIONS requests that aren't preflights are answered with an
+// Allow header, unless the route lists OPTIONS and answers them itself.
+func withCORS(methods []string, h http.HandlerFunc) http.HandlerFunc {
+	allowed := make(map[string]bool)
+	var list []string
+	add := func(m string) {
+		if !allowed[m] {
+			allowed[m] = true
+			list = append(list, m)
+		}
+	}
+	for _, m := range methods {
+		add(m)
+		if m == http.MethodGet {
+			add(http.MethodHead)
+		}
+	}
+	ownOptions := allowed[http.MethodOptions]
+	add(http.MethodOptions)
+	allow := strings.Join(list, ", ")
+	maxAge := strconv.Itoa(int(corsMaxAge.Seconds()))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("Access-Control-Allow-Origin", "*")
+		header.Add("Vary", "Origin")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+			header.Set("Access-Control-Allow-Methods", allow)
+			header.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			header.Set("Access-Control-Max-Age", maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		header.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+
+		switch {
+		case r.Method == http.MethodOptions && !ownOptions:
+			header.Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+		case !allowed[r.Method]:
+			header.Set("Allow", allow)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		default:
+			h(w, r)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPreflightAllRoutes(t *testing.T) {
+	cfg = defaultConfig()
+	public, admin := http.NewServeMux(), http.NewServeMux()
+	registerRoutes(public, admin)
+
+	for _, rt := range apiRoutes() {
+		path := rt.pattern
+		if strings.HasSuffix(path, "/") && path != "/" {
+			path += "x"
+		}
+		for _, method := range rt.methods {
+			if method == http.MethodOptions {
+				continue
+			}
+			req := httptest.NewRequest(http.MethodOptions, path, nil)
+			req.Header.Set("Origin", "https://example.com")
+			req.Header.Set("Access-Control-Request-Method", method)
+			req.Header.Set("Access-Control-Request-Headers", "content-type, authorization")
+			rec := httptest.NewRecorder()
+			public.ServeHTTP(rec, req)
+
+			h := rec.Header()
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("%s preflight for %s: status %d, want 204", path, method, rec.Code)
+			}
+			if h.Get("Access-Control-Allow-Origin") != "*" {
+				t.Errorf("%s: missing Access-Control-Allow-Origin", path)
+			}
+			if !strings.Contains(h.Get("Access-Control-Allow-Methods"), method) {
+				t.Errorf("%s: Access-Control-Allow-Methods %q lacks %s", path, h.Get("Access-Control-Allow-Methods"), method)
+			}
+			if !strings.Contains(h.Get("Access-Control-Allow-Headers"), "Authorization") {
+				t.Errorf("%s: Authorization not allowed", path)
+			}
+			if h.Get("Access-Control-Max-Age") != "600" {
+				t.Errorf("%s: Access-Control-Max-Age %q, want 600", path, h.Get("Access-Control-Max-Age"))
+			}
+			vary := strings.Join(h.Values("Vary"), ", ")
+			for _, v := range []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"} {
+				if !strings.Contains(vary, v) {
+					t.Errorf("%s: Vary %q lacks %s", path, vary, v)
+				}
+			}
+		}
+	}
+}
+
+func TestPreflightSkipsHandler(t *testing.T) {
+	h := withCORS([]string{http.MethodPost}, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("handler called for %s", r.Method)
+	})
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want 204", rec.Code)
+	}
+}
+
+func TestPlainOptions(t *testing.T) {
+	h := withCORS([]string{http.MethodGet}, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("handler called for %s", r.Method)
+	})
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodOptions, "/", nil))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Fatalf("got %d with Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+
+	// Routes that list OPTIONS answer it themselves
+	called := false
+	own := withCORS([]string{http.MethodPost, http.MethodOptions}, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	own(httptest.NewRecorder(), httptest.NewRequest(http.MethodOptions, "/", nil))
+	if !called {
+		t.Fatal("handler not called for its own OPTIONS")
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	h := withCORS([]string{http.MethodGet, http.MethodPost}, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("handler called for %s", r.Method)
+	})
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodDelete, "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status %d, want 405", rec.Code)
+	}
+	if got := rec.Header().Get("Allow"); got != "GET, HEAD, POST, OPTIONS" {
+		t.Fatalf("Allow %q", got)
+	}
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatal("405 without Access-Control-Allow-Origin")
+	}
+}
+
+func TestAdminPreflightWithoutToken(t *testing.T) {
+	cfg = defaultConfig()
+	cfg.Admin.Token = "secret"
+	public, admin := http.NewServeMux(), http.NewServeMux()
+	registerRoutes(public, admin)
+
+	req := httptest.NewRequest(http.MethodOptions, "/sessions", nil)
+	req.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+	rec := httptest.NewRecorder()
+	public.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want 204", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	public.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d without token, want 401", rec.Code)
+	}
+}
+
+func TestAdminWithoutTokenIsLocalOnly(t *testing.T) {
+	cfg = defaultConfig()
+	public, admin := http.NewServeMux(), http.NewServeMux()
+	registerRoutes(public, admin)
+
+	for _, tc := range []struct {
+		remote, forwarded string
+		want              int
+	}{
+		{"192.0.2.1:1234", "", http.StatusUnauthorized},
+		{"127.0.0.1:1234", "", http.StatusOK},
+		{"[::1]:1234", "", http.StatusOK},
+		{"127.0.0.1:1234", "192.0.2.1", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+		req.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		rec := httptest.NewRecorder()
+		public.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("from %s (forwarded for %q): status %d, want %d", tc.remote, tc.forwarded, rec.Code, tc.want)
+		}
+	}
+}
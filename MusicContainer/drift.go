@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+// The pipe carries raw PCM with no header, so a generator that writes
+// 44.1kHz audio is played as if it were 48kHz: pitched up and, since it
+// arrives slower than it is played, with the ingest buffer running dry
+// every few seconds. The drift check times how fast frames actually arrive
+// and, over five minutes, compares that with the rate they are assumed to
+// have. When it lands on a common sample rate instead, it publishes a
+// sample_rate_mismatch status event for alert rules, and with
+// audio.auto_resample it resamples the input from the detected rate.
+
+const (
+	driftWindow    = 5 * time.Minute
+	driftStall     = time.Second // a longer wait is a stalled generator, not drift
+	driftTolerance = 0.01        // ratios closer to 1 than this are fine
+	driftMatch     = 0.005       // how close a rate must be to a common one
+)
+
+var commonSampleRates = []int{8000, 11025, 16000, 22050, 24000, 32000, 44100, 48000, 88200, 96000}
+
+var inputRateRatio = newGauge("radio_input_rate_ratio", "Rate the generator sends at over the last five minutes, as a fraction of the rate it is assumed to send.")
+
+// SampleRateMismatch is the data of a sample_rate_mismatch event.
+type SampleRateMismatch struct {
+	AssumedRate  int     `json:"assumed_rate"`
+	MeasuredRate float64 `json:"measured_rate"`
+	DetectedRate int     `json:"detected_rate"`
+	Resampling   bool    `json:"resampling"`
+}
+
+// driftDetector is only used from readStems.
+type driftDetector struct {
+	rate          int // the station's rate
+	channels      int
+	bytesPerFrame int
+	autoResample  bool
+
+	inputRate  int          // the rate the input is taken to have
+	reported   int          // the last detected rate published
+	resamplers []*resampler // one per stem while inputRate isn't rate
+	pending    [][]byte
+
+	started time.Time
+	active  time.Duration // time spent waiting for the generator
+	frames  int
+}
+
+func newDriftDetector(rate, channels, bytesPerFrame int, autoResample bool) *driftDetector {
+	return &driftDetector{
+		rate:          rate,
+		channels:      channels,
+		bytesPerFrame: bytesPerFrame,
+		autoResample:  autoResample,
+		inputRate:     rate,
+	}
+}
+
+// observe records that a frame took wait to arrive.
+func (d *driftDetector) observe(wait time.Duration) {
+	if wait > driftStall || d.started.IsZero() {
+		d.reset()
+		return
+	}
+	d.active += wait
+	d.frames++
+	if time.Since(d.started) >= driftWindow {
+		d.check()
+		d.reset()
+	}
+}
+
+func (d *driftDetector) reset() {
+	d.started = time.Now()
+	d.active = 0
+	d.frames = 0
+}
+
+func (d *driftDetector) check() {
+	if d.active <= 0 {
+		return
+	}
+	samples := float64(d.frames * d.bytesPerFrame / 2 / d.channels)
+	measured := samples / d.active.Seconds()
+	ratio := measured / float64(d.inputRate)
+	inputRateRatio.Set(ratio)
+	if math.Abs(ratio-1) <= driftTolerance {
+		return
+	}
+
+	detected := 0
+	for _, r := range commonSampleRates {
+		if math.Abs(measured-float64(r))/float64(r) <= driftMatch {
+			detected = r
+		}
+	}
+	if detected == 0 || detected == d.inputRate || detected == d.reported {
+		// Not a known rate: most likely a generator running ahead in bursts
+		return
+	}
+	d.reported = detected
+	log.Printf("WARNING: the generator sends about %.0f samples/s, not %d. It is probably producing %dHz audio.", measured, d.inputRate, detected)
+	mismatch := SampleRateMismatch{
+		AssumedRate:  d.inputRate,
+		MeasuredRate: math.Round(measured),
+		DetectedRate: detected,
+		Resampling:   d.autoResample,
+	}
+	if d.autoResample {
+		d.resampleFrom(detected)
+	}
+	status.Publish("sample_rate_mismatch", mismatch)
+}
+
+// resampleFrom converts the input from rate to the station's rate from now
+// on.
+func (d *driftDetector) resampleFrom(rate int) {
+	log.Printf("Resampling the input from %dHz to %dHz", rate, d.rate)
+	d.inputRate = rate
+	d.resamplers = nil
+	d.pending = nil
+}
+
+// convert resamples one frame of every stem, returning the whole frames
+// ready so far: none, one, or now and then two.
+func (d *driftDetector) convert(frame [][]byte) [][][]byte {
+	if d.inputRate == d.rate {
+		return [][][]byte{frame}
+	}
+	if len(d.resamplers) != len(frame) {
+		d.resamplers = make([]*resampler, len(frame))
+		for i := range frame {
+			d.resamplers[i] = newResampler(d.inputRate, d.rate, d.channels)
+		}
+		d.pending = make([][]byte, len(frame))
+	}
+	for i, in := range frame {
+		d.pending[i] = d.resamplers[i].process(in, d.pending[i])
+		pcmBytes.put(in)
+	}
+	var out [][][]byte
+	for len(d.pending[0]) >= d.bytesPerFrame {
+		next := make([][]byte, len(d.pending))
+		for i := range d.pending {
+			next[i] = pcmBytes.clone(d.pending[i][:d.bytesPerFrame])
+			d.pending[i] = d.pending[i][d.bytesPerFrame:]
+		}
+		out = append(out, next)
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+var dspSettings atomic.Pointer[DSPConfig]
+
+func setDSPConfig(c DSPConfig) {
+	dspSettings.Store(&c)
+}
+
+func currentDSPConfig() DSPConfig {
+	if c := dspSettings.Load(); c != nil {
+		return *c
+	}
+	return DSPConfig{}
+}
+
+func (c DSPConfig) validate() error {
+	if c.GainDB < -24 || c.GainDB > 24 {
+		return fmt.Errorf("gain_db must be between -24 and 24, got %v", c.GainDB)
+	}
+	if c.TargetLUFS != 0 && (c.TargetLUFS < -36 || c.TargetLUFS > -6) {
+		return fmt.Errorf("target_lufs must be between -36 and -6, got %v", c.TargetLUFS)
+	}
+	if comp := c.Compressor; comp.Enabled {
+		if comp.ThresholdDB < -60 || comp.ThresholdDB > 0 {
+			return fmt.Errorf("compressor threshold_db must be between -60 and 0, got %v", comp.ThresholdDB)
+		}
+		if comp.Ratio < 1 || comp.Ratio > 20 {
+			return fmt.Errorf("compressor ratio must be between 1 and 20, got %v", comp.Ratio)
+		}
+		if comp.Attack < 0 || comp.Release < 0 {
+			return fmt.Errorf("compressor attack and release can't be negative")
+		}
+		if comp.MakeupDB < 0 || comp.MakeupDB > 24 {
+			return fmt.Errorf("compressor makeup_db must be between 0 and 24, got %v", comp.MakeupDB)
+		}
+	}
+	if lim := c.Limiter; lim.Enabled {
+		if lim.CeilingDB < -12 || lim.CeilingDB > 0 {
+			return fmt.Errorf("limiter ceiling_db must be between -12 and 0, got %v", lim.CeilingDB)
+		}
+		if lim.Release < 0 {
+			return fmt.Errorf("limiter release can't be negative")
+		}
+	}
+	return nil
+}
+
+// handleDSP shows the DSP settings on GET. PUT changes them between frames;
+// fields left out of the body keep their value:
+//
+//	curl -X PUT /api/dsp -d '{"limiter": {"enabled": true}}'
+func handleDSP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		c := currentDSPConfig()
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := c.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setDSPConfig(c)
+		log.Printf("DSP settings changed: %+v", c)
+		status.Publish("dsp", c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentDSPConfig())
+}
+
+// dspChain is the processing one mix goes through before it is encoded:
+// gain, compressor, loudness normalization, then the limiter, so nothing
+// before it can push a peak over the ceiling.
+type dspChain struct {
+	dynamics *dynamicsProcessor
+	norm     *loudnessNormalizer
+}
+
+func newDSPChain(mix string, sampleRate, channels int) *dspChain {
+	return &dspChain{
+		dynamics: newDynamicsProcessor(mix, sampleRate, channels),
+		norm:     newLoudnessNormalizer(mix, channels),
+	}
+}
+
+func (d *dspChain) process(samples []int16) {
+	c := currentDSPConfig()
+	processPCM(samples)
+	d.dynamics.compress(samples, c.Compressor)
+	d.norm.process(samples)
+	d.dynamics.limit(samples, c.Limiter)
+}
+
+// processPCM applies the gain setting to a frame of interleaved samples in
+// place.
+func processPCM(samples []int16) {
+	c := dspSettings.Load()
+	if c == nil || c.GainDB == 0 {
+		return
+	}
+
+	gain := math.Pow(10, c.GainDB/20)
+	for i, s := range samples {
+		v := float64(s) * gain
+		if v > math.MaxInt16 {
+			v = math.MaxInt16
+		} else if v < math.MinInt16 {
+			v = math.MinInt16
+		}
+		samples[i] = int16(v)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// By default pion generates a DTLS certificate per peer connection, so the
+// fingerprint in our answers changes all the time. With dtls.cert_file set
+// every peer connection presents the same certificate, kept on disk across
+// restarts, so monitoring and native clients can pin its fingerprint. It is
+// replaced every dtls.rotate; the previous fingerprint stays listed in /dtls
+// and the change is published as a "dtls_rotated" status event. The
+// --cert-dir flag sets dtls.cert_file to dtlsCertName in that directory.
+
+// dtlsGrace is how long a certificate stays valid after it is due for
+// rotation, so a server that was down at the time doesn't serve an expired one.
+const dtlsGrace = 7 * 24 * time.Hour
+
+// dtlsCertName is the certificate's file name under --cert-dir.
+const dtlsCertName = "dtls.pem"
+
+var (
+	dtlsMu       sync.Mutex
+	dtlsCert     *webrtc.Certificate // nil when pion picks its own
+	dtlsPrevious []webrtc.DTLSFingerprint
+)
+
+// setupDTLS loads or creates the pinned certificate and keeps it rotated.
+func setupDTLS(c DTLSConfig) error {
+	if c.CertFile == "" {
+		return nil
+	}
+	cert, err := loadDTLSCert(c.CertFile)
+	switch {
+	case os.IsNotExist(err):
+		log.Printf("No DTLS certificate at %s, creating one", c.CertFile)
+		cert, err = issueDTLSCert(c)
+	case err == nil && dtlsDue(cert):
+		log.Printf("DTLS certificate %s is due for rotation", c.CertFile)
+		cert, err = issueDTLSCert(c)
+	}
+	if err != nil {
+		return err
+	}
+	dtlsMu.Lock()
+	dtlsCert = cert
+	dtlsMu.Unlock()
+	log.Printf("Using DTLS certificate %s, valid until %s", c.CertFile, cert.Expires().Format(time.RFC3339))
+
+	schedule.Every("dtls_renewal", time.Hour, func() error {
+		dtlsMu.Lock()
+		due := dtlsDue(dtlsCert)
+		dtlsMu.Unlock()
+		if !due {
+			return nil
+		}
+		return rotateDTLS(c)
+	})
+	return nil
+}
+
+func dtlsDue(cert *webrtc.Certificate) bool {
+	return time.Until(cert.Expires()) < dtlsGrace
+}
+
+func loadDTLSCert(path string) (*webrtc.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := webrtc.CertificateFromPEM(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("reading DTLS certificate %s: %w", path, err)
+	}
+	return cert, nil
+}
+
+// issueDTLSCert creates a certificate valid for one rotation period plus the
+// grace period and saves it to the configured file.
+func issueDTLSCert(c DTLSConfig) (*webrtc.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cert, err := webrtc.NewCertificate(key, x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: cfg.Station.Name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Duration(c.Rotate) + dtlsGrace),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating DTLS certificate: %w", err)
+	}
+	data, err := cert.PEM()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.CertFile), 0o755); err != nil {
+		return nil, err
+	}
+	tmp := c.CertFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, c.CertFile); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// rotateDTLS replaces the pinned certificate. Peer connections that are
+// already up keep the one they started with.
+func rotateDTLS(c DTLSConfig) error {
+	cert, err := issueDTLSCert(c)
+	if err != nil {
+		return err
+	}
+	fingerprints, _ := cert.GetFingerprints()
+
+	dtlsMu.Lock()
+	if dtlsCert != nil {
+		dtlsPrevious, _ = dtlsCert.GetFingerprints()
+	}
+	dtlsCert = cert
+	dtlsMu.Unlock()
+
+	log.Printf("Rotated DTLS certificate, valid until %s", cert.Expires().Format(time.RFC3339))
+	status.Publish("dtls_rotated", map[string]interface{}{"fingerprints": fingerprints, "expires": cert.Expires()})
+	return nil
+}
+
+// dtlsCertificates returns the certificates for a new peer connection.
+func dtlsCertificates() []webrtc.Certificate {
+	dtlsMu.Lock()
+	defer dtlsMu.Unlock()
+	if dtlsCert == nil {
+		return nil
+	}
+	return []webrtc.Certificate{*dtlsCert}
+}
+
+// DTLSStatus describes the pinned certificate.
+type DTLSStatus struct {
+	Fingerprints []webrtc.DTLSFingerprint `json:"fingerprints"`
+	Previous     []webrtc.DTLSFingerprint `json:"previous,omitempty"`
+	Expires      time.Time                `json:"expires"`
+	RotatesAt    time.Time                `json:"rotates_at"`
+}
+
+func dtlsStatus() *DTLSStatus {
+	dtlsMu.Lock()
+	defer dtlsMu.Unlock()
+	if dtlsCert == nil {
+		return nil
+	}
+	fingerprints, _ := dtlsCert.GetFingerprints()
+	return &DTLSStatus{
+		Fingerprints: fingerprints,
+		Previous:     dtlsPrevious,
+		Expires:      dtlsCert.Expires(),
+		RotatesAt:    dtlsCert.Expires().Add(-dtlsGrace),
+	}
+}
+
+// handleDTLS shows the pinned certificate on GET and rotates it on POST.
+func handleDTLS(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if cfg.DTLS.CertFile == "" {
+			http.Error(w, "No pinned DTLS certificate configured", http.StatusConflict)
+			return
+		}
+		if err := rotateDTLS(cfg.DTLS); err != nil {
+			log.Printf("Error rotating DTLS certificate: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	st := dtlsStatus()
+	if st == nil {
+		http.Error(w, "No pinned DTLS certificate configured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
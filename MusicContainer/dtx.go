@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Discontinuous transmission (encoder.dtx) stops sending audio while the
+// station is silent, such as in the gaps between generated segments, so a
+// listener's bandwidth drops to almost nothing. The encoder runs with Opus
+// DTX, and the server stops sending once the PCM has stayed silent for the
+// hangover, except for one packet every 400ms as Opus DTX itself does. The
+// fan-out moves the RTP timestamp on over the gap and marks the first packet
+// after it, so players see a pause rather than loss. It is off by default:
+// some players conceal a DTX gap with noise or drop the stream.
+
+const (
+	dtxThreshold = 33                     // peak sample at or below which a frame is silent, about -60 dBFS
+	dtxHangover  = 200 * time.Millisecond // silence still sent before transmission stops
+	dtxKeepalive = 400 * time.Millisecond // between packets while silent
+)
+
+var dtxSkipped = newCounter("radio_dtx_frames_skipped_total", "Silent frames not sent to listeners because of DTX.")
+
+// silenceGate decides which frames to send while DTX is on.
+type silenceGate struct {
+	enabled bool
+	silent  int // consecutive silent frames
+}
+
+func isSilent(pcm []int16) bool {
+	for _, s := range pcm {
+		if s > dtxThreshold || s < -dtxThreshold {
+			return false
+		}
+	}
+	return true
+}
+
+// transmit reports whether the frame should be sent to listeners.
+func (g *silenceGate) transmit(pcm []int16) bool {
+	hangover := framesIn(dtxHangover)
+	if !isSilent(pcm) {
+		if g.enabled && g.silent > hangover {
+			log.Println("Audio resumed, ending DTX.")
+			status.Publish("dtx", map[string]bool{"active": false})
+		}
+		g.silent = 0
+		return true
+	}
+	g.silent++
+	if !g.enabled || g.silent <= hangover {
+		return true
+	}
+	if g.silent == hangover+1 {
+		log.Println("Station is silent, pausing transmission (DTX).")
+		status.Publish("dtx", map[string]bool{"active": true})
+	}
+	if (g.silent-hangover)%framesIn(dtxKeepalive) == 0 {
+		return true
+	}
+	dtxSkipped.Inc()
+	return false
+}
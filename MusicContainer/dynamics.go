@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// The dynamics stage keeps hot generator output from clipping. The
+// compressor gently turns down everything above its threshold by its ratio,
+// with a 6 dB soft knee. The limiter is a brick wall: it follows the peak
+// with an instant attack, so no sample leaves above the ceiling. Both are
+// stereo-linked, so the image doesn't shift, and both are set with the rest
+// of the DSP settings, so they can be switched at runtime.
+
+const compressorKneeDB = 6
+
+var dynamicsReduction = newGauge("radio_dynamics_reduction_db", "Deepest gain reduction in the last frame, by mix and stage.")
+
+type dynamicsProcessor struct {
+	mix        string
+	channels   int
+	sampleRate int
+	compDB     float64 // compressor gain reduction, <= 0
+	limEnv     float64 // limiter peak envelope, linear
+}
+
+func newDynamicsProcessor(mix string, sampleRate, channels int) *dynamicsProcessor {
+	return &dynamicsProcessor{mix: mix, channels: channels, sampleRate: sampleRate}
+}
+
+// timeCoef is the one-pole smoothing coefficient for time constant d.
+func (p *dynamicsProcessor) timeCoef(d Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return math.Exp(-1 / (time.Duration(d).Seconds() * float64(p.sampleRate)))
+}
+
+// framePeak returns the largest magnitude among the channels of frame i.
+func framePeak(pcm []int16, channels, i int) float64 {
+	var peak float64
+	for ch := 0; ch < channels; ch++ {
+		if v := math.Abs(float64(pcm[i*channels+ch])); v > peak {
+			peak = v
+		}
+	}
+	return peak / 32768
+}
+
+func scaleFrame(pcm []int16, channels, i int, gain float64) {
+	for ch := 0; ch < channels; ch++ {
+		v := float64(pcm[i*channels+ch]) * gain
+		if v > math.MaxInt16 {
+			v = math.MaxInt16
+		} else if v < math.MinInt16 {
+			v = math.MinInt16
+		}
+		pcm[i*channels+ch] = int16(v)
+	}
+}
+
+// compress runs the compressor over pcm in place.
+func (p *dynamicsProcessor) compress(pcm []int16, c CompressorConfig) {
+	if !c.Enabled {
+		p.compDB = 0
+		return
+	}
+	attack, release := p.timeCoef(c.Attack), p.timeCoef(c.Release)
+	deepest := 0.0
+	for i := 0; i < len(pcm)/p.channels; i++ {
+		level := 20 * math.Log10(math.Max(framePeak(pcm, p.channels, i), 1e-6))
+		over := level - c.ThresholdDB
+		var want float64
+		switch {
+		case over >= compressorKneeDB/2:
+			want = over * (1/c.Ratio - 1)
+		case over > -compressorKneeDB/2:
+			x := over + compressorKneeDB/2
+			want = (1/c.Ratio - 1) * x * x / (2 * compressorKneeDB)
+		}
+		coef := release
+		if want < p.compDB {
+			coef = attack
+		}
+		p.compDB = want + coef*(p.compDB-want)
+		deepest = math.Min(deepest, p.compDB)
+		scaleFrame(pcm, p.channels, i, math.Pow(10, (p.compDB+c.MakeupDB)/20))
+	}
+	dynamicsReduction.Set(math.Round(deepest*10)/10, "mix", p.mix, "stage", "compressor")
+}
+
+// limit runs the limiter over pcm in place.
+func (p *dynamicsProcessor) limit(pcm []int16, c LimiterConfig) {
+	if !c.Enabled {
+		p.limEnv = 0
+		return
+	}
+	ceiling := math.Pow(10, c.CeilingDB/20)
+	release := p.timeCoef(c.Release)
+	lowest := 1.0
+	for i := 0; i < len(pcm)/p.channels; i++ {
+		p.limEnv = math.Max(framePeak(pcm, p.channels, i), p.limEnv*release)
+		if p.limEnv > ceiling {
+			gain := ceiling / p.limEnv
+			lowest = math.Min(lowest, gain)
+			scaleFrame(pcm, p.channels, i, gain)
+		}
+	}
+	dynamicsReduction.Set(math.Round(20*math.Log10(lowest)*10)/10, "mix", p.mix, "stage", "limiter")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// /embed is a small player meant for an <iframe> on someone else's site:
+// a play button, the genre on air and nothing else. It signals through the
+// same /offer endpoint as the full player. The query string themes it:
+//
+//	station   the station ID, 404 if this server doesn't carry it
+//	accent    accent colour as hex, without the #
+//	theme     dark (default) or light
+//	autoplay  1 to start playing on load, if the browser allows it
+//
+// embed.frame_ancestors restricts which sites may frame it. Since the page
+// fetches listener tokens from this server's own origin, auth.origins alone
+// would not keep other sites from framing it, so without frame_ancestors
+// the sites in auth.origins are the ones allowed.
+
+var embedAccent = regexp.MustCompile(`^[0-9a-fA-F]{3}([0-9a-fA-F]{3})?$`)
+
+type embedPage struct {
+	Station  string
+	Accent   string
+	Light    bool
+	Autoplay bool
+}
+
+func handleEmbed(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if id := q.Get("station"); id != "" && id != cfg.Station.ID {
+		http.Error(w, "No station "+id+" on this server", http.StatusNotFound)
+		return
+	}
+	page := embedPage{
+		Station:  cfg.Station.Name,
+		Accent:   "bb86fc",
+		Light:    q.Get("theme") == "light",
+		Autoplay: q.Get("autoplay") == "1",
+	}
+	if a := q.Get("accent"); a != "" {
+		if !embedAccent.MatchString(a) {
+			http.Error(w, "accent must be a hex colour such as ff8800", http.StatusBadRequest)
+			return
+		}
+		page.Accent = a
+	}
+
+	ancestors := cfg.Embed.FrameAncestors
+	if len(ancestors) == 0 && len(cfg.Auth.Origins) > 0 {
+		ancestors = append([]string{"'self'"}, cfg.Auth.Origins...)
+	}
+	if len(ancestors) > 0 {
+		w.Header().Set("Content-Security-Policy", "frame-ancestors "+strings.Join(ancestors, " "))
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := embedTemplate.Execute(w, page); err != nil {
+		log.Printf("Error rendering embed player: %v", err)
+	}
+}
+
+var embedTemplate = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Station}}</title>
+    <style>
+        :root {
+            --accent: #{{.Accent}};
+            --bg: {{if .Light}}#ffffff{{else}}#121212{{end}};
+            --text: {{if .Light}}#1e1e1e{{else}}#e0e0e0{{end}};
+            --text-secondary: {{if .Light}}#666666{{else}}#a0a0a0{{end}};
+        }
+        * { margin: 0; padding: 0; box-sizing: border-box; }
+        html, body { height: 100%; }
+        body {
+            font-family: system-ui, sans-serif;
+            background: var(--bg);
+            color: var(--text);
+            display: flex;
+            align-items: center;
+            gap: 12px;
+            padding: 12px;
+            overflow: hidden;
+        }
+        button {
+            flex: none;
+            width: 48px;
+            height: 48px;
+            border: none;
+            border-radius: 50%;
+            background: var(--accent);
+            color: var(--bg);
+            font-size: 18px;
+            cursor: pointer;
+        }
+        button:disabled { opacity: 0.5; cursor: default; }
+        .info { min-width: 0; }
+        .station { font-weight: 600; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; }
+        .status { font-size: 13px; color: var(--text-secondary); white-space: nowrap; overflow: hidden; text-overflow: ellipsis; }
+    </style>
+</head>
+<body>
+    <button id="play" aria-label="Play">&#9654;</button>
+    <div class="info">
+        <div class="station">{{.Station}}</div>
+        <div class="status" id="status">Press play to listen</div>
+    </div>
+    <audio id="audio" autoplay></audio>
+    <script>
+        const autoplay = {{.Autoplay}};
+        const playBtn = document.getElementById('play');
+        const statusDiv = document.getElementById('status');
+        const audio = document.getElementById('audio');
+        let pc = null;
+        let genre = '';
+
+        function setPlaying(playing) {
+            playBtn.innerHTML = playing ? '&#10074;&#10074;' : '&#9654;';
+            playBtn.setAttribute('aria-label', playing ? 'Pause' : 'Play');
+        }
+
+        function stop(message) {
+            if (pc) {
+                pc.close();
+                pc = null;
+            }
+            audio.srcObject = null;
+            setPlaying(false);
+            playBtn.disabled = false;
+            statusDiv.textContent = message;
+        }
+
+        async function listenerToken() {
+            try {
+                const response = await fetch('/api/token', { method: 'POST', cache: 'no-store' });
+                if (response.ok) return (await response.json()).token;
+            } catch (error) {}
+            return null;
+        }
+
+        async function iceServers() {
+            try {
+                const response = await fetch('/ice-servers');
+                if (response.ok) return (await response.json()).iceServers;
+            } catch (error) {}
+            return [{urls: 'stun:stun.l.google.com:19302'}];
+        }
+
+        function gathered() {
+            return new Promise(resolve => {
+                if (pc.iceGatheringState === 'complete') return resolve();
+                pc.addEventListener('icegatheringstatechange', () => {
+                    if (pc.iceGatheringState === 'complete') resolve();
+                });
+                setTimeout(resolve, 1000);
+            });
+        }
+
+        async function start() {
+            playBtn.disabled = true;
+            statusDiv.textContent = 'Connecting...';
+            try {
+                const token = await listenerToken();
+                pc = new RTCPeerConnection({ iceServers: await iceServers() });
+                pc.addTransceiver('audio', { direction: 'recvonly' });
+                // Gives the offer a data section, so the server can open its metadata channel
+                pc.createDataChannel('control');
+                pc.ontrack = (event) => {
+                    if (event.track.kind === 'audio' && !audio.srcObject) audio.srcObject = event.streams[0];
+                };
+                pc.ondatachannel = (event) => {
+                    if (event.channel.label !== 'metadata') return;
+                    event.channel.onmessage = (msg) => {
+                        genre = JSON.parse(msg.data).genre;
+                        if (pc && pc.connectionState === 'connected') statusDiv.textContent = genre;
+                    };
+                };
+                pc.onconnectionstatechange = () => {
+                    if (!pc) return;
+                    if (pc.connectionState === 'connected') {
+                        playBtn.disabled = false;
+                        setPlaying(true);
+                        statusDiv.textContent = genre || 'Live';
+                    } else if (pc.connectionState === 'failed' || pc.connectionState === 'closed') {
+                        stop('Connection lost');
+                    }
+                };
+
+                await pc.setLocalDescription(await pc.createOffer());
+                await gathered();
+                const headers = {'Content-Type': 'application/json'};
+                if (token) headers['Authorization'] = 'Bearer ' + token;
+                const response = await fetch('/offer', {
+                    method: 'POST',
+                    headers: headers,
+                    body: JSON.stringify({ type: pc.localDescription.type, sdp: pc.localDescription.sdp })
+                });
+                if (response.status === 503) {
+                    // Offline, full, busy or restarting: try again when told to
+                    const rejection = await response.json();
+                    const after = rejection.retry_after || 10;
+                    stop('Unavailable, retrying in ' + after + 's...');
+                    playBtn.disabled = true;
+                    setTimeout(start, after * 1000);
+                    return;
+                }
+                if (!response.ok) throw new Error('offer refused with ' + response.status);
+                const answer = await response.json();
+                await pc.setRemoteDescription({ type: answer.type, sdp: answer.sdp });
+                audio.play().catch(() => {
+                    // Autoplay blocked until the visitor interacts
+                    stop('Press play to listen');
+                });
+            } catch (error) {
+                console.error('Embed player error:', error);
+                stop('Could not connect');
+            }
+        }
+
+        playBtn.onclick = () => {
+            if (pc) stop('Paused');
+            else start();
+        };
+        if (autoplay) start();
+    </script>
+</body>
+</html>
+`))
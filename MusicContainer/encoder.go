@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+var (
+	encoderMu      sync.Mutex
+	encoderConfig  EncoderConfig
+	bitrateCap     int // 0 means uncapped
+	encoderChanged = make(chan struct{}, 1)
+)
+
+// audioFrame returns the length of one audio frame, audio.frame_duration.
+func audioFrame() time.Duration {
+	if d := time.Duration(cfg.Audio.FrameDuration); d > 0 {
+		return d
+	}
+	return 20 * time.Millisecond
+}
+
+// framesIn returns how many audio frames last about d, at least one.
+func framesIn(d time.Duration) int {
+	return max(1, int((d+audioFrame()/2)/audioFrame()))
+}
+
+// currentEncoderConfig returns the encoder settings as configured, before any
+// bitrate cap.
+func currentEncoderConfig() EncoderConfig {
+	encoderMu.Lock()
+	defer encoderMu.Unlock()
+	return encoderConfig
+}
+
+// effectiveEncoderConfig returns the settings the encoder should run with
+// right now, i.e. the configured ones limited by the bitrate cap.
+func effectiveEncoderConfig() EncoderConfig {
+	encoderMu.Lock()
+	defer encoderMu.Unlock()
+	c := encoderConfig
+	if bitrateCap > 0 && bitrateCap < c.Bitrate {
+		c.Bitrate = bitrateCap
+	}
+	return c
+}
+
+// setEncoderConfig stores new encoder settings; the audio loop picks them up
+// between frames.
+func setEncoderConfig(c EncoderConfig) {
+	encoderMu.Lock()
+	encoderConfig = c
+	encoderMu.Unlock()
+	notifyEncoderChanged()
+}
+
+// setBitrateCap limits the encoder bitrate without touching the configured
+// value, so lifting the cap restores it. Zero removes the cap.
+func setBitrateCap(bps int) {
+	encoderMu.Lock()
+	changed := bitrateCap != bps
+	bitrateCap = bps
+	encoderMu.Unlock()
+	if changed {
+		notifyEncoderChanged()
+	}
+}
+
+func notifyEncoderChanged() {
+	select {
+	case encoderChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (c EncoderConfig) validate() error {
+	if c.Bitrate < 6000 || c.Bitrate > 510000 {
+		return fmt.Errorf("bitrate must be between 6000 and 510000, got %d", c.Bitrate)
+	}
+	if c.Complexity < 0 || c.Complexity > 10 {
+		return fmt.Errorf("complexity must be between 0 and 10, got %d", c.Complexity)
+	}
+	if c.PacketLossPerc < 0 || c.PacketLossPerc > 100 {
+		return fmt.Errorf("packet_loss_perc must be between 0 and 100, got %d", c.PacketLossPerc)
+	}
+	if _, err := opusApplication(c.Application); err != nil {
+		return err
+	}
+	if _, _, err := opusRateControl(c.RateControl); err != nil {
+		return err
+	}
+	if c.Spare != "" {
+		if _, err := opusApplication(c.Spare); err != nil {
+			return fmt.Errorf("spare: %w", err)
+		}
+	}
+	return nil
+}
+
+// handleEncoder shows the encoder settings on GET. PUT changes them without
+// interrupting the stream; fields left out of the body keep their value:
+//
+//	curl -X PUT /api/encoder -d '{"bitrate": 96000, "fec": true}'
+func handleEncoder(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		c := currentEncoderConfig()
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := c.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setEncoderConfig(c)
+		log.Printf("Encoder settings changed: %+v", c)
+		status.Publish("encoder", c)
+	}
+
+	encoderMu.Lock()
+	capBps := bitrateCap
+	encoderMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"configured":  currentEncoderConfig(),
+		"effective":   effectiveEncoderConfig(),
+		"bitrate_cap": capBps,
+	})
+}
+
+func opusApplication(name string) (opus.Application, error) {
+	switch name {
+	case "", "audio":
+		return opus.AppAudio, nil
+	case "voip":
+		return opus.AppVoIP, nil
+	case "lowdelay":
+		return opus.AppRestrictedLowdelay, nil
+	}
+	return 0, fmt.Errorf("application must be audio, voip or lowdelay, got %q", name)
+}
+
+// opusRateControl returns the VBR and VBR constraint settings for a
+// rate_control mode.
+func opusRateControl(mode string) (vbr, constrained bool, err error) {
+	switch mode {
+	case "", "cvbr":
+		return true, true, nil
+	case "vbr":
+		return true, false, nil
+	case "cbr":
+		return false, false, nil
+	}
+	return false, false, fmt.Errorf("rate_control must be vbr, cvbr or cbr, got %q", mode)
+}
+
+func applyEncoderConfig(enc *opus.Encoder, c EncoderConfig) error {
+	vbr, constrained, err := opusRateControl(c.RateControl)
+	if err != nil {
+		return err
+	}
+	if err := setVBR(enc, vbr); err != nil {
+		return fmt.Errorf("setting VBR: %w", err)
+	}
+	if err := setVBRConstraint(enc, constrained); err != nil {
+		return fmt.Errorf("setting VBR constraint: %w", err)
+	}
+	if err := enc.SetBitrate(c.Bitrate); err != nil {
+		return fmt.Errorf("setting bitrate: %w", err)
+	}
+	if err := enc.SetComplexity(c.Complexity); err != nil {
+		return fmt.Errorf("setting complexity: %w", err)
+	}
+	if err := enc.SetInBandFEC(c.FEC); err != nil {
+		return fmt.Errorf("setting FEC: %w", err)
+	}
+	if err := enc.SetPacketLossPerc(c.PacketLossPerc); err != nil {
+		return fmt.Errorf("setting packet loss: %w", err)
+	}
+	if err := enc.SetDTX(c.DTX); err != nil {
+		return fmt.Errorf("setting DTX: %w", err)
+	}
+	return nil
+}
+
+// How many frames a replacement encoder encodes in parallel with the old one
+// before taking over, so its internal state already follows the signal.
+const encoderHandoverFrames = 5
+
+// hotEncoder is an Opus encoder that can be reconfigured while the stream is
+// running without ever missing a frame. Bitrate, rate control, complexity,
+// FEC, packet loss and DTX are applied to the live encoder between frames, keeping its
+// state.
+// Settings libopus can't change after the first frame (the application) get
+// a fresh encoder instead, which is primed on the live signal for a few
+// frames before the output switches over to it. That encoder comes from a
+// spare built in the background when there is one, as creating it inside
+// the frame loop can eat much of a frame's time.
+type hotEncoder struct {
+	sampleRate int
+	channels   int
+	enc        *opus.Encoder
+	app        string
+
+	next     *opus.Encoder
+	nextApp  string
+	warmLeft int
+	scratch  []byte
+
+	spare    chan *opus.Encoder // holds the spare once it's built
+	spareApp string
+}
+
+var encoderSpares = newCounter("radio_encoder_spares_total", "Encoder application switches, by whether a spare encoder was ready.")
+
+func newHotEncoder(sampleRate, channels int, c EncoderConfig) (*hotEncoder, error) {
+	enc, err := newConfiguredEncoder(sampleRate, channels, c)
+	if err != nil {
+		return nil, err
+	}
+	h := &hotEncoder{
+		sampleRate: sampleRate,
+		channels:   channels,
+		enc:        enc,
+		app:        c.Application,
+		scratch:    make([]byte, 4000),
+	}
+	h.keepSpare(c.Spare)
+	return h, nil
+}
+
+// keepSpare starts keeping a spare encoder for app ready, replacing one kept
+// for another application.
+func (h *hotEncoder) keepSpare(app string) {
+	if app == h.spareApp {
+		return
+	}
+	h.spareApp, h.spare = app, nil
+	if app != "" {
+		// A spare still being built for the old application lands in the
+		// old channel and is dropped with it.
+		h.spare = make(chan *opus.Encoder, 1)
+		h.buildSpare()
+	}
+}
+
+func (h *hotEncoder) buildSpare() {
+	spare, app := h.spare, h.spareApp
+	go func() {
+		var enc *opus.Encoder
+		application, err := opusApplication(app)
+		if err == nil {
+			enc, err = opus.NewEncoder(h.sampleRate, h.channels, application)
+		}
+		if err != nil {
+			log.Printf("Error building spare Opus encoder: %v", err)
+			return
+		}
+		spare <- enc
+	}()
+}
+
+// takeSpare returns the spare encoder if it is ready and for app, and starts
+// building the next one.
+func (h *hotEncoder) takeSpare(app string) *opus.Encoder {
+	if h.spare == nil || app != h.spareApp {
+		return nil
+	}
+	select {
+	case enc := <-h.spare:
+		h.buildSpare()
+		return enc
+	default:
+		return nil
+	}
+}
+
+func newConfiguredEncoder(sampleRate, channels int, c EncoderConfig) (*opus.Encoder, error) {
+	app, err := opusApplication(c.Application)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := opus.NewEncoder(sampleRate, channels, app)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyEncoderConfig(enc, c); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// Reconfigure switches the encoder to c, live where possible and through a
+// primed replacement otherwise.
+func (h *hotEncoder) Reconfigure(c EncoderConfig) error {
+	h.keepSpare(c.Spare)
+	if c.Application == h.app {
+		// Drop any replacement still warming up for a previous change
+		h.next = nil
+		return applyEncoderConfig(h.enc, c)
+	}
+
+	next := h.takeSpare(c.Application)
+	if next != nil {
+		encoderSpares.Inc("spare", "ready")
+		if err := applyEncoderConfig(next, c); err != nil {
+			return err
+		}
+	} else {
+		encoderSpares.Inc("spare", "missing")
+		var err error
+		if next, err = newConfiguredEncoder(h.sampleRate, h.channels, c); err != nil {
+			return err
+		}
+	}
+	h.next, h.nextApp, h.warmLeft = next, c.Application, encoderHandoverFrames
+	log.Printf("Priming new Opus encoder (application %q) for handover", c.Application)
+	return nil
+}
+
+// Encode encodes one frame with the live encoder, and feeds the same frame to
+// a replacement encoder that is warming up, swapping it in once it's ready.
+func (h *hotEncoder) Encode(pcm []int16, out []byte) (int, error) {
+	if h.next != nil {
+		if _, err := h.next.Encode(pcm, h.scratch); err != nil {
+			log.Printf("Error priming replacement encoder, keeping the old one: %v", err)
+			h.next = nil
+		} else if h.warmLeft--; h.warmLeft <= 0 {
+			h.enc, h.app, h.next = h.next, h.nextApp, nil
+			log.Println("Switched to the new Opus encoder.")
+		}
+	}
+	return h.enc.Encode(pcm, out)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Fade-in lets a new listener's audio rise from silence over audio.fade_in
+// instead of starting mid-phrase at full volume. The main mix is encoded
+// once for everyone, so it can't be faded for one listener. Instead a small
+// pool of fade encoders each encode the main mix through a rising gain, as
+// a feed of their own ("fadein-1"). A listener who connects is put on a
+// fade feed that has just started, or on a free one, and moved to their
+// usual feed once it reaches full volume. A fade feed only encodes while
+// someone is on it. When every fade encoder is busy, listeners join without
+// a fade.
+
+const (
+	fadeInSlots = 4
+	fadeInShare = 100 * time.Millisecond // a just-started fade stays open to new listeners this long
+)
+
+var (
+	fadeInRequests = make(chan *session, 64)
+	fadeIns        = newCounter("radio_fade_ins_total", "Listeners who joined, by whether they got a fade-in.")
+)
+
+// requestFadeIn asks the audio loop to fade s in, if fade-in is on.
+func requestFadeIn(s *session) {
+	if cfg.Audio.FadeIn <= 0 || s.output == nil {
+		return
+	}
+	select {
+	case fadeInRequests <- s:
+	default:
+		fadeIns.Inc("faded", "no")
+	}
+}
+
+type fadeSlot struct {
+	feed    string
+	encoder *hotEncoder
+	pcm     []int16
+	frame   int // frames into the fade, 0 when idle
+	members []*session
+}
+
+// fadePool is the set of fade encoders. It belongs to the audio loop.
+type fadePool struct {
+	slots    []*fadeSlot
+	channels int
+	frames   int // the length of a fade
+}
+
+// startFadeIns creates the fade encoders, or returns nil if fade-in is off.
+func startFadeIns(sampleRate, channels, samplesPerFrame int, frameDuration time.Duration) *fadePool {
+	if cfg.Audio.FadeIn <= 0 {
+		return nil
+	}
+	p := &fadePool{channels: channels, frames: int(time.Duration(cfg.Audio.FadeIn) / frameDuration)}
+	if p.frames < 1 {
+		p.frames = 1
+	}
+	for i := 1; i <= fadeInSlots; i++ {
+		feed := fmt.Sprintf("fadein-%d", i)
+		if err := acquireEncoder(feed); err != nil {
+			log.Printf("Error starting fade-in encoder %s: %v", feed, err)
+			break
+		}
+		encoder, err := newHotEncoder(sampleRate, channels, effectiveEncoderConfig())
+		if err != nil {
+			log.Printf("Error starting fade-in encoder %s: %v", feed, err)
+			break
+		}
+		p.slots = append(p.slots, &fadeSlot{feed: feed, encoder: encoder, pcm: make([]int16, samplesPerFrame*channels)})
+	}
+	log.Printf("Fading new listeners in over %v with %d encoders", time.Duration(cfg.Audio.FadeIn), len(p.slots))
+	return p
+}
+
+// admit puts listeners who just connected on a fade feed.
+func (p *fadePool) admit(out *encodedFrame) {
+	for {
+		select {
+		case s := <-fadeInRequests:
+			p.join(s, out)
+		default:
+			return
+		}
+	}
+}
+
+// join puts s on a fade. It moves to the fade's feed just before out is
+// written, so it hears the fade from its first frame.
+func (p *fadePool) join(s *session, out *encodedFrame) {
+	var slot *fadeSlot
+	for _, sl := range p.slots {
+		if sl.frame > 0 && sl.frame <= framesIn(fadeInShare) {
+			slot = sl
+			break
+		}
+		if sl.frame == 0 && slot == nil {
+			slot = sl
+		}
+	}
+	if slot == nil || !isQualityFeed(s.output.Feed()) {
+		fadeIns.Inc("faded", "no")
+		return
+	}
+	if slot.frame == 0 {
+		slot.frame = 1
+	}
+	slot.members = append(slot.members, s)
+	feed := slot.feed
+	out.before = append(out.before, func() { s.output.SetFeed(feed) })
+	fadeIns.Inc("faded", "yes")
+}
+
+// encode encodes the main mix for each running fade, and moves listeners
+// on once their fade is over, right after out is written.
+func (p *fadePool) encode(out *encodedFrame, pcm []int16, validator *opusValidator) {
+	for _, sl := range p.slots {
+		if sl.frame == 0 {
+			continue
+		}
+		// A curve that rises gently out of silence
+		t := float64(sl.frame) / float64(p.frames)
+		gain := t * t
+		for i, v := range pcm {
+			sl.pcm[i] = int16(math.Round(float64(v) * gain))
+		}
+		if packet, err := out.encode(sl.encoder, sl.pcm, validator); err != nil {
+			log.Printf("Error encoding fade-in %s: %v", sl.feed, err)
+		} else {
+			out.send(sl.feed, packet)
+		}
+
+		if sl.frame++; sl.frame > p.frames {
+			members, feed := sl.members, sl.feed
+			out.after = append(out.after, func() {
+				for _, s := range members {
+					if s.output.Feed() == feed {
+						s.output.SetFeed(qualityFeed(int(s.bitrate.Load())))
+					}
+				}
+			})
+			sl.frame, sl.members = 0, nil
+		}
+	}
+}
+
+func (p *fadePool) reconfigure(c EncoderConfig) {
+	for _, sl := range p.slots {
+		if err := sl.encoder.Reconfigure(c); err != nil {
+			log.Printf("Error reconfiguring Opus encoder for %s: %v", sl.feed, err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	opusClockRate = 48000
+	mainFeed      = "main"
+
+	// Bytes each packet costs on the wire on top of its payload:
+	// IPv4 (20) + UDP (8) + RTP (12) + SRTP auth tag (10).
+	packetOverhead = 50
+)
+
+var opusCapability = webrtc.RTPCodecCapability{
+	MimeType:  webrtc.MimeTypeOpus,
+	ClockRate: opusClockRate,
+	Channels:  2,
+	// More descriptive SDP line for stereo music
+	SDPFmtpLine: "minptime=10;useinbandfec=1;stereo=1;sprop-stereo=1;maxaveragebitrate=128000",
+}
+
+// setOpusChannels tells listeners whether the station is mono or stereo.
+// Opus is always signalled as two channels; stereo=0 only says the sender
+// prefers mono.
+func setOpusChannels(channels int) {
+	if channels == 1 {
+		opusCapability.SDPFmtpLine = strings.Replace(opusCapability.SDPFmtpLine, "stereo=1;sprop-stereo=1", "stereo=0;sprop-stereo=0", 1)
+	}
+}
+
+// rtpOutput is one listener's outgoing audio track. It owns the RTP sequence
+// number and timestamp for that sender, so the stream the listener receives
+// stays continuous no matter which feed is writing into it: switching
+// between the pipe, bootstrap or any other source never resets the client's
+// jitter buffer.
+type rtpOutput struct {
+	track *webrtc.TrackLocalStaticRTP
+
+	mu        sync.Mutex
+	feed      string
+	seq       uint16
+	ts        uint32
+	lastWrite time.Time
+	pkt       rtp.Packet // reused for every write
+
+	packets atomic.Uint64 // sent to this listener, for the receipt
+	bytes   atomic.Uint64
+}
+
+func newRTPOutput(feed string) (*rtpOutput, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(opusCapability, "audio", "pion")
+	if err != nil {
+		return nil, err
+	}
+	return outputForTrack(track, feed), nil
+}
+
+// outputForTrack wraps track in an output following feed.
+func outputForTrack(track *webrtc.TrackLocalStaticRTP, feed string) *rtpOutput {
+	// Random starting points, as RFC 3550 recommends
+	return &rtpOutput{
+		track: track,
+		feed:  feed,
+		seq:   uint16(rand.Uint32()),
+		ts:    rand.Uint32(),
+	}
+}
+
+// Feed returns the name of the feed this output follows.
+func (o *rtpOutput) Feed() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.feed
+}
+
+// SetFeed switches the output to another feed. Sequence numbers and
+// timestamps carry on from where the previous feed left them.
+func (o *rtpOutput) SetFeed(feed string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.feed = feed
+}
+
+func (o *rtpOutput) write(payload []byte, duration time.Duration) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	marker := false
+	if o.lastWrite.IsZero() {
+		marker = true
+	} else if gap := now.Sub(o.lastWrite); gap > 2*duration {
+		// The feed stalled. Move the timestamp on by the time that actually
+		// passed, so the receiver sees a pause instead of late packets, and
+		// flag the start of the new talkspurt.
+		o.ts += uint32((gap - duration) * opusClockRate / time.Second)
+		marker = true
+	}
+	o.lastWrite = now
+
+	o.pkt.Header = rtp.Header{
+		Version:        2,
+		Marker:         marker,
+		SequenceNumber: o.seq,
+		Timestamp:      o.ts,
+	}
+	o.pkt.Payload = payload
+	o.seq++
+	o.ts += uint32(duration * opusClockRate / time.Second)
+
+	chaos.write()
+
+	// Pion fills in the SSRC and payload type negotiated for this sender
+	return o.track.WriteRTP(&o.pkt)
+}
+
+// fanout delivers encoded frames from each feed to the outputs following it.
+type fanout struct {
+	mu      sync.RWMutex
+	outputs map[*rtpOutput]struct{}
+
+	// Running totals used to measure what each listener costs
+	packetsSent atomic.Uint64
+	bytesSent   atomic.Uint64
+	writeNanos  atomic.Int64
+}
+
+var broadcast = &fanout{outputs: make(map[*rtpOutput]struct{})}
+
+func (f *fanout) Add(o *rtpOutput) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.outputs[o] = struct{}{}
+}
+
+func (f *fanout) Remove(o *rtpOutput) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.outputs, o)
+}
+
+// Has reports whether o is attached.
+func (f *fanout) Has(o *rtpOutput) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, ok := f.outputs[o]
+	return ok
+}
+
+// Count returns the number of outputs currently attached.
+func (f *fanout) Count() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.outputs)
+}
+
+// Write sends one encoded frame from feed to every output following it.
+func (f *fanout) Write(feed string, payload []byte, duration time.Duration) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for o := range f.outputs {
+		if o.Feed() != feed {
+			continue
+		}
+		start := time.Now()
+		err := o.write(payload, duration)
+		f.writeNanos.Add(int64(time.Since(start)))
+		if err != nil {
+			// This error can happen if the peer connection is closed.
+			// It's often not critical, so it isn't logged.
+			continue
+		}
+		f.packetsSent.Add(1)
+		f.bytesSent.Add(uint64(len(payload) + packetOverhead))
+		o.packets.Add(1)
+		o.bytes.Add(uint64(len(payload)))
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every listener holds several file descriptors: UDP sockets for ICE, the
+// signaling connection and, with TCP candidates, listeners of their own.
+// When the process runs out, offers fail halfway through negotiation with
+// errors like "socket: too many open files". Instead, the server counts its
+// open descriptors and stops taking new listeners once they reach
+// fdHighWater of RLIMIT_NOFILE, answering offers with a 503 server_busy
+// until usage drops below fdLowWater. Each change publishes a
+// file_descriptors status event.
+
+const (
+	fdHighWater     = 0.9
+	fdLowWater      = 0.8
+	fdCheckInterval = 5 * time.Second
+	fdRecount       = time.Second // how stale a count offers may use
+	busyRetry       = 30 * time.Second
+)
+
+var (
+	openFDs = newGauge("radio_open_fds", "Open file descriptors.")
+	maxFDs  = newGauge("radio_max_fds", "The process's file descriptor limit (RLIMIT_NOFILE).")
+)
+
+// FDUsage is the file_descriptors part of /status.
+type FDUsage struct {
+	Open      int  `json:"open"`
+	Limit     int  `json:"limit"`
+	Accepting bool `json:"accepting"`
+}
+
+type fdMonitor struct {
+	mu        sync.Mutex
+	open      int
+	limit     int
+	countedAt time.Time
+	exhausted bool
+}
+
+var fds = &fdMonitor{}
+
+// countFDs counts the process's open descriptors, or returns -1 where
+// /proc isn't available.
+func countFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries) - 1 // ReadDir's own
+}
+
+// check recounts the descriptors and updates the accepting state.
+func (m *fdMonitor) check() {
+	open, limit := countFDs(), fdLimit()
+	m.mu.Lock()
+	m.open, m.limit, m.countedAt = open, limit, time.Now()
+	if open < 0 || limit <= 0 {
+		m.mu.Unlock()
+		return
+	}
+	was := m.exhausted
+	switch used := float64(open) / float64(limit); {
+	case used >= fdHighWater:
+		m.exhausted = true
+	case used < fdLowWater:
+		m.exhausted = false
+	}
+	now := m.exhausted
+	m.mu.Unlock()
+
+	openFDs.Set(float64(open))
+	maxFDs.Set(float64(limit))
+	if now == was {
+		return
+	}
+	state := "ok"
+	if now {
+		state = "exhausted"
+		log.Printf("WARNING: %d of %d file descriptors in use, not accepting new listeners", open, limit)
+	} else {
+		log.Printf("File descriptors back to %d of %d, accepting listeners again", open, limit)
+	}
+	status.Publish("file_descriptors", map[string]interface{}{"state": state, "open": open, "limit": limit})
+}
+
+func (m *fdMonitor) run() {
+	m.check()
+	u := m.Usage()
+	if u.Open < 0 {
+		log.Printf("Can't count open file descriptors on this system, not watching them")
+		return
+	}
+	log.Printf("File descriptor limit is %d", u.Limit)
+	for range time.Tick(fdCheckInterval) {
+		m.check()
+	}
+}
+
+// Exhausted reports whether new listeners should be turned away. It
+// recounts if the last count is more than a second old, since a burst of
+// offers can use up the rest quickly.
+func (m *fdMonitor) Exhausted() bool {
+	m.mu.Lock()
+	stale := time.Since(m.countedAt) > fdRecount && m.open >= 0
+	m.mu.Unlock()
+	if stale {
+		m.check()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.exhausted
+}
+
+func (m *fdMonitor) Usage() FDUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return FDUsage{Open: m.open, Limit: m.limit, Accepting: !m.exhausted}
+}
+
+func writeServerBusy(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(busyRetry.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(serverBusy())
+}
+
+func serverBusy() map[string]interface{} {
+	return map[string]interface{}{
+		"error":       "server_busy",
+		"reason":      "file_descriptors",
+		"retry_after": int(busyRetry.Seconds()),
+	}
+}
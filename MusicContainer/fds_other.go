@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// fdLimit returns -1: this platform has no descriptor limit to watch.
+func fdLimit() int {
+	return -1
+}
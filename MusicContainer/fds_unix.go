@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// fdLimit returns the soft RLIMIT_NOFILE, or -1 if it can't be read.
+func fdLimit() int {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return -1
+	}
+	return int(rl.Cur)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Feature flags gate experimental subsystems so they can be rolled out to a
+// share of sessions, or only on some stations, before everyone gets them.
+// Flags come from the config file and can be overridden at runtime through
+// /flags; an override lasts until it is deleted or the server restarts.
+
+const (
+	flagStemMixes = "stem_mixes" // mix.list / mix.select on the control channel
+	flagReactions = "reactions"  // reaction.send on the control channel
+)
+
+// knownFlags lists every flag and its state when the config doesn't set it.
+var knownFlags = map[string]FlagConfig{
+	flagStemMixes: {Enabled: true},
+	flagReactions: {Enabled: true},
+}
+
+var (
+	flagsMu       sync.Mutex
+	flagOverrides = make(map[string]FlagConfig)
+)
+
+// percent returns the share of sessions the flag is rolled out to.
+func (f FlagConfig) percent() int {
+	if f.Percent == nil {
+		return 100
+	}
+	return *f.Percent
+}
+
+func (f FlagConfig) validate() error {
+	if p := f.percent(); p < 0 || p > 100 {
+		return fmt.Errorf("percent must be between 0 and 100, got %d", p)
+	}
+	return nil
+}
+
+// flagState returns the flag's settings and where they came from.
+func flagState(name string) (FlagConfig, string) {
+	flagsMu.Lock()
+	o, ok := flagOverrides[name]
+	flagsMu.Unlock()
+	if ok {
+		return o, "override"
+	}
+	if f, ok := cfg.Flags[name]; ok {
+		return f, "config"
+	}
+	return knownFlags[name], "default"
+}
+
+// flagEnabled reports whether a flag is on for the given session. Pass an
+// empty session for station-wide subsystems, which are only on when the
+// flag is rolled out to everyone. A session stays in or out of a rollout for
+// as long as it lives, as the decision hashes the flag and session IDs.
+func flagEnabled(name, sessionID string) bool {
+	f, _ := flagState(name)
+	if !f.Enabled {
+		return false
+	}
+	if len(f.Stations) > 0 {
+		found := false
+		for _, s := range f.Stations {
+			found = found || s == cfg.Station.ID
+		}
+		if !found {
+			return false
+		}
+	}
+	p := f.percent()
+	if sessionID == "" || p >= 100 {
+		return p >= 100
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + sessionID))
+	return int(h.Sum32()%100) < p
+}
+
+// FlagStatus is one flag in the /flags listing.
+type FlagStatus struct {
+	Name     string   `json:"name"`
+	Enabled  bool     `json:"enabled"`
+	Percent  int      `json:"percent"`
+	Stations []string `json:"stations,omitempty"`
+	Source   string   `json:"source"` // default, config or override
+}
+
+func listFlags() []FlagStatus {
+	names := make(map[string]bool)
+	for name := range knownFlags {
+		names[name] = true
+	}
+	for name := range cfg.Flags {
+		names[name] = true
+	}
+
+	out := make([]FlagStatus, 0, len(names))
+	for name := range names {
+		f, source := flagState(name)
+		out = append(out, FlagStatus{Name: name, Enabled: f.Enabled, Percent: f.percent(), Stations: f.Stations, Source: source})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// handleFlags lists flags on GET, sets an override on POST and removes one
+// on DELETE (?name=...).
+func handleFlags(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+			FlagConfig
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := req.FlagConfig.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flagsMu.Lock()
+		flagOverrides[req.Name] = req.FlagConfig
+		flagsMu.Unlock()
+		log.Printf("Flag %s overridden: enabled=%v percent=%d", req.Name, req.Enabled, req.percent())
+		status.Publish("flag_changed", map[string]interface{}{"name": req.Name, "enabled": req.Enabled, "percent": req.percent()})
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		flagsMu.Lock()
+		delete(flagOverrides, name)
+		flagsMu.Unlock()
+		log.Printf("Flag %s override removed", name)
+		status.Publish("flag_changed", map[string]interface{}{"name": name, "override": false})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"flags": listFlags()})
+}
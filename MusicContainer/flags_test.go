@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFlagRollout(t *testing.T) {
+	cfg = defaultConfig()
+	cfg.Station.ID = "main"
+	percent := 25
+	cfg.Flags = map[string]FlagConfig{flagReactions: {Enabled: true, Percent: &percent}}
+
+	on := 0
+	for i := 0; i < 1000; i++ {
+		id := "session-" + strconv.Itoa(i)
+		got := flagEnabled(flagReactions, id)
+		if got != flagEnabled(flagReactions, id) {
+			t.Fatalf("session %s moved in or out of the rollout", id)
+		}
+		if got {
+			on++
+		}
+	}
+	if on < 150 || on > 350 {
+		t.Errorf("a 25%% rollout is on for %d of 1000 sessions", on)
+	}
+	if flagEnabled(flagReactions, "") {
+		t.Error("a partial rollout is on station-wide")
+	}
+
+	cfg.Flags[flagReactions] = FlagConfig{Enabled: true, Stations: []string{"other"}}
+	if flagEnabled(flagReactions, "session-1") {
+		t.Error("a flag limited to another station is on")
+	}
+}
+
+func TestFlagGatesCapability(t *testing.T) {
+	cfg = defaultConfig()
+	c := &controlChannel{sess: &session{id: "session-1"}}
+	if !c.hasCapability("reactions") {
+		t.Fatal("reactions are off by default")
+	}
+
+	post := httptest.NewRequest(http.MethodPost, "/flags", strings.NewReader(`{"name": "reactions", "enabled": false}`))
+	handleFlags(httptest.NewRecorder(), post)
+	if c.hasCapability("reactions") {
+		t.Error("reactions are still offered with the flag overridden off")
+	}
+	if !c.hasCapability("mixes") {
+		t.Error("overriding reactions took away mixes")
+	}
+
+	del := httptest.NewRequest(http.MethodDelete, "/flags?name=reactions", nil)
+	handleFlags(httptest.NewRecorder(), del)
+	if !c.hasCapability("reactions") {
+		t.Error("reactions are not back once the override is removed")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// Glitch forensics keep the last few seconds of pipeline timings and log
+// lines around, and when listeners may have heard a glitch (a pipeline
+// underrun, or a receiver report with a burst of packet loss) save them with
+// the state of the station as a snapshot. Snapshots are kept in memory and
+// served to admins on /glitches for post-mortems.
+
+const (
+	glitchHistory   = 5 * time.Second // pipeline timings kept
+	glitchLogLines  = 100
+	glitchSnapshots = 20 // the oldest snapshot is dropped first
+
+	// A snapshot is taken this long after its trigger, so it also shows
+	// how the pipeline recovered.
+	glitchSettle = time.Second
+	// Repeats of the same trigger for the same session are ignored for this
+	// long, so a flapping generator doesn't flush out older snapshots.
+	glitchCooldown = 30 * time.Second
+
+	glitchLossFraction = 26 // of 256, about 10% of packets lost in one report
+)
+
+// Glitch triggers.
+const (
+	glitchUnderrun = "underrun"
+	glitchLoss     = "loss"
+	glitchManual   = "manual"
+)
+
+var glitchCaptures = newCounter("radio_glitch_snapshots_total", "Glitch snapshots captured, by trigger.")
+
+// FrameTiming is one pipeline tick.
+type FrameTiming struct {
+	At     time.Time `json:"at"`
+	Queued int       `json:"queued"`          // frames waiting in the ingest buffer
+	LateMS float64   `json:"late_ms"`         // how far the pacer ran behind its tick
+	Event  string    `json:"event,omitempty"` // "underrun" or "drop"
+}
+
+// GlitchSnapshot is everything captured for one glitch.
+type GlitchSnapshot struct {
+	GlitchSummary
+	Genre     string         `json:"genre"`
+	Encoder   EncoderConfig  `json:"encoder"`
+	Latency   LatencyReport  `json:"latency"`
+	Listeners ListenerCounts `json:"listeners"`
+	Frames    []FrameTiming  `json:"frames"`
+	Sessions  []SessionInfo  `json:"sessions"` // the affected session, or all of them
+	Logs      []string       `json:"logs"`
+}
+
+// GlitchSummary is a snapshot's entry in the /glitches list.
+type GlitchSummary struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Trigger string    `json:"trigger"`
+	Session string    `json:"session,omitempty"`
+	Detail  string    `json:"detail"`
+}
+
+// glitchRecorder holds the rolling timings and log lines, and the snapshots
+// taken from them.
+type glitchRecorder struct {
+	mu        sync.Mutex
+	frames    []FrameTiming // ring, next write at frameNext
+	frameNext int
+	logs      []string // ring, next write at logNext
+	logNext   int
+	snapshots []*GlitchSnapshot
+	last      map[string]time.Time // last trigger per trigger and session
+}
+
+var glitches = &glitchRecorder{last: make(map[string]time.Time)}
+
+// frame records one pipeline tick.
+func (g *glitchRecorder) frame(queued int, late time.Duration, event string) {
+	t := FrameTiming{At: time.Now(), Queued: queued, LateMS: float64(late) / float64(time.Millisecond), Event: event}
+	g.mu.Lock()
+	if len(g.frames) < framesIn(glitchHistory) {
+		g.frames = append(g.frames, t)
+	} else {
+		g.frames[g.frameNext] = t
+	}
+	g.frameNext = (g.frameNext + 1) % framesIn(glitchHistory)
+	g.mu.Unlock()
+}
+
+// Write keeps the station's log lines; main tees the log into it.
+func (g *glitchRecorder) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	g.mu.Lock()
+	if len(g.logs) < glitchLogLines {
+		g.logs = append(g.logs, line)
+	} else {
+		g.logs[g.logNext] = line
+	}
+	g.logNext = (g.logNext + 1) % glitchLogLines
+	g.mu.Unlock()
+	return len(p), nil
+}
+
+// Trigger schedules a snapshot for a glitch. sess is the affected session,
+// or "" when every listener is.
+func (g *glitchRecorder) Trigger(trigger, sess, detail string) {
+	now := time.Now()
+	key := trigger + "/" + sess
+	g.mu.Lock()
+	if now.Sub(g.last[key]) < glitchCooldown {
+		g.mu.Unlock()
+		return
+	}
+	for k, t := range g.last {
+		if now.Sub(t) >= glitchCooldown {
+			delete(g.last, k)
+		}
+	}
+	g.last[key] = now
+	g.mu.Unlock()
+
+	summary := GlitchSummary{ID: newSessionID()[:12], Time: now, Trigger: trigger, Session: sess, Detail: detail}
+	time.AfterFunc(glitchSettle, func() { g.capture(summary) })
+}
+
+func (g *glitchRecorder) capture(summary GlitchSummary) {
+	snap := &GlitchSnapshot{
+		GlitchSummary: summary,
+		Genre:         getCurrentGenre(),
+		Encoder:       effectiveEncoderConfig(),
+		Latency:       latency.Report(),
+		Listeners:     currentListeners(),
+	}
+	if summary.Session != "" {
+		if info, ok := sessions.Info(summary.Session); ok {
+			snap.Sessions = []SessionInfo{info}
+		}
+	} else {
+		snap.Sessions = sessions.List()
+	}
+
+	g.mu.Lock()
+	// Unroll the rings, oldest first
+	snap.Frames = append(append(snap.Frames, g.frames[g.frameNext:]...), g.frames[:g.frameNext]...)
+	snap.Logs = append(append(snap.Logs, g.logs[g.logNext:]...), g.logs[:g.logNext]...)
+	g.snapshots = append(g.snapshots, snap)
+	if len(g.snapshots) > glitchSnapshots {
+		g.snapshots = g.snapshots[1:]
+	}
+	g.mu.Unlock()
+
+	glitchCaptures.Inc("trigger", summary.Trigger)
+	status.Publish("glitch", summary)
+	log.Printf("Captured glitch snapshot %s (%s: %s)", summary.ID, summary.Trigger, summary.Detail)
+}
+
+// receptionReport records a receiver report for the session's main track
+// and triggers a snapshot on a burst of loss.
+func (s *session) receptionReport(r rtcp.ReceptionReport) {
+	s.packetsLost.Store(int64(r.TotalLost))
+	s.fractionLost.Store(uint32(r.FractionLost))
+	s.jitter.Store(r.Jitter)
+	s.rtcp.add(r, time.Now())
+	if r.FractionLost >= glitchLossFraction {
+		glitches.Trigger(glitchLoss, s.id, fmt.Sprintf("%.0f%% packet loss", float64(r.FractionLost)*100/256))
+	}
+}
+
+// List returns the snapshots, newest first.
+func (g *glitchRecorder) List() []GlitchSummary {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]GlitchSummary, 0, len(g.snapshots))
+	for i := len(g.snapshots) - 1; i >= 0; i-- {
+		out = append(out, g.snapshots[i].GlitchSummary)
+	}
+	return out
+}
+
+func (g *glitchRecorder) Get(id string) *GlitchSnapshot {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, s := range g.snapshots {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// handleGlitches lists the snapshots on GET /glitches, returns one on
+// GET /glitches/<id> and takes one by hand on POST /glitches.
+func handleGlitches(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/glitches")
+	id = strings.TrimPrefix(id, "/")
+
+	var resp interface{}
+	switch {
+	case r.Method == http.MethodPost:
+		glitches.Trigger(glitchManual, "", "requested by an admin")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case id == "":
+		resp = glitches.List()
+	default:
+		snap := glitches.Get(id)
+		if snap == nil {
+			http.Error(w, "Glitch snapshot not found", http.StatusNotFound)
+			return
+		}
+		resp = snap
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// The server gathers ICE candidates on every interface and network type by
+// default. In a container that means bridge and veth addresses no client can
+// reach, which clients still try before the ones that work. ice.network_types
+// and the interface and address filters below stop those candidates from
+// being gathered at all; ice.prune only strips them from the answer.
+//
+// ice.candidate_types picks which kinds of candidate are offered at all:
+// host alone for a LAN deployment, or srflx and relay for a cloud server
+// behind 1:1 NAT whose host addresses are private. STUN servers are only
+// used when srflx is allowed and TURN servers only when relay is, and with
+// relay alone nothing else is gathered. Candidates of other types that pion
+// still gathers (host ones, unless relay is the only type) are left out of
+// answers and trickle messages.
+//
+// With ice.udp_port set every peer connection shares one UDP socket per
+// address, so a firewall or `docker run -p 8443:8443/udp` only needs to let
+// that port through, not the whole ephemeral range.
+
+var networkTypeNames = map[string]webrtc.NetworkType{
+	"udp4": webrtc.NetworkTypeUDP4,
+	"udp6": webrtc.NetworkTypeUDP6,
+	"tcp4": webrtc.NetworkTypeTCP4,
+	"tcp6": webrtc.NetworkTypeTCP6,
+}
+
+// gatherPolicy decides where candidates are gathered.
+type gatherPolicy struct {
+	networkTypes []webrtc.NetworkType
+	interfaces   []string // glob patterns, empty allows all
+	skip         []string // glob patterns
+	nets         []*net.IPNet
+	udpMux       ice.UDPMux      // nil for a port per connection
+	types        map[string]bool // candidate types allowed, nil for all
+}
+
+// candidateTypeNames are the candidate types ice.candidate_types takes.
+// Peer reflexive candidates are learned during checks, not gathered.
+var candidateTypeNames = map[string]bool{"host": true, "srflx": true, "relay": true}
+
+var gathering = &gatherPolicy{networkTypes: []webrtc.NetworkType{
+	webrtc.NetworkTypeUDP4,
+	webrtc.NetworkTypeUDP6,
+	webrtc.NetworkTypeTCP4,
+	webrtc.NetworkTypeTCP6,
+}}
+
+func newGatherPolicy(c ICEConfig) (*gatherPolicy, error) {
+	p := &gatherPolicy{
+		networkTypes: gathering.networkTypes,
+		interfaces:   c.Interfaces,
+		skip:         c.SkipInterfaces,
+	}
+	if len(c.NetworkTypes) > 0 {
+		p.networkTypes = nil
+		for _, name := range c.NetworkTypes {
+			t, ok := networkTypeNames[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown network type %q, want udp4, udp6, tcp4 or tcp6", name)
+			}
+			p.networkTypes = append(p.networkTypes, t)
+		}
+	}
+	for _, name := range c.CandidateTypes {
+		name = strings.ToLower(name)
+		if !candidateTypeNames[name] {
+			return nil, fmt.Errorf("unknown candidate type %q, want host, srflx or relay", name)
+		}
+		if p.types == nil {
+			p.types = make(map[string]bool)
+		}
+		p.types[name] = true
+	}
+	for _, pattern := range append(append([]string(nil), c.Interfaces...), c.SkipInterfaces...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad interface pattern %q", pattern)
+		}
+	}
+	for _, cidr := range c.Addresses {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("address filter %q: %w", cidr, err)
+		}
+		p.nets = append(p.nets, n)
+	}
+	return p, nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *gatherPolicy) allowInterface(name string) bool {
+	if len(p.interfaces) > 0 && !matchAny(p.interfaces, name) {
+		return false
+	}
+	return !matchAny(p.skip, name)
+}
+
+func (p *gatherPolicy) allowIP(ip net.IP) bool {
+	if len(p.nets) == 0 {
+		return true
+	}
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowType reports whether candidates of type typ (host, srflx, prflx or
+// relay) may be used. Peer reflexive candidates go with server reflexive.
+func (p *gatherPolicy) allowType(typ string) bool {
+	if p.types == nil {
+		return true
+	}
+	if typ == "prflx" {
+		typ = "srflx"
+	}
+	return p.types[typ]
+}
+
+// relayOnly reports whether relay candidates are the only ones allowed.
+func (p *gatherPolicy) relayOnly() bool {
+	return len(p.types) == 1 && p.types["relay"]
+}
+
+// configure drops the ICE servers that would gather disallowed candidate
+// types, and gathers nothing but relay candidates when that is all there is.
+func (p *gatherPolicy) configure(config *webrtc.Configuration) {
+	if p.types == nil {
+		return
+	}
+	servers := config.ICEServers[:0]
+	for _, s := range config.ICEServers {
+		var urls []string
+		for _, u := range s.URLs {
+			if strings.HasPrefix(u, "turn") && p.types["relay"] || strings.HasPrefix(u, "stun") && p.types["srflx"] {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) > 0 {
+			s.URLs = urls
+			servers = append(servers, s)
+		}
+	}
+	config.ICEServers = servers
+	if p.relayOnly() {
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+}
+
+// listenUDP opens the shared ICE port on every address the policy gathers
+// on. Port 0 leaves each peer connection to pick its own.
+func (p *gatherPolicy) listenUDP(port int) error {
+	if port == 0 {
+		return nil
+	}
+	var networks []ice.NetworkType
+	for _, t := range p.networkTypes {
+		switch t {
+		case webrtc.NetworkTypeUDP4:
+			networks = append(networks, ice.NetworkTypeUDP4)
+		case webrtc.NetworkTypeUDP6:
+			networks = append(networks, ice.NetworkTypeUDP6)
+		}
+	}
+	if len(networks) == 0 {
+		return fmt.Errorf("udp_port is set but network_types gathers no UDP candidates")
+	}
+	opts := []ice.UDPMuxFromPortOption{ice.UDPMuxFromPortWithNetworks(networks...)}
+	if len(p.interfaces) > 0 || len(p.skip) > 0 {
+		opts = append(opts, ice.UDPMuxFromPortWithInterfaceFilter(p.allowInterface))
+	}
+	if len(p.nets) > 0 {
+		opts = append(opts, ice.UDPMuxFromPortWithIPFilter(p.allowIP))
+	}
+	mux, err := ice.NewMultiUDPMuxFromPort(port, opts...)
+	if err != nil {
+		return fmt.Errorf("listening on UDP port %d: %w", port, err)
+	}
+	p.udpMux = mux
+	log.Printf("All ICE traffic goes through UDP port %d", port)
+	return nil
+}
+
+// apply sets up a peer connection's setting engine to gather by the policy.
+func (p *gatherPolicy) apply(se *webrtc.SettingEngine) {
+	se.SetNetworkTypes(p.networkTypes)
+	if p.udpMux != nil {
+		se.SetICEUDPMux(p.udpMux)
+	}
+	if len(p.interfaces) > 0 || len(p.skip) > 0 {
+		se.SetInterfaceFilter(p.allowInterface)
+	}
+	if len(p.nets) > 0 {
+		se.SetIPFilter(p.allowIP)
+	}
+}
+
+// logInterfaces says which local interfaces candidates will be gathered on.
+func (p *gatherPolicy) logInterfaces() {
+	if len(p.interfaces) == 0 && len(p.skip) == 0 {
+		return
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	var used, skipped []string
+	for _, iface := range ifaces {
+		if p.allowInterface(iface.Name) {
+			used = append(used, iface.Name)
+		} else {
+			skipped = append(skipped, iface.Name)
+		}
+	}
+	log.Printf("Gathering ICE candidates on %s, skipping %s", strings.Join(used, ", "), strings.Join(skipped, ", "))
+	if len(used) == 0 {
+		log.Printf("WARNING: no interface left to gather ICE candidates on, clients will not be able to connect")
+	}
+}
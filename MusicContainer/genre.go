@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Genre request sources, from least to most authoritative by default.
+const (
+	sourceAuto      = "auto"       // see genrestats.go
+	sourceLocalTime = "local_time" // see localtime.go
+	sourceListener  = "listener"
+	sourceVote      = "vote"
+	sourceSchedule  = "schedule"
+	sourceAdmin     = "admin"
+)
+
+// GenreRequest is one source's claim on what the station should play.
+type GenreRequest struct {
+	Genre   string
+	Vars    map[string]string
+	Source  string
+	Expires time.Time
+}
+
+// GenreDecision records what the arbiter did with a request and why. Every
+// decision is published on the status channel.
+type GenreDecision struct {
+	Genre    string    `json:"genre"`
+	Prompt   string    `json:"prompt,omitempty"`
+	Source   string    `json:"source"`
+	Accepted bool      `json:"accepted"`
+	Reason   string    `json:"reason"`
+	Expires  time.Time `json:"expires,omitempty"`
+}
+
+// genreArbiter keeps the latest live request from each source. The station
+// plays the request from the highest-priority source; requests expire after
+// the configured TTL, at which point the next best live request takes over.
+// When nothing is live the station keeps playing whatever it played last.
+type genreArbiter struct {
+	mu        sync.Mutex
+	pending   map[string]*GenreRequest
+	effective *GenreRequest
+	genre     string
+	prompt    string
+}
+
+var arbiter = &genreArbiter{pending: make(map[string]*GenreRequest)}
+
+func getCurrentGenre() string {
+	arbiter.mu.Lock()
+	defer arbiter.mu.Unlock()
+	return arbiter.genre
+}
+
+// currentGenreVars returns the prompt variables of the request on air, if any.
+func currentGenreVars() map[string]string {
+	arbiter.mu.Lock()
+	defer arbiter.mu.Unlock()
+	if arbiter.effective == nil {
+		return nil
+	}
+	return arbiter.effective.Vars
+}
+
+func genrePriority(source string) int {
+	return cfg.Genre.Priorities[source]
+}
+
+// Submit offers a request to the arbiter and applies it if it wins.
+func (a *genreArbiter) Submit(req GenreRequest) (GenreDecision, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	req.Genre = taxonomy.Canonical(req.Genre)
+	if blocklist.Blocked(req.Genre) {
+		d := GenreDecision{Genre: req.Genre, Source: req.Source, Reason: "genre is blocklisted"}
+		log.Printf("Genre request %q from %s refused: %s", req.Genre, req.Source, d.Reason)
+		status.Publish("genre_decision", d)
+		return d, errGenreBlocked
+	}
+	if req.Source != sourceAuto && req.Source != sourceLocalTime {
+		genreStats.Human()
+	}
+	now := time.Now()
+	a.expireLocked(now)
+
+	if req.Expires.IsZero() {
+		req.Expires = now.Add(time.Duration(cfg.Genre.TTL))
+	}
+	a.pending[req.Source] = &req
+
+	if cur := a.effective; cur != nil && genrePriority(cur.Source) > genrePriority(req.Source) {
+		d := GenreDecision{
+			Genre:   req.Genre,
+			Source:  req.Source,
+			Reason:  fmt.Sprintf("%s request for %q holds the station until %s", cur.Source, cur.Genre, cur.Expires.Format(time.Kitchen)),
+			Expires: req.Expires,
+		}
+		log.Printf("Genre request %q from %s queued: %s", req.Genre, req.Source, d.Reason)
+		status.Publish("genre_decision", d)
+		return d, nil
+	}
+
+	reason := "highest priority live request"
+	if a.effective == nil {
+		reason = "no other live request"
+	} else if a.effective.Source == req.Source {
+		reason = "replaces earlier " + req.Source + " request"
+	}
+	return a.applyLocked(&req, reason)
+}
+
+// Expire drops requests past their TTL and falls back to the next best live
+// request if the effective one expired.
+func (a *genreArbiter) Expire() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expireLocked(time.Now())
+}
+
+func (a *genreArbiter) expireLocked(now time.Time) {
+	a.dropLocked(func(req *GenreRequest) bool { return now.After(req.Expires) }, "expired")
+}
+
+// DropBlocked drops requests for blocklisted genres, taking the station
+// off one if it is on air.
+func (a *genreArbiter) DropBlocked() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.dropLocked(func(req *GenreRequest) bool { return blocklist.Blocked(req.Genre) }, "blocklisted")
+	if !blocklist.Blocked(a.genre) {
+		return
+	}
+	// Nothing else was live, so fall back to the station's default
+	fallback := taxonomy.Canonical(cfg.Genre.Default)
+	if blocklist.Blocked(fallback) {
+		log.Printf("Genre %q is blocklisted but so is the default, %q", a.genre, fallback)
+		return
+	}
+	req := &GenreRequest{Genre: fallback, Source: sourceAuto, Expires: time.Now().Add(time.Duration(cfg.Genre.TTL))}
+	a.pending[sourceAuto] = req
+	if _, err := a.applyLocked(req, a.genre+" is blocklisted"); err != nil {
+		log.Printf("Error applying fallback genre: %v", err)
+	}
+}
+
+// dropLocked drops the requests drop picks, falling back to the next best
+// live request if the effective one was dropped.
+func (a *genreArbiter) dropLocked(drop func(*GenreRequest) bool, why string) {
+	dropped := false
+	for source, req := range a.pending {
+		if drop(req) {
+			delete(a.pending, source)
+			if req == a.effective {
+				dropped = true
+			}
+		}
+	}
+	if !dropped {
+		return
+	}
+
+	prev := a.effective
+	a.effective = nil
+
+	var best *GenreRequest
+	for _, req := range a.pending {
+		if best == nil || genrePriority(req.Source) > genrePriority(best.Source) {
+			best = req
+		}
+	}
+	if best == nil {
+		log.Printf("Genre request %q from %s %s, keeping current genre", prev.Genre, prev.Source, why)
+		status.Publish("genre_decision", GenreDecision{
+			Genre:    a.genre,
+			Source:   prev.Source,
+			Accepted: true,
+			Reason:   prev.Source + " request " + why + ", no other live request",
+		})
+		return
+	}
+	if _, err := a.applyLocked(best, prev.Source+" request "+why); err != nil {
+		log.Printf("Error applying fallback genre: %v", err)
+	}
+}
+
+func (a *genreArbiter) applyLocked(req *GenreRequest, reason string) (GenreDecision, error) {
+	prompt := expandPrompt(taxonomy.Prompt(req.Genre), req.Vars)
+	if prompt != req.Genre {
+		log.Printf("Expanded prompt: %s", prompt)
+	}
+	if err := writeGenreRequest(prompt); err != nil {
+		return GenreDecision{}, err
+	}
+
+	if a.genre != "" && a.genre != req.Genre {
+		transitions.trigger()
+	}
+	a.effective = req
+	a.genre = req.Genre
+	a.prompt = prompt
+	genreStats.Switched(req.Genre)
+	recordAiring(req.Genre)
+
+	d := GenreDecision{
+		Genre:    req.Genre,
+		Prompt:   prompt,
+		Source:   req.Source,
+		Accepted: true,
+		Reason:   reason,
+		Expires:  req.Expires,
+	}
+	log.Printf("Genre now %q from %s: %s", req.Genre, req.Source, reason)
+	status.Publish("genre_decision", d)
+	return d, nil
+}
+
+// Reapply re-sends the current genre, e.g. after the prompt template changed.
+func (a *genreArbiter) Reapply() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var vars map[string]string
+	if a.effective != nil {
+		vars = a.effective.Vars
+	}
+	a.prompt = expandPrompt(taxonomy.Prompt(a.genre), vars)
+	return writeGenreRequest(a.prompt)
+}
+
+// runGenreExpiry periodically expires stale genre requests.
+func runGenreExpiry() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		arbiter.Expire()
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Genre statistics record how well each genre keeps its audience: for every
+// stretch on air we count the listeners present when it started, those who
+// joined during it and those who left. A genre's retention is the share of
+// those listeners that were still there when it ended. Stats are kept in
+// genre.stats_file across restarts and listed on /genres/stats.
+//
+// With genre.auto_dj enabled, the station picks a genre by itself when no
+// listener, vote, schedule or admin request has come in for auto_dj.idle,
+// choosing at random among the auto_dj.top best-retaining genres.
+
+// GenreStats is one genre's entry in /genres/stats.
+type GenreStats struct {
+	Genre   string  `json:"genre"`
+	Plays   int     `json:"plays"`
+	Airtime float64 `json:"airtime_s"`
+	Start   int     `json:"listeners_at_start"` // summed over plays
+	Joins   int     `json:"joins"`
+	Leaves  int     `json:"leaves"`
+	// JoinsByHour buckets joins by hour of day in the station's timezone.
+	JoinsByHour [24]int `json:"joins_by_hour"`
+	// Retention is 1 - leaves/(start+joins), or 1 with no listeners at all.
+	Retention float64 `json:"retention"`
+}
+
+func (g *GenreStats) score() {
+	g.Retention = 1
+	if total := g.Start + g.Joins; total > 0 {
+		g.Retention = 1 - float64(g.Leaves)/float64(total)
+	}
+}
+
+type genreTracker struct {
+	mu        sync.Mutex
+	stats     map[string]*GenreStats
+	current   string
+	since     time.Time
+	listeners int // connected listeners right now
+	lastHuman time.Time
+	dirty     bool
+}
+
+var genreStats = &genreTracker{stats: make(map[string]*GenreStats), lastHuman: time.Now()}
+
+func (t *genreTracker) entry(genre string) *GenreStats {
+	g := t.stats[genre]
+	if g == nil {
+		g = &GenreStats{Genre: genre}
+		t.stats[genre] = g
+	}
+	return g
+}
+
+// closeLocked adds the airtime of the genre going off air.
+func (t *genreTracker) closeLocked(now time.Time) {
+	if t.current == "" {
+		return
+	}
+	g := t.entry(t.current)
+	g.Airtime += now.Sub(t.since).Seconds()
+	g.score()
+}
+
+// Switched records that genre went on air.
+func (t *genreTracker) Switched(genre string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if genre == t.current {
+		return
+	}
+	t.closeLocked(now)
+	g := t.entry(genre)
+	g.Plays++
+	g.Start += t.listeners
+	t.current, t.since, t.dirty = genre, now, true
+}
+
+// Human records a request from anyone but the auto DJ, even one that was
+// queued rather than played.
+func (t *genreTracker) Human() {
+	t.mu.Lock()
+	t.lastHuman = time.Now()
+	t.mu.Unlock()
+}
+
+// Joined and Left count listeners that actually connected.
+func (t *genreTracker) Joined() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners++
+	if t.current != "" {
+		g := t.entry(t.current)
+		g.Joins++
+		g.JoinsByHour[time.Now().In(stationTZ).Hour()]++
+		t.dirty = true
+	}
+}
+
+func (t *genreTracker) Left() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners--
+	if t.current != "" {
+		t.entry(t.current).Leaves++
+		t.dirty = true
+	}
+}
+
+// List returns every genre's stats, best retention first. The genre on air
+// includes its airtime so far.
+func (t *genreTracker) List() []GenreStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]GenreStats, 0, len(t.stats))
+	for _, g := range t.stats {
+		s := *g
+		if s.Genre == t.current {
+			s.Airtime += time.Since(t.since).Seconds()
+		}
+		s.score()
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Retention != out[j].Retention {
+			return out[i].Retention > out[j].Retention
+		}
+		return out[i].Airtime > out[j].Airtime
+	})
+	return out
+}
+
+func (t *genreTracker) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []GenreStats
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Stats saved before the taxonomy knew a genre, or under another of
+	// its names, are merged into it
+	merged := make(map[string]bool)
+	for i := range list {
+		g := list[i]
+		g.Genre = taxonomy.Canonical(g.Genre)
+		if prev := t.stats[g.Genre]; prev != nil && merged[g.Genre] {
+			prev.merge(&g)
+			continue
+		}
+		merged[g.Genre] = true
+		t.stats[g.Genre] = &g
+	}
+	return nil
+}
+
+func (g *GenreStats) merge(o *GenreStats) {
+	g.Plays += o.Plays
+	g.Airtime += o.Airtime
+	g.Start += o.Start
+	g.Joins += o.Joins
+	g.Leaves += o.Leaves
+	for h := range g.JoinsByHour {
+		g.JoinsByHour[h] += o.JoinsByHour[h]
+	}
+	g.score()
+}
+
+func (t *genreTracker) save(path string) error {
+	t.mu.Lock()
+	dirty := t.dirty
+	t.dirty = false
+	t.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(t.List(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// startGenreStats loads saved stats and schedules saving them and the auto DJ.
+func startGenreStats(c GenreConfig) {
+	if c.StatsFile != "" {
+		if err := genreStats.load(c.StatsFile); err != nil {
+			log.Printf("Error loading genre stats from %s: %v", c.StatsFile, err)
+		}
+		schedule.Every("genre_stats_save", 5*time.Minute, func() error {
+			return genreStats.save(c.StatsFile)
+		})
+	}
+	if c.AutoDJ.Enabled {
+		schedule.Every("auto_dj", time.Minute, func() error {
+			return autoDJ(c.AutoDJ)
+		})
+		log.Printf("Auto DJ picks a genre after %v without requests", time.Duration(c.AutoDJ.Idle))
+	}
+}
+
+// autoDJ rotates to one of the best-retaining genres once nobody has asked
+// for anything in a while.
+func autoDJ(c AutoDJConfig) error {
+	genreStats.mu.Lock()
+	idle := time.Since(genreStats.lastHuman)
+	onAir := time.Since(genreStats.since)
+	current := genreStats.current
+	genreStats.mu.Unlock()
+	if idle < time.Duration(c.Idle) || onAir < time.Duration(c.Idle) {
+		return nil
+	}
+
+	var picks []string
+	for _, g := range genreStats.List() {
+		if len(picks) == c.Top {
+			break
+		}
+		if g.Genre != current && g.Plays >= c.MinPlays && !blocklist.Blocked(g.Genre) {
+			picks = append(picks, g.Genre)
+		}
+	}
+	if len(picks) == 0 {
+		return nil
+	}
+	genre := picks[rand.Intn(len(picks))]
+	log.Printf("Auto DJ: no requests for %v, switching to %q", idle.Round(time.Minute), genre)
+	_, err := arbiter.Submit(GenreRequest{Genre: genre, Source: sourceAuto})
+	return err
+}
+
+func handleGenreStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(genreStats.List())
+}
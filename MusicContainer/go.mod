@@ -3,6 +3,11 @@ module chobinbeats
 go 1.21
 
 require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/pion/ice/v4 v4.0.2
+	github.com/pion/interceptor v0.1.37
+	github.com/pion/rtcp v1.2.14
+	github.com/pion/rtp v1.8.9
 	github.com/pion/webrtc/v4 v4.0.0
 	gopkg.in/hraban/opus.v2 v2.0.0-20230925203106-0188a62cb302
 )
\ No newline at end of file
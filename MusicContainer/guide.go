@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // the container image has no zoneinfo
+)
+
+// The programming guide plays genre.schedule blocks like "morning jazz"
+// through the schedule source, at times of day in station.timezone rather
+// than the server's clock. A block holds the station until its end, so
+// listener requests queue behind it while admin requests still win.
+// /guide lists the blocks coming up in the next 24 hours.
+
+// stationTZ is the station's timezone, set from station.timezone at startup.
+var stationTZ = time.UTC
+
+func setupStationTimezone(name string) error {
+	if name == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("station timezone: %w", err)
+	}
+	stationTZ = loc
+	return nil
+}
+
+// parseClock reads a time of day written as "HH:MM".
+func parseClock(s string) (hour, minute int, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("time of day %q must look like 07:30", s)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (b GuideBlock) validate() error {
+	if b.Genre == "" {
+		return fmt.Errorf("block without a genre")
+	}
+	if _, _, err := parseClock(b.Start); err != nil {
+		return err
+	}
+	if _, _, err := parseClock(b.End); err != nil {
+		return err
+	}
+	if b.Start == b.End {
+		return fmt.Errorf("block %q starts when it ends", b.Genre)
+	}
+	for _, d := range b.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("unknown day %q, use mon..sun", d)
+		}
+	}
+	return nil
+}
+
+// runsOn reports whether the block starts on the given day.
+func (b GuideBlock) runsOn(day time.Weekday) bool {
+	if len(b.Days) == 0 {
+		return true
+	}
+	for _, d := range b.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// GuideSlot is one occurrence of a block.
+type GuideSlot struct {
+	Genre string    `json:"genre"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	vars map[string]string
+}
+
+// guideSlots lists the occurrences of blocks that overlap [from, to), in
+// start order. Blocks whose end is before their start run past midnight.
+func guideSlots(blocks []GuideBlock, from, to time.Time) []GuideSlot {
+	return guideSlotsIn(blocks, from, to, stationTZ)
+}
+
+// guideSlotsIn is guideSlots with the blocks' times of day in loc.
+func guideSlotsIn(blocks []GuideBlock, from, to time.Time, loc *time.Location) []GuideSlot {
+	var slots []GuideSlot
+	local := from.In(loc)
+	for offset := -1; ; offset++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, loc)
+		if !day.Before(to) {
+			break
+		}
+		for _, b := range blocks {
+			if !b.runsOn(day.Weekday()) {
+				continue
+			}
+			sh, sm, _ := parseClock(b.Start)
+			eh, em, _ := parseClock(b.End)
+			start := time.Date(day.Year(), day.Month(), day.Day(), sh, sm, 0, 0, loc)
+			end := time.Date(day.Year(), day.Month(), day.Day(), eh, em, 0, 0, loc)
+			if !end.After(start) {
+				end = time.Date(day.Year(), day.Month(), day.Day()+1, eh, em, 0, 0, loc)
+			}
+			if end.After(from) && start.Before(to) {
+				slots = append(slots, GuideSlot{Genre: b.Genre, Start: start, End: end, vars: b.Vars})
+			}
+		}
+	}
+	sort.SliceStable(slots, func(i, j int) bool { return slots[i].Start.Before(slots[j].Start) })
+	return slots
+}
+
+var (
+	guideMu   sync.Mutex
+	guideLast time.Time // start of the last slot submitted
+)
+
+// applyGuide submits the block that is on air now, once per occurrence.
+func applyGuide(blocks []GuideBlock) error {
+	now := time.Now()
+	slots := guideSlots(blocks, now, now.Add(time.Second))
+	if len(slots) == 0 {
+		return nil
+	}
+	// With overlapping blocks the one that started last wins
+	slot := slots[len(slots)-1]
+
+	guideMu.Lock()
+	defer guideMu.Unlock()
+	if slot.Start.Equal(guideLast) {
+		return nil
+	}
+	guideLast = slot.Start
+	log.Printf("Programming guide: %q until %s", slot.Genre, slot.End.Format("15:04 MST"))
+	_, err := arbiter.Submit(GenreRequest{Genre: slot.Genre, Vars: slot.vars, Source: sourceSchedule, Expires: slot.End})
+	return err
+}
+
+func startGuide(blocks []GuideBlock) {
+	if len(blocks) == 0 {
+		return
+	}
+	schedule.Every("programming_guide", 30*time.Second, func() error {
+		return applyGuide(blocks)
+	})
+	log.Printf("Programming guide has %d blocks in %s", len(blocks), stationTZ)
+}
+
+// handleGuide lists the next 24 hours of the programming guide.
+func handleGuide(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	slots := guideSlots(cfg.Genre.Schedule, now, now.Add(24*time.Hour))
+	if slots == nil {
+		slots = []GuideSlot{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"timezone": stationTZ.String(),
+		"now":      now.In(stationTZ),
+		"slots":    slots,
+	})
+}
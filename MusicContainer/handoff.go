@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A handoff moves a station's listeners to another server so this one can
+// go down for maintenance. An admin POSTs the other server's URL to
+// /handoff; this server asks the other one to accept the station
+// (/handoff/accept), which hands back a token. Every listener with a control
+// channel is then told to reconnect there with the token, new offers are
+// redirected the same way, and this server drains: once its listeners have
+// left, or the drain timeout passes, the rest are closed.
+//
+// On the accepting side the token lets migrating listeners in ahead of the
+// waitlist, so a full station doesn't turn its own listeners away. That
+// makes both routes as sensitive as the station itself, so they need an
+// admin token or the admin listener, and listeners are only ever sent to a
+// server listed in handoff.peers.
+
+const (
+	handoffDefaultDrain = 5 * time.Minute
+	handoffTokenTTL     = 30 * time.Minute
+	handoffCheck        = 5 * time.Second
+)
+
+var handoffListeners = newCounter("radio_handoff_listeners_total", "Listeners admitted with a handoff token from another server.")
+
+// HandoffState is the /handoff response.
+type HandoffState struct {
+	// Outgoing
+	URL        string    `json:"url,omitempty"`
+	Started    time.Time `json:"started,omitempty"`
+	DrainUntil time.Time `json:"drain_until,omitempty"`
+	Remaining  int       `json:"remaining"`
+	Done       bool      `json:"done"`
+	// Incoming
+	Accepted map[string]time.Time `json:"accepted,omitempty"` // token -> expiry
+}
+
+type handoffManager struct {
+	mu       sync.Mutex
+	url      string // where listeners are sent, "" when not handing off
+	token    string
+	started  time.Time
+	until    time.Time
+	done     bool
+	cancel   chan struct{}
+	accepted map[string]time.Time // tokens issued to other servers
+}
+
+var handoff = &handoffManager{accepted: make(map[string]time.Time)}
+
+// moved returns where new listeners should go instead, if anywhere.
+func (h *handoffManager) moved() (url, token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.url, h.token
+}
+
+// Valid reports whether token was issued by /handoff/accept and is still good.
+func (h *handoffManager) Valid(token string) bool {
+	if token == "" {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Now().Before(h.accepted[token])
+}
+
+// Start hands the station to the server at url.
+func (h *handoffManager) Start(url, adminToken string, drain time.Duration) error {
+	token, err := requestHandoff(url, adminToken)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	if h.url != "" && !h.done {
+		close(h.cancel)
+	}
+	h.url, h.token = url, token
+	h.started = time.Now()
+	h.until = h.started.Add(drain)
+	h.done = false
+	h.cancel = make(chan struct{})
+	cancel := h.cancel
+	h.mu.Unlock()
+
+	log.Printf("Handing the station off to %s, draining for %v", url, drain)
+	status.Publish("handoff", h.State())
+	notifyReconnect(url, token)
+	go h.drain(cancel)
+	return nil
+}
+
+// Cancel stops redirecting listeners. Those already told to move stay moved.
+func (h *handoffManager) Cancel() {
+	h.mu.Lock()
+	if h.url != "" && !h.done {
+		close(h.cancel)
+	}
+	h.url, h.token = "", ""
+	h.mu.Unlock()
+	log.Printf("Handoff cancelled")
+	status.Publish("handoff", h.State())
+}
+
+// drain waits for the listeners to leave, then closes any that haven't.
+func (h *handoffManager) drain(cancel chan struct{}) {
+	ticker := time.NewTicker(handoffCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cancel:
+			return
+		case now := <-ticker.C:
+			h.mu.Lock()
+			until := h.until
+			h.mu.Unlock()
+			if sessions.Count() > 0 && now.Before(until) {
+				continue
+			}
+		}
+		for _, s := range sessions.List() {
+			sessions.close(s.ID, "handoff")
+		}
+
+		h.mu.Lock()
+		h.done = true
+		h.mu.Unlock()
+		log.Printf("Handoff drained, every listener has left")
+		status.Publish("handoff", h.State())
+		return
+	}
+}
+
+// Accept issues a token for listeners moving here from another server.
+func (h *handoffManager) Accept() (string, time.Time) {
+	token := newSessionID()
+	now := time.Now()
+	expires := now.Add(handoffTokenTTL)
+	h.mu.Lock()
+	for t, exp := range h.accepted {
+		if now.After(exp) {
+			delete(h.accepted, t)
+		}
+	}
+	h.accepted[token] = expires
+	h.mu.Unlock()
+	return token, expires
+}
+
+func (h *handoffManager) State() HandoffState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := HandoffState{
+		URL:        h.url,
+		Started:    h.started,
+		DrainUntil: h.until,
+		Done:       h.done,
+		Accepted:   make(map[string]time.Time, len(h.accepted)),
+	}
+	if h.url != "" && !h.done {
+		st.Remaining = sessions.Count()
+	}
+	for t, exp := range h.accepted {
+		st.Accepted[t[:8]] = exp
+	}
+	return st
+}
+
+// handoffPeer returns the configured peer url names, or "" if it isn't one.
+func handoffPeer(url string) string {
+	url = strings.TrimRight(url, "/")
+	for _, p := range cfg.Handoff.Peers {
+		if p = strings.TrimRight(p, "/"); strings.EqualFold(p, url) {
+			return p
+		}
+	}
+	return ""
+}
+
+// handoffRequest is the body of /handoff/accept.
+type handoffRequest struct {
+	Station string            `json:"station"`
+	Genre   string            `json:"genre"`
+	Vars    map[string]string `json:"vars,omitempty"`
+}
+
+// requestHandoff asks the server at url to take over the station and
+// returns the token its listeners should reconnect with.
+func requestHandoff(url, adminToken string) (string, error) {
+	body, err := json.Marshal(handoffRequest{
+		Station: cfg.Station.ID,
+		Genre:   getCurrentGenre(),
+		Vars:    currentGenreVars(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/handoff/accept", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("contacting %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s refused the handoff: %s", url, resp.Status)
+	}
+	var accepted struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&accepted); err != nil || accepted.Token == "" {
+		return "", fmt.Errorf("%s sent no handoff token", url)
+	}
+	return accepted.Token, nil
+}
+
+// notifyReconnect tells every listener with a control channel to move.
+func notifyReconnect(url, token string) {
+	channels := sessions.controlChannels()
+	for _, c := range channels {
+		c.Notify("reconnect", map[string]string{"url": url, "token": token})
+	}
+	log.Printf("Asked %d listeners to reconnect to %s", len(channels), url)
+}
+
+// writeStationMoved answers an offer while the station is handed off.
+func writeStationMoved(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(stationMoved())
+}
+
+func stationMoved() map[string]interface{} {
+	url, token := handoff.moved()
+	return map[string]interface{}{
+		"error":       "station_moved",
+		"url":         url,
+		"token":       token,
+		"retry_after": 0,
+	}
+}
+
+// handleHandoff shows the handoff state on GET, starts a handoff on POST
+// ({"url": ..., "admin_token": ..., "drain": "5m"}) and cancels it on DELETE.
+func handleHandoff(w http.ResponseWriter, r *http.Request) {
+	if !adminSecured() {
+		http.Error(w, "Handoffs need admin.token or the admin listener", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			URL        string   `json:"url"`
+			AdminToken string   `json:"admin_token"`
+			Drain      Duration `json:"drain"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+			http.Error(w, "url is required", http.StatusBadRequest)
+			return
+		}
+		drain := time.Duration(req.Drain)
+		if drain <= 0 {
+			drain = handoffDefaultDrain
+		}
+		peer := handoffPeer(req.URL)
+		if peer == "" {
+			http.Error(w, fmt.Sprintf("%s is not in handoff.peers", req.URL), http.StatusForbidden)
+			return
+		}
+		if err := handoff.Start(peer, req.AdminToken, drain); err != nil {
+			log.Printf("Error starting handoff: %v", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	case http.MethodDelete:
+		handoff.Cancel()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(handoff.State())
+}
+
+// handleHandoffAccept takes over a station from another server.
+func handleHandoffAccept(w http.ResponseWriter, r *http.Request) {
+	if !adminSecured() {
+		http.Error(w, "Handoffs need admin.token or the admin listener", http.StatusForbidden)
+		return
+	}
+	var req handoffRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Station != cfg.Station.ID {
+		http.Error(w, fmt.Sprintf("This server runs station %q", cfg.Station.ID), http.StatusConflict)
+		return
+	}
+	if req.Genre != "" {
+		if _, err := arbiter.Submit(GenreRequest{Genre: req.Genre, Vars: req.Vars, Source: sourceAdmin}); err != nil {
+			log.Printf("Error writing genre file: %v", err)
+		}
+	}
+
+	token, expires := handoff.Accept()
+	log.Printf("Accepted a handoff of station %s from %s", req.Station, r.RemoteAddr)
+	status.Publish("handoff", map[string]interface{}{"accepted_from": r.RemoteAddr, "expires": expires})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expires": expires})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// turnCredentialTTL is how long credentials made from a TURN secret last.
+// They only need to outlive ICE restarts, not the whole session.
+const turnCredentialTTL = 12 * time.Hour
+
+// turnCredentialCache shares credentials between peer connections for a few
+// minutes instead of minting them for each one.
+var turnCredentialCache = newTTLCache[string, [2]string]("turn_credentials", 10*time.Minute, 64)
+
+// iceServers returns the configured STUN and TURN servers, with fresh
+// credentials for TURN servers that use a shared secret.
+func iceServers() []webrtc.ICEServer {
+	servers := make([]webrtc.ICEServer, 0, len(cfg.ICE.Servers))
+	for _, s := range cfg.ICE.Servers {
+		server := webrtc.ICEServer{URLs: s.URLs}
+		switch {
+		case s.Secret != "":
+			creds, _ := turnCredentialCache.GetOrLoad(s.Secret, func() ([2]string, error) {
+				username, credential := turnCredentials(s.Secret, time.Now().Add(turnCredentialTTL))
+				return [2]string{username, credential}, nil
+			})
+			server.Username, server.Credential = creds[0], creds[1]
+		case s.Username != "":
+			server.Username = s.Username
+			server.Credential = s.Credential
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// turnCredentials makes TURN REST API credentials: the username carries the
+// expiry and the password is its HMAC-SHA1 under the shared secret.
+func turnCredentials(secret string, expires time.Time) (string, string) {
+	username := fmt.Sprintf("%d:%s", expires.Unix(), cfg.Station.ID)
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// handleICEServers gives browsers the ICE servers to use for their side of
+// the connection.
+func handleICEServers(w http.ResponseWriter, r *http.Request) {
+	// Credentials change every few minutes, so they mustn't be cached
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"iceServers": iceServers()})
+}
+
+// setICEServerLinks advertises the ICE servers as Link headers, the way WHIP
+// and WHEP clients expect them.
+func setICEServerLinks(w http.ResponseWriter) {
+	for _, s := range iceServers() {
+		for _, u := range s.URLs {
+			link := fmt.Sprintf("<%s>; rel=\"ice-server\"", u)
+			if s.Username != "" {
+				link += fmt.Sprintf("; username=%q; credential=%q; credential-type=\"password\"", s.Username, s.Credential)
+			}
+			w.Header().Add("Link", link)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"chobinbeats/ingestframe"
+)
+
+// Network ingest lets a remote encoder or generator push PCM (the same
+// s16le 48kHz stereo the pipe carries) over TCP, optionally wrapped in TLS.
+// A source must authenticate before any audio is accepted:
+//
+//	source: HELLO <source> <station> [frames/1]
+//	server: CHALLENGE <hex nonce>
+//	source: AUTH key=<stream key> mac=<hex HMAC-SHA256(psk, nonce)>
+//	server: OK [frames/1]
+//
+// Only the credentials the source is configured with are checked, but at
+// least one is required. Sources configured with cert_cn must also present a
+// client certificate issued by client_ca with that common name.
+//
+// Sources that ask for frames/1 send their audio in ingestframe frames,
+// which the server checks against the station's format and position; older
+// sources send raw PCM with nothing to check it by.
+
+const (
+	ingestHandshakeTimeout = 10 * time.Second
+	ingestFraming          = "frames/1"
+)
+
+var (
+	ingestAuthFailures = newCounter("radio_ingest_auth_failures_total", "Network ingest connections that failed to authenticate.")
+	ingestFrameErrors  = newCounter("radio_ingest_frame_errors_total", "Damaged or out-of-sequence ingest frames, by source and reason.")
+
+	ingestMu     sync.Mutex
+	ingestActive = make(map[string]io.Closer) // source name -> TCP or WHIP connection
+)
+
+var errIngestUnauthorized = errors.New("unauthorized")
+
+// startIngest listens for network sources if ingest is configured.
+func startIngest(c IngestConfig, sampleRate, channels, bytesPerFrame int) error {
+	if c.Listen == "" {
+		return nil
+	}
+	for _, src := range c.Sources {
+		if src.StreamKey == "" && src.PSK == "" && src.CertCN == "" {
+			return fmt.Errorf("ingest source %s has no credentials", src.Name)
+		}
+		if src.CertCN != "" && c.ClientCA == "" {
+			return fmt.Errorf("ingest source %s requires a client certificate but no client_ca is set", src.Name)
+		}
+	}
+
+	var ln net.Listener
+	var err error
+	if c.TLSCert != "" {
+		tlsConfig, err := ingestTLSConfig(c)
+		if err != nil {
+			return err
+		}
+		ln, err = tls.Listen("tcp", c.Listen, tlsConfig)
+		if err != nil {
+			return err
+		}
+	} else {
+		ln, err = net.Listen("tcp", c.Listen)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Accepting network ingest on %s", c.Listen)
+	format := pcmFormat(sampleRate, channels)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("Error accepting ingest connection: %v", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			go serveIngest(conn, c, format, bytesPerFrame)
+		}
+	}()
+	return nil
+}
+
+func ingestTLSConfig(c IngestConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading ingest certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCA != "" {
+		pem, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading ingest client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		// Sources without cert_cn may still connect without a certificate
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+func serveIngest(conn net.Conn, c IngestConfig, format ingestframe.Format, bytesPerFrame int) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+
+	conn.SetDeadline(time.Now().Add(ingestHandshakeTimeout))
+	r := bufio.NewReader(conn)
+	src, framing, err := authenticateIngest(conn, r, c)
+	if err != nil {
+		name := "unknown"
+		if src != nil {
+			name = src.Name
+		}
+		ingestAuthFailures.Inc("source", name)
+		log.Printf("Error authenticating ingest from %s: %v", remote, err)
+		fmt.Fprintf(conn, "ERR %v\n", err)
+		return
+	}
+
+	stem := src.Stem
+	if stem == "" {
+		stem = currentStems()[0].Name
+	}
+	input := stemInput(stem)
+	if input == nil {
+		fmt.Fprintf(conn, "ERR unknown stem\n")
+		return
+	}
+
+	claimIngest(src.Name, conn)
+	defer releaseIngest(src.Name, conn)
+
+	conn.SetDeadline(time.Time{})
+	if framing != "" {
+		fmt.Fprintf(conn, "OK %s\n", framing)
+	} else {
+		fmt.Fprintf(conn, "OK\n")
+		log.Printf("Ingest source %s sends raw PCM; update it to %s framing", src.Name, ingestFraming)
+	}
+	log.Printf("Ingest source %s connected from %s, feeding stem %s", src.Name, remote, stem)
+	status.Publish("ingest", map[string]string{"source": src.Name, "state": "connected"})
+
+	if framing != "" {
+		err = readIngestFrames(src.Name, r, format, bytesPerFrame, input)
+	} else {
+		for {
+			pcm := pcmBytes.get(bytesPerFrame)
+			if _, err = io.ReadFull(r, pcm); err != nil {
+				pcmBytes.put(pcm)
+				break
+			}
+			input <- pcm
+		}
+	}
+	log.Printf("Ingest source %s disconnected: %v", src.Name, err)
+	status.Publish("ingest", map[string]string{"source": src.Name, "state": "disconnected"})
+}
+
+// readIngestFrames feeds a framed source's audio to input in pipeline-sized
+// pieces until the connection ends or the source breaks the framing.
+// Damaged frames are skipped; the gap they leave is logged with the next one.
+// Float audio, audio at another sample rate, and mono or stereo audio are
+// converted to the station's format.
+func readIngestFrames(name string, r *bufio.Reader, format ingestframe.Format, bytesPerFrame int, input chan<- []byte) error {
+	fr := ingestframe.NewReader(r)
+	var pending []byte
+	var next uint64
+	started := false
+	var conv *inputConverter
+	for {
+		f, err := fr.ReadFrame()
+		if err == ingestframe.ErrChecksum {
+			ingestFrameErrors.Inc("source", name, "reason", "checksum")
+			run.error("ingest_frame")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if f.Format.BytesPerSample() == 0 || f.Format.SampleRate == 0 || f.Format.Channels < 1 || f.Format.Channels > 2 {
+			return fmt.Errorf("source sends %v, the station runs %v", f.Format, format)
+		}
+		if len(f.Payload)%(f.Format.BytesPerSample()*int(f.Format.Channels)) != 0 {
+			return fmt.Errorf("frame at %d ends mid-sample", f.Timestamp)
+		}
+		if started && f.Timestamp != next {
+			ingestFrameErrors.Inc("source", name, "reason", "gap")
+			run.error("ingest_frame")
+			log.Printf("Ingest source %s jumped from sample %d to %d", name, next, f.Timestamp)
+		}
+		started, next = true, f.Timestamp+uint64(f.Samples())
+
+		if f.Format != format {
+			if !conv.converts(f.Format) {
+				conv = newInputConverter(name, f.Format, format, bytesPerFrame)
+			}
+			conv.push(f.Payload, input)
+			continue
+		}
+		conv = nil
+		pending = append(pending, f.Payload...)
+		sent := 0
+		for ; len(pending)-sent >= bytesPerFrame; sent += bytesPerFrame {
+			input <- pcmBytes.clone(pending[sent : sent+bytesPerFrame])
+		}
+		pending = append(pending[:0], pending[sent:]...)
+	}
+}
+
+// claimIngest records conn as the source's connection. There is one per
+// source; a reconnecting source replaces its old one.
+func claimIngest(name string, conn io.Closer) {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	if old := ingestActive[name]; old != nil {
+		old.Close()
+	}
+	ingestActive[name] = conn
+}
+
+func releaseIngest(name string, conn io.Closer) {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	if ingestActive[name] == conn {
+		delete(ingestActive, name)
+	}
+}
+
+// authenticateIngest runs the handshake and returns the source it proved to
+// be and the framing it asked for ("" for raw PCM). The source is also
+// returned alongside an error once it is known, for logging.
+func authenticateIngest(conn net.Conn, r *bufio.Reader, c IngestConfig) (*IngestSource, string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, "", err
+	}
+	fields := strings.Fields(line)
+	if (len(fields) != 3 && len(fields) != 4) || fields[0] != "HELLO" {
+		return nil, "", errors.New("expected HELLO <source> <station> [framing]")
+	}
+	framing := ""
+	if len(fields) == 4 {
+		if fields[3] != ingestFraming {
+			return nil, "", fmt.Errorf("unsupported framing %s, this server speaks %s", fields[3], ingestFraming)
+		}
+		framing = fields[3]
+	}
+
+	var src *IngestSource
+	for i := range c.Sources {
+		if c.Sources[i].Name == fields[1] {
+			src = &c.Sources[i]
+		}
+	}
+	// A source is only ever allowed to feed the station it is bound to
+	if src == nil || src.Station != fields[2] || src.Station != cfg.Station.ID {
+		return src, "", errIngestUnauthorized
+	}
+
+	if src.CertCN != "" {
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok {
+			return src, "", errIngestUnauthorized
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			return src, "", err
+		}
+		chains := tlsConn.ConnectionState().VerifiedChains
+		if len(chains) == 0 || chains[0][0].Subject.CommonName != src.CertCN {
+			return src, "", errIngestUnauthorized
+		}
+	}
+
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	fmt.Fprintf(conn, "CHALLENGE %s\n", hex.EncodeToString(nonce))
+
+	line, err = r.ReadString('\n')
+	if err != nil {
+		return src, "", err
+	}
+	fields = strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "AUTH" {
+		return src, "", errors.New("expected AUTH")
+	}
+	var key, mac string
+	for _, f := range fields[1:] {
+		if v, ok := strings.CutPrefix(f, "key="); ok {
+			key = v
+		} else if v, ok := strings.CutPrefix(f, "mac="); ok {
+			mac = v
+		}
+	}
+
+	if src.StreamKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(src.StreamKey)) != 1 {
+		return src, "", errIngestUnauthorized
+	}
+	if src.PSK != "" {
+		h := hmac.New(sha256.New, []byte(src.PSK))
+		h.Write(nonce)
+		want := hex.EncodeToString(h.Sum(nil))
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(mac)), []byte(want)) != 1 {
+			return src, "", errIngestUnauthorized
+		}
+	}
+	return src, framing, nil
+}
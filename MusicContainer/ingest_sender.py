@@ -0,0 +1,133 @@
+"""Reference sender for the radio's network ingest.
+
+Authenticates with the ingest handshake, then streams s16le PCM in
+frames/1 framing (see ingestframe/frame.go), paced in real time:
+
+    python ingest_sender.py --host radio.example.com --source studio \
+        --station main --key SECRET --wav input.wav
+    ffmpeg -i input.mp3 -f s16le -ar 48000 -ac 2 - | \
+        python ingest_sender.py --host radio.example.com --source studio \
+        --station main --psk SHARED
+"""
+import argparse
+import hashlib
+import hmac
+import socket
+import ssl
+import struct
+import sys
+import time
+import wave
+import zlib
+
+MAGIC = b"IRFR"
+VERSION = 1
+ENCODING_S16LE = 1
+FRAMING = "frames/1"
+
+# magic, version, encoding, channels, reserved, sample rate, timestamp, length
+HEADER = struct.Struct(">4sBBBBIQI")
+
+
+def encode_frame(pcm, timestamp, sample_rate, channels):
+    """Frames one chunk of s16le PCM. timestamp is its first sample's position."""
+    header = HEADER.pack(MAGIC, VERSION, ENCODING_S16LE, channels, 0,
+                         sample_rate, timestamp, len(pcm))
+    crc = zlib.crc32(header + pcm) & 0xFFFFFFFF
+    return header + pcm + struct.pack(">I", crc)
+
+
+class FrameSender:
+    """Sends PCM as frames, keeping track of the stream position."""
+
+    def __init__(self, sock, sample_rate=48000, channels=2):
+        self.sock = sock
+        self.sample_rate = sample_rate
+        self.channels = channels
+        self.position = 0
+
+    def send(self, pcm):
+        self.sock.sendall(encode_frame(pcm, self.position, self.sample_rate, self.channels))
+        self.position += len(pcm) // (2 * self.channels)
+
+
+def connect(args):
+    """Opens the connection and runs the handshake, asking for framing."""
+    sock = socket.create_connection((args.host, args.port), timeout=10)
+    if args.tls:
+        ctx = ssl.create_default_context(cafile=args.ca)
+        if args.cert:
+            ctx.load_cert_chain(args.cert, args.cert_key)
+        sock = ctx.wrap_socket(sock, server_hostname=args.host)
+    reader = sock.makefile("rb")
+
+    sock.sendall(f"HELLO {args.source} {args.station} {FRAMING}\n".encode())
+    line = reader.readline().decode().strip()
+    if not line.startswith("CHALLENGE "):
+        raise RuntimeError(f"handshake failed: {line}")
+    nonce = bytes.fromhex(line.split()[1])
+
+    auth = "AUTH"
+    if args.key:
+        auth += f" key={args.key}"
+    if args.psk:
+        auth += " mac=" + hmac.new(args.psk.encode(), nonce, hashlib.sha256).hexdigest()
+    sock.sendall((auth + "\n").encode())
+
+    line = reader.readline().decode().strip()
+    if line != f"OK {FRAMING}":
+        raise RuntimeError(f"handshake failed: {line}")
+    sock.settimeout(None)
+    return sock
+
+
+def open_input(args):
+    """Returns a function reading up to n bytes of PCM, b"" at the end."""
+    if not args.wav:
+        return sys.stdin.buffer.read
+    w = wave.open(args.wav, "rb")
+    if w.getsampwidth() != 2 or w.getframerate() != args.rate or w.getnchannels() != args.channels:
+        raise RuntimeError(f"{args.wav} must be 16-bit {args.rate}Hz with {args.channels} channels")
+    return lambda n: w.readframes(n // (2 * args.channels))
+
+
+def main():
+    p = argparse.ArgumentParser(description=__doc__, formatter_class=argparse.RawDescriptionHelpFormatter)
+    p.add_argument("--host", required=True)
+    p.add_argument("--port", type=int, default=9000)
+    p.add_argument("--source", required=True, help="source name from the server's ingest config")
+    p.add_argument("--station", required=True)
+    p.add_argument("--key", help="stream key")
+    p.add_argument("--psk", help="pre-shared key for the HMAC challenge")
+    p.add_argument("--tls", action="store_true")
+    p.add_argument("--ca", help="CA bundle to verify the server with")
+    p.add_argument("--cert", help="client certificate, for sources with cert_cn")
+    p.add_argument("--cert-key", help="client certificate key")
+    p.add_argument("--wav", help="read from a WAV file instead of stdin")
+    p.add_argument("--rate", type=int, default=48000)
+    p.add_argument("--channels", type=int, default=2)
+    p.add_argument("--frame-ms", type=int, default=20)
+    args = p.parse_args()
+
+    read = open_input(args)
+    sender = FrameSender(connect(args), args.rate, args.channels)
+    chunk = args.rate * args.frame_ms // 1000 * 2 * args.channels
+    interval = args.frame_ms / 1000
+    print(f"Streaming to {args.host}:{args.port} as {args.source}")
+
+    next_send = time.monotonic()
+    while True:
+        pcm = read(chunk)
+        if not pcm:
+            break
+        # Drop a trailing partial sample rather than break the framing
+        pcm = pcm[:len(pcm) - len(pcm) % (2 * args.channels)]
+        if pcm:
+            sender.send(pcm)
+        next_send += interval
+        time.sleep(max(0, next_send - time.monotonic()))
+    print("Input finished")
+
+
+if __name__ == "__main__":
+    main()
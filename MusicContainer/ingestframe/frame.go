@@ -0,0 +1,220 @@
+// Package ingestframe implements the framing network ingest sources use
+// once they have authenticated. Each frame carries its own audio format and
+// position, so the server can check what it is being sent and notice gaps,
+// instead of trusting an unmarked byte stream to line up.
+//
+// A frame is a 24-byte header, the payload and a CRC-32 (IEEE) of both,
+// all big-endian:
+//
+//	offset  size  field
+//	0       4     magic "IRFR"
+//	4       1     version (1)
+//	5       1     encoding (1 = signed 16-bit little-endian PCM, 2 = one Opus packet,
+//	              3 = 32-bit float little-endian PCM)
+//	6       1     channels
+//	7       1     reserved, 0
+//	8       4     sample rate in Hz
+//	12      8     timestamp: position of the first sample, in samples
+//	20      4     payload length in bytes
+//	24      n     payload
+//	24+n    4     CRC-32 of bytes 0 to 24+n
+package ingestframe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	Magic   = "IRFR"
+	Version = 1
+
+	HeaderSize = 24
+	// MaxPayload bounds a frame's payload, one second of 48kHz stereo
+	// s16le and then some.
+	MaxPayload = 1 << 18
+)
+
+// Encodings.
+const (
+	EncodingS16LE = 1
+	EncodingOpus  = 2
+	EncodingF32LE = 3
+)
+
+var (
+	ErrBadMagic = errors.New("ingestframe: bad magic")
+	ErrChecksum = errors.New("ingestframe: checksum mismatch")
+	ErrTooLarge = errors.New("ingestframe: payload too large")
+	ErrEmpty    = errors.New("ingestframe: empty payload")
+	ErrReserved = errors.New("ingestframe: reserved byte set")
+)
+
+// VersionError is returned for frames of a version this package doesn't speak.
+type VersionError struct {
+	Version uint8
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("ingestframe: unsupported version %d", e.Version)
+}
+
+// Format describes the audio in a frame.
+type Format struct {
+	Encoding   uint8
+	Channels   uint8
+	SampleRate uint32
+}
+
+func (f Format) String() string {
+	enc := fmt.Sprintf("encoding %d", f.Encoding)
+	switch f.Encoding {
+	case EncodingS16LE:
+		enc = "s16le"
+	case EncodingOpus:
+		enc = "opus"
+	case EncodingF32LE:
+		enc = "f32le"
+	}
+	return fmt.Sprintf("%s %dHz %dch", enc, f.SampleRate, f.Channels)
+}
+
+// BytesPerSample is the size of one sample of one channel, or 0 for Opus
+// and unknown encodings.
+func (f Format) BytesPerSample() int {
+	switch f.Encoding {
+	case EncodingS16LE:
+		return 2
+	case EncodingF32LE:
+		return 4
+	}
+	return 0
+}
+
+// Frame is one frame of audio.
+type Frame struct {
+	Format    Format
+	Timestamp uint64 // position of the first sample, in samples
+	Payload   []byte
+}
+
+// Samples is the number of samples per channel in the frame.
+func (f *Frame) Samples() int {
+	n := f.Format.BytesPerSample() * int(f.Format.Channels)
+	if n == 0 {
+		return 0
+	}
+	return len(f.Payload) / n
+}
+
+// Append appends the encoded frame to b.
+func (f *Frame) Append(b []byte) ([]byte, error) {
+	if len(f.Payload) == 0 {
+		return b, ErrEmpty
+	}
+	if len(f.Payload) > MaxPayload {
+		return b, ErrTooLarge
+	}
+	start := len(b)
+	b = append(b, Magic...)
+	b = append(b, Version, f.Format.Encoding, f.Format.Channels, 0)
+	b = binary.BigEndian.AppendUint32(b, f.Format.SampleRate)
+	b = binary.BigEndian.AppendUint64(b, f.Timestamp)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(f.Payload)))
+	b = append(b, f.Payload...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start:])), nil
+}
+
+// Writer writes frames to a stream.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) WriteFrame(f *Frame) error {
+	var err error
+	if w.buf, err = f.Append(w.buf[:0]); err != nil {
+		return err
+	}
+	_, err = w.w.Write(w.buf)
+	return err
+}
+
+// Reader reads frames from a stream.
+type Reader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Reader{r: br}
+}
+
+// ReadFrame reads the next frame. Its payload is only valid until the next
+// call. ErrChecksum leaves the reader at the start of the following frame, so
+// the caller may skip the damaged one; after any other error the stream is
+// out of step and should be dropped.
+func (r *Reader) ReadFrame() (*Frame, error) {
+	if cap(r.buf) < HeaderSize {
+		r.buf = make([]byte, HeaderSize, HeaderSize+4096)
+	}
+	header := r.buf[:HeaderSize]
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != Magic {
+		return nil, ErrBadMagic
+	}
+	if header[4] != Version {
+		return nil, &VersionError{Version: header[4]}
+	}
+	if header[7] != 0 {
+		return nil, ErrReserved
+	}
+	n := int(binary.BigEndian.Uint32(header[20:24]))
+	if n == 0 {
+		return nil, ErrEmpty
+	}
+	if n > MaxPayload {
+		return nil, ErrTooLarge
+	}
+
+	size := HeaderSize + n + 4
+	if cap(r.buf) < size {
+		grown := make([]byte, size)
+		copy(grown, header)
+		r.buf = grown
+	}
+	frame := r.buf[:size]
+	if _, err := io.ReadFull(r.r, frame[HeaderSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	body := frame[:HeaderSize+n]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(frame[HeaderSize+n:]) {
+		return nil, ErrChecksum
+	}
+	return &Frame{
+		Format: Format{
+			Encoding:   frame[5],
+			Channels:   frame[6],
+			SampleRate: binary.BigEndian.Uint32(frame[8:12]),
+		},
+		Timestamp: binary.BigEndian.Uint64(frame[12:20]),
+		Payload:   frame[HeaderSize : HeaderSize+n],
+	}, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyPlan splits the configured end-to-end latency budget between the
+// stages of the signal path. One frame always goes to framing the audio for
+// the encoder; the rest is ingest buffering, of which the pre-roll is
+// filled before live audio starts (and again after an underrun) and the
+// remainder is slack the pacer may fall behind by before it drops audio to
+// catch up. A prebuffer sets the pre-roll explicitly, growing the ingest
+// buffer (and with it the budget) if it doesn't fit.
+type latencyPlan struct {
+	Budget        time.Duration `json:"-"`
+	BudgetMS      int64         `json:"budget_ms"`
+	IngestFrames  int           `json:"ingest_frames"`
+	PrerollFrames int           `json:"preroll_frames"`
+	PacerSlack    time.Duration `json:"-"`
+	PacerSlackMS  int64         `json:"pacer_slack_ms"`
+}
+
+func planLatency(budget, prebuffer, frame time.Duration) latencyPlan {
+	ingest := int((budget - frame) / frame)
+	if ingest < 2 {
+		ingest = 2
+	}
+	preroll := ingest / 2
+	if prebuffer > 0 {
+		preroll = int((prebuffer + frame - 1) / frame)
+		// Leave at least a frame of slack on top
+		ingest = max(ingest, preroll+1)
+	}
+	slack := time.Duration(ingest-preroll) * frame
+
+	// The budget may have been too small to honour
+	budget = frame + time.Duration(ingest)*frame
+	return latencyPlan{
+		Budget:        budget,
+		BudgetMS:      budget.Milliseconds(),
+		IngestFrames:  ingest,
+		PrerollFrames: preroll,
+		PacerSlack:    slack,
+		PacerSlackMS:  slack.Milliseconds(),
+	}
+}
+
+// latencyMeter tracks the latency the signal path actually achieves, as
+// moving averages over recent frames.
+type latencyMeter struct {
+	mu        sync.Mutex
+	plan      latencyPlan
+	frame     time.Duration
+	queued    float64 // frames waiting in the ingest buffer
+	lateness  float64 // seconds the pacer ran behind its ticks
+	underruns uint64
+	dropped   uint64
+	ppm       float64 // pacing correction, see pacing.go
+}
+
+var latency = &latencyMeter{}
+
+func (m *latencyMeter) setPlan(plan latencyPlan, frame time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.plan = plan
+	m.frame = frame
+}
+
+// observe records one live frame leaving the ingest buffer.
+func (m *latencyMeter) observe(queued int, late time.Duration) {
+	const alpha = 0.02 // roughly the last second of frames
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued += alpha * (float64(queued) - m.queued)
+	m.lateness += alpha * (late.Seconds() - m.lateness)
+	glitches.frame(queued, late, "")
+}
+
+func (m *latencyMeter) setCorrection(ppm float64) {
+	m.mu.Lock()
+	m.ppm = ppm
+	m.mu.Unlock()
+}
+
+func (m *latencyMeter) underrun() {
+	m.mu.Lock()
+	m.underruns++
+	m.mu.Unlock()
+	glitches.frame(0, 0, "underrun")
+	glitches.Trigger(glitchUnderrun, "", "the generator fell behind and the pre-roll ran dry")
+}
+
+func (m *latencyMeter) drop() {
+	m.mu.Lock()
+	m.dropped++
+	m.mu.Unlock()
+	glitches.frame(0, 0, "drop")
+}
+
+// LatencyReport is the latency section of /status.
+type LatencyReport struct {
+	Plan       latencyPlan `json:"plan"`
+	AchievedMS float64     `json:"achieved_ms"`
+	QueueMS    float64     `json:"queue_ms"`
+	PacerMS    float64     `json:"pacer_ms"`
+	Underruns  uint64      `json:"underruns"`
+	Dropped    uint64      `json:"dropped_frames"`
+	PacingPPM  float64     `json:"pacing_correction_ppm"`
+}
+
+func (m *latencyMeter) Report() LatencyReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	frameMS := float64(m.frame) / float64(time.Millisecond)
+	queueMS := m.queued * frameMS
+	pacerMS := m.lateness * 1000
+	return LatencyReport{
+		Plan:       m.plan,
+		AchievedMS: frameMS + queueMS + pacerMS,
+		QueueMS:    queueMS,
+		PacerMS:    pacerMS,
+		Underruns:  m.underruns,
+		Dropped:    m.dropped,
+		PacingPPM:  m.ppm,
+	}
+}
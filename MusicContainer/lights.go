@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The light show turns the server into the controller for Philips Hue
+// lights and Art-Net (DMX) fixtures. Brightness follows the music's energy
+// and flashes on each beat of the beat clock (see beat.go) while it is
+// confident; colour comes from the current genre's scene and moves on with
+// the beats. DMX is refreshed 25 times a second. Hue bridges only take
+// about ten commands a second, so its lights are updated in turn, each with
+// a short transition to smooth the steps.
+
+const (
+	lightsRate         = 40 * time.Millisecond
+	hueRate            = 100 * time.Millisecond
+	artNetPort         = 6454
+	lightsMinBeatConf  = 0.2
+	lightsDefaultFloor = 0.1
+)
+
+var lightUpdates = newCounter("radio_light_updates_total", "Light updates sent, by output and result.")
+
+// lightLevel is the broadcast's RMS level, 0 to 1, as float64 bits. It is
+// only measured while a light show runs.
+var (
+	lightsOn   atomic.Bool
+	lightLevel atomic.Uint64
+)
+
+// measureLightLevel is called by the audio loop with every frame.
+func measureLightLevel(pcm []int16) {
+	if !lightsOn.Load() || len(pcm) == 0 {
+		return
+	}
+	var sum float64
+	for _, s := range pcm {
+		v := float64(s) / 32768
+		sum += v * v
+	}
+	lightLevel.Store(math.Float64bits(math.Sqrt(sum / float64(len(pcm)))))
+}
+
+type rgb struct{ r, g, b float64 }
+
+type lightScene struct {
+	colors        []rgb
+	beatsPerColor int
+	floor         float64
+}
+
+func parseScene(s LightScene) (lightScene, error) {
+	scene := lightScene{beatsPerColor: s.BeatsPerColor, floor: s.Floor}
+	if scene.beatsPerColor <= 0 {
+		scene.beatsPerColor = 4
+	}
+	if s.Floor == 0 {
+		scene.floor = lightsDefaultFloor
+	} else if s.Floor < 0 || s.Floor > 1 {
+		return scene, fmt.Errorf("floor must be between 0 and 1, got %v", s.Floor)
+	}
+	for _, c := range s.Colors {
+		v, err := strconv.ParseUint(strings.TrimPrefix(c, "#"), 16, 32)
+		if err != nil || len(strings.TrimPrefix(c, "#")) != 6 {
+			return scene, fmt.Errorf("color %q is not #rrggbb", c)
+		}
+		scene.colors = append(scene.colors, rgb{float64(v>>16) / 255, float64(v>>8&0xff) / 255, float64(v&0xff) / 255})
+	}
+	if len(scene.colors) == 0 {
+		scene.colors = []rgb{{1, 1, 1}}
+	}
+	return scene, nil
+}
+
+func fixtureWidth(typ string) int {
+	switch typ {
+	case "dimmer":
+		return 1
+	case "rgb":
+		return 3
+	case "rgbw":
+		return 4
+	}
+	return 0
+}
+
+func artNetAddr(addr string) (*net.UDPAddr, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("no address")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(artNetPort))
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
+// lightShow works out what the lights should show from moment to moment.
+type lightShow struct {
+	scenes map[string]lightScene
+	peak   float64
+	beat   int64 // beats seen, for moving through the colours
+	phase  float64
+
+	color atomic.Value // rgb
+	level atomic.Uint64
+}
+
+func startLights(c LightsConfig) error {
+	if c.Hue == nil && c.ArtNet == nil {
+		return nil
+	}
+	show := &lightShow{scenes: make(map[string]lightScene)}
+	for genre, s := range c.Scenes {
+		scene, err := parseScene(s)
+		if err != nil {
+			return fmt.Errorf("scene %s: %w", genre, err)
+		}
+		show.scenes[taxonomy.Canonical(genre)] = scene
+	}
+	show.color.Store(rgb{1, 1, 1})
+
+	var dmx *artNetOutput
+	if c.ArtNet != nil {
+		var err error
+		if dmx, err = newArtNetOutput(*c.ArtNet); err != nil {
+			return err
+		}
+		log.Printf("Driving %d DMX fixtures over Art-Net at %s", len(c.ArtNet.Fixtures), c.ArtNet.Address)
+	}
+	if c.Hue != nil {
+		go runHue(*c.Hue, show)
+		log.Printf("Driving %d Hue lights on %s", len(c.Hue.Lights), c.Hue.Bridge)
+	}
+	lightsOn.Store(true)
+	go show.run(dmx)
+	return nil
+}
+
+func (s *lightShow) scene() lightScene {
+	if scene, ok := s.scenes[getCurrentGenre()]; ok {
+		return scene
+	}
+	if scene, ok := s.scenes["default"]; ok {
+		return scene
+	}
+	scene, _ := parseScene(LightScene{})
+	return scene
+}
+
+func (s *lightShow) run(dmx *artNetOutput) {
+	ticker := time.NewTicker(lightsRate)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.step(now)
+		if dmx != nil {
+			dmx.send(s.color.Load().(rgb), math.Float64frombits(s.level.Load()))
+		}
+	}
+}
+
+// step works out the brightness and colour for now.
+func (s *lightShow) step(now time.Time) {
+	scene := s.scene()
+
+	// Energy, relative to a slowly falling recent peak
+	level := math.Float64frombits(lightLevel.Load())
+	s.peak = math.Max(level, s.peak*0.998)
+	energy := 0.0
+	if s.peak > 1e-4 {
+		energy = level / s.peak
+	}
+
+	// A flash that fades over each beat
+	pulse := 0.0
+	if ev, ok := beatHub.Snapshot()["beat"]; ok {
+		if clock, _ := ev.Data.(BeatClock); clock.Confidence >= lightsMinBeatConf && clock.PeriodMS > 0 {
+			since := float64(now.UnixMilli() - clock.BeatAt)
+			phase := math.Mod(since/clock.PeriodMS, 1)
+			if phase < 0 {
+				phase++
+			}
+			if phase < s.phase {
+				s.beat++
+			}
+			s.phase = phase
+			pulse = math.Exp(-6 * phase)
+		}
+	}
+
+	bri := scene.floor + (1-scene.floor)*math.Min(1, 0.6*energy+0.4*pulse)
+	if level < 1e-4 {
+		bri = scene.floor // silence
+	}
+	s.level.Store(math.Float64bits(bri))
+	s.color.Store(scene.colors[int(s.beat/int64(scene.beatsPerColor))%len(scene.colors)])
+}
+
+// artNetOutput sends one DMX universe as ArtDmx packets.
+type artNetOutput struct {
+	conn     *net.UDPConn
+	universe int
+	fixtures []LightFixture
+	seq      uint8
+	packet   []byte
+}
+
+func newArtNetOutput(c ArtNetConfig) (*artNetOutput, error) {
+	addr, err := artNetAddr(c.Address)
+	if err != nil {
+		return nil, fmt.Errorf("artnet address: %w", err)
+	}
+	for _, f := range c.Fixtures {
+		if width := fixtureWidth(f.Type); width == 0 || f.Channel < 1 || f.Channel+width-1 > 512 {
+			return nil, fmt.Errorf("fixture %s doesn't fit the universe, or has an unknown type", f.Name)
+		}
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &artNetOutput{conn: conn, universe: c.Universe, fixtures: c.Fixtures, packet: make([]byte, 18+512)}, nil
+}
+
+func (o *artNetOutput) send(color rgb, bri float64) {
+	p := o.packet
+	copy(p, "Art-Net\x00")
+	binary.LittleEndian.PutUint16(p[8:], 0x5000) // OpDmx
+	binary.BigEndian.PutUint16(p[10:], 14)       // protocol version
+	o.seq++
+	if o.seq == 0 {
+		o.seq = 1 // 0 turns sequencing off
+	}
+	p[12] = o.seq
+	p[13] = 0
+	p[14] = byte(o.universe)      // SubUni
+	p[15] = byte(o.universe >> 8) // Net
+	binary.BigEndian.PutUint16(p[16:], 512)
+	data := p[18:]
+	dmx := func(v float64) byte { return byte(math.Round(math.Max(0, math.Min(1, v)) * 255)) }
+	for _, f := range o.fixtures {
+		ch := data[f.Channel-1:]
+		switch f.Type {
+		case "dimmer":
+			ch[0] = dmx(bri)
+		case "rgb":
+			ch[0], ch[1], ch[2] = dmx(color.r*bri), dmx(color.g*bri), dmx(color.b*bri)
+		case "rgbw":
+			w := math.Min(color.r, math.Min(color.g, color.b))
+			ch[0], ch[1], ch[2], ch[3] = dmx((color.r-w)*bri), dmx((color.g-w)*bri), dmx((color.b-w)*bri), dmx(w*bri)
+		}
+	}
+	if _, err := o.conn.Write(p); err != nil {
+		lightUpdates.Inc("output", "artnet", "result", "error")
+		return
+	}
+	lightUpdates.Inc("output", "artnet", "result", "ok")
+}
+
+// runHue updates the Hue lights in turn, one per hueRate.
+func runHue(c HueConfig, show *lightShow) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	ticker := time.NewTicker(hueRate)
+	defer ticker.Stop()
+	failing := false
+	for i := 0; ; i++ {
+		<-ticker.C
+		light := c.Lights[i%len(c.Lights)]
+		x, y := hueXY(show.color.Load().(rgb))
+		body, _ := json.Marshal(map[string]interface{}{
+			"on":             true,
+			"bri":            1 + int(253*math.Float64frombits(show.level.Load())),
+			"xy":             []float64{x, y},
+			"transitiontime": 1, // 100ms
+		})
+		err := putHueState(client, c, light, body)
+		if err != nil {
+			lightUpdates.Inc("output", "hue", "result", "error")
+			if !failing {
+				log.Printf("Error updating Hue light %s: %v", light, err)
+			}
+			failing = true
+			continue
+		}
+		if failing {
+			log.Println("Hue bridge is answering again.")
+		}
+		failing = false
+		lightUpdates.Inc("output", "hue", "result", "ok")
+	}
+}
+
+func putHueState(client *http.Client, c HueConfig, light string, body []byte) error {
+	url := "http://" + c.Bridge + "/api/" + c.Username + "/lights/" + light + "/state"
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bridge answered %s", resp.Status)
+	}
+	// The bridge answers 200 with a list of errors when the request fails
+	var results []map[string]json.RawMessage
+	if json.NewDecoder(resp.Body).Decode(&results) == nil {
+		for _, r := range results {
+			if e, ok := r["error"]; ok {
+				return fmt.Errorf("bridge error: %s", e)
+			}
+		}
+	}
+	return nil
+}
+
+// hueXY converts an sRGB colour to the CIE xy the Hue API takes.
+func hueXY(c rgb) (float64, float64) {
+	gamma := func(v float64) float64 {
+		if v > 0.04045 {
+			return math.Pow((v+0.055)/1.055, 2.4)
+		}
+		return v / 12.92
+	}
+	r, g, b := gamma(c.r), gamma(c.g), gamma(c.b)
+	X := r*0.4124 + g*0.3576 + b*0.1805
+	Y := r*0.2126 + g*0.7152 + b*0.0722
+	Z := r*0.0193 + g*0.1192 + b*0.9505
+	if sum := X + Y + Z; sum > 0 {
+		return math.Round(X/sum*10000) / 10000, math.Round(Y/sum*10000) / 10000
+	}
+	return 0.3127, 0.3290 // white point
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Listener IDs tell returning listeners apart without storing anything that
+// identifies them for long. The browser keeps a random ID in a cookie; the
+// server never stores it, only a pseudonym derived from it with the token
+// secret and the current rotation period ("l_3kq..."). The same browser has
+// the same pseudonym for the whole period and an unrelated one in the next,
+// and at rotation the server forgets the pseudonyms it saw, so nothing links
+// a listener across periods.
+
+const (
+	listenerIDCookie        = "radio_lid"
+	defaultListenerRotation = 24 * time.Hour
+)
+
+var listenerSessions = newCounter("radio_listener_sessions_total", "Listener sessions that connected, by whether the listener was seen earlier in the rotation period.")
+
+func listenerRotation() time.Duration {
+	return listenerRotationOf(cfg.Auth.ListenerIDs)
+}
+
+func listenerRotationOf(c ListenerIDConfig) time.Duration {
+	if r := time.Duration(c.Rotation); r > 0 {
+		return r
+	}
+	return defaultListenerRotation
+}
+
+// ensureListenerCookie gives the browser a listener ID cookie if it has no
+// valid one yet.
+func ensureListenerCookie(w http.ResponseWriter, r *http.Request) {
+	if !cfg.Auth.ListenerIDs.Enabled || rawListenerID(r) != "" {
+		return
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     listenerIDCookie,
+		Value:    id + "." + listenerTokens.sign("lid."+id),
+		Path:     "/",
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// rawListenerID returns the ID in the request's cookie, or "" if it has
+// none or the ID wasn't issued by this server (or one sharing its secret).
+func rawListenerID(r *http.Request) string {
+	c, err := r.Cookie(listenerIDCookie)
+	if err != nil {
+		return ""
+	}
+	id, sig, ok := strings.Cut(c.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(listenerTokens.sign("lid."+id))) {
+		return ""
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(id); err != nil || len(b) != 16 {
+		return ""
+	}
+	return id
+}
+
+// listenerID returns the request's pseudonym for the current rotation
+// period, or "" if it has no listener ID.
+func listenerID(r *http.Request) string {
+	raw := rawListenerID(r)
+	if !cfg.Auth.ListenerIDs.Enabled || raw == "" {
+		return ""
+	}
+	period := time.Now().UnixNano() / int64(listenerRotation())
+	return "l_" + listenerTokens.sign("listener." + strconv.FormatInt(period, 10) + "." + raw)[:16]
+}
+
+// voterID returns the key a blocklist vote from r is counted under, or "" if
+// it has no listener ID. Unlike the pseudonym it doesn't rotate, so a
+// browser can't vote again once its pseudonym changes; it is only kept in
+// the vote tally, see blocklist.go.
+func voterID(r *http.Request) string {
+	raw := rawListenerID(r)
+	if !cfg.Auth.ListenerIDs.Enabled || raw == "" {
+		return ""
+	}
+	return listenerTokens.sign("vote." + raw)
+}
+
+// listenersSeen holds the pseudonyms seen in the current period.
+var listenersSeen = struct {
+	sync.Mutex
+	period int64
+	ids    map[string]bool
+}{ids: make(map[string]bool)}
+
+var _ = newGaugeFunc("radio_listeners_unique", "Distinct listeners seen in the current rotation period.", func() float64 {
+	listenersSeen.Lock()
+	defer listenersSeen.Unlock()
+	return float64(len(listenersSeen.ids))
+})
+
+// recordListener counts a connected session towards the unique and
+// returning listener figures.
+func recordListener(id string) {
+	if id == "" {
+		return
+	}
+	period := time.Now().UnixNano() / int64(listenerRotation())
+	listenersSeen.Lock()
+	if period != listenersSeen.period {
+		listenersSeen.period = period
+		listenersSeen.ids = make(map[string]bool)
+	}
+	returning := listenersSeen.ids[id]
+	listenersSeen.ids[id] = true
+	listenersSeen.Unlock()
+
+	if returning {
+		listenerSessions.Inc("returning", "yes")
+	} else {
+		listenerSessions.Inc("returning", "no")
+	}
+}
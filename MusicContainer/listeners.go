@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Listener counts come from the sessions' peer connection state rather than
+// from offers received: a session is "connected" once its peer connection
+// is, and "receiving" while its client also keeps sending RTCP reports. The
+// counts are served on /api/listeners, exported as metrics and pushed to
+// clients as a "listeners" status event and on the metadata channel.
+
+const (
+	listenerCountInterval = 2 * time.Second
+	// A client that sent RTCP this recently is still receiving audio.
+	listenerActiveWindow = 10 * time.Second
+)
+
+// ListenerCounts is the /api/listeners response.
+type ListenerCounts struct {
+	Sessions  int       `json:"sessions"`  // admitted, including ones still connecting
+	Connected int       `json:"connected"` // peer connection is up
+	Receiving int       `json:"receiving"` // connected and sending RTCP
+	Peak      int       `json:"peak"`      // most receiving since startup
+	PeakAt    time.Time `json:"peak_at,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+var (
+	listenerMu     sync.Mutex
+	listenerCounts ListenerCounts
+
+	listenerGauge = newGauge("radio_listeners_by_state", "Listener sessions that are connected or receiving.")
+)
+
+// countListeners counts the sessions in each state.
+func (m *sessionManager) countListeners(now time.Time) (sessions, connected, receiving int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sessions {
+		sessions++
+		if s.state != webrtc.PeerConnectionStateConnected {
+			continue
+		}
+		connected++
+		if now.Sub(time.Unix(0, s.lastSeen.Load())) < listenerActiveWindow {
+			receiving++
+		}
+	}
+	return
+}
+
+// currentListeners returns the latest counts.
+func currentListeners() ListenerCounts {
+	listenerMu.Lock()
+	defer listenerMu.Unlock()
+	return listenerCounts
+}
+
+// runListenerCount recounts listeners and publishes changes.
+func runListenerCount() {
+	for now := range time.Tick(listenerCountInterval) {
+		total, connected, receiving := sessions.countListeners(now)
+
+		listenerMu.Lock()
+		prev := listenerCounts
+		c := prev
+		c.Sessions, c.Connected, c.Receiving, c.Updated = total, connected, receiving, now
+		if receiving > c.Peak {
+			c.Peak, c.PeakAt = receiving, now
+		}
+		listenerCounts = c
+		listenerMu.Unlock()
+
+		listenerGauge.Set(float64(connected), "state", "connected")
+		listenerGauge.Set(float64(receiving), "state", "receiving")
+		if c.Sessions != prev.Sessions || c.Connected != prev.Connected || c.Receiving != prev.Receiving {
+			status.Publish("listeners", c)
+		}
+	}
+}
+
+func handleListeners(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(currentListeners())
+}
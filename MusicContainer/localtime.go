@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// A station that serves one listener at a time, like a private station with
+// a listener cap of 1, can play for that listener's time of day rather than
+// the station's. The player sends its timezone with the offer, and when a
+// listener connects while nobody else is listening, the genre.local_time
+// block on air in their timezone is submitted through the local_time
+// source. Its priority sits just above auto, so any listener, vote, schedule
+// or admin request still wins; the pick holds until the block ends. Blocks
+// look like genre.schedule blocks:
+//
+//	"local_time": [
+//	  {"genre": "focus beats", "start": "07:00", "end": "12:00", "days": ["mon", "tue", "wed", "thu", "fri"]},
+//	  {"genre": "late night ambient", "start": "22:00", "end": "04:00"}
+//	]
+
+// setLocalClock records the listener's timezone, preferring the IANA name
+// over the bare UTC offset.
+func (s *session) setLocalClock(tz string, utcOffset *int) {
+	if len(cfg.Genre.LocalTime) == 0 {
+		return
+	}
+	if tz != "" && len(tz) < 64 {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			s.clock = loc
+			return
+		}
+	}
+	if utcOffset != nil && *utcOffset >= -14*60 && *utcOffset <= 14*60 {
+		s.clock = time.FixedZone("", *utcOffset*60)
+	}
+}
+
+// applyLocalTimeGenre submits the local_time block on air for the listener
+// who just connected, if they are the only one.
+func applyLocalTimeGenre(s *session) {
+	if len(cfg.Genre.LocalTime) == 0 || s.clock == nil || sessions.Count() != 1 {
+		return
+	}
+	now := time.Now()
+	slots := guideSlotsIn(cfg.Genre.LocalTime, now, now.Add(time.Second), s.clock)
+	if len(slots) == 0 {
+		return
+	}
+	// With overlapping blocks the one that started last wins, as in the guide
+	slot := slots[len(slots)-1]
+	log.Printf("Listener %s is alone at %s their time, asking for %q", s.id, now.In(s.clock).Format("15:04"), slot.Genre)
+	if _, err := arbiter.Submit(GenreRequest{Genre: slot.Genre, Vars: slot.vars, Source: sourceLocalTime, Expires: slot.End}); err != nil {
+		log.Printf("Error applying local time genre: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// /poll is trickle ICE over plain HTTP, for webviews and networks that block
+// WebSockets. The client POSTs the same offer message /ws takes to /poll and
+// gets the answer straight away, with a "channel" ID. The server buffers its
+// candidates on the channel as pion finds them:
+//
+//	GET  /poll/<channel>?after=n    waits up to 25s for messages past the
+//	                                first n, returns {"messages": [...], "next": m}
+//	POST /poll/<channel>            {"candidates": [...]} from the client
+//
+// Messages are the candidate messages /ws sends, ending with a candidate of
+// null once gathering is done. A channel is dropped after 30 seconds
+// without a request; the peer connection lives on without it. Rejections
+// are the same as on /offer.
+
+const longPollWait = 25 * time.Second // below the usual 30s proxy timeout
+
+type pollChannel struct {
+	id    string
+	pc    *webrtc.PeerConnection
+	timer *time.Timer // drops the channel when it goes quiet
+
+	mu      sync.Mutex
+	msgs    []interface{}
+	arrived chan struct{} // closed and replaced when messages arrive
+}
+
+var (
+	pollMu       sync.Mutex
+	pollChannels = make(map[string]*pollChannel)
+)
+
+func newPollChannel(pc *webrtc.PeerConnection) *pollChannel {
+	c := &pollChannel{id: newSessionID(), pc: pc, arrived: make(chan struct{})}
+	c.timer = time.AfterFunc(wsSignalTimeout, func() {
+		pollMu.Lock()
+		delete(pollChannels, c.id)
+		pollMu.Unlock()
+	})
+	pollMu.Lock()
+	pollChannels[c.id] = c
+	pollMu.Unlock()
+	return c
+}
+
+// getPollChannel returns the channel and keeps it alive, or nil.
+func getPollChannel(id string) *pollChannel {
+	pollMu.Lock()
+	defer pollMu.Unlock()
+	c := pollChannels[id]
+	if c != nil {
+		c.timer.Reset(wsSignalTimeout)
+	}
+	return c
+}
+
+// candidate buffers a local candidate, or the end-of-candidates marker for
+// nil.
+func (c *pollChannel) candidate(cand *webrtc.ICECandidate) {
+	msg := map[string]interface{}{"type": "candidate", "candidate": nil}
+	if cand != nil {
+		if answerFilter.dropCandidate(cand) {
+			return
+		}
+		msg["candidate"] = cand.ToJSON()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, msg)
+	close(c.arrived)
+	c.arrived = make(chan struct{})
+}
+
+// since returns the messages past the first n, and a channel that is closed
+// when more arrive.
+func (c *pollChannel) since(n int) ([]interface{}, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n < len(c.msgs) {
+		return append([]interface{}(nil), c.msgs[n:]...), nil
+	}
+	return nil, c.arrived
+}
+
+func handlePoll(w http.ResponseWriter, r *http.Request) {
+	if id := strings.TrimPrefix(r.URL.Path, "/poll/"); id != r.URL.Path && id != "" {
+		c := getPollChannel(id)
+		if c == nil {
+			http.Error(w, "Signaling channel not found", http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			pollMessages(w, r, c)
+		} else {
+			pollCandidates(w, r, c)
+		}
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pollOffer(w, r)
+}
+
+// pollMessages answers once there is something past ?after=, or after
+// longPollWait with no messages.
+func pollMessages(w http.ResponseWriter, r *http.Request, c *pollChannel) {
+	after, _ := strconv.Atoi(r.URL.Query().Get("after"))
+	if after < 0 {
+		after = 0
+	}
+	timeout := time.NewTimer(longPollWait)
+	defer timeout.Stop()
+
+	msgs, arrived := c.since(after)
+	for msgs == nil {
+		select {
+		case <-arrived:
+			msgs, arrived = c.since(after)
+		case <-timeout.C:
+			msgs = []interface{}{}
+		case <-r.Context().Done():
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"messages": msgs, "next": after + len(msgs)})
+}
+
+// pollCandidates adds the client's candidates to the peer connection.
+func pollCandidates(w http.ResponseWriter, r *http.Request, c *pollChannel) {
+	var req struct {
+		Candidates []webrtc.ICECandidateInit `json:"candidates"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	for _, cand := range req.Candidates {
+		if err := c.pc.AddICECandidate(cand); err != nil {
+			log.Printf("Error adding ICE candidate from %s: %v", r.RemoteAddr, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func pollOffer(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var o wsMessage
+	if err := json.Unmarshal(body, &o); err != nil || o.Type != "offer" {
+		log.Printf("Error reading offer from %s: expected an offer", r.RemoteAddr)
+		http.Error(w, "Expected an offer", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Received long-poll offer from %s", r.RemoteAddr)
+
+	admitted, code := admit(r, o.Handoff, o.Ticket)
+	if code != "" {
+		writeAdmissionRejection(w, admitted, code)
+		return
+	}
+	sess := admitted.session
+	sess.setProbe(o.Probe)
+	sess.setLocalClock(o.TZ, o.UTCOffset)
+
+	peerConnection, err := newListenerPeer(sess)
+	if err != nil {
+		log.Printf("Error setting up peer connection: %v", err)
+		sessions.Remove(sess.id)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c, answerSDP, err := answerTrickle(peerConnection, o.SDP)
+	if err != nil {
+		log.Printf("Error answering offer: %v", err)
+		sessions.Remove(sess.id)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pollAnswer{
+		answer: answer{
+			Type:    "answer",
+			SDP:     answerSDP,
+			Session: sess.id,
+			Bitrate: int(sess.bitrate.Load()),
+			Resume:  resumeToken(sess.id),
+			Audio:   currentReadiness(),
+		},
+		Channel: c.id,
+	})
+	log.Printf("Sent long-poll answer to %s", r.RemoteAddr)
+}
+
+// pollAnswer is an answer whose candidates follow on a poll channel.
+type pollAnswer struct {
+	answer
+	Channel string `json:"channel"`
+}
+
+// answerTrickle applies a client's offer and returns the answer right away,
+// with a poll channel the server's candidates are buffered on as they are
+// gathered.
+func answerTrickle(peerConnection *webrtc.PeerConnection, offerSDP string) (*pollChannel, string, error) {
+	c := newPollChannel(peerConnection)
+	peerConnection.OnICECandidate(c.candidate)
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offerSDP,
+	}); err != nil {
+		return nil, "", fmt.Errorf("setting remote description: %w", err)
+	}
+	answerSDP, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("creating answer: %w", err)
+	}
+	if err := peerConnection.SetLocalDescription(answerSDP); err != nil {
+		return nil, "", fmt.Errorf("setting local description: %w", err)
+	}
+	return c, applyAnswerHooks(answerSDP.SDP), nil
+}
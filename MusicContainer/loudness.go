@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// The loudness meter measures the broadcast's short-term loudness (ITU-R
+// BS.1770 K-weighting over a 3 second window) and publishes it to clients
+// that asked for it on the control channel. The web player uses it for
+// "night mode", riding its own volume towards a steady level; the broadcast
+// itself is never changed.
+
+const (
+	loudnessWindow   = 3 * time.Second
+	loudnessInterval = 500 * time.Millisecond // between hints
+)
+
+// Hints go out on their own hub so the status channel isn't flooded.
+var loudnessHub = &statusHub{
+	subs: make(map[chan StatusEvent]struct{}),
+	last: make(map[string]StatusEvent),
+}
+
+// biquad is one second-order IIR section (direct form I).
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting returns the BS.1770 pre-filter and RLB high-pass for 48kHz.
+func kWeighting() [2]biquad {
+	return [2]biquad{
+		{b0: 1.53512485958697, b1: -2.69169618940638, b2: 1.19839281085285, a1: -1.69065929318241, a2: 0.73248077421585},
+		{b0: 1, b1: -2, b2: 1, a1: -1.99004745483398, a2: 0.99007225036621},
+	}
+}
+
+type loudnessMeter struct {
+	channels int
+	filters  [][2]biquad // per channel
+	power    []float64   // mean square per frame, summed over channels
+	next     int
+	filled   int
+	frames   int
+	interval int // frames between hints
+}
+
+func newLoudnessMeter(channels int) *loudnessMeter {
+	m := &loudnessMeter{
+		channels: channels,
+		filters:  make([][2]biquad, channels),
+		power:    make([]float64, framesIn(loudnessWindow)),
+		interval: framesIn(loudnessInterval),
+	}
+	for i := range m.filters {
+		m.filters[i] = kWeighting()
+	}
+	return m
+}
+
+// add measures one frame of interleaved samples and publishes a hint every
+// loudnessInterval.
+func (m *loudnessMeter) add(pcm []int16) {
+	var sum float64
+	for i, s := range pcm {
+		f := &m.filters[i%m.channels]
+		x := f[1].process(f[0].process(float64(s) / 32768))
+		sum += x * x
+	}
+	m.power[m.next] = sum / float64(len(pcm)/m.channels)
+	m.next = (m.next + 1) % len(m.power)
+	if m.filled < len(m.power) {
+		m.filled++
+	}
+
+	m.frames++
+	if m.frames%m.interval == 0 {
+		loudnessHub.Publish("loudness", map[string]float64{"short_term_lufs": m.shortTerm()})
+	}
+}
+
+// shortTerm returns the loudness over the last 3 seconds in LUFS.
+func (m *loudnessMeter) shortTerm() float64 {
+	var sum float64
+	for _, p := range m.power[:m.filled] {
+		sum += p
+	}
+	if m.filled == 0 || sum == 0 {
+		return -70 // the BS.1770 absolute gate, effectively silence
+	}
+	lufs := -0.691 + 10*math.Log10(sum/float64(m.filled))
+	return math.Max(math.Round(lufs*10)/10, -70)
+}
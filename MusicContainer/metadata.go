@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Every peer connection gets a server-opened DataChannel labelled "metadata"
+// on which the station pushes a JSON snapshot whenever something the player
+// shows changes, so the UI doesn't have to poll:
+//
+//	{"genre": "jazz", "started_at": "...", "uptime_s": 5400, "listeners": 12, "generator": "live"}
+//
+// The channel is one-way; use the control channel to talk back.
+
+const (
+	metadataLabel = "metadata"
+
+	metadataCheckInterval = 2 * time.Second
+	metadataRefresh       = 30 * time.Second // resend even if nothing changed
+)
+
+var streamStarted = time.Now()
+
+// StationMetadata is one message on the metadata channel.
+type StationMetadata struct {
+	Genre     string    `json:"genre"`
+	StartedAt time.Time `json:"started_at"`
+	UptimeS   int64     `json:"uptime_s"`
+	Listeners int       `json:"listeners"` // receiving, see listeners.go
+	Generator string    `json:"generator"` // "starting", "bootstrap", "live" or "offline"
+}
+
+func currentMetadata() StationMetadata {
+	generator := "starting"
+	if ev, ok := status.Snapshot()["audio_source"]; ok {
+		if data, ok := ev.Data.(map[string]string); ok {
+			generator = data["source"]
+		}
+	}
+	if !stationOnline.Load() {
+		generator = "offline"
+	}
+	return StationMetadata{
+		Genre:     getCurrentGenre(),
+		StartedAt: streamStarted,
+		UptimeS:   int64(time.Since(streamStarted).Seconds()),
+		Listeners: currentListeners().Receiving,
+		Generator: generator,
+	}
+}
+
+// openMetadataChannel adds the metadata channel to a listener's peer
+// connection. It has to exist before the answer is created.
+func openMetadataChannel(sess *session, pc *webrtc.PeerConnection) error {
+	dc, err := pc.CreateDataChannel(metadataLabel, nil)
+	if err != nil {
+		return err
+	}
+	dc.OnOpen(func() {
+		sendMetadata(dc, currentMetadata())
+	})
+	sess.metadata = dc
+	return nil
+}
+
+func sendMetadata(dc *webrtc.DataChannel, m StationMetadata) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("Error encoding metadata: %v", err)
+		return
+	}
+	// A closing channel is cleaned up with its session
+	dc.SendText(string(data))
+}
+
+// runMetadata pushes a snapshot to every open metadata channel when the
+// genre, listener count or generator state changes.
+func runMetadata() {
+	var last StationMetadata
+	var lastSent time.Time
+	for now := range time.Tick(metadataCheckInterval) {
+		m := currentMetadata()
+		changed := m.Genre != last.Genre || m.Listeners != last.Listeners || m.Generator != last.Generator
+		if !changed && now.Sub(lastSent) < metadataRefresh {
+			continue
+		}
+		last, lastSent = m, now
+
+		sessions.mu.Lock()
+		var channels []*webrtc.DataChannel
+		for _, s := range sessions.sessions {
+			if s.metadata != nil && s.metadata.ReadyState() == webrtc.DataChannelStateOpen {
+				channels = append(channels, s.metadata)
+			}
+		}
+		sessions.mu.Unlock()
+		for _, dc := range channels {
+			sendMetadata(dc, m)
+		}
+	}
+}
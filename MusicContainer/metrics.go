@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A tiny metrics registry rendered in the Prometheus text format, so the
+// station can be scraped without pulling in the full client library.
+
+type metric struct {
+	name string
+	help string
+	kind string // "counter", "gauge" or "histogram"
+
+	mu      sync.Mutex
+	values  map[string]float64 // rendered label set -> value
+	fn      func() float64     // for gauges computed at scrape time
+	buckets []float64          // histogram upper bounds
+	hists   map[string]*histogram
+}
+
+// histogram is one label set's observations.
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+var (
+	metricsMu sync.Mutex
+	registry  []*metric
+)
+
+func register(m *metric) *metric {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	registry = append(registry, m)
+	return m
+}
+
+func newCounter(name, help string) *metric {
+	return register(&metric{name: name, help: help, kind: "counter", values: make(map[string]float64)})
+}
+
+func newGauge(name, help string) *metric {
+	return register(&metric{name: name, help: help, kind: "gauge", values: make(map[string]float64)})
+}
+
+// newGaugeFunc registers a gauge whose value is read from fn on every scrape.
+func newGaugeFunc(name, help string, fn func() float64) *metric {
+	return register(&metric{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+// newCounterFunc registers a counter whose value is read from fn on every
+// scrape, for totals that are already tracked elsewhere.
+func newCounterFunc(name, help string, fn func() float64) *metric {
+	return register(&metric{name: name, help: help, kind: "counter", fn: fn})
+}
+
+// defaultBuckets suit request latencies in seconds.
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func newHistogram(name, help string, buckets []float64) *metric {
+	return register(&metric{name: name, help: help, kind: "histogram", buckets: buckets, hists: make(map[string]*histogram)})
+}
+
+// Observe adds a value to a histogram.
+func (m *metric) Observe(v float64, labels ...string) {
+	key := labelString(labels)
+	m.mu.Lock()
+	h := m.hists[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.hists[key] = h
+	}
+	for i, le := range m.buckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+	m.mu.Unlock()
+}
+
+// labelString renders alternating key/value pairs as {k="v",...}.
+func labelString(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (m *metric) Add(v float64, labels ...string) {
+	key := labelString(labels)
+	m.mu.Lock()
+	m.values[key] += v
+	m.mu.Unlock()
+}
+
+func (m *metric) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+func (m *metric) Set(v float64, labels ...string) {
+	key := labelString(labels)
+	m.mu.Lock()
+	m.values[key] = v
+	m.mu.Unlock()
+}
+
+func (m *metric) write(sb *strings.Builder) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.fn != nil {
+		fmt.Fprintf(sb, "%s %g\n", m.name, m.fn())
+		return
+	}
+
+	if m.kind == "histogram" {
+		m.writeHistogram(sb)
+		return
+	}
+
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(sb, "%s%s %g\n", m.name, k, m.values[k])
+	}
+	m.mu.Unlock()
+}
+
+func (m *metric) writeHistogram(sb *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.hists))
+	for k := range m.hists {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := m.hists[k]
+		// le goes in with the other labels
+		withLE := func(le string) string {
+			if k == "" {
+				return `{le="` + le + `"}`
+			}
+			return strings.TrimSuffix(k, "}") + `,le="` + le + `"}`
+		}
+		var cumulative uint64
+		for i, le := range m.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", m.name, withLE(fmt.Sprint(le)), cumulative)
+		}
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", m.name, withLE("+Inf"), h.count)
+		fmt.Fprintf(sb, "%s_sum%s %g\n", m.name, k, h.sum)
+		fmt.Fprintf(sb, "%s_count%s %d\n", m.name, k, h.count)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	metrics := append([]*metric(nil), registry...)
+	metricsMu.Unlock()
+
+	var sb strings.Builder
+	for _, m := range metrics {
+		m.write(&sb)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, sb.String())
+}
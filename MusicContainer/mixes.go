@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// A mix variant is a second rendition of the station built from the same
+// stems with some of them left out. Every variant is mixed and encoded once
+// per frame and published as its own feed, so switching a listener between
+// mixes is just pointing their output at another feed.
+type mixVariant struct {
+	name    string
+	keep    []bool // per stem, in stem order
+	encoder *hotEncoder
+	levels  []float64
+	dsp     *dspChain
+}
+
+var (
+	mixesMu sync.Mutex
+	mixes   = map[string]bool{mainFeed: true}
+)
+
+// mixAvailable reports whether name is a mix listeners can switch to.
+func mixAvailable(name string) bool {
+	mixesMu.Lock()
+	defer mixesMu.Unlock()
+	return mixes[name]
+}
+
+func availableMixes() []string {
+	mixesMu.Lock()
+	defer mixesMu.Unlock()
+	names := make([]string, 0, len(mixes))
+	for name := range mixes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newMixVariant(c MixConfig, stems []StemConfig, sampleRate, channels int) (*mixVariant, error) {
+	if c.Name == "" || c.Name == mainFeed {
+		return nil, fmt.Errorf("mix needs a name other than %q", mainFeed)
+	}
+	if len(c.Mute) > 0 && len(c.Solo) > 0 {
+		return nil, fmt.Errorf("mix %s sets both mute and solo", c.Name)
+	}
+
+	keep := make([]bool, len(stems))
+	for i := range keep {
+		keep[i] = len(c.Solo) == 0
+	}
+	for _, name := range append(c.Mute, c.Solo...) {
+		i := stemIndex(stems, name)
+		if i < 0 {
+			return nil, fmt.Errorf("mix %s refers to unknown stem %q", c.Name, name)
+		}
+		keep[i] = len(c.Solo) > 0
+	}
+
+	if err := acquireEncoder(c.Name); err != nil {
+		return nil, err
+	}
+	encoder, err := newHotEncoder(sampleRate, channels, effectiveEncoderConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &mixVariant{
+		name:    c.Name,
+		keep:    keep,
+		encoder: encoder,
+		levels:  make([]float64, len(stems)),
+		dsp:     newDSPChain(c.Name, sampleRate, channels),
+	}, nil
+}
+
+// startMixVariants sets up every configured mix. A mix that can't start is
+// logged and left out; the main mix always runs.
+func startMixVariants(sampleRate, channels int) []*mixVariant {
+	stems := currentStems()
+	var variants []*mixVariant
+	for _, c := range cfg.Audio.Mixes {
+		v, err := newMixVariant(c, stems, sampleRate, channels)
+		if err != nil {
+			log.Printf("Error starting mix %s: %v", c.Name, err)
+			continue
+		}
+		mixesMu.Lock()
+		mixes[v.name] = true
+		mixesMu.Unlock()
+		variants = append(variants, v)
+		log.Printf("Serving stem mix %s", v.name)
+	}
+	return variants
+}
+
+// mix renders the variant's frame from the stems into out, using the
+// station's current stem gains for the stems it keeps.
+func (v *mixVariant) mix(stems [][]byte, levels []float64, out []int16) {
+	for i := range v.levels {
+		v.levels[i] = 0
+		if v.keep[i] {
+			v.levels[i] = levels[i]
+		}
+	}
+	mixStems(stems, v.levels, out)
+}
+
+// encode encodes the variant's frame and queues it for its feed.
+func (v *mixVariant) encode(out *encodedFrame, pcm []int16, validator *opusValidator) {
+	packet, err := out.encode(v.encoder, pcm, validator)
+	if err != nil {
+		log.Printf("Error encoding mix %s: %v", v.name, err)
+		return
+	}
+	out.send(v.name, packet)
+}
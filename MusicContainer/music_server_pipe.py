@@ -3,12 +3,24 @@ import threading
 import queue
 import numpy as np
 import os
+import struct
+import zlib
 from magenta_rt import system
 
 # The frame size must match the Go server!
 # 48000 Hz * 0.020 s = 960 samples per frame
 PIPE_FRAME_SIZE = 960
 
+# Set RADIO_PIPE_FRAMING=1 to wrap each frame in the server's ingestframe
+# header, so the server can check the sample rate and channels.
+PIPE_FRAMING = os.environ.get("RADIO_PIPE_FRAMING") == "1"
+
+def frame_pcm(pcm: bytes, sample_rate: int, channels: int, timestamp: int) -> bytes:
+    """Wraps s16le PCM in an ingestframe frame, see ingestframe/frame.go."""
+    header = struct.pack(">4sBBBBIQI", b"IRFR", 1, 1, channels, 0, sample_rate, timestamp, len(pcm))
+    body = header + pcm
+    return body + struct.pack(">I", zlib.crc32(body))
+
 class AudioFade:
     """Handles the short, intra-chunk crossfade from Magenta's model."""
     def __init__(self, chunk_size: int, num_chunks: int, stereo: bool):
@@ -49,6 +61,7 @@ class ContinuousMusicPipeWriter:
         self.genre_monitor_thread = None
         self.stop_event = threading.Event()
         self.pipe_handle = None
+        self.samples_written = 0
         self.current_genre = style
         self.last_genre_check = 0
 
@@ -89,7 +102,9 @@ class ContinuousMusicPipeWriter:
                         with open(self.genre_file_path, 'r') as f:
                             content = f.read().strip()
                         
-                        new_genre = content.split(":")[-1] # Gets genre from "SMOOTH:genre" or "genre"
+                        # Gets genre from "SMOOTH:genre" or "genre". Only strip the prefix,
+                        # templated prompts may contain colons of their own.
+                        new_genre = content[len("SMOOTH:"):] if content.startswith("SMOOTH:") else content
                         
                         if new_genre and new_genre != self.current_genre:
                             print(f"Genre change detected: '{self.current_genre}' -> '{new_genre}'")
@@ -183,7 +198,11 @@ class ContinuousMusicPipeWriter:
 
             if frame_to_send is not None:
                 try:
-                    os.write(self.pipe_handle, frame_to_send.tobytes())
+                    data = frame_to_send.tobytes()
+                    if PIPE_FRAMING:
+                        data = frame_pcm(data, self.sample_rate, self.channels, self.samples_written)
+                    os.write(self.pipe_handle, data)
+                    self.samples_written += len(frame_to_send)
                 except Exception as e:
                     print(f"ERROR writing to pipe (likely closed): {e}")
                     self.stop_event.set()
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Retransmissions let listeners recover packets lost on the way instead of
+// concealing them. The answer offers NACK feedback on Opus and, for clients
+// that offer it, an RTX payload type; pion's responder keeps the last few
+// hundred packets of every track and resends the ones a client NACKs, on
+// the RTX stream if negotiated and on the original one otherwise. In-band
+// FEC still covers single losses the client can't wait for.
+
+const (
+	opusPayloadType = 111 // what RegisterDefaultCodecs gives Opus
+	rtxPayloadType  = 63
+)
+
+var (
+	nacksReceived = newCounter("radio_nacks_received_total", "NACK packets received from listeners.")
+	packetsNacked = newCounter("radio_packets_nacked_total", "RTP packets listeners asked to have resent.")
+)
+
+// configureNACK adds NACK and RTX to a peer connection's media engine and
+// interceptors. It must run after the default codecs are registered.
+func configureNACK(m *webrtc.MediaEngine, interceptors *interceptor.Registry, c NACKConfig) error {
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    "audio/rtx",
+			ClockRate:   opusClockRate,
+			SDPFmtpLine: fmt.Sprintf("apt=%d", opusPayloadType),
+		},
+		PayloadType: rtxPayloadType,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return fmt.Errorf("registering RTX: %w", err)
+	}
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeAudio)
+
+	responder, err := nack.NewResponderInterceptor(nack.ResponderSize(uint16(c.Buffer)))
+	if err != nil {
+		return fmt.Errorf("creating NACK responder: %w", err)
+	}
+	interceptors.Add(responder)
+	return nil
+}
+
+// countNACK records a NACK from a listener. The responder does the resending.
+func countNACK(p *rtcp.TransportLayerNack) {
+	nacksReceived.Inc()
+	n := 0
+	for i := range p.Nacks {
+		n += len(p.Nacks[i].PacketList())
+	}
+	packetsNacked.Add(float64(n))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Loudness normalization rides the station's level towards dsp.target_lufs,
+// so a quiet piano piece and a loud rock track that follow each other play
+// at about the same loudness. It measures EBU R128 loudness (BS.1770
+// K-weighting, 400ms blocks with 75% overlap, the -70 LUFS absolute and
+// -10 LU relative gates) over a sliding window and moves the gain slowly,
+// so it follows the change between segments rather than the music's own
+// dynamics. Silence holds the gain where it is.
+
+const (
+	normalizeBlock      = 400 * time.Millisecond
+	normalizeStep       = 100 * time.Millisecond // a new block this often
+	normalizeWindow     = 10 * time.Second
+	normalizeMaxBoostDB = 12
+	normalizeMaxCutDB   = 20
+	normalizeSlewDB     = 2 // per second
+)
+
+var normalizeGain = newGauge("radio_normalize_gain_db", "Gain applied by loudness normalization, by mix.")
+
+type loudnessNormalizer struct {
+	mix      string
+	channels int
+	filters  [][2]biquad
+	frames   []float64 // mean square of the last block's frames
+	next     int
+	blocks   []float64 // mean square of each block in the window
+	filled   int
+	nextBlk  int
+	count    int
+	step     int     // frames between blocks
+	slewDB   float64 // per block
+	gainDB   float64 // applied now
+}
+
+func newLoudnessNormalizer(mix string, channels int) *loudnessNormalizer {
+	step := framesIn(normalizeStep)
+	every := time.Duration(step) * audioFrame()
+	n := &loudnessNormalizer{
+		mix:      mix,
+		channels: channels,
+		filters:  make([][2]biquad, channels),
+		frames:   make([]float64, framesIn(normalizeBlock)),
+		blocks:   make([]float64, int(normalizeWindow/every)),
+		step:     step,
+		slewDB:   normalizeSlewDB * every.Seconds(),
+	}
+	for i := range n.filters {
+		n.filters[i] = kWeighting()
+	}
+	return n
+}
+
+// process normalizes one frame of interleaved samples in place, if the DSP
+// settings ask for it.
+func (n *loudnessNormalizer) process(pcm []int16) {
+	c := dspSettings.Load()
+	if c == nil || c.TargetLUFS == 0 {
+		if n.gainDB != 0 {
+			n.gainDB = 0
+			normalizeGain.Set(0, "mix", n.mix)
+		}
+		return
+	}
+
+	var sum float64
+	for i, s := range pcm {
+		f := &n.filters[i%n.channels]
+		x := f[1].process(f[0].process(float64(s) / 32768))
+		sum += x * x
+	}
+	n.frames[n.next] = sum / float64(len(pcm)/n.channels)
+	n.next = (n.next + 1) % len(n.frames)
+	n.count++
+
+	prev := n.gainDB
+	if n.count >= len(n.frames) && n.count%n.step == 0 {
+		n.addBlock()
+		if lufs, ok := n.loudness(); ok {
+			want := math.Max(-normalizeMaxCutDB, math.Min(normalizeMaxBoostDB, c.TargetLUFS-lufs))
+			n.gainDB += math.Max(-n.slewDB, math.Min(n.slewDB, want-n.gainDB))
+			normalizeGain.Set(math.Round(n.gainDB*10)/10, "mix", n.mix)
+		}
+	}
+	applyGainRamp(pcm, n.channels, prev, n.gainDB)
+}
+
+func (n *loudnessNormalizer) addBlock() {
+	var sum float64
+	for _, p := range n.frames {
+		sum += p
+	}
+	n.blocks[n.nextBlk] = sum / float64(len(n.frames))
+	n.nextBlk = (n.nextBlk + 1) % len(n.blocks)
+	if n.filled < len(n.blocks) {
+		n.filled++
+	}
+}
+
+// loudness returns the gated loudness of the window in LUFS, or false if
+// it is all silence.
+func (n *loudnessNormalizer) loudness() (float64, bool) {
+	gated := func(threshold float64) (float64, bool) {
+		var sum float64
+		var count int
+		for _, p := range n.blocks[:n.filled] {
+			if p > 0 && blockLUFS(p) > threshold {
+				sum += p
+				count++
+			}
+		}
+		if count == 0 {
+			return 0, false
+		}
+		return blockLUFS(sum / float64(count)), true
+	}
+	abs, ok := gated(-70)
+	if !ok {
+		return 0, false
+	}
+	return gated(abs - 10)
+}
+
+func blockLUFS(meanSquare float64) float64 {
+	return -0.691 + 10*math.Log10(meanSquare)
+}
+
+// applyGainRamp scales pcm by a gain moving from fromDB to toDB over the
+// frame, clipping at full scale.
+func applyGainRamp(pcm []int16, channels int, fromDB, toDB float64) {
+	if fromDB == 0 && toDB == 0 {
+		return
+	}
+	from, to := math.Pow(10, fromDB/20), math.Pow(10, toDB/20)
+	frames := len(pcm) / channels
+	for i := 0; i < frames; i++ {
+		g := from + (to-from)*float64(i+1)/float64(frames)
+		for ch := 0; ch < channels; ch++ {
+			v := float64(pcm[i*channels+ch]) * g
+			if v > math.MaxInt16 {
+				v = math.MaxInt16
+			} else if v < math.MinInt16 {
+				v = math.MinInt16
+			}
+			pcm[i*channels+ch] = int16(v)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Alert is what a notifier delivers when an alert rule fires.
+type Alert struct {
+	Rule    string      `json:"rule"`
+	Station string      `json:"station"`
+	Event   string      `json:"event"`
+	Time    time.Time   `json:"time"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf("[%s] %s: %s", a.Station, a.Rule, a.Message)
+}
+
+// Notifier delivers alerts to one destination.
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+func newNotifier(c NotifierConfig) (Notifier, error) {
+	switch c.Type {
+	case "webhook":
+		if c.URL == "" {
+			return nil, fmt.Errorf("webhook notifier needs a url")
+		}
+		return webhookNotifier{url: c.URL}, nil
+	case "slack":
+		if c.URL == "" {
+			return nil, fmt.Errorf("slack notifier needs a url")
+		}
+		return slackNotifier{url: c.URL}, nil
+	case "discord":
+		if c.URL == "" {
+			return nil, fmt.Errorf("discord notifier needs a url")
+		}
+		return discordNotifier{url: c.URL}, nil
+	case "smtp":
+		if c.SMTPAddr == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("smtp notifier needs smtp_addr, from and to")
+		}
+		return smtpNotifier{c}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type %q", c.Type)
+}
+
+// postJSON sends body to url and treats any non-2xx answer as a failure.
+func postJSON(ctx context.Context, url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+// webhookNotifier posts the alert as JSON to any URL.
+type webhookNotifier struct{ url string }
+
+func (n webhookNotifier) Notify(ctx context.Context, a Alert) error {
+	return postJSON(ctx, n.url, a)
+}
+
+// slackNotifier posts to a Slack incoming webhook.
+type slackNotifier struct{ url string }
+
+func (n slackNotifier) Notify(ctx context.Context, a Alert) error {
+	return postJSON(ctx, n.url, map[string]string{"text": a.String()})
+}
+
+// discordNotifier posts to a Discord channel webhook.
+type discordNotifier struct{ url string }
+
+func (n discordNotifier) Notify(ctx context.Context, a Alert) error {
+	return postJSON(ctx, n.url, map[string]string{"content": a.String()})
+}
+
+// smtpNotifier emails the alert.
+type smtpNotifier struct{ c NotifierConfig }
+
+func (n smtpNotifier) Notify(ctx context.Context, a Alert) error {
+	var auth smtp.Auth
+	if n.c.Username != "" {
+		host := strings.Split(n.c.SMTPAddr, ":")[0]
+		auth = smtp.PlainAuth("", n.c.Username, n.c.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n",
+		n.c.From, strings.Join(n.c.To, ", "), a.String(), a.Message)
+
+	// net/smtp takes no context, so give up waiting on it instead
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(n.c.SMTPAddr, auth, n.c.From, n.c.To, []byte(msg))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+/*
+#cgo pkg-config: opus
+#include <opus.h>
+
+static int radio_encoder_set_vbr(void *st, opus_int32 vbr)
+{
+	return opus_encoder_ctl((OpusEncoder *)st, OPUS_SET_VBR(vbr));
+}
+
+static int radio_encoder_set_vbr_constraint(void *st, opus_int32 constrained)
+{
+	return opus_encoder_ctl((OpusEncoder *)st, OPUS_SET_VBR_CONSTRAINT(constrained));
+}
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+// The pinned opus.v2 has no setters for VBR, so these call opus_encoder_ctl
+// on the encoder's state directly. opus.Encoder starts with its
+// *OpusEncoder, which points into a []byte on the Go heap, so passing it to
+// C is allowed. Check the layout again when bumping opus.v2.
+
+func opusState(enc *opus.Encoder) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(enc))
+}
+
+func boolInt(b bool) C.opus_int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// setVBR switches the encoder between variable and constant bitrate.
+func setVBR(enc *opus.Encoder, vbr bool) error {
+	if res := C.radio_encoder_set_vbr(opusState(enc), boolInt(vbr)); res != C.OPUS_OK {
+		return opus.Error(res)
+	}
+	return nil
+}
+
+// setVBRConstraint keeps variable bitrate packets close to the bitrate.
+func setVBRConstraint(enc *opus.Encoder, constrained bool) error {
+	if res := C.radio_encoder_set_vbr_constraint(opusState(enc), boolInt(constrained)); res != C.OPUS_OK {
+		return opus.Error(res)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+// Validation modes for encoded packets.
+const (
+	validateOff    = "off"    // don't inspect packets
+	validateLog    = "log"    // log anomalies but send packets unchanged
+	validateDrop   = "drop"   // drop anomalous packets
+	validateRepair = "repair" // replace anomalous packets with encoded silence
+)
+
+// opusPacketInfo is what the TOC byte (RFC 6716 section 3.1) says about a
+// packet.
+type opusPacketInfo struct {
+	config   int
+	stereo   bool
+	frames   int
+	duration time.Duration
+}
+
+// Frame sizes per TOC config, in units of 100µs.
+var opusFrameSizes = [32]int{
+	100, 200, 400, 600, 100, 200, 400, 600, 100, 200, 400, 600, // SILK NB/MB/WB
+	100, 200, 100, 200, // Hybrid SWB/FB
+	25, 50, 100, 200, 25, 50, 100, 200, 25, 50, 100, 200, 25, 50, 100, 200, // CELT NB/WB/SWB/FB
+}
+
+// encodeSilence returns one frame of digital silence encoded with a throwaway
+// encoder, used to stand in for packets that fail validation.
+func encodeSilence(sampleRate, channels, samplesPerFrame int) ([]byte, error) {
+	enc, err := opus.NewEncoder(sampleRate, channels, opus.AppAudio)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4000)
+	n, err := enc.Encode(make([]int16, samplesPerFrame*channels), buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func parseOpusTOC(packet []byte) (opusPacketInfo, error) {
+	if len(packet) == 0 {
+		return opusPacketInfo{}, errors.New("empty packet")
+	}
+
+	toc := packet[0]
+	info := opusPacketInfo{
+		config: int(toc >> 3),
+		stereo: toc&0x04 != 0,
+	}
+
+	switch toc & 0x03 {
+	case 0:
+		info.frames = 1
+	case 1, 2:
+		info.frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return info, errors.New("code 3 packet missing frame count byte")
+		}
+		info.frames = int(packet[1] & 0x3f)
+		if info.frames == 0 {
+			return info, errors.New("code 3 packet with zero frames")
+		}
+	}
+
+	info.duration = time.Duration(info.frames*opusFrameSizes[info.config]) * 100 * time.Microsecond
+	if info.duration > 120*time.Millisecond {
+		return info, fmt.Errorf("packet duration %v exceeds 120ms", info.duration)
+	}
+	return info, nil
+}
+
+// opusValidator checks every encoded packet against what the encoder was
+// configured to produce before it reaches WriteSample. Misconfiguration then
+// shows up in the logs instead of as garbled audio on the clients.
+type opusValidator struct {
+	mode          string
+	frameDuration time.Duration
+	channels      int
+	silence       []byte
+
+	checked   atomic.Uint64
+	anomalies atomic.Uint64
+	lastLog   time.Time
+}
+
+func newOpusValidator(mode string, frameDuration time.Duration, channels int, silence []byte) *opusValidator {
+	return &opusValidator{
+		mode:          mode,
+		frameDuration: frameDuration,
+		channels:      channels,
+		silence:       silence,
+	}
+}
+
+func (v *opusValidator) inspect(packet []byte) error {
+	info, err := parseOpusTOC(packet)
+	if err != nil {
+		return err
+	}
+	if info.duration != v.frameDuration {
+		return fmt.Errorf("packet is %v, expected %v (config %d, %d frames)", info.duration, v.frameDuration, info.config, info.frames)
+	}
+	// libopus may code a stereo stream as mono when the input is mono, but
+	// a stereo packet from a mono encoder means the encoder is misconfigured.
+	if info.stereo && v.channels == 1 {
+		return errors.New("stereo packet from a mono encoder")
+	}
+	return nil
+}
+
+// check returns the packet to send in place of packet, or nil when it should
+// be dropped.
+func (v *opusValidator) check(packet []byte) []byte {
+	if v == nil || v.mode == validateOff {
+		return packet
+	}
+
+	v.checked.Add(1)
+	err := v.inspect(packet)
+	if err == nil {
+		return packet
+	}
+
+	n := v.anomalies.Add(1)
+	// Log at most once per second so a persistent fault doesn't flood the log
+	if time.Since(v.lastLog) > time.Second {
+		v.lastLog = time.Now()
+		log.Printf("Opus packet anomaly (%d of %d packets so far): %v", n, v.checked.Load(), err)
+		status.Publish("opus_anomaly", map[string]interface{}{
+			"error":     err.Error(),
+			"anomalies": n,
+			"checked":   v.checked.Load(),
+			"mode":      v.mode,
+		})
+	}
+
+	switch v.mode {
+	case validateDrop:
+		return nil
+	case validateRepair:
+		return v.silence
+	}
+	return packet
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// The pacer ticks by the server's clock and the generator writes by its
+// own, so even with matching sample rates one runs a little faster than the
+// other: a hundred parts per million is enough to drain or fill the ingest
+// buffer over a few hours, ending in underruns or in listeners hearing the
+// full latency budget. The pacing corrector watches how full the buffer is
+// on average and nudges the pacer's period, a step at a time, until the
+// fill holds steady around the pre-roll. The nudges are bounded
+// by pacingMaxPPM, far below what a listener's jitter buffer absorbs.
+
+const (
+	pacingWindow  = 10 * time.Second // the fill is averaged over this long
+	pacingStepPPM = 50               // how far one window may move the period
+	pacingMaxPPM  = 5000             // 0.5%
+)
+
+var pacingCorrection = newGauge("radio_pacer_correction_ppm", "How much faster than nominal the pacer ticks to follow the generator's clock, in parts per million.")
+
+// pacingCorrector is only used from the pacing loop.
+type pacingCorrector struct {
+	enabled bool
+	frame   time.Duration
+	window  int     // frames per window
+	target  float64 // frames the buffer should hold
+	full    float64 // a fill this high is the generator blocked on a full buffer
+
+	sum   float64
+	count int
+	ppm   float64 // positive ticks faster
+}
+
+func newPacingCorrector(enabled bool, plan latencyPlan, frame time.Duration) *pacingCorrector {
+	return &pacingCorrector{
+		enabled: enabled,
+		frame:   frame,
+		window:  int(pacingWindow / frame),
+		target:  float64(plan.PrerollFrames),
+		full:    float64(plan.IngestFrames) - 0.5,
+	}
+}
+
+// observe records the fill for one live frame. It returns the pacer's new
+// period when it changes, or 0.
+func (p *pacingCorrector) observe(queued int) time.Duration {
+	if !p.enabled {
+		return 0
+	}
+	p.sum += float64(queued)
+	p.count++
+	if p.count < p.window {
+		return 0
+	}
+	fill := p.sum / float64(p.count)
+	p.reset()
+
+	prev := p.ppm
+	switch {
+	case fill >= p.full:
+		// A generator that runs ahead is held back by the full buffer and
+		// needs no help; let any correction wear off
+		p.ppm -= math.Copysign(math.Min(math.Abs(p.ppm), pacingStepPPM), p.ppm)
+	case fill > p.target+1:
+		p.ppm = math.Min(p.ppm+pacingStepPPM, pacingMaxPPM)
+	case fill < p.target-1:
+		p.ppm = math.Max(p.ppm-pacingStepPPM, -pacingMaxPPM)
+	}
+	if p.ppm == prev {
+		return 0
+	}
+	pacingCorrection.Set(p.ppm)
+	latency.setCorrection(p.ppm)
+	return time.Duration(float64(p.frame) / (1 + p.ppm/1e6))
+}
+
+// reset starts a new window, after an underrun or while the generator is
+// away. The correction so far is kept.
+func (p *pacingCorrector) reset() {
+	p.sum, p.count = 0, 0
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Audio goes through the server in stages, each on its own goroutine and
+// connected to the next by a short queue:
+//
+//	pipe readers   read the inputs into the ring buffer (stems.go, source.go)
+//	pacer          pops a frame every tick, mixes the stems and fills in
+//	               bootstrap or standby audio (generateAudio)
+//	dsp            effects, processing and everything that measures or
+//	               records the processed audio
+//	encoder        every Opus encoder: the main mix, stem mixes, tiers,
+//	               fade-ins and commentary
+//	writer         sends the packets to the listeners' tracks
+//
+// Only the pacer keeps time. A stage that takes long for a frame delays the
+// frames behind it, and radio_pipeline_stage_seconds shows which stage that
+// was. The pacer never waits for the stages: a frame that finds the queue
+// to the dsp stage full is dropped and counted in
+// radio_pipeline_frames_dropped_total, so a stalled stage costs listeners
+// frames rather than stopping the clock.
+
+const (
+	pipelineDepth = 2    // frames queued between two stages
+	opusMaxPacket = 4000 // a safe, large buffer for one Opus packet
+)
+
+var pipelineStageTime = newHistogram("radio_pipeline_stage_seconds", "Time each audio pipeline stage spends on a frame, by stage.",
+	[]float64{0.0005, 0.001, 0.002, 0.005, 0.01, 0.02, 0.05})
+
+var pipelineDropped = newCounter("radio_pipeline_frames_dropped_total", "Frames the pacer dropped because the pipeline was still busy with earlier ones.")
+
+// opusBytes holds the encoded packets between the encoder and the writer.
+var opusBytes slicePool[byte]
+
+// pipelineFrame is one tick's audio on its way from the pacer to the
+// encoder. Its buffers come from pcmSamples and go back there once it is
+// encoded.
+type pipelineFrame struct {
+	pcm     []int16   // the main mix; nil on a tick without audio
+	mixes   [][]int16 // one per stem mix, in the variants' order
+	standby bool      // standby audio rather than the generator's
+}
+
+// release returns the frame's buffers to pcmSamples.
+func (f *pipelineFrame) release() {
+	if f.pcm != nil {
+		pcmSamples.put(f.pcm)
+	}
+	for _, m := range f.mixes {
+		pcmSamples.put(m)
+	}
+	f.pcm, f.mixes = nil, nil
+}
+
+// encodedFrame is one tick's output of the encoder.
+type encodedFrame struct {
+	main     []byte // the main feed's packet, nil if there is none
+	standby  bool
+	transmit bool // false while DTX holds the station's feeds back
+	packets  []feedPacket
+	// Feed switches that must land between two frames, so a listener
+	// neither misses a frame nor gets one twice
+	before, after []func()
+	bufs          [][]byte // from opusBytes, holding the packets
+}
+
+type feedPacket struct {
+	feed   string
+	packet []byte
+}
+
+var encodedFrames = sync.Pool{New: func() any { return new(encodedFrame) }}
+
+// encode encodes pcm with enc and returns the packet as validator passes it,
+// which may be nil.
+func (f *encodedFrame) encode(enc *hotEncoder, pcm []int16, validator *opusValidator) ([]byte, error) {
+	buf := opusBytes.get(opusMaxPacket)
+	f.bufs = append(f.bufs, buf)
+	n, err := enc.Encode(pcm, buf)
+	if err != nil {
+		return nil, err
+	}
+	return validator.check(buf[:n]), nil
+}
+
+// send queues packet for feed, unless it is nil or DTX holds the frame back.
+func (f *encodedFrame) send(feed string, packet []byte) {
+	if packet != nil && f.transmit {
+		f.packets = append(f.packets, feedPacket{feed: feed, packet: packet})
+	}
+}
+
+// release returns the frame and its buffers to their pools.
+func (f *encodedFrame) release() {
+	for _, b := range f.bufs {
+		opusBytes.put(b)
+	}
+	clear(f.bufs)
+	clear(f.packets)
+	clear(f.before)
+	clear(f.after)
+	*f = encodedFrame{bufs: f.bufs[:0], packets: f.packets[:0], before: f.before[:0], after: f.after[:0]}
+	encodedFrames.Put(f)
+}
+
+// pipeline holds the stages after the pacer. Each field belongs to the
+// stage it is listed under.
+type pipeline struct {
+	channels        int
+	samplesPerFrame int
+	frameDuration   time.Duration
+
+	// dsp
+	dsp      *dspChain
+	mixPCM   [][]int16 // every mix of the frame, for effects played over all of them
+	loudness *loudnessMeter
+	beats    *beatTracker
+
+	// encoder
+	encoder    *hotEncoder
+	variants   []*mixVariant
+	tiers      []*qualityTier
+	fades      *fadePool
+	commentary *commentaryBus
+	validator  *opusValidator
+	dtx        *silenceGate
+
+	toDSP     chan *pipelineFrame
+	toEncoder chan *pipelineFrame
+	toWriter  chan *encodedFrame
+}
+
+// start runs the stages on their own goroutines.
+func (p *pipeline) start() {
+	p.toDSP = make(chan *pipelineFrame, pipelineDepth)
+	p.toEncoder = make(chan *pipelineFrame, pipelineDepth)
+	p.toWriter = make(chan *encodedFrame, pipelineDepth)
+	go p.runDSP()
+	go p.runEncoder()
+	go p.runWriter()
+}
+
+// newFrame returns a frame with buffers for the main mix and every stem
+// mix.
+func (p *pipeline) newFrame() *pipelineFrame {
+	f := &pipelineFrame{pcm: pcmSamples.get(p.samplesPerFrame * p.channels)}
+	for range p.variants {
+		f.mixes = append(f.mixes, pcmSamples.get(len(f.pcm)))
+	}
+	return f
+}
+
+// queue hands f from the pacer to the dsp stage. If the stage is still busy
+// with the frames before it, f is dropped instead and queue returns false.
+func (p *pipeline) queue(f *pipelineFrame) bool {
+	select {
+	case p.toDSP <- f:
+		return true
+	default:
+		f.release()
+		pipelineDropped.Inc()
+		return false
+	}
+}
+
+func (p *pipeline) runDSP() {
+	for f := range p.toDSP {
+		if f.pcm != nil {
+			start := time.Now()
+			taps.pcm(tapPostIngest, f.pcm)
+			p.mixPCM = append(append(p.mixPCM[:0], f.pcm), f.mixes...)
+			transitions.mix(p.mixPCM...)
+			p.dsp.process(f.pcm)
+			taps.pcm(tapPostDSP, f.pcm)
+			archive.Record(f.pcm)
+			waveforms.Record(f.pcm)
+			p.loudness.add(f.pcm)
+			p.beats.add(f.pcm)
+			measureLightLevel(f.pcm)
+			for i, v := range p.variants {
+				v.dsp.process(f.mixes[i])
+			}
+			pipelineStageTime.Observe(time.Since(start).Seconds(), "stage", "dsp")
+		}
+		p.toEncoder <- f
+	}
+}
+
+func (p *pipeline) runEncoder() {
+	for f := range p.toEncoder {
+		start := time.Now()
+		out := encodedFrames.Get().(*encodedFrame)
+		if p.commentary != nil {
+			p.commentary.encode(out)
+		}
+		if f.pcm != nil {
+			p.encode(f, out)
+			f.release()
+		}
+		pipelineStageTime.Observe(time.Since(start).Seconds(), "stage", "encoder")
+		p.toWriter <- out
+	}
+}
+
+// encode encodes one frame of audio for every feed.
+func (p *pipeline) encode(f *pipelineFrame, out *encodedFrame) {
+	// Pick up encoder settings changed since the last frame. This never
+	// interrupts the stream, see hotEncoder.
+	select {
+	case <-encoderChanged:
+		if err := p.encoder.Reconfigure(effectiveEncoderConfig()); err != nil {
+			log.Printf("Error reconfiguring Opus encoder: %v", err)
+		}
+		for _, v := range p.variants {
+			if err := v.encoder.Reconfigure(effectiveEncoderConfig()); err != nil {
+				log.Printf("Error reconfiguring Opus encoder for mix %s: %v", v.name, err)
+			}
+		}
+		for _, t := range p.tiers {
+			t.reconfigure()
+		}
+		if p.fades != nil {
+			p.fades.reconfigure(effectiveEncoderConfig())
+		}
+		p.dtx.enabled = effectiveEncoderConfig().DTX
+	default:
+	}
+
+	// Every encoder still sees every frame, but silent ones may not be sent
+	out.transmit = p.dtx.transmit(f.pcm)
+	out.standby = f.standby
+
+	// Alternative stem mixes go out on their own feeds
+	for i, v := range p.variants {
+		v.encode(out, f.mixes[i], p.validator)
+	}
+
+	packet, err := out.encode(p.encoder, f.pcm, p.validator)
+	if err == nil {
+		err = chaos.encode()
+	}
+	if err != nil {
+		log.Printf("Error encoding to Opus: %v", err)
+		run.error("encoder")
+		return
+	}
+	run.framesEncoded.Add(1)
+	if packet == nil {
+		return
+	}
+	out.main = packet
+
+	// Lower quality tiers of the same audio
+	for _, t := range p.tiers {
+		t.encode(out, f.pcm, p.validator)
+	}
+
+	// New listeners rising from silence, see fadein.go
+	if p.fades != nil {
+		p.fades.admit(out)
+		p.fades.encode(out, f.pcm, p.validator)
+	}
+}
+
+func (p *pipeline) runWriter() {
+	for f := range p.toWriter {
+		start := time.Now()
+		for _, fn := range f.before {
+			fn()
+		}
+		if f.main != nil {
+			taps.packet(f.main, p.samplesPerFrame)
+			// The fan-out handles RTP sequencing and timestamps per
+			// listener.
+			if f.transmit {
+				broadcast.Write(mainFeed, f.main, p.frameDuration)
+			}
+			if !f.standby {
+				markFrame()
+			}
+		}
+		for _, pkt := range f.packets {
+			broadcast.Write(pkt.feed, pkt.packet, p.frameDuration)
+		}
+		for _, fn := range f.after {
+			fn()
+		}
+		pipelineStageTime.Observe(time.Since(start).Seconds(), "stage", "writer")
+		f.release()
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacerDropsFramesWhenDSPStalls(t *testing.T) {
+	// No dsp stage reads the queue, as if it were stuck on a frame
+	p := &pipeline{channels: 2, samplesPerFrame: 960, variants: make([]*mixVariant, 1), toDSP: make(chan *pipelineFrame, pipelineDepth)}
+	for i := 0; i < pipelineDepth; i++ {
+		if !p.queue(p.newFrame()) {
+			t.Fatalf("frame %d dropped with room in the queue", i)
+		}
+	}
+
+	before := pipelineDropped.values[""]
+	f := p.newFrame()
+	done := make(chan bool)
+	go func() { done <- p.queue(f) }()
+	select {
+	case queued := <-done:
+		if queued {
+			t.Error("a full queue took another frame")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the pacer blocked on a stalled dsp stage")
+	}
+	if got := pipelineDropped.values[""] - before; got != 1 {
+		t.Errorf("radio_pipeline_frames_dropped_total went up by %v, want 1", got)
+	}
+	if f.pcm != nil || f.mixes != nil {
+		t.Error("the dropped frame's buffers weren't returned to the pool")
+	}
+	if len(p.toDSP) != pipelineDepth {
+		t.Errorf("queue holds %d frames, want %d", len(p.toDSP), pipelineDepth)
+	}
+}
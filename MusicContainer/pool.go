@@ -0,0 +1,43 @@
+package main
+
+import "sync"
+
+// Every frame of PCM is read into a fresh buffer, handed from the input
+// goroutines to the pacing loop, mixed into another that goes through the
+// pipeline stages, and copied again for the archive and the live waveform,
+// fifty times a second. Those buffers come from pools so the garbage
+// collector doesn't have to keep pace with the frame rate. Whoever uses a
+// buffer last puts it back; one that is never put back is simply collected.
+
+var (
+	pcmBytes   slicePool[byte]  // raw frames from the inputs to the pacing loop
+	pcmSamples slicePool[int16] // frames between the pipeline stages, and copies for the archive and waveform
+)
+
+// slicePool reuses slices of T. A pooled slice that is too small for a
+// request is dropped for a new one, so a pool can serve frames of any size.
+type slicePool[T any] struct {
+	pool sync.Pool
+}
+
+// get returns a slice of length n with undefined contents.
+func (p *slicePool[T]) get(n int) []T {
+	if b, ok := p.pool.Get().(*[]T); ok && cap(*b) >= n {
+		return (*b)[:n]
+	}
+	return make([]T, n)
+}
+
+// clone returns a pooled copy of s.
+func (p *slicePool[T]) clone(s []T) []T {
+	b := p.get(len(s))
+	copy(b, s)
+	return b
+}
+
+// put returns b to the pool. Nothing may use it afterwards.
+func (p *slicePool[T]) put(b []T) {
+	if cap(b) > 0 {
+		p.pool.Put(&b)
+	}
+}
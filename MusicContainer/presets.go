@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+const (
+	presetFormat  = "infiniteradio.preset"
+	presetVersion = 1
+)
+
+// Preset is a shareable "sound pack": a prompt template plus the DSP and
+// encoder settings that go with it. Sections are kept as the bundle wrote
+// them and laid over the station's current settings when the preset is
+// installed, so sections and fields left out of a bundle keep their current
+// values.
+type Preset struct {
+	Format      string          `json:"format"`
+	Version     int             `json:"version"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Author      string          `json:"author,omitempty"`
+	Prompt      json.RawMessage `json:"prompt,omitempty"`
+	DSP         json.RawMessage `json:"dsp,omitempty"`
+	Encoder     json.RawMessage `json:"encoder,omitempty"`
+}
+
+// presetSettings are the settings a preset installs.
+type presetSettings struct {
+	prompt  PromptConfig
+	dsp     DSPConfig
+	encoder EncoderConfig
+}
+
+var presetNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+func (p *Preset) validate() error {
+	if p.Format != presetFormat {
+		return fmt.Errorf("unknown format %q, expected %q", p.Format, presetFormat)
+	}
+	if p.Version < 1 || p.Version > presetVersion {
+		return fmt.Errorf("unsupported preset version %d", p.Version)
+	}
+	if !presetNamePattern.MatchString(p.Name) {
+		return fmt.Errorf("invalid preset name %q (lowercase letters, digits, - and _)", p.Name)
+	}
+	s, err := p.settings()
+	if err != nil {
+		return err
+	}
+	if p.DSP != nil {
+		if err := s.dsp.validate(); err != nil {
+			return fmt.Errorf("dsp: %w", err)
+		}
+	}
+	if p.Encoder != nil {
+		if err := s.encoder.validate(); err != nil {
+			return fmt.Errorf("encoder: %w", err)
+		}
+	}
+	return nil
+}
+
+// settings lays the preset's sections over the station's current settings.
+func (p *Preset) settings() (s presetSettings, err error) {
+	if s.prompt, err = overlay(currentPromptConfig(), p.Prompt); err != nil {
+		return s, fmt.Errorf("prompt: %w", err)
+	}
+	if s.dsp, err = overlay(currentDSPConfig(), p.DSP); err != nil {
+		return s, fmt.Errorf("dsp: %w", err)
+	}
+	if s.encoder, err = overlay(currentEncoderConfig(), p.Encoder); err != nil {
+		return s, fmt.Errorf("encoder: %w", err)
+	}
+	return s, nil
+}
+
+// overlay decodes section over a copy of current, so the fields section
+// leaves out keep their current values. Objects are merged the same way,
+// field by field or key by key; lists are replaced. The copy goes through
+// JSON so the maps current shares with the live settings aren't touched.
+func overlay[T any](current T, section json.RawMessage) (T, error) {
+	var out T
+	data, err := json.Marshal(current)
+	if err != nil {
+		return out, err
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return out, err
+	}
+	if section != nil {
+		err = json.Unmarshal(section, &out)
+	}
+	return out, err
+}
+
+// install makes the preset's settings live on the running station.
+func (p *Preset) install() error {
+	s, err := p.settings()
+	if err != nil {
+		return err
+	}
+	if p.Prompt != nil {
+		setPromptConfig(s.prompt)
+		// Re-send the current genre so the new template is heard right away
+		if err := arbiter.Reapply(); err != nil {
+			log.Printf("Error writing genre file: %v", err)
+		}
+	}
+	if p.DSP != nil {
+		setDSPConfig(s.dsp)
+	}
+	if p.Encoder != nil {
+		setEncoderConfig(s.encoder)
+	}
+	log.Printf("Installed preset %q", p.Name)
+	return nil
+}
+
+// currentPreset captures the live station settings as a bundle.
+func currentPreset(name string) *Preset {
+	prompt, _ := json.Marshal(currentPromptConfig())
+	dsp, _ := json.Marshal(currentDSPConfig())
+	encoder, _ := json.Marshal(currentEncoderConfig())
+	return &Preset{
+		Format:  presetFormat,
+		Version: presetVersion,
+		Name:    name,
+		Prompt:  prompt,
+		DSP:     dsp,
+		Encoder: encoder,
+	}
+}
+
+func presetPath(name string) string {
+	return filepath.Join(cfg.PresetDir, name+".json")
+}
+
+func loadPreset(name string) (*Preset, error) {
+	if !presetNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid preset name %q", name)
+	}
+	data, err := os.ReadFile(presetPath(name))
+	if err != nil {
+		return nil, err
+	}
+	var p Preset
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parsing preset %s: %w", name, err)
+	}
+	return &p, nil
+}
+
+func savePreset(p *Preset) error {
+	if err := os.MkdirAll(cfg.PresetDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(presetPath(p.Name), data, 0644)
+}
+
+func listPresets() ([]*Preset, error) {
+	matches, err := filepath.Glob(filepath.Join(cfg.PresetDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	presets := make([]*Preset, 0, len(matches))
+	for _, m := range matches {
+		name := filepath.Base(m)
+		p, err := loadPreset(name[:len(name)-len(".json")])
+		if err != nil {
+			log.Printf("Skipping preset %s: %v", m, err)
+			continue
+		}
+		presets = append(presets, p)
+	}
+	return presets, nil
+}
+
+func handleListPresets(w http.ResponseWriter, r *http.Request) {
+	presets, err := listPresets()
+	if err != nil {
+		log.Printf("Error listing presets: %v", err)
+		http.Error(w, "Failed to list presets", http.StatusInternalServerError)
+		return
+	}
+
+	type summary struct {
+		Name        string `json:"name"`
+		Description string `json:"description,omitempty"`
+		Author      string `json:"author,omitempty"`
+	}
+	out := make([]summary, 0, len(presets))
+	for _, p := range presets {
+		out = append(out, summary{Name: p.Name, Description: p.Description, Author: p.Author})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// handleExportPreset returns an installed preset by ?name=, or the station's
+// live settings as a new bundle when no installed preset has that name.
+func handleExportPreset(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = cfg.Station.ID
+	}
+
+	p, err := loadPreset(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p = currentPreset(name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".json"))
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(p)
+}
+
+// handleImportPreset saves a bundle and, unless ?apply=false, installs it.
+func handleImportPreset(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var p Preset
+	if err := json.Unmarshal(body, &p); err != nil {
+		http.Error(w, "Invalid preset: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.validate(); err != nil {
+		http.Error(w, "Invalid preset: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := savePreset(&p); err != nil {
+		log.Printf("Error saving preset %q: %v", p.Name, err)
+		http.Error(w, "Failed to save preset", http.StatusInternalServerError)
+		return
+	}
+
+	applied := r.URL.Query().Get("apply") != "false"
+	if applied {
+		if err := p.install(); err != nil {
+			http.Error(w, "Invalid preset: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"name":    p.Name,
+		"applied": applied,
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPartialPresetKeepsCurrentSettings(t *testing.T) {
+	setPromptConfig(PromptConfig{Template: "{genre} music", Vars: map[string]string{"mood": "mellow"}})
+	setDSPConfig(DSPConfig{GainDB: 3, Compressor: CompressorConfig{Enabled: true, ThresholdDB: -12, Ratio: 3}})
+	setEncoderConfig(EncoderConfig{Bitrate: 128000, Complexity: 8, FEC: true, PacketLossPerc: 5, Application: "audio"})
+
+	var p Preset
+	if err := json.Unmarshal([]byte(`{
+		"format": "infiniteradio.preset", "version": 1, "name": "partial",
+		"prompt": {"vars": {"era": "80s"}},
+		"dsp": {"compressor": {"ratio": 4}},
+		"encoder": {"bitrate": 96000}
+	}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := p.settings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := s.encoder; e.Bitrate != 96000 || e.Complexity != 8 || !e.FEC || e.PacketLossPerc != 5 || e.Application != "audio" {
+		t.Errorf("encoder = %+v, want only the bitrate changed", e)
+	}
+	if d := s.dsp; d.GainDB != 3 || !d.Compressor.Enabled || d.Compressor.ThresholdDB != -12 || d.Compressor.Ratio != 4 {
+		t.Errorf("dsp = %+v, want only the compressor ratio changed", d)
+	}
+	if pr := s.prompt; pr.Template != "{genre} music" || pr.Vars["mood"] != "mellow" || pr.Vars["era"] != "80s" {
+		t.Errorf("prompt = %+v, want the template kept and the var added", pr)
+	}
+	if _, ok := currentPromptConfig().Vars["era"]; ok {
+		t.Error("laying the preset over the live prompt settings changed them")
+	}
+
+	p.Encoder = json.RawMessage(`{"bitrate": 1}`)
+	if err := p.validate(); err == nil {
+		t.Error("a partial section that makes the merged settings invalid passed validation")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// /probe lets the web player measure its connection before it offers:
+//
+//	GET /probe             a tiny JSON reply, timed for the round trip, that
+//	                       also lists the bitrates the station serves
+//	GET /probe?size=262144 that many incompressible bytes, timed for bandwidth
+//
+// The client sends what it measured as "probe" with its offer. The server
+// picks the quality the connection can carry, and the client warns the user
+// when even the lowest one won't fit.
+
+const (
+	probeDefaultSize = 256 << 10
+	probeMaxSize     = 1 << 20
+
+	// A connection should have this much more bandwidth than the stream needs
+	probeHeadroom = 1.5
+)
+
+// probePayload is random so compression on the way can't skew the result.
+var probePayload = func() []byte {
+	b := make([]byte, probeMaxSize)
+	rand.Read(b)
+	return b
+}()
+
+// ProbeResult is what the client measured.
+type ProbeResult struct {
+	DownKbps float64 `json:"down_kbps"`
+	RTTMs    float64 `json:"rtt_ms"`
+}
+
+// neededKbps is the bandwidth a listener needs for bitrate, with headroom.
+func neededKbps(bitrate int) float64 {
+	return float64(perListenerBps(bitrate)) * probeHeadroom / 1000
+}
+
+// pickBitrate returns the highest bitrate the probed connection can carry,
+// or the lowest one when none fits. Without a probe it returns the highest.
+func pickBitrate(p *ProbeResult) int {
+	bitrates := stationBitrates()
+	best := bitrates[0]
+	for _, b := range bitrates {
+		if p == nil || p.DownKbps <= 0 || neededKbps(b) <= p.DownKbps {
+			best = b
+		}
+	}
+	return best
+}
+
+func handleProbe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	sizeParam := r.URL.Query().Get("size")
+	if sizeParam == "" {
+		bitrates := stationBitrates()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"bitrates": bitrates,
+			"min_kbps": neededKbps(bitrates[0]),
+		})
+		return
+	}
+
+	size, err := strconv.Atoi(sizeParam)
+	if err != nil || size <= 0 {
+		size = probeDefaultSize
+	}
+	if size > probeMaxSize {
+		size = probeMaxSize
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.Write(probePayload[:size])
+}
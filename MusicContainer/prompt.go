@@ -0,0 +1,120 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// PromptProcessor turns the genre a listener asked for into the prompt that
+// is actually handed to the generator.
+type PromptProcessor interface {
+	Process(genre string, vars map[string]string) string
+}
+
+// promptChain runs processors in order, feeding each one's output into the
+// next as the {genre} value.
+type promptChain []PromptProcessor
+
+func (c promptChain) Process(genre string, vars map[string]string) string {
+	for _, p := range c {
+		genre = p.Process(genre, vars)
+	}
+	return genre
+}
+
+var placeholderPattern = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
+
+// templateProcessor wraps the genre in the station's prompt template, e.g.
+// "lofi {genre} beats, {mood}, high fidelity".
+type templateProcessor struct {
+	template  string
+	overrides map[string]string
+	defaults  map[string]string
+}
+
+func newTemplateProcessor(c PromptConfig) *templateProcessor {
+	overrides := make(map[string]string, len(c.Overrides))
+	for genre, tmpl := range c.Overrides {
+		overrides[normalizeGenre(genre)] = tmpl
+	}
+	return &templateProcessor{
+		template:  c.Template,
+		overrides: overrides,
+		defaults:  c.Vars,
+	}
+}
+
+func (t *templateProcessor) Process(genre string, vars map[string]string) string {
+	tmpl := t.template
+	if o, ok := t.overrides[normalizeGenre(genre)]; ok {
+		tmpl = o
+	}
+	if tmpl == "" {
+		return genre
+	}
+
+	out := placeholderPattern.ReplaceAllStringFunc(tmpl, func(m string) string {
+		name := m[1 : len(m)-1]
+		if name == "genre" {
+			return genre
+		}
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return t.defaults[name]
+	})
+	return tidyPrompt(out)
+}
+
+// normalizeGenre resolves genre through the taxonomy, so overrides match
+// every name a genre goes by.
+func normalizeGenre(genre string) string {
+	return strings.ToLower(taxonomy.Canonical(genre))
+}
+
+// tidyPrompt cleans up the separators left behind by empty variables, so
+// "lofi jazz, , high fidelity" becomes "lofi jazz, high fidelity".
+func tidyPrompt(s string) string {
+	parts := strings.Split(s, ",")
+	kept := parts[:0]
+	for _, p := range parts {
+		p = strings.Join(strings.Fields(p), " ")
+		if p != "" {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, ", ")
+}
+
+var (
+	promptMu        sync.RWMutex
+	promptConfig    PromptConfig
+	promptProcessor PromptProcessor = promptChain{}
+)
+
+func buildPromptProcessor(c PromptConfig) PromptProcessor {
+	return promptChain{newTemplateProcessor(c)}
+}
+
+func setPromptConfig(c PromptConfig) {
+	p := buildPromptProcessor(c)
+
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	promptConfig = c
+	promptProcessor = p
+}
+
+func currentPromptConfig() PromptConfig {
+	promptMu.RLock()
+	defer promptMu.RUnlock()
+	return promptConfig
+}
+
+// expandPrompt runs the station's prompt processor over a requested genre.
+func expandPrompt(genre string, vars map[string]string) string {
+	promptMu.RLock()
+	defer promptMu.RUnlock()
+	return promptProcessor.Process(genre, vars)
+}
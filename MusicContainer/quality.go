@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Every listener gets a connection quality grade from A to F, worked out
+// from their receiver reports: packet loss, jitter, and how often adaptive
+// bitrate had to move them in the last minute. The grade is pushed over the
+// control channel so players can show a badge, and tallied per network so
+// networks that are bad for every listener on them stand out. With
+// quality.asn_file set (an iptoasn.com TSV) networks are autonomous
+// systems; otherwise they are /24 (IPv4) or /48 (IPv6) prefixes.
+
+const (
+	qualityInterval = 10 * time.Second
+	qualityWindow   = 6 // intervals bitrate switches are counted over
+	maxNetworks     = 10000
+)
+
+// gradeSteps are the worst loss (%), jitter (ms) and bitrate switches each
+// grade from A to D allows. Anything worse is an F.
+var gradeSteps = []struct {
+	lossPct  float64
+	jitterMs float64
+	switches int64
+}{
+	{1, 20, 0},
+	{3, 40, 1},
+	{5, 80, 2},
+	{10, 150, 3},
+}
+
+var grades = []string{"A", "B", "C", "D", "F"}
+
+var listenerGrades = newGauge("radio_listener_grade", "Connected listeners by connection quality grade.")
+
+func qualityGrade(lossPct, jitterMs float64, switches int64) string {
+	for i, step := range gradeSteps {
+		if lossPct <= step.lossPct && jitterMs <= step.jitterMs && switches <= step.switches {
+			return grades[i]
+		}
+	}
+	return grades[len(grades)-1]
+}
+
+// QualityGrade is the quality.grade notification.
+type QualityGrade struct {
+	Grade    string  `json:"grade"`
+	LossPct  float64 `json:"loss_pct"`
+	JitterMs float64 `json:"jitter_ms"`
+	Switches int64   `json:"switches"` // bitrate changes in the last minute
+}
+
+// jitterMs is the interarrival jitter from the latest receiver report.
+func (s *session) jitterMs() float64 {
+	return float64(s.jitter.Load()) * 1000 / opusClockRate
+}
+
+// regrade works out the session's grade and tells the client if it changed.
+// It is only called from runQuality.
+func (s *session) regrade(control *controlChannel) string {
+	s.switchLog = append(s.switchLog, s.bitrateSwitches.Load())
+	if len(s.switchLog) > qualityWindow+1 {
+		s.switchLog = s.switchLog[1:]
+	}
+	q := QualityGrade{
+		LossPct:  float64(s.fractionLost.Load()) * 100 / 256,
+		JitterMs: s.jitterMs(),
+		Switches: s.switchLog[len(s.switchLog)-1] - s.switchLog[0],
+	}
+	q.Grade = qualityGrade(q.LossPct, q.JitterMs, q.Switches)
+
+	if old, _ := s.grade.Swap(q.Grade).(string); old != q.Grade {
+		if old != "" {
+			log.Printf("Session %s quality went from %s to %s", s.id, old, q.Grade)
+		}
+		if control != nil && control.hasCapability("quality") {
+			control.Notify("quality.grade", q)
+		}
+	}
+	return q.Grade
+}
+
+func runQuality() {
+	for range time.Tick(qualityInterval) {
+		type graded struct {
+			s       *session
+			control *controlChannel
+		}
+		sessions.mu.Lock()
+		var live []graded
+		for _, s := range sessions.sessions {
+			// Only grade listeners that have sent a receiver report
+			if s.state == webrtc.PeerConnectionStateConnected && s.lastSeen.Load() > 0 {
+				live = append(live, graded{s, s.control})
+			}
+		}
+		sessions.mu.Unlock()
+
+		counts := make(map[string]int)
+		for _, g := range live {
+			grade := g.s.regrade(g.control)
+			counts[grade]++
+			if g.s.network == "" {
+				g.s.network = networkOf(g.s.remote)
+			}
+			networkQuality.add(g.s.network, grade)
+		}
+		for _, grade := range grades {
+			listenerGrades.Set(float64(counts[grade]), "grade", grade)
+		}
+	}
+}
+
+// NetworkQuality is one network's line in /quality/networks. Each listener
+// adds a sample every ten seconds.
+type NetworkQuality struct {
+	Network string           `json:"network"`
+	Samples int64            `json:"samples"`
+	Grades  map[string]int64 `json:"grades"`
+	// BadPct is the share of samples graded D or F.
+	BadPct float64 `json:"bad_pct"`
+}
+
+type networkTally struct {
+	mu       sync.Mutex
+	networks map[string]*NetworkQuality
+}
+
+var networkQuality = &networkTally{networks: make(map[string]*NetworkQuality)}
+
+func (t *networkTally) add(network, grade string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.networks[network]
+	if n == nil {
+		if len(t.networks) >= maxNetworks {
+			network = "other"
+			n = t.networks[network]
+		}
+		if n == nil {
+			n = &NetworkQuality{Network: network, Grades: make(map[string]int64)}
+			t.networks[network] = n
+		}
+	}
+	n.Samples++
+	n.Grades[grade]++
+}
+
+// List returns the networks with at least min samples, worst first.
+func (t *networkTally) List(min int64) []NetworkQuality {
+	t.mu.Lock()
+	out := make([]NetworkQuality, 0, len(t.networks))
+	for _, n := range t.networks {
+		if n.Samples < min {
+			continue
+		}
+		c := *n
+		c.Grades = make(map[string]int64, len(n.Grades))
+		for g, v := range n.Grades {
+			c.Grades[g] = v
+		}
+		c.BadPct = float64(c.Grades["D"]+c.Grades["F"]) * 100 / float64(c.Samples)
+		out = append(out, c)
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].BadPct != out[j].BadPct {
+			return out[i].BadPct > out[j].BadPct
+		}
+		return out[i].Samples > out[j].Samples
+	})
+	return out
+}
+
+// asnRange is one line of an iptoasn.com table.
+type asnRange struct {
+	start, end netip.Addr
+	name       string // "AS3320 DTAG"
+}
+
+var asnTable []asnRange
+
+// loadASNTable reads an iptoasn.com TSV (ip2asn-v4.tsv, ip2asn-combined.tsv):
+// range start, range end, AS number, country, AS description.
+func loadASNTable(path string) ([]asnRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var table []asnRange
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) < 5 {
+			continue
+		}
+		asn, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad AS number %q", line, fields[2])
+		}
+		if asn == 0 {
+			continue // not routed
+		}
+		start, err1 := netip.ParseAddr(fields[0])
+		end, err2 := netip.ParseAddr(fields[1])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("line %d: bad address range", line)
+		}
+		table = append(table, asnRange{start: start, end: end, name: fmt.Sprintf("AS%d %s", asn, fields[4])})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(table, func(i, j int) bool { return table[i].start.Less(table[j].start) })
+	return table, nil
+}
+
+var networkCache = newTTLCache[string, string]("network", time.Hour, maxNetworks)
+
+// networkOf names the network a listener's address belongs to.
+func networkOf(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	network, _ := networkCache.GetOrLoad(host, func() (string, error) {
+		return lookupNetwork(host), nil
+	})
+	return network
+}
+
+func lookupNetwork(host string) string {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "unknown"
+	}
+	addr = addr.Unmap()
+
+	if len(asnTable) > 0 {
+		i := sort.Search(len(asnTable), func(i int) bool { return addr.Less(asnTable[i].start) }) - 1
+		if i >= 0 && asnTable[i].end.Compare(addr) >= 0 {
+			return asnTable[i].name
+		}
+		return "unknown"
+	}
+	bits := 24
+	if addr.Is6() {
+		bits = 48
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+func startQuality(c QualityConfig) {
+	if c.ASNFile != "" {
+		table, err := loadASNTable(c.ASNFile)
+		if err != nil {
+			log.Printf("Error loading ASN table, grouping listeners by prefix: %v", err)
+		} else {
+			asnTable = table
+			log.Printf("Loaded %d AS ranges from %s", len(table), c.ASNFile)
+		}
+	}
+	go runQuality()
+}
+
+// handleQualityNetworks lists networks by connection quality, worst first.
+// ?min= skips networks with fewer samples (default 30, five minutes of one
+// listener).
+func handleQualityNetworks(w http.ResponseWriter, r *http.Request) {
+	min := int64(30)
+	if v, err := strconv.ParseInt(r.URL.Query().Get("min"), 10, 64); err == nil {
+		min = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(networkQuality.List(min))
+}
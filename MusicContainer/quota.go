@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Over-quota behaviours.
+const (
+	overQuotaReject   = "reject"   // turn the listener away
+	overQuotaDegrade  = "degrade"  // lower the bitrate for everyone to fit the egress cap
+	overQuotaWaitlist = "waitlist" // queue the listener until a slot frees up
+)
+
+const (
+	// A waitlisted listener that stops retrying loses its place after this.
+	waitlistTimeout = 30 * time.Second
+	waitlistRetry   = 5 * time.Second
+
+	// Turned away listeners are told to come back when a slot should be
+	// free, going by how often listeners have left recently.
+	departureWindow = 15 * time.Minute
+	maxDepartures   = 100
+	fullRetry       = 30 * time.Second // too few departures to go by
+	minFullRetry    = 5 * time.Second
+	maxFullRetry    = 10 * time.Minute
+)
+
+// listenerCap is station.quota.max_listeners, which can be changed at
+// runtime through /api/listeners/cap. 0 means no cap.
+var listenerCap atomic.Int64
+
+// departures are when the most recent listeners left, oldest first.
+var departures struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func recordDeparture(at time.Time) {
+	departures.mu.Lock()
+	defer departures.mu.Unlock()
+	departures.times = append(departures.times, at)
+	if len(departures.times) > maxDepartures {
+		departures.times = departures.times[1:]
+	}
+}
+
+// estimatedWait guesses how long until position slots have freed up, from
+// the average time between recent departures.
+func estimatedWait(position int) time.Duration {
+	now := time.Now()
+	departures.mu.Lock()
+	var recent []time.Time
+	for _, t := range departures.times {
+		if now.Sub(t) < departureWindow {
+			recent = append(recent, t)
+		}
+	}
+	departures.mu.Unlock()
+	if len(recent) < 3 {
+		return fullRetry
+	}
+	gap := now.Sub(recent[0]) / time.Duration(len(recent))
+	wait := gap * time.Duration(position)
+	if wait < minFullRetry {
+		return minFullRetry
+	}
+	if wait > maxFullRetry {
+		return maxFullRetry
+	}
+	return wait
+}
+
+var (
+	quotaRejections = newCounter("radio_quota_rejections_total", "Offers turned away by station quotas.")
+	bitrateCapGauge = newGauge("radio_bitrate_cap_bps", "Bitrate cap applied by the egress quota, 0 when uncapped.")
+	encoderGauge    = newGauge("radio_encoders", "Opus encoders running for the station.")
+	_               = newGaugeFunc("radio_listeners", "Connected listener sessions.", func() float64 {
+		return float64(sessions.Count())
+	})
+	_ = newGaugeFunc("radio_waitlist_length", "Listeners waiting for a slot.", func() float64 {
+		sessions.mu.Lock()
+		defer sessions.mu.Unlock()
+		return float64(len(sessions.waitlist))
+	})
+	_ = newCounterFunc("radio_egress_bytes_total", "Bytes sent to listeners, including packet overhead.", func() float64 {
+		return float64(broadcast.bytesSent.Load())
+	})
+)
+
+type waitlistEntry struct {
+	ticket   string
+	lastSeen time.Time
+}
+
+// admission is the outcome of asking the session manager for a slot.
+type admission struct {
+	session  *session
+	reason   string // why the listener was turned away
+	ticket   string // waitlist ticket to retry with
+	position int    // 1-based place in the waitlist
+	retry    int    // seconds to wait, when rate limited
+}
+
+// perListenerBps estimates the egress one listener costs at bitrate.
+func perListenerBps(bitrate int) int {
+	packetsPerSec := int(time.Second / audioFrame())
+	return bitrate + packetsPerSec*packetOverhead*8
+}
+
+// checkQuota reports whether n listeners fit the station's quota and, if the
+// egress quota forces it, the bitrate cap they need.
+func checkQuota(n int) (ok bool, capBps int, reason string) {
+	q := cfg.Station.Quota
+	if limit := listenerCap.Load(); limit > 0 && int64(n) > limit {
+		return false, 0, "listeners"
+	}
+	if q.MaxEgressBitsPerSec <= 0 || n == 0 {
+		return true, 0, ""
+	}
+
+	bitrate := currentEncoderConfig().Bitrate
+	if int64(n*perListenerBps(bitrate)) <= q.MaxEgressBitsPerSec {
+		return true, 0, ""
+	}
+	if q.OverQuota == overQuotaDegrade {
+		capBps = int(q.MaxEgressBitsPerSec/int64(n)) - perListenerBps(0)
+		if capBps >= q.MinBitrate {
+			return true, capBps, ""
+		}
+	}
+	return false, 0, "egress"
+}
+
+// Admit reserves a session slot for a new listener if the station's quota
+// allows it. ticket is the waitlist ticket from an earlier attempt, if any.
+// Listeners handed off from another server don't queue behind the waitlist.
+func (m *sessionManager) Admit(remote, ticket string, handedOff bool) admission {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	live := m.waitlist[:0]
+	for _, e := range m.waitlist {
+		if now.Sub(e.lastSeen) < waitlistTimeout {
+			live = append(live, e)
+		}
+	}
+	m.waitlist = live
+
+	ok, _, reason := checkQuota(len(m.sessions) + 1)
+	waitlisting := cfg.Station.Quota.OverQuota == overQuotaWaitlist
+
+	// Listeners already waiting go first
+	if ok && waitlisting && !handedOff && len(m.waitlist) > 0 && m.waitlist[0].ticket != ticket {
+		ok, reason = false, "waitlist"
+	}
+
+	if !ok {
+		quotaRejections.Inc("station", cfg.Station.ID, "reason", reason)
+		if !waitlisting {
+			return admission{reason: reason}
+		}
+		for i, e := range m.waitlist {
+			if e.ticket == ticket {
+				e.lastSeen = now
+				return admission{reason: reason, ticket: ticket, position: i + 1}
+			}
+		}
+		e := &waitlistEntry{ticket: newSessionID(), lastSeen: now}
+		m.waitlist = append(m.waitlist, e)
+		return admission{reason: reason, ticket: e.ticket, position: len(m.waitlist)}
+	}
+
+	if waitlisting && len(m.waitlist) > 0 && m.waitlist[0].ticket == ticket {
+		m.waitlist = m.waitlist[1:]
+	}
+
+	if handedOff {
+		handoffListeners.Inc()
+	}
+	s := &session{id: newSessionID(), remote: remote, created: now}
+	m.sessions[s.id] = s
+	go m.rebalance()
+	return admission{session: s}
+}
+
+// rebalance re-applies the egress quota's bitrate cap for the current number
+// of listeners.
+func (m *sessionManager) rebalance() {
+	_, capBps, _ := checkQuota(m.Count())
+	setBitrateCap(capBps)
+	bitrateCapGauge.Set(float64(capBps))
+	if capBps > 0 {
+		log.Printf("Egress quota caps bitrate at %d bps", capBps)
+	}
+}
+
+// writeQuotaRejection answers an offer that didn't fit the station's quota.
+func writeQuotaRejection(w http.ResponseWriter, a admission) {
+	resp, retry := quotaRejection(a)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// quotaRejection describes a rejected admission and when to try again.
+func quotaRejection(a admission) (map[string]interface{}, time.Duration) {
+	resp := map[string]interface{}{
+		"error":  "station_full",
+		"reason": a.reason,
+	}
+	retry := waitlistRetry
+	if a.ticket != "" {
+		resp["waitlist_ticket"] = a.ticket
+		resp["position"] = a.position
+		resp["estimated_wait"] = int(estimatedWait(a.position).Seconds())
+	} else {
+		retry = estimatedWait(1)
+	}
+	resp["retry_after"] = int(retry.Seconds())
+	return resp, retry
+}
+
+// handleListenerCap shows the listener cap on GET and changes it on PUT:
+//
+//	curl -X PUT /api/listeners/cap -d '{"max_listeners": 200}'
+//
+// Lowering it below the current count turns new listeners away but keeps
+// the ones already connected. 0 removes the cap.
+func handleListenerCap(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var req struct {
+			MaxListeners *int `json:"max_listeners"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MaxListeners == nil {
+			http.Error(w, "Invalid request body, expected {\"max_listeners\": n}", http.StatusBadRequest)
+			return
+		}
+		if *req.MaxListeners < 0 {
+			http.Error(w, "max_listeners must not be negative", http.StatusBadRequest)
+			return
+		}
+		listenerCap.Store(int64(*req.MaxListeners))
+		log.Printf("Listener cap set to %d", *req.MaxListeners)
+		status.Publish("listener_cap", map[string]int{"max_listeners": *req.MaxListeners})
+		go sessions.rebalance()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"max_listeners": listenerCap.Load(),
+		"listeners":     sessions.Count(),
+	})
+}
+
+var (
+	encoderSlotsMu sync.Mutex
+	encoderSlots   = make(map[string]bool)
+)
+
+// acquireEncoder claims one of the station's encoder slots for name.
+func acquireEncoder(name string) error {
+	encoderSlotsMu.Lock()
+	defer encoderSlotsMu.Unlock()
+
+	if limit := cfg.Station.Quota.MaxEncoders; limit > 0 && len(encoderSlots) >= limit && !encoderSlots[name] {
+		quotaRejections.Inc("station", cfg.Station.ID, "reason", "encoders")
+		return fmt.Errorf("station already runs its maximum of %d encoders", limit)
+	}
+	encoderSlots[name] = true
+	encoderGauge.Set(float64(len(encoderSlots)), "station", cfg.Station.ID)
+	return nil
+}
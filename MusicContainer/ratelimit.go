@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Offers and genre changes are rate limited per client IP with a token
+// bucket each: a client may make Burst requests at once, and PerMinute
+// more every minute after that. Behind a reverse proxy every request comes
+// from the proxy, so X-Forwarded-For is used instead when the request comes
+// from one of rate_limit.trusted_proxies. Reads (GET and HEAD) aren't
+// limited, but the WebSocket upgrade that starts signaling is. Admins are
+// never limited.
+
+const maxBuckets = 100000
+
+var rateLimited = newCounter("radio_rate_limited_total", "Requests refused by the per-IP rate limiter, by limit.")
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is one limit, with a bucket per client IP.
+type rateLimiter struct {
+	name  string
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+var limiters = make(map[string]*rateLimiter)
+
+func newRateLimiter(name string, c LimitConfig) *rateLimiter {
+	return &rateLimiter{
+		name:    name,
+		rate:    c.PerMinute / 60,
+		burst:   float64(max(c.Burst, 1)),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from ip's bucket. When there is none it returns how
+// long until there will be.
+func (l *rateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[ip]
+	if b == nil {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets buckets that have filled up again, which are the same as
+// no bucket at all.
+func (l *rateLimiter) sweep(now time.Time) {
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+func (l *rateLimiter) runSweeper() {
+	for now := range time.Tick(time.Minute) {
+		l.mu.Lock()
+		l.sweep(now)
+		l.mu.Unlock()
+	}
+}
+
+func setupRateLimits(c RateLimitConfig) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	for name, lc := range map[string]LimitConfig{"offer": c.Offer, "genre": c.Genre} {
+		if lc.PerMinute <= 0 {
+			continue
+		}
+		l := newRateLimiter(name, lc)
+		limiters[name] = l
+		go l.runSweeper()
+		log.Printf("Rate limiting %s requests to %g a minute per IP, bursts of %d", name, lc.PerMinute, int(l.burst))
+	}
+	return nil
+}
+
+func (c RateLimitConfig) validate() error {
+	for _, p := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil {
+			return fmt.Errorf("trusted proxy %q: %w", p, err)
+		}
+	}
+	if c.Offer.PerMinute < 0 || c.Genre.PerMinute < 0 || c.Offer.Burst < 0 || c.Genre.Burst < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	return nil
+}
+
+// clientIP is the address a request comes from. For requests from a
+// trusted proxy it is the last address in X-Forwarded-For that isn't a
+// trusted proxy itself, since proxies append to the header.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func trustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, p := range cfg.RateLimit.TrustedProxies {
+		if _, n, err := net.ParseCIDR(p); err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// limited wraps h with the named rate limit, if it is configured.
+func limited(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, retry := allowRequest(name, r); !ok {
+			writeRateLimited(w, retry)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// allowRequest takes r out of the named rate limit. When the limit is used
+// up it returns false and the seconds until it allows r again.
+func allowRequest(name string, r *http.Request) (bool, int) {
+	l := limiters[name]
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	upgrade := strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+	if l == nil || (read && !upgrade) || (cfg.Admin.Token != "" && isAdmin(r)) {
+		return true, 0
+	}
+	key := clientIP(r)
+	if id := listenerID(r); cfg.RateLimit.PerListener && id != "" {
+		key = id
+	}
+	if ok, wait := l.allow(key, time.Now()); !ok {
+		rateLimited.Inc("limit", name)
+		log.Printf("Rate limited %s on %s", key, r.URL.Path)
+		return false, int(math.Ceil(wait.Seconds()))
+	}
+	return true, 0
+}
+
+func writeRateLimited(w http.ResponseWriter, retry int) {
+	if w.Header().Get("API-Version") == "2" {
+		writeAPIError(w, http.StatusTooManyRequests, apiError{Code: "rate_limited", Message: apiErrorMessages["rate_limited"], RetryAfter: retry})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": "rate_limited", "retry_after": retry})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Audio readiness tells a listener in the offer answer whether the
+// generator's audio is on air yet. Without it a listener who connects while
+// the generator warms up sees "connected" and hears silence (or the
+// bootstrap loop) with no idea for how long.
+
+// AudioReadiness is the "audio" field of an answer. ETAMS is how long until
+// generator audio should start, when that can be told: while the pre-roll
+// fills up, or during warm-up if audio.warmup says how long it takes.
+type AudioReadiness struct {
+	Flowing bool   `json:"flowing"`
+	Source  string `json:"source"` // live, bootstrap, standby or none
+	ETAMS   int64  `json:"eta_ms,omitempty"`
+}
+
+// readiness is updated by the audio loop on every tick.
+var readiness struct {
+	flowing  atomic.Bool
+	everLive atomic.Bool
+	boot     atomic.Bool // a bootstrap loop is playing
+	queued   atomic.Int32
+	preroll  atomic.Int32
+	frame    atomic.Int64 // frame duration
+}
+
+// observeReadiness records the state of the audio loop for one tick.
+func observeReadiness(flowing, boot bool, queued, preroll int, frame time.Duration) {
+	readiness.flowing.Store(flowing)
+	if flowing {
+		readiness.everLive.Store(true)
+	}
+	readiness.boot.Store(boot)
+	readiness.queued.Store(int32(queued))
+	readiness.preroll.Store(int32(preroll))
+	readiness.frame.Store(int64(frame))
+}
+
+// currentReadiness describes the audio a listener would get right now.
+func currentReadiness() *AudioReadiness {
+	if readiness.flowing.Load() {
+		return &AudioReadiness{Flowing: true, Source: "live"}
+	}
+	r := &AudioReadiness{Source: "none"}
+	switch {
+	case readiness.boot.Load():
+		r.Source = "bootstrap"
+	case readiness.everLive.Load() && cfg.Audio.Standby.Mode != "off":
+		r.Source = "standby"
+	}
+
+	queued, preroll := readiness.queued.Load(), readiness.preroll.Load()
+	frame := time.Duration(readiness.frame.Load())
+	switch {
+	case queued > 0 && queued < preroll:
+		// The generator is producing; playback starts once the pre-roll is full
+		r.ETAMS = (time.Duration(preroll-queued) * frame).Milliseconds()
+	case !readiness.everLive.Load() && cfg.Audio.Warmup > 0:
+		left := time.Duration(cfg.Audio.Warmup) - time.Since(streamStarted)
+		if left < time.Second {
+			left = time.Second
+		}
+		r.ETAMS = left.Milliseconds()
+	}
+	return r
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When a listener's session ends the server writes them a receipt: how long
+// they listened, the bitrate they got on average, how many packets went
+// missing and the genres they heard. The hello result carries a signed
+// receipt_url for the session; the web player keeps it and, on its next
+// visit, fetches the receipt once to show a "you listened for 2h 13m"
+// recap. Receipts are kept in memory for receiptTTL and are gone once
+// fetched.
+
+const (
+	receiptTTL      = 24 * time.Hour
+	maxReceipts     = 10000
+	maxGenreAirings = 1000 // genres remembered for receipts
+)
+
+// PlaybackReceipt is the /api/receipt response.
+type PlaybackReceipt struct {
+	Session     string    `json:"session"`
+	Station     string    `json:"station"`
+	Started     time.Time `json:"started"`
+	Ended       time.Time `json:"ended"`
+	Duration    float64   `json:"duration_s"`
+	Bitrate     int64     `json:"average_bitrate_bps"`
+	PacketsLost int64     `json:"packets_lost"`
+	Loss        float64   `json:"loss"` // of the packets sent
+	Genres      []string  `json:"genres"`
+}
+
+type storedReceipt struct {
+	receipt PlaybackReceipt
+	expires time.Time
+}
+
+// genreAiring is a genre going on air.
+type genreAiring struct {
+	genre string
+	at    time.Time
+}
+
+var receipts = struct {
+	mu      sync.Mutex
+	byID    map[string]storedReceipt
+	airings []genreAiring
+}{byID: make(map[string]storedReceipt)}
+
+// recordAiring notes that genre went on air.
+func recordAiring(genre string) {
+	receipts.mu.Lock()
+	defer receipts.mu.Unlock()
+	if n := len(receipts.airings); n > 0 && receipts.airings[n-1].genre == genre {
+		return
+	}
+	receipts.airings = append(receipts.airings, genreAiring{genre, time.Now()})
+	if len(receipts.airings) > maxGenreAirings {
+		receipts.airings = receipts.airings[len(receipts.airings)-maxGenreAirings:]
+	}
+}
+
+// genresBetweenLocked lists the genres on air at some point from from to
+// to, in the order they first played.
+func genresBetweenLocked(from, to time.Time) []string {
+	genres := []string{}
+	seen := make(map[string]bool)
+	for i, a := range receipts.airings {
+		// An airing counts until the next one starts
+		if a.at.After(to) {
+			break
+		}
+		if i+1 < len(receipts.airings) && !receipts.airings[i+1].at.After(from) {
+			continue
+		}
+		if !seen[a.genre] {
+			seen[a.genre] = true
+			genres = append(genres, a.genre)
+		}
+	}
+	return genres
+}
+
+// writeReceipt keeps the receipt for a session that has ended. Only
+// sessions that connected get one.
+func writeReceipt(s *session) {
+	now := time.Now()
+	r := PlaybackReceipt{
+		Session:     s.id,
+		Station:     cfg.Station.ID,
+		Started:     s.joined,
+		Ended:       now,
+		Duration:    now.Sub(s.joined).Seconds(),
+		PacketsLost: s.packetsLost.Load(),
+	}
+	if s.output != nil {
+		if r.Duration > 0 {
+			r.Bitrate = int64(float64(s.output.bytes.Load()*8) / r.Duration)
+		}
+		if sent := s.output.packets.Load(); sent > 0 {
+			r.Loss = float64(r.PacketsLost) / float64(sent)
+		}
+	}
+
+	receipts.mu.Lock()
+	defer receipts.mu.Unlock()
+	r.Genres = genresBetweenLocked(s.joined, now)
+	for id, stored := range receipts.byID {
+		if now.After(stored.expires) {
+			delete(receipts.byID, id)
+		}
+	}
+	if len(receipts.byID) >= maxReceipts {
+		return
+	}
+	receipts.byID[s.id] = storedReceipt{receipt: r, expires: now.Add(receiptTTL)}
+}
+
+// receiptURL is where a session's receipt can be fetched once it has
+// ended.
+func receiptURL(id string) string {
+	return "/api/receipt?r=" + id + "." + listenerTokens.sign("receipt."+id)
+}
+
+func handleReceipt(w http.ResponseWriter, r *http.Request) {
+	id, sig, _ := strings.Cut(r.URL.Query().Get("r"), ".")
+	if id == "" || !hmac.Equal([]byte(sig), []byte(listenerTokens.sign("receipt."+id))) {
+		http.Error(w, "Invalid receipt", http.StatusForbidden)
+		return
+	}
+
+	receipts.mu.Lock()
+	stored, ok := receipts.byID[id]
+	delete(receipts.byID, id)
+	receipts.mu.Unlock()
+	if !ok || time.Now().After(stored.expires) {
+		// Still listening, already fetched or expired
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(stored.receipt)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Flaky clients send the same offer more than once: a double-clicked play
+// button, or a fetch that retries after a timeout. Each copy would otherwise
+// build its own peer connection, and all but one would be left orphaned.
+// Offers are keyed by the client's address and SDP; a duplicate waits for
+// the first copy and gets its response, and a successful answer is replayed
+// for offerReplayWindow afterwards.
+
+const offerReplayWindow = 10 * time.Second
+
+var offerReplays = newCounter("radio_offer_replays_total", "Duplicate offers answered from an earlier response.")
+
+type offerResponse struct {
+	done    chan struct{} // closed once the response below is filled in
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+var (
+	offerCacheMu sync.Mutex
+	offerCache   = make(map[string]*offerResponse)
+)
+
+func offerKey(remote, sdp string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	sum := sha256.Sum256([]byte(host + "\n" + sdp))
+	return hex.EncodeToString(sum[:])
+}
+
+// claimOffer returns the response for key and whether the caller is the
+// first to ask, in which case it must fill the response in.
+func claimOffer(key string) (*offerResponse, bool) {
+	offerCacheMu.Lock()
+	defer offerCacheMu.Unlock()
+
+	now := time.Now()
+	for k, resp := range offerCache {
+		if !resp.expires.IsZero() && now.After(resp.expires) {
+			delete(offerCache, k)
+		}
+	}
+	if resp, ok := offerCache[key]; ok {
+		return resp, false
+	}
+	resp := &offerResponse{done: make(chan struct{})}
+	offerCache[key] = resp
+	return resp, true
+}
+
+// finishOffer publishes the response to anyone waiting on it. Only answers
+// are kept around; after a failure the next copy gets a fresh attempt.
+func finishOffer(key string, resp *offerResponse) {
+	offerCacheMu.Lock()
+	if resp.status == http.StatusOK {
+		resp.expires = time.Now().Add(offerReplayWindow)
+	} else {
+		delete(offerCache, key)
+	}
+	offerCacheMu.Unlock()
+	close(resp.done)
+}
+
+// recordingWriter passes a response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// dedupeOffers wraps the /offer handler so duplicate offers share a response.
+func dedupeOffers(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("Error reading request body: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var o offer
+		if err := json.Unmarshal(body, &o); err != nil || o.SDP == "" {
+			next(w, r) // let the handler reject it
+			return
+		}
+
+		key := offerKey(r.RemoteAddr, o.SDP)
+		resp, first := claimOffer(key)
+		if !first {
+			select {
+			case <-resp.done:
+			case <-r.Context().Done():
+				return
+			}
+			log.Printf("Replaying response to duplicate offer from %s", r.RemoteAddr)
+			offerReplays.Inc()
+			for k, v := range resp.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+			return
+		}
+
+		rec := &recordingWriter{ResponseWriter: w}
+		defer func() {
+			resp.status = rec.status
+			resp.header = w.Header().Clone()
+			resp.body = rec.body.Bytes()
+			finishOffer(key, resp)
+		}()
+		next(rec, r)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// At the end of every run the server sums up how it went: how long it was
+// up, how many listener-minutes it served, how many frames it encoded, the
+// errors it ran into and its peak audience. The report is logged and, if
+// shutdown.report names notifiers from alerts.notifiers, sent to them as an
+// alert with the report as its data.
+
+// runStats are the totals for this run that nothing else keeps.
+type runStats struct {
+	listened      atomic.Int64 // nanoseconds summed over listeners who left
+	listeners     atomic.Int64 // listeners who connected
+	framesEncoded atomic.Uint64
+
+	mu     sync.Mutex
+	errors map[string]uint64
+}
+
+var run = &runStats{errors: make(map[string]uint64)}
+
+// left adds a listener's time on the station.
+func (r *runStats) left(d time.Duration) {
+	r.listened.Add(int64(d))
+}
+
+// error counts an error in category.
+func (r *runStats) error(category string) {
+	r.mu.Lock()
+	r.errors[category]++
+	r.mu.Unlock()
+}
+
+// ShutdownReport is the summary of one run.
+type ShutdownReport struct {
+	Station         string            `json:"station"`
+	Version         string            `json:"version"`
+	Started         time.Time         `json:"started"`
+	Uptime          float64           `json:"uptime_s"`
+	ListenerMinutes float64           `json:"listener_minutes"`
+	Listeners       int64             `json:"listeners"`
+	PeakListeners   int               `json:"peak_listeners"`
+	PeakAt          time.Time         `json:"peak_at,omitempty"`
+	FramesEncoded   uint64            `json:"frames_encoded"`
+	Errors          map[string]uint64 `json:"errors"`
+}
+
+// report sums up the run so far. Listeners still connected don't count
+// towards the listener-minutes, so it is taken once they are closed.
+func (r *runStats) report() ShutdownReport {
+	lat := latency.Report()
+	peak := currentListeners()
+	rep := ShutdownReport{
+		Station:         cfg.Station.ID,
+		Version:         buildVersion(),
+		Started:         streamStarted,
+		Uptime:          time.Since(streamStarted).Seconds(),
+		ListenerMinutes: time.Duration(r.listened.Load()).Minutes(),
+		Listeners:       r.listeners.Load(),
+		PeakListeners:   peak.Peak,
+		PeakAt:          peak.PeakAt,
+		FramesEncoded:   r.framesEncoded.Load(),
+		Errors:          map[string]uint64{"underrun": lat.Underruns, "dropped_frame": lat.Dropped},
+	}
+	r.mu.Lock()
+	for k, v := range r.errors {
+		rep.Errors[k] = v
+	}
+	r.mu.Unlock()
+	return rep
+}
+
+func (s ShutdownReport) String() string {
+	cats := make([]string, 0, len(s.Errors))
+	for k, v := range s.Errors {
+		if v > 0 {
+			cats = append(cats, fmt.Sprintf("%s %d", k, v))
+		}
+	}
+	sort.Strings(cats)
+	errs := "none"
+	if len(cats) > 0 {
+		errs = strings.Join(cats, ", ")
+	}
+	up := time.Duration(s.Uptime * float64(time.Second)).Round(time.Second)
+	return fmt.Sprintf("up %v, %.1f listener-minutes from %d listeners (peak %d), %d frames encoded, errors: %s",
+		up, s.ListenerMinutes, s.Listeners, s.PeakListeners, s.FramesEncoded, errs)
+}
+
+// sendShutdownReport logs the report and sends it to the notifiers in
+// shutdown.report, giving up when ctx is done.
+func sendShutdownReport(ctx context.Context) {
+	rep := run.report()
+	log.Printf("Shutdown report: %s", rep)
+	if len(cfg.Shutdown.Report) == 0 {
+		return
+	}
+
+	a := Alert{
+		Rule:    "shutdown_report",
+		Station: rep.Station,
+		Event:   "shutdown",
+		Time:    time.Now(),
+		Message: rep.String(),
+		Data:    rep,
+	}
+	var wg sync.WaitGroup
+	for _, name := range cfg.Shutdown.Report {
+		n, err := newNotifier(cfg.Alerts.Notifiers[name])
+		if err != nil {
+			log.Printf("Error sending shutdown report to %s: %v", name, err)
+			continue
+		}
+		wg.Add(1)
+		go func(name string, n Notifier) {
+			defer wg.Done()
+			if err := n.Notify(ctx, a); err != nil {
+				log.Printf("Error sending shutdown report to %s: %v", name, err)
+				alertsSent.Inc("rule", a.Rule, "notifier", name, "result", "error")
+				return
+			}
+			alertsSent.Inc("rule", a.Rule, "notifier", name, "result", "ok")
+		}(name, n)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"math"
+
+	"chobinbeats/ingestframe"
+)
+
+// resampler converts interleaved 16-bit PCM from one sample rate to another
+// by linear interpolation. It keeps its position across calls, so a stream
+// can be fed in chunks of any size.
+type resampler struct {
+	from, to int
+	channels int
+	step     float64   // input samples per output sample
+	t        float64   // next output position; 0 is prev, 1 the next input sample
+	prev     []float64 // last input sample of the previous chunk, per channel
+}
+
+func newResampler(from, to, channels int) *resampler {
+	return &resampler{
+		from:     from,
+		to:       to,
+		channels: channels,
+		step:     float64(from) / float64(to),
+		t:        1,
+		prev:     make([]float64, channels),
+	}
+}
+
+// process resamples in (s16le) and appends the result to out.
+func (r *resampler) process(in, out []byte) []byte {
+	ch := r.channels
+	n := len(in) / 2 / ch
+	sample := func(i, c int) float64 {
+		if i < 0 {
+			return r.prev[c]
+		}
+		return float64(int16(binary.LittleEndian.Uint16(in[(i*ch+c)*2:])))
+	}
+	for ; r.t < float64(n); r.t += r.step {
+		i := int(r.t)
+		frac := r.t - float64(i)
+		for c := 0; c < ch; c++ {
+			v := sample(i-1, c)*(1-frac) + sample(i, c)*frac
+			out = binary.LittleEndian.AppendUint16(out, uint16(int16(v)))
+		}
+	}
+	if n > 0 {
+		r.t -= float64(n)
+		for c := 0; c < ch; c++ {
+			r.prev[c] = sample(n-1, c)
+		}
+	}
+	return out
+}
+
+var inputClipped = newCounter("radio_input_clipped_samples_total", "Float input samples beyond full scale, clipped on conversion, by input.")
+
+// inputConverter brings audio in another format to the station's: it turns
+// float samples into 16-bit ones, mixes them to the station's channel count,
+// resamples them and cuts the result into pipeline-sized frames. A nil
+// inputConverter passes frames through.
+type inputConverter struct {
+	name          string
+	in            ingestframe.Format // the input's
+	toChannels    int                // the station's
+	r             *resampler         // nil when the rates match
+	bytesPerFrame int
+	pending       []byte
+	floats, mixed []byte // reused by the conversion steps
+}
+
+// newInputConverter converts audio in the in format to format, or returns
+// nil if it already matches. An encoding, rate or channel count of 0 is the
+// station's.
+func newInputConverter(name string, in, format ingestframe.Format, bytesPerFrame int) *inputConverter {
+	if in.Encoding == 0 {
+		in.Encoding = format.Encoding
+	}
+	if in.SampleRate == 0 {
+		in.SampleRate = format.SampleRate
+	}
+	if in.Channels == 0 {
+		in.Channels = format.Channels
+	}
+	if in == format {
+		return nil
+	}
+	to, toChannels := int(format.SampleRate), int(format.Channels)
+	c := &inputConverter{name: name, in: in, toChannels: toChannels, bytesPerFrame: bytesPerFrame}
+	if in.Encoding != format.Encoding {
+		log.Printf("Converting %s from %v", name, in)
+	}
+	if int(in.Channels) != toChannels {
+		log.Printf("Mixing %s from %d to %d channels", name, in.Channels, toChannels)
+	}
+	if rate := int(in.SampleRate); rate != to {
+		log.Printf("Resampling %s from %dHz to %dHz", name, rate, to)
+		c.r = newResampler(rate, to, toChannels)
+	}
+	return c
+}
+
+// converts reports whether c is for audio in the in format.
+func (c *inputConverter) converts(in ingestframe.Format) bool {
+	return c != nil && c.in == in
+}
+
+// push converts in and sends every whole frame ready so far to frames.
+func (c *inputConverter) push(in []byte, frames chan<- []byte) {
+	if c.in.Encoding == ingestframe.EncodingF32LE {
+		var clipped int
+		c.floats, clipped = floatToS16(c.floats, in)
+		in = c.floats
+		if clipped > 0 {
+			inputClipped.Add(float64(clipped), "input", c.name)
+		}
+	}
+	if int(c.in.Channels) != c.toChannels {
+		c.mixed = remix(c.mixed, in, int(c.in.Channels), c.toChannels)
+		in = c.mixed
+	}
+	if c.r != nil {
+		c.pending = c.r.process(in, c.pending)
+	} else {
+		c.pending = append(c.pending, in...)
+	}
+	sent := 0
+	for ; len(c.pending)-sent >= c.bytesPerFrame; sent += c.bytesPerFrame {
+		frames <- pcmBytes.clone(c.pending[sent : sent+c.bytesPerFrame])
+	}
+	c.pending = append(c.pending[:0], c.pending[sent:]...)
+}
+
+// remix converts s16le audio between mono and stereo into out, reusing its
+// space. Mono is copied to both channels; stereo is downmixed to the average
+// of the two.
+func remix(out, in []byte, from, to int) []byte {
+	switch {
+	case from == 1 && to == 2:
+		out = resize(out, len(in)*2)
+		for i := 0; i+1 < len(in); i += 2 {
+			copy(out[i*2:], in[i:i+2])
+			copy(out[i*2+2:], in[i:i+2])
+		}
+		return out
+	case from == 2 && to == 1:
+		out = resize(out, len(in)/2)
+		for i := 0; i+3 < len(in); i += 4 {
+			l := int32(int16(binary.LittleEndian.Uint16(in[i:])))
+			r := int32(int16(binary.LittleEndian.Uint16(in[i+2:])))
+			binary.LittleEndian.PutUint16(out[i/2:], uint16(int16((l+r)/2)))
+		}
+		return out
+	}
+	return append(out[:0], in...)
+}
+
+// floatToS16 converts f32le samples to s16le into out, reusing its space.
+// Samples beyond full scale are clipped to it and counted; NaNs become
+// silence.
+func floatToS16(out, in []byte) ([]byte, int) {
+	out = resize(out, len(in)/2)
+	clipped := 0
+	for i := 0; i+3 < len(in); i += 4 {
+		v := float64(math.Float32frombits(binary.LittleEndian.Uint32(in[i:])))
+		switch {
+		case v != v:
+			v = 0
+		case v > 1:
+			v, clipped = 1, clipped+1
+		case v < -1:
+			v, clipped = -1, clipped+1
+		}
+		binary.LittleEndian.PutUint16(out[i/2:], uint16(int16(math.Round(v*math.MaxInt16))))
+	}
+	return out, clipped
+}
+
+// resize returns b with length n, reallocating only if it is too small.
+func resize(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// When a listener's network changes (Wi-Fi to LTE) ICE breaks but the peer
+// connection, its Opus track and its control channel are still good. The
+// client restarts ICE by sending a new offer with fresh credentials for the
+// session it already has, as "session" in a POST to /offer or as a PATCH
+// to its WHEP resource. Only the transport is renegotiated; the session
+// keeps its place in the fan-out.
+
+var iceRestarts = newCounter("radio_ice_restarts_total", "ICE restarts on existing sessions, by outcome.")
+
+// errNoSession means the session to restart is gone, so the client has to
+// connect from scratch.
+var errNoSession = fmt.Errorf("session not found")
+
+// restartICE answers a renegotiation offer for an existing session.
+func restartICE(id, offerSDP string) (string, error) {
+	sess := sessions.Get(id)
+	if sess == nil || sess.pc == nil || sess.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		iceRestarts.Inc("outcome", "not_found")
+		return "", errNoSession
+	}
+
+	// One renegotiation at a time per peer connection
+	sess.negotiate.Lock()
+	defer sess.negotiate.Unlock()
+
+	answerSDP, err := answerOffer(sess.pc, offerSDP)
+	if err != nil {
+		iceRestarts.Inc("outcome", "error")
+		return "", err
+	}
+	iceRestarts.Inc("outcome", "ok")
+	log.Printf("Restarted ICE for session %s", id)
+	return answerSDP, nil
+}
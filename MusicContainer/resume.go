@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A listener whose peer connection is gone (tab refresh, a network blip the
+// ICE restart couldn't save) can get its session back for
+// sessions.resume_window after it ended. Every answer carries a resume token
+// next to the session ID; the player keeps both in sessionStorage and POSTs
+// them with a fresh offer to /reconnect. That skips the bandwidth probe, the
+// listener token and the waitlist. Neither side waits for ICE gathering:
+// the answer comes back at once with a long-poll channel, and candidates
+// trickle over /poll/<channel> as on /poll (see longpoll.go). The session
+// keeps its ID, probe and quality tier.
+//
+// Sessions ended on purpose (hung up, kicked by an admin, handed off, shut
+// down) can't be resumed.
+
+var sessionResumes = newCounter("radio_session_resumes_total", "Attempts to resume a session through /reconnect, by outcome.")
+
+// resumeKey signs resume tokens. It lives only as long as the process.
+var resumeKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// resumableReasons are the ways a session can end that leave it resumable.
+var resumableReasons = map[string]bool{
+	"failed":       true,
+	"closed":       true,
+	"disconnected": true,
+	"idle":         true,
+}
+
+// resumable is what a session needs to be restored.
+type resumable struct {
+	probe      *ProbeResult
+	bitrate    int64
+	maxBitrate int64
+	until      time.Time
+}
+
+// resumeToken returns the token that proves ownership of session id, or ""
+// when resuming is off.
+func resumeToken(id string) string {
+	if cfg.Sessions.ResumeWindow <= 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, resumeKey)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// keepResumable remembers a session that just ended, if it may be resumed.
+func (m *sessionManager) keepResumable(s *session, reason string) {
+	if cfg.Sessions.ResumeWindow <= 0 || !resumableReasons[reason] {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !s.connected {
+		return
+	}
+	for id, r := range m.resumable {
+		if now.After(r.until) {
+			delete(m.resumable, id)
+		}
+	}
+	if m.resumable == nil {
+		m.resumable = make(map[string]*resumable)
+	}
+	m.resumable[s.id] = &resumable{
+		probe:      s.probe,
+		bitrate:    s.bitrate.Load(),
+		maxBitrate: s.maxBitrate.Load(),
+		until:      now.Add(time.Duration(cfg.Sessions.ResumeWindow)),
+	}
+}
+
+// Resume re-admits the listener that held session id under the same ID.
+// A session that is still open, because the server hasn't noticed the old
+// connection is gone, is closed first. Resumed listeners skip the waitlist
+// but not the quota. found is false if there is nothing to resume.
+func (m *sessionManager) Resume(id, token, remote string) (a admission, found bool) {
+	if want := resumeToken(id); want == "" || !hmac.Equal([]byte(token), []byte(want)) {
+		return admission{}, false
+	}
+
+	if s := m.Get(id); s != nil {
+		m.mu.Lock()
+		connected := s.connected
+		m.mu.Unlock()
+		if !connected {
+			return admission{}, false
+		}
+		r := &resumable{probe: s.probe, bitrate: s.bitrate.Load(), maxBitrate: s.maxBitrate.Load()}
+		m.close(id, "resumed")
+		m.mu.Lock()
+		if m.resumable == nil {
+			m.resumable = make(map[string]*resumable)
+		}
+		m.resumable[id] = r
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.resumable[id]
+	if r == nil || (!r.until.IsZero() && time.Now().After(r.until)) {
+		delete(m.resumable, id)
+		return admission{}, false
+	}
+	if ok, _, reason := checkQuota(len(m.sessions) + 1); !ok {
+		quotaRejections.Inc("station", cfg.Station.ID, "reason", reason)
+		return admission{reason: reason}, true
+	}
+	delete(m.resumable, id)
+
+	s := &session{id: id, remote: remote, created: time.Now()}
+	s.probe = r.probe
+	s.bitrate.Store(r.bitrate)
+	s.maxBitrate.Store(r.maxBitrate)
+	m.sessions[id] = s
+	go m.rebalance()
+	return admission{session: s}, true
+}
+
+// handleReconnect answers {"session", "resume", "type", "sdp"} with a new
+// answer for the same session and the poll channel its candidates trickle
+// on, or 404 session_not_found when the player has to connect from scratch.
+func handleReconnect(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var o struct {
+		offer
+		Resume string `json:"resume"`
+	}
+	if err := json.Unmarshal(body, &o); err != nil || o.Session == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if shuttingDown.Load() {
+		writeShuttingDown(w)
+		return
+	}
+	if url, _ := handoff.moved(); url != "" {
+		writeStationMoved(w)
+		return
+	}
+	if !stationOnline.Load() {
+		writeStationOffline(w)
+		return
+	}
+	if fds.Exhausted() {
+		writeServerBusy(w)
+		return
+	}
+
+	admitted, found := sessions.Resume(o.Session, o.Resume, r.RemoteAddr)
+	if !found {
+		sessionResumes.Inc("outcome", "not_found")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "session_not_found"})
+		return
+	}
+	if admitted.session == nil {
+		sessionResumes.Inc("outcome", "quota")
+		log.Printf("Could not resume session %s for %s: over %s quota", o.Session, r.RemoteAddr, admitted.reason)
+		writeQuotaRejection(w, admitted)
+		return
+	}
+	sess := admitted.session
+	established := false
+	defer func() {
+		if !established {
+			sessions.Remove(sess.id)
+		}
+	}()
+
+	peerConnection, err := newListenerPeer(sess)
+	if err != nil {
+		sessionResumes.Inc("outcome", "error")
+		log.Printf("Error setting up peer connection: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c, answerSDP, err := answerTrickle(peerConnection, o.SDP)
+	if err != nil {
+		sessionResumes.Inc("outcome", "error")
+		log.Printf("Error answering offer: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	established = true
+	sessionResumes.Inc("outcome", "ok")
+	log.Printf("Resumed session %s for %s", sess.id, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pollAnswer{
+		answer: answer{
+			Type:    "answer",
+			SDP:     answerSDP,
+			Session: sess.id,
+			Bitrate: int(sess.bitrate.Load()),
+			Resume:  resumeToken(sess.id),
+			Audio:   currentReadiness(),
+		},
+		Channel: c.id,
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import "sync"
+
+// frameRing is the jitter buffer between the pipe readers and the encoder.
+// The readers push at whatever pace the generator writes and block once it
+// is full, which holds the generator back; the pacing loop pops one frame a
+// tick and never waits, so a generator running late for a moment drains
+// the buffer instead of stalling the stream.
+type frameRing struct {
+	mu      sync.Mutex
+	notFull *sync.Cond
+	slots   [][][]byte
+	head    int // next frame to pop
+	n       int
+}
+
+func newFrameRing(size int) *frameRing {
+	r := &frameRing{slots: make([][][]byte, size)}
+	r.notFull = sync.NewCond(&r.mu)
+	return r
+}
+
+// Push adds a frame, waiting for room if the ring is full.
+func (r *frameRing) Push(frame [][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.n == len(r.slots) {
+		r.notFull.Wait()
+	}
+	r.slots[(r.head+r.n)%len(r.slots)] = frame
+	r.n++
+}
+
+// Pop takes the oldest frame, or returns nil if the ring is empty.
+func (r *frameRing) Pop() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.n == 0 {
+		return nil
+	}
+	frame := r.slots[r.head]
+	r.slots[r.head] = nil
+	r.head = (r.head + 1) % len(r.slots)
+	r.n--
+	r.notFull.Signal()
+	return frame
+}
+
+// putFrame returns a popped frame's buffers to their pool.
+func putFrame(frame [][]byte) {
+	for _, b := range frame {
+		pcmBytes.put(b)
+	}
+}
+
+// Len is the number of frames waiting.
+func (r *frameRing) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.n
+}
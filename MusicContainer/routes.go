@@ -0,0 +1,107 @@
+package main
+
+import "net/http"
+
+// apiRoute is one HTTP endpoint and the methods it serves, besides OPTIONS.
+type apiRoute struct {
+	pattern string
+	methods []string
+	handler http.HandlerFunc
+	admin   bool // needs the admin token, or lives on the admin listener
+	// successor is the v2 route replacing a frozen v1 one, see apiv2.go.
+	successor string
+}
+
+func apiRoutes() []apiRoute {
+	return []apiRoute{
+		{pattern: "/", methods: []string{http.MethodGet}, handler: serveHome},
+		{pattern: "/embed", methods: []string{http.MethodGet}, handler: handleEmbed},
+		{pattern: "/offer", methods: []string{http.MethodPost}, handler: dedupeOffers(handleOffer), successor: apiV2Prefix + "/offer"},
+		{pattern: "/reconnect", methods: []string{http.MethodPost}, handler: limited("offer", handleReconnect)},
+		{pattern: "/api/token", methods: []string{http.MethodGet, http.MethodPost}, handler: handleToken},
+		{pattern: "/ws", methods: []string{http.MethodGet}, handler: handleWebSocket},
+		{pattern: "/poll", methods: []string{http.MethodPost}, handler: handlePoll},
+		{pattern: "/poll/", methods: []string{http.MethodGet, http.MethodPost}, handler: handlePoll},
+		{pattern: "/probe", methods: []string{http.MethodGet}, handler: handleProbe},
+		{pattern: "/ice-servers", methods: []string{http.MethodGet}, handler: handleICEServers},
+		{pattern: whepPath, methods: []string{http.MethodPost, http.MethodPatch, http.MethodDelete, http.MethodOptions}, handler: handleWHEP},
+		{pattern: whepPath + "/", methods: []string{http.MethodPost, http.MethodPatch, http.MethodDelete, http.MethodOptions}, handler: handleWHEP},
+		{pattern: whipPath, methods: []string{http.MethodPost, http.MethodDelete, http.MethodOptions}, handler: handleWHIP},
+		{pattern: whipPath + "/", methods: []string{http.MethodPost, http.MethodDelete, http.MethodOptions}, handler: handleWHIP},
+		{pattern: "/genre", methods: []string{http.MethodPost}, handler: limited("genre", handleGenreChange), successor: apiV2Prefix + "/genre"},
+		{pattern: "/current-genre", methods: []string{http.MethodGet}, handler: handleCurrentGenre, successor: apiV2Prefix + "/genre"},
+		{pattern: "/api/listeners", methods: []string{http.MethodGet}, handler: handleListeners},
+		{pattern: "/api/receipt", methods: []string{http.MethodGet}, handler: handleReceipt},
+		{pattern: "/guide", methods: []string{http.MethodGet}, handler: handleGuide},
+		{pattern: "/genres/stats", methods: []string{http.MethodGet}, handler: handleGenreStats},
+		{pattern: "/genres/taxonomy", methods: []string{http.MethodGet}, handler: handleTaxonomy},
+		{pattern: "/genres/blocklist/vote", methods: []string{http.MethodPost}, handler: limited("genre", handleBlocklistVote)},
+		{pattern: "/beat", methods: []string{http.MethodGet, http.MethodPost}, handler: handleBeat},
+		{pattern: "/status", methods: []string{http.MethodGet}, handler: handleStatus},
+		{pattern: "/status/events", methods: []string{http.MethodGet}, handler: handleStatusEvents},
+		{pattern: "/metrics", methods: []string{http.MethodGet}, handler: handleMetrics},
+		{pattern: "/presets", methods: []string{http.MethodGet}, handler: handleListPresets},
+		{pattern: "/archive", methods: []string{http.MethodGet}, handler: handleArchive},
+		{pattern: "/archive/", methods: []string{http.MethodGet}, handler: handleArchive},
+		{pattern: "/waveform/live", methods: []string{http.MethodGet}, handler: handleLiveWaveform},
+
+		{pattern: "/api/versions", methods: []string{http.MethodGet}, handler: handleAPIVersions},
+		{pattern: apiV2Prefix + "/offer", methods: []string{http.MethodPost}, handler: apiV2(handleOfferV2)},
+		{pattern: apiV2Prefix + "/genre", methods: []string{http.MethodGet, http.MethodPost}, handler: apiV2(limited("genre", handleGenreV2))},
+		{pattern: apiV2Prefix + "/stations", methods: []string{http.MethodGet}, handler: apiV2(handleStationsV2)},
+		{pattern: apiV2Prefix + "/stations/", methods: []string{http.MethodGet}, handler: apiV2(handleStationsV2)},
+		{pattern: apiV2Prefix + "/sessions/", methods: []string{http.MethodGet, http.MethodDelete}, handler: apiV2(handleSessionsV2)},
+		{pattern: apiV2Prefix + "/auth", methods: []string{http.MethodGet}, handler: apiV2(handleAuthV2)},
+
+		{pattern: "/api/encoder", methods: []string{http.MethodGet, http.MethodPut}, handler: handleEncoder, admin: true},
+		{pattern: "/api/dsp", methods: []string{http.MethodGet, http.MethodPut}, handler: handleDSP, admin: true},
+		{pattern: "/chaos", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, handler: handleChaos, admin: true},
+		{pattern: "/telemetry", methods: []string{http.MethodGet}, handler: handleTelemetry, admin: true},
+		{pattern: "/taps", methods: []string{http.MethodGet}, handler: handleTaps, admin: true},
+		{pattern: "/quality/networks", methods: []string{http.MethodGet}, handler: handleQualityNetworks, admin: true},
+		{pattern: "/update", methods: []string{http.MethodGet, http.MethodPost}, handler: handleUpdate, admin: true},
+		{pattern: "/api/listeners/cap", methods: []string{http.MethodGet, http.MethodPut}, handler: handleListenerCap, admin: true},
+		{pattern: "/api/stats", methods: []string{http.MethodGet}, handler: handleStats, admin: true},
+		{pattern: "/capacity", methods: []string{http.MethodGet}, handler: handleCapacity, admin: true},
+		{pattern: "/presets/export", methods: []string{http.MethodGet}, handler: handleExportPreset, admin: true},
+		{pattern: "/presets/import", methods: []string{http.MethodPost}, handler: handleImportPreset, admin: true},
+		{pattern: "/transitions", methods: []string{http.MethodGet, http.MethodPut}, handler: handleTransitions, admin: true},
+		{pattern: "/genres/blocklist", methods: []string{http.MethodGet, http.MethodPost}, handler: handleBlocklist, admin: true},
+		{pattern: "/genres/blocklist/", methods: []string{http.MethodDelete}, handler: handleBlocklist, admin: true},
+		{pattern: "/transitions/", methods: []string{http.MethodPost, http.MethodDelete}, handler: handleTransitions, admin: true},
+		{pattern: "/stems", methods: []string{http.MethodGet, http.MethodPost}, handler: handleStems, admin: true},
+		{pattern: "/flags", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, handler: handleFlags, admin: true},
+		{pattern: "/dtls", methods: []string{http.MethodGet, http.MethodPost}, handler: handleDTLS, admin: true},
+		{pattern: "/sessions", methods: []string{http.MethodGet, http.MethodDelete}, handler: handleSessions, admin: true},
+		{pattern: "/glitches", methods: []string{http.MethodGet, http.MethodPost}, handler: handleGlitches, admin: true},
+		{pattern: "/glitches/", methods: []string{http.MethodGet}, handler: handleGlitches, admin: true},
+		{pattern: "/handoff", methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}, handler: handleHandoff, admin: true},
+		{pattern: "/handoff/accept", methods: []string{http.MethodPost}, handler: handleHandoffAccept, admin: true},
+		{pattern: "/state/export", methods: []string{http.MethodGet}, handler: handleStateExport, admin: true},
+		{pattern: "/state/import", methods: []string{http.MethodPost}, handler: handleStateImport, admin: true},
+	}
+}
+
+// registerRoutes adds the API to the public mux. Admin endpoints go on the
+// admin mux when an admin listener is configured, otherwise on the public
+// one behind the admin token.
+func registerRoutes(public, admin *http.ServeMux) {
+	routes := apiRoutes()
+	byPattern := make(map[string]http.HandlerFunc, len(routes))
+	for _, rt := range routes {
+		byPattern[rt.pattern] = rt.handler
+	}
+	for _, rt := range routes {
+		mux, h := public, rt.handler
+		if rt.successor != "" {
+			h = frozenV1(rt.pattern, rt.successor, h, byPattern[rt.successor])
+		}
+		if rt.admin {
+			h = requireAdmin(h)
+			if cfg.Admin.Listen != "" {
+				mux = admin
+			}
+		}
+		mux.HandleFunc(rt.pattern, instrument(rt.pattern, withCORS(rt.methods, h)))
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// Each listener's receiver reports are kept for rtcpWindow so operators can
+// see who has a bad connection and whether it is a blip or lasting. Round
+// trip times come from the reports' LSR and DLSR fields, which clients fill
+// in from the sender reports the server sends every second. GET /sessions
+// shows the summary per session and ?sort=loss, jitter or rtt puts the
+// worst first.
+
+const (
+	rtcpWindow     = 5 * time.Minute
+	maxRTCPSamples = 600 // browsers report about once a second
+)
+
+var (
+	listenerRTT    = newHistogram("radio_listener_rtt_seconds", "Round trip times from listener receiver reports.", []float64{0.01, 0.025, 0.05, 0.1, 0.2, 0.4, 0.8, 1.6})
+	listenerJitter = newHistogram("radio_listener_jitter_seconds", "Interarrival jitter from listener receiver reports.", []float64{0.005, 0.01, 0.02, 0.04, 0.08, 0.15, 0.3})
+)
+
+type rtcpSample struct {
+	at       time.Time
+	lossPct  float64
+	jitterMs float64
+	rttMs    float64 // -1 when the report had no sender report to go by
+}
+
+// rtcpStats is a session's recent receiver reports.
+type rtcpStats struct {
+	mu      sync.Mutex
+	samples []rtcpSample
+}
+
+// StatSummary summarizes one measure over the window.
+type StatSummary struct {
+	Avg float64 `json:"avg"`
+	P95 float64 `json:"p95"`
+	Max float64 `json:"max"`
+}
+
+// RTCPStats is the session's receiver reports over the last rtcpWindow.
+type RTCPStats struct {
+	Reports  int          `json:"reports"`
+	LossPct  StatSummary  `json:"loss_pct"`
+	JitterMs StatSummary  `json:"jitter_ms"`
+	RTTMs    *StatSummary `json:"rtt_ms,omitempty"`
+}
+
+// reportRTT works out the round trip time from a receiver report, using the
+// time the report arrived. ok is false if the client hasn't seen a sender
+// report yet.
+func reportRTT(r rtcp.ReceptionReport, now time.Time) (time.Duration, bool) {
+	if r.LastSenderReport == 0 {
+		return 0, false
+	}
+	// The middle 32 bits of the NTP timestamp, in 1/65536 seconds
+	ntp := uint32(now.Unix()+2208988800)<<16 | uint32(uint64(now.Nanosecond())<<16/1e9)
+	rtt := ntp - r.LastSenderReport - r.Delay
+	if int32(rtt) < 0 {
+		return 0, false
+	}
+	return time.Duration(uint64(rtt) * uint64(time.Second) >> 16), true
+}
+
+func (st *rtcpStats) add(r rtcp.ReceptionReport, now time.Time) {
+	jitterMs := float64(r.Jitter) * 1000 / opusClockRate
+	sample := rtcpSample{at: now, lossPct: float64(r.FractionLost) * 100 / 256, jitterMs: jitterMs, rttMs: -1}
+	if rtt, ok := reportRTT(r, now); ok {
+		sample.rttMs = float64(rtt) / float64(time.Millisecond)
+		listenerRTT.Observe(rtt.Seconds())
+	}
+	listenerJitter.Observe(jitterMs / 1000)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.samples = append(st.samples, sample)
+	drop := 0
+	for drop < len(st.samples) && (now.Sub(st.samples[drop].at) > rtcpWindow || len(st.samples)-drop > maxRTCPSamples) {
+		drop++
+	}
+	st.samples = append(st.samples[:0], st.samples[drop:]...)
+}
+
+// latestRTT is the round trip time from the newest report that had one.
+func (st *rtcpStats) latestRTT() (float64, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for i := len(st.samples) - 1; i >= 0; i-- {
+		if st.samples[i].rttMs >= 0 {
+			return st.samples[i].rttMs, true
+		}
+	}
+	return 0, false
+}
+
+// summary returns the stats over the window, or nil before the first report.
+func (st *rtcpStats) summary(now time.Time) *RTCPStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var loss, jitter, rtt []float64
+	for _, s := range st.samples {
+		if now.Sub(s.at) > rtcpWindow {
+			continue
+		}
+		loss = append(loss, s.lossPct)
+		jitter = append(jitter, s.jitterMs)
+		if s.rttMs >= 0 {
+			rtt = append(rtt, s.rttMs)
+		}
+	}
+	if len(loss) == 0 {
+		return nil
+	}
+	out := &RTCPStats{Reports: len(loss), LossPct: summarize(loss), JitterMs: summarize(jitter)}
+	if len(rtt) > 0 {
+		s := summarize(rtt)
+		out.RTTMs = &s
+	}
+	return out
+}
+
+// summarize sorts values in place.
+func summarize(values []float64) StatSummary {
+	sort.Float64s(values)
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	p95 := values[int(math.Ceil(0.95*float64(len(values))))-1]
+	round := func(v float64) float64 { return math.Round(v*10) / 10 }
+	return StatSummary{Avg: round(sum / float64(len(values))), P95: round(p95), Max: round(values[len(values)-1])}
+}
+
+// sortSessions orders sessions worst first by loss, jitter or rtt, using
+// the averages over the window. Sessions without reports go last.
+func sortSessions(list []SessionInfo, by string) bool {
+	var key func(*RTCPStats) (float64, bool)
+	switch by {
+	case "loss":
+		key = func(s *RTCPStats) (float64, bool) { return s.LossPct.Avg, true }
+	case "jitter":
+		key = func(s *RTCPStats) (float64, bool) { return s.JitterMs.Avg, true }
+	case "rtt":
+		key = func(s *RTCPStats) (float64, bool) {
+			if s.RTTMs == nil {
+				return 0, false
+			}
+			return s.RTTMs.Avg, true
+		}
+	default:
+		return false
+	}
+	value := func(info SessionInfo) (float64, bool) {
+		if info.RTCP == nil {
+			return 0, false
+		}
+		return key(info.RTCP)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		a, aok := value(list[i])
+		b, bok := value(list[j])
+		if aok != bok {
+			return aok
+		}
+		return a > b
+	})
+	return true
+}
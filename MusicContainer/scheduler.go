@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The scheduler runs periodic maintenance inside the server instead of
+// leaving it to an external cron. Each job runs every interval give or take
+// a tenth of it, so jobs registered together don't all fire at once, or
+// daily at a fixed time of day in the station's timezone. A run that is
+// still going when the next one is due makes that one skip. The last
+// outcome of every job is listed under "jobs" in /status.
+
+const jobJitter = 0.1
+
+type job struct {
+	name  string
+	every string                        // for /status
+	next  func(time.Time) time.Duration // time until the next run
+	fn    func() error
+
+	// Guarded by scheduler.mu
+	running bool
+	status  JobStatus
+}
+
+// JobStatus is one job's entry in /status.
+type JobStatus struct {
+	Name         string    `json:"name"`
+	Every        string    `json:"every"`
+	Running      bool      `json:"running"`
+	LastRun      time.Time `json:"last_run,omitempty"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	NextRun      time.Time `json:"next_run"`
+	Runs         int       `json:"runs"`
+	Failures     int       `json:"failures"`
+	Skipped      int       `json:"skipped"`
+}
+
+type scheduler struct {
+	mu   sync.Mutex
+	jobs []*job
+}
+
+var schedule = &scheduler{}
+
+var jobRuns = newCounter("radio_job_runs_total", "Scheduled job runs, by job and outcome.")
+
+// Every runs fn every interval, starting one interval from now.
+func (s *scheduler) Every(name string, every time.Duration, fn func() error) {
+	s.add(&job{
+		name:  name,
+		every: every.String(),
+		next:  func(time.Time) time.Duration { return jittered(every) },
+		fn:    fn,
+	})
+}
+
+// Daily runs fn every day at hour:minute station time.
+func (s *scheduler) Daily(name string, hour, minute int, fn func() error) {
+	s.add(&job{
+		name:  name,
+		every: fmt.Sprintf("daily at %02d:%02d %s", hour, minute, stationTZ),
+		next: func(now time.Time) time.Duration {
+			return nextDaily(now, hour, minute).Sub(now)
+		},
+		fn: fn,
+	})
+}
+
+// nextDaily returns the next hour:minute in the station's timezone after
+// now. time.Date normalizes times skipped by a DST change.
+func nextDaily(now time.Time, hour, minute int) time.Time {
+	local := now.In(stationTZ)
+	at := time.Date(local.Year(), local.Month(), local.Day(), hour, minute, 0, 0, stationTZ)
+	if !at.After(now) {
+		at = time.Date(local.Year(), local.Month(), local.Day()+1, hour, minute, 0, 0, stationTZ)
+	}
+	return at
+}
+
+func (s *scheduler) add(j *job) {
+	s.mu.Lock()
+	s.jobs = append(s.jobs, j)
+	s.mu.Unlock()
+	go s.loop(j)
+}
+
+func jittered(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*jobJitter*float64(d))
+}
+
+func (s *scheduler) loop(j *job) {
+	for {
+		wait := j.next(time.Now())
+		s.mu.Lock()
+		j.status.NextRun = time.Now().Add(wait)
+		s.mu.Unlock()
+		time.Sleep(wait)
+
+		s.mu.Lock()
+		if j.running {
+			j.status.Skipped++
+			s.mu.Unlock()
+			jobRuns.Inc("job", j.name, "outcome", "skipped")
+			log.Printf("Skipping job %s: previous run still going", j.name)
+			continue
+		}
+		j.running = true
+		s.mu.Unlock()
+		go s.run(j)
+	}
+}
+
+func (s *scheduler) run(j *job) {
+	start := time.Now()
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+		return j.fn()
+	}()
+
+	s.mu.Lock()
+	j.running = false
+	j.status.Runs++
+	j.status.LastRun = start
+	j.status.LastDuration = time.Since(start).String()
+	j.status.LastError = ""
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Error running job %s: %v", j.name, err)
+		jobRuns.Inc("job", j.name, "outcome", "error")
+		return
+	}
+	jobRuns.Inc("job", j.name, "outcome", "ok")
+}
+
+// Status lists every job by name.
+func (s *scheduler) Status() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		st := j.status
+		st.Name = j.name
+		st.Every = j.every
+		st.Running = j.running
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].Name < out[k].Name })
+	return out
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v4"
+)
+
+// session is one listener's peer connection.
+type session struct {
+	id       string
+	remote   string
+	created  time.Time
+	pc       *webrtc.PeerConnection
+	output   *rtpOutput
+	control  *controlChannel     // nil until the client opens one; guarded by sessionManager.mu
+	metadata *webrtc.DataChannel // opened by the server, see metadata.go
+
+	commentary *rtpOutput // nil unless the station has commentary
+
+	probe   *ProbeResult   // what the client measured before offering, if anything
+	clock   *time.Location // the listener's timezone, if they sent it
+	bitrate atomic.Int64   // quality tier, picked from the probe or asked for
+	// The listener's pseudonymous ID, if they have one, see listenerid.go
+	listener string
+
+	// Adaptive bitrate, see adaptive.go. upSince is only touched by runAdaptive.
+	estimator  cc.BandwidthEstimator // nil unless adaptive bitrate is on
+	maxBitrate atomic.Int64          // the listener's own choice, 0 if none
+	upSince    time.Time             // since when the estimate allows a higher tier
+
+	// Guarded by sessionManager.mu
+	state      webrtc.PeerConnectionState
+	stateSince time.Time
+	connected  bool      // has ever connected
+	joined     time.Time // when it first connected
+
+	lastSeen atomic.Int64 // unix nanoseconds of the last RTCP from the client
+
+	// From the client's receiver reports on the main track
+	packetsLost  atomic.Int64
+	fractionLost atomic.Uint32 // of 256, over the last report interval
+	jitter       atomic.Uint32 // in RTP timestamp units
+	rtcp         rtcpStats     // every report over the last few minutes
+
+	// Connection quality, see quality.go. switchLog and network are only
+	// touched by runQuality.
+	bitrateSwitches atomic.Int64 // adaptive bitrate changes
+	grade           atomic.Value // string
+	switchLog       []int64
+	network         string
+
+	negotiate sync.Mutex // held while renegotiating, see restartICE
+}
+
+// setProbe records the client's probe and picks its bitrate.
+func (s *session) setProbe(p *ProbeResult) {
+	s.probe = p
+	s.bitrate.Store(int64(pickBitrate(p)))
+}
+
+// touch records that the client is still there.
+func (s *session) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// sessionManager tracks every listener session and decides whether new ones
+// may join (see quota.go).
+type sessionManager struct {
+	mu        sync.Mutex
+	sessions  map[string]*session
+	waitlist  []*waitlistEntry
+	resumable map[string]*resumable // ended sessions, see resume.go
+}
+
+var sessions = &sessionManager{sessions: make(map[string]*session)}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (m *sessionManager) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+// Get returns the session with the given ID, or nil.
+func (m *sessionManager) Get(id string) *session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessions[id]
+}
+
+// Remove forgets a session, detaches its outputs from the fan-out and
+// closes its peer connection.
+func (m *sessionManager) Remove(id string) {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	delete(m.sessions, id)
+	wasConnected := ok && s.connected
+	m.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if wasConnected {
+		genreStats.Left()
+		recordDeparture(time.Now())
+		run.left(time.Since(s.joined))
+		writeReceipt(s)
+	}
+	if s.output != nil {
+		broadcast.Remove(s.output)
+	}
+	if s.commentary != nil {
+		broadcast.Remove(s.commentary)
+	}
+	if s.pc != nil {
+		// Closing from inside pion's own callbacks must not block them
+		go s.pc.Close()
+	}
+	m.rebalance()
+}
+
+// controlChannels returns the control channel of every session that has one.
+func (m *sessionManager) controlChannels() []*controlChannel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var channels []*controlChannel
+	for _, s := range m.sessions {
+		if s.control != nil {
+			channels = append(channels, s.control)
+		}
+	}
+	return channels
+}
+
+// setControl records the control channel a session's client opened.
+func (m *sessionManager) setControl(s *session, c *controlChannel) {
+	m.mu.Lock()
+	s.control = c
+	m.mu.Unlock()
+}
+
+var sessionsClosed = newCounter("radio_sessions_closed_total", "Listener sessions closed, by reason.")
+
+// close removes a session for the given reason.
+func (m *sessionManager) close(id, reason string) {
+	s := m.Get(id)
+	if s == nil {
+		return
+	}
+	log.Printf("Closing session %s: %s", id, reason)
+	sessionsClosed.Inc("reason", reason)
+	switch reason {
+	case "failed", "connect_timeout":
+		run.error("session_" + reason)
+	}
+	m.keepResumable(s, reason)
+	m.Remove(id)
+}
+
+// SetState records a session's peer connection state. Failed and closed
+// connections are removed right away; disconnected ones get
+// sessions.disconnect_grace to recover, see runReaper.
+func (m *sessionManager) SetState(id string, state webrtc.PeerConnectionState) {
+	m.mu.Lock()
+	s := m.sessions[id]
+	joined := false
+	if s != nil {
+		s.state = state
+		s.stateSince = time.Now()
+		if state == webrtc.PeerConnectionStateConnected {
+			joined = !s.connected
+			if joined {
+				s.joined = time.Now()
+			}
+			s.connected = true
+			s.touch()
+		}
+	}
+	m.mu.Unlock()
+
+	if joined {
+		run.listeners.Add(1)
+		genreStats.Joined()
+		applyLocalTimeGenre(s)
+		requestFadeIn(s)
+		recordListener(s.listener)
+	}
+
+	switch state {
+	case webrtc.PeerConnectionStateFailed:
+		m.close(id, "failed")
+	case webrtc.PeerConnectionStateClosed:
+		m.close(id, "closed")
+	}
+}
+
+// runReaper closes sessions that never connect, stay disconnected or stop
+// sending RTCP, so their goroutines and ports are not leaked.
+func (m *sessionManager) runReaper(c SessionsConfig) {
+	for now := range time.Tick(5 * time.Second) {
+		var expired [][2]string
+		m.mu.Lock()
+		for id, s := range m.sessions {
+			switch {
+			case !s.connected && now.Sub(s.created) > time.Duration(c.ConnectTimeout):
+				expired = append(expired, [2]string{id, "connect_timeout"})
+			case s.state == webrtc.PeerConnectionStateDisconnected && now.Sub(s.stateSince) > time.Duration(c.DisconnectGrace):
+				expired = append(expired, [2]string{id, "disconnected"})
+			case s.connected && now.Sub(time.Unix(0, s.lastSeen.Load())) > time.Duration(c.IdleTimeout):
+				expired = append(expired, [2]string{id, "idle"})
+			}
+		}
+		m.mu.Unlock()
+		for _, e := range expired {
+			m.close(e[0], e[1])
+		}
+	}
+}
+
+// SessionInfo describes one live session.
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	Remote     string    `json:"remote"`
+	Listener   string    `json:"listener,omitempty"`
+	Created    time.Time `json:"created"`
+	State      string    `json:"state"`
+	LastSeen   time.Time `json:"last_seen,omitempty"`
+	Feed       string    `json:"feed,omitempty"`
+	Control    bool      `json:"control"`
+	Commentary bool      `json:"commentary"`
+	Bitrate    int       `json:"bitrate,omitempty"`
+	ProbeKbps  float64   `json:"probe_kbps,omitempty"`
+	// EstimateBps is the adaptive bitrate estimate, see adaptive.go.
+	EstimateBps int `json:"estimate_bps,omitempty"`
+	// From the client's latest receiver report.
+	PacketsLost int64   `json:"packets_lost"`
+	LossPct     float64 `json:"loss_pct"`
+	JitterMs    float64 `json:"jitter_ms"`
+	RTTMs       float64 `json:"rtt_ms,omitempty"`
+	// RTCP summarizes the receiver reports of the last 5 minutes, see
+	// rtcpstats.go.
+	RTCP *RTCPStats `json:"rtcp,omitempty"`
+	// Grade is the connection quality grade, see quality.go.
+	Grade string `json:"grade,omitempty"`
+}
+
+// List returns every live session, oldest first.
+func (m *sessionManager) List() []SessionInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]SessionInfo, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		out = append(out, s.info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// Info describes the session with the given ID.
+func (m *sessionManager) Info(id string) (SessionInfo, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return SessionInfo{}, false
+	}
+	return s.info(), true
+}
+
+// info describes the session. The caller holds sessionManager.mu.
+func (s *session) info() SessionInfo {
+	info := SessionInfo{
+		ID:          s.id,
+		Remote:      s.remote,
+		Listener:    s.listener,
+		Created:     s.created,
+		State:       s.state.String(),
+		Control:     s.control != nil,
+		Bitrate:     int(s.bitrate.Load()),
+		PacketsLost: s.packetsLost.Load(),
+		LossPct:     float64(s.fractionLost.Load()) * 100 / 256,
+		JitterMs:    s.jitterMs(),
+	}
+	info.Grade, _ = s.grade.Load().(string)
+	info.RTTMs, _ = s.rtcp.latestRTT()
+	info.RTCP = s.rtcp.summary(time.Now())
+	if s.probe != nil {
+		info.ProbeKbps = s.probe.DownKbps
+	}
+	if s.estimator != nil {
+		info.EstimateBps = s.estimator.GetTargetBitrate()
+	}
+	if seen := s.lastSeen.Load(); seen > 0 {
+		info.LastSeen = time.Unix(0, seen)
+	}
+	if s.output != nil {
+		info.Feed = s.output.Feed()
+	}
+	if s.commentary != nil {
+		info.Commentary = broadcast.Has(s.commentary)
+	}
+	return info
+}
+
+// handleSessions lists the live sessions on GET, worst connections first
+// with ?sort=loss, jitter or rtt, and closes one on DELETE (?id=...).
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if sessions.Get(id) == nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		sessions.close(id, "admin")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list := sessions.List()
+	if by := r.URL.Query().Get("sort"); by != "" && !sortSessions(list, by) {
+		http.Error(w, "sort must be loss, jitter or rtt", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"sessions": list})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// On SIGTERM or SIGINT the server shuts down instead of dying mid-stream.
+// New offers are refused with 503 shutting_down, listeners with a control
+// channel are told to reconnect in a few seconds (to whichever server is up
+// by then), and every peer connection is closed, so browsers see their
+// tracks end rather than waiting for ICE to time out. The archive's open
+// segment is then finished, the shutdown report sent (see report.go) and
+// the HTTP server stopped. Whatever hasn't finished after shutdown.drain is
+// abandoned and the process exits.
+
+const shutdownRetry = 5 * time.Second // how long listeners wait before reconnecting
+
+var shuttingDown atomic.Bool
+
+// serveHTTP serves the listener API on ln until the process is told to stop.
+func serveHTTP(ln net.Listener) error {
+	// Cancelled on shutdown, which ends the status streams
+	base, cancel := context.WithCancel(context.Background())
+	server := &http.Server{BaseContext: func(net.Listener) context.Context { return base }}
+	go handleSignals(server, cancel)
+	if err := server.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	// handleSignals exits the process once it is done
+	select {}
+}
+
+func handleSignals(server *http.Server, cancelRequests context.CancelFunc) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	s := <-sig
+	// A second signal kills the process right away
+	signal.Stop(sig)
+
+	drain := time.Duration(cfg.Shutdown.Drain)
+	log.Printf("Received %v, shutting down within %v", s, drain)
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	shutdown(ctx, server, cancelRequests)
+	if ctx.Err() != nil {
+		log.Printf("Shutdown took longer than %v, exiting anyway", drain)
+	} else {
+		log.Printf("Shut down cleanly")
+	}
+	os.Exit(0)
+}
+
+func shutdown(ctx context.Context, server *http.Server, cancelRequests context.CancelFunc) {
+	shuttingDown.Store(true)
+	status.Publish("shutdown", map[string]interface{}{"listeners": sessions.Count()})
+
+	channels := sessions.controlChannels()
+	for _, c := range channels {
+		c.Notify("reconnect", map[string]interface{}{"url": "", "token": "", "after_ms": shutdownRetry.Milliseconds()})
+	}
+	if len(channels) > 0 {
+		// Give the control channels a moment to deliver the notification
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-ctx.Done():
+		}
+	}
+
+	closeAllSessions(ctx)
+	if err := archive.Close(ctx); err != nil {
+		log.Printf("Error finishing archive segment: %v", err)
+	}
+	if cfg.Genre.StatsFile != "" {
+		if err := genreStats.save(cfg.Genre.StatsFile); err != nil {
+			log.Printf("Error saving genre stats: %v", err)
+		}
+	}
+	sendShutdownReport(ctx)
+
+	cancelRequests()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping HTTP server: %v", err)
+	}
+}
+
+// closeAllSessions closes every peer connection and waits for them to
+// finish closing, which is when the DTLS close alert has gone out.
+func closeAllSessions(ctx context.Context) {
+	sessions.mu.Lock()
+	all := make([]*session, 0, len(sessions.sessions))
+	for _, s := range sessions.sessions {
+		all = append(all, s)
+	}
+	sessions.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range all {
+		if s.pc == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *session) {
+			defer wg.Done()
+			if err := s.pc.Close(); err != nil {
+				log.Printf("Error closing session %s: %v", s.id, err)
+			}
+		}(s)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	for _, s := range all {
+		sessions.close(s.id, "shutdown")
+	}
+	log.Printf("Closed %d listener sessions", len(all))
+}
+
+// writeShuttingDown answers an offer while the server is shutting down.
+func writeShuttingDown(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(shutdownRetry.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(serverShuttingDown())
+}
+
+func serverShuttingDown() map[string]interface{} {
+	return map[string]interface{}{
+		"error":       "shutting_down",
+		"retry_after": int(shutdownRetry.Seconds()),
+	}
+}
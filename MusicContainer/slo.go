@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every route records its latency and status codes. On top of that,
+// alerts.slos defines service level objectives for routes, such as 99% of
+// offers succeeding, checked over a sliding window. A route is burning its
+// error budget when it fails faster than the objective allows; the burn
+// rate is how many times faster. Crossing the SLO's burn_rate publishes an
+// "slo" status event with state "burning", and "ok" once it recovers, which
+// alert rules can notify on like any other event.
+//
+// A request fails when it is answered with a 5xx other than 503, which the
+// station uses to turn listeners away on purpose (offline, full, moved), or
+// when it takes longer than the SLO's latency.
+
+const sloSlot = 10 * time.Second
+
+var (
+	httpRequests = newCounter("radio_http_requests_total", "HTTP requests by route, method and status code.")
+	httpDuration = newHistogram("radio_http_request_duration_seconds", "HTTP request latency by route and method. Streams and WebSockets are left out.", defaultBuckets)
+	sloBurnRate  = newGauge("radio_slo_burn_rate", "How many times faster than its objective allows each SLO's route is failing.")
+)
+
+// statusRecorder notes the status a handler answers with. It passes
+// flushes and hijacks through for the streaming and WebSocket routes.
+type statusRecorder struct {
+	http.ResponseWriter
+	status    int
+	streaming bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	w.streaming = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection can't be hijacked")
+	}
+	w.status = http.StatusSwitchingProtocols
+	w.streaming = true
+	return h.Hijack()
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// instrument records the latency and status of every request to route.
+func instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r)
+		elapsed := time.Since(start)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpRequests.Inc("route", route, "method", r.Method, "code", strconv.Itoa(rec.status))
+		if !rec.streaming {
+			httpDuration.Observe(elapsed.Seconds(), "route", route, "method", r.Method)
+		}
+		for _, s := range slos[route] {
+			s.record(rec.status, elapsed, rec.streaming)
+		}
+	}
+}
+
+type sloCount struct {
+	slot       int64
+	total, bad int
+}
+
+// slo tracks one objective over a ring of ten second slots.
+type slo struct {
+	c       SLOConfig
+	slots   []sloCount
+	burning bool
+}
+
+// slos are the objectives by route. It is filled in before the routes are
+// registered and only read after; sloMu guards the slots.
+var (
+	slos  = make(map[string][]*slo)
+	sloMu sync.Mutex
+)
+
+func (s *slo) record(status int, elapsed time.Duration, streaming bool) {
+	bad := (status >= 500 && status != http.StatusServiceUnavailable) ||
+		(!streaming && s.c.Latency > 0 && elapsed > time.Duration(s.c.Latency))
+	slot := time.Now().UnixNano() / int64(sloSlot)
+	sloMu.Lock()
+	defer sloMu.Unlock()
+	c := &s.slots[slot%int64(len(s.slots))]
+	if c.slot != slot {
+		*c = sloCount{slot: slot}
+	}
+	c.total++
+	if bad {
+		c.bad++
+	}
+}
+
+// counts sums the slots within the window.
+func (s *slo) counts() (total, bad int) {
+	oldest := time.Now().UnixNano()/int64(sloSlot) - int64(len(s.slots)) + 1
+	sloMu.Lock()
+	defer sloMu.Unlock()
+	for _, c := range s.slots {
+		if c.slot >= oldest {
+			total += c.total
+			bad += c.bad
+		}
+	}
+	return total, bad
+}
+
+func (c SLOConfig) validate() error {
+	switch {
+	case c.Name == "" || c.Route == "":
+		return fmt.Errorf("every SLO needs a name and a route")
+	case c.Objective <= 0 || c.Objective >= 1:
+		return fmt.Errorf("SLO %s: objective must be between 0 and 1, like 0.99", c.Name)
+	case time.Duration(c.Window) < sloSlot:
+		return fmt.Errorf("SLO %s: window must be at least %v", c.Name, sloSlot)
+	case c.BurnRate < 0:
+		return fmt.Errorf("SLO %s: burn_rate must not be negative", c.Name)
+	}
+	return nil
+}
+
+func setupSLOs(cs []SLOConfig) error {
+	var all []*slo
+	for _, c := range cs {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if c.BurnRate == 0 {
+			c.BurnRate = 1
+		}
+		s := &slo{c: c, slots: make([]sloCount, time.Duration(c.Window)/sloSlot)}
+		slos[c.Route] = append(slos[c.Route], s)
+		all = append(all, s)
+	}
+	if len(all) > 0 {
+		go runSLOs(all)
+		log.Printf("Watching %d SLOs", len(all))
+	}
+	return nil
+}
+
+func runSLOs(all []*slo) {
+	for range time.Tick(sloSlot) {
+		for _, s := range all {
+			s.evaluate()
+		}
+	}
+}
+
+func (s *slo) evaluate() {
+	total, bad := s.counts()
+	burn := 0.0
+	if total > 0 {
+		burn = float64(bad) / float64(total) / (1 - s.c.Objective)
+	}
+	sloBurnRate.Set(burn, "slo", s.c.Name)
+
+	// Too few requests to say anything, stay as we are
+	if total < s.c.MinRequests {
+		return
+	}
+	burning := burn >= s.c.BurnRate
+	if burning == s.burning {
+		return
+	}
+	s.burning = burning
+	state := "ok"
+	if burning {
+		state = "burning"
+		log.Printf("WARNING: SLO %s is burning its error budget %.1fx too fast (%d of %d requests to %s failed)", s.c.Name, burn, bad, total, s.c.Route)
+	} else {
+		log.Printf("SLO %s recovered", s.c.Name)
+	}
+	status.Publish("slo", map[string]interface{}{
+		"slo":          s.c.Name,
+		"route":        s.c.Route,
+		"state":        state,
+		"burn_rate":    burn,
+		"success_rate": 1 - float64(bad)/float64(total),
+		"requests":     total,
+		"window":       s.c.Window,
+	})
+}
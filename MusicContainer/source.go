@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"chobinbeats/ingestframe"
+)
+
+// The generator's PCM reaches the server through an AudioSource. Where
+// pipe_path (or --input for the main pipe) is a plain path, that is a named
+// pipe on this host, as it always was. The other sources let the generator
+// run somewhere else:
+//
+//	-              stdin, e.g. `python generator.py | webrtc_server --input -`
+//	tcp://:9000    listens and reads from one generator connection at a time
+//	udp://:9000    listens and reads datagrams from anyone who sends them
+//	testtone       beeps for measuring latency downstream, see testtone.go
+//
+// None of these authenticate; bind them to a private address, or use
+// network ingest (ingest.go) across untrusted networks.
+//
+// A generator may wrap its audio in ingestframe frames instead of sending
+// raw PCM. Every frame states its sample rate and channels, so a generator
+// running at the wrong format is turned away at its first frame instead of
+// playing as noise, and its timestamps show where audio went missing.
+// audio.framing is "auto" (frames when the stream starts with the frame
+// magic, raw PCM otherwise), "framed" to refuse raw PCM, or "raw".
+
+// AudioSource is somewhere raw PCM can be read from. Open is called again
+// whenever the stream it returned breaks.
+type AudioSource interface {
+	Open() (io.ReadCloser, error)
+	String() string
+}
+
+// formattedSource is an AudioSource that sends raw PCM in a format of its
+// own, whatever audio.framing and the input_ settings say.
+type formattedSource interface {
+	AudioSource
+	Format() ingestframe.Format
+}
+
+// errSourceDone is returned by Open when a source can't be read again.
+var errSourceDone = errors.New("source can't be reopened")
+
+// newAudioSource parses a pipe_path or --input value.
+func newAudioSource(input string) (AudioSource, error) {
+	switch {
+	case input == "-" || input == "stdin":
+		return &stdinSource{}, nil
+	case input == toneInput:
+		return toneSource{}, nil
+	case strings.HasPrefix(input, "tcp://"):
+		return &tcpSource{addr: strings.TrimPrefix(input, "tcp://")}, nil
+	case strings.HasPrefix(input, "udp://"):
+		return &udpSource{addr: strings.TrimPrefix(input, "udp://")}, nil
+	case strings.Contains(input, "://"):
+		return nil, fmt.Errorf("unknown audio input %q, want a path, -, tcp://, udp:// or testtone", input)
+	case input == "":
+		return nil, errors.New("no audio input given")
+	}
+	return pipeSource(input), nil
+}
+
+// pipeSource is a named pipe the generator writes into.
+type pipeSource string
+
+func (p pipeSource) Open() (io.ReadCloser, error) {
+	f, err := os.Open(string(p))
+	if err == nil {
+		// The previous process's descriptor, if any, has done its job
+		releaseHeldPipe(string(p))
+	}
+	return f, err
+}
+
+func (p pipeSource) String() string { return "pipe " + string(p) }
+
+// stdinSource is the server's standard input, which ends for good at EOF.
+type stdinSource struct {
+	opened bool
+}
+
+func (s *stdinSource) Open() (io.ReadCloser, error) {
+	if s.opened {
+		return nil, errSourceDone
+	}
+	s.opened = true
+	return io.NopCloser(os.Stdin), nil
+}
+
+func (s *stdinSource) String() string { return "stdin" }
+
+// tcpSource accepts one generator connection at a time.
+type tcpSource struct {
+	addr string
+	ln   net.Listener
+}
+
+func (t *tcpSource) Open() (io.ReadCloser, error) {
+	if t.ln == nil {
+		ln, err := net.Listen("tcp", t.addr)
+		if err != nil {
+			return nil, err
+		}
+		t.ln = ln
+	}
+	conn, err := t.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Audio input connection from %s", conn.RemoteAddr())
+	return conn, nil
+}
+
+func (t *tcpSource) String() string { return "tcp://" + t.addr }
+
+// udpSource reads datagrams of PCM. Lost datagrams are simply missing from
+// the stream, and ones that aren't whole samples are dropped so a bad packet
+// can't shift every sample after it.
+type udpSource struct {
+	addr string
+	conn net.PacketConn
+}
+
+func (u *udpSource) Open() (io.ReadCloser, error) {
+	if u.conn == nil {
+		conn, err := net.ListenPacket("udp", u.addr)
+		if err != nil {
+			return nil, err
+		}
+		u.conn = conn
+	}
+	return &udpReader{conn: u.conn, buf: make([]byte, 65536), sampleSize: rawFormat().BytesPerSample()}, nil
+}
+
+func (u *udpSource) String() string { return "udp://" + u.addr }
+
+// udpReader turns datagrams into a stream. Closing it leaves the socket
+// open for the next Open.
+type udpReader struct {
+	conn       net.PacketConn
+	buf        []byte
+	rest       []byte
+	sampleSize int
+}
+
+func (r *udpReader) Read(p []byte) (int, error) {
+	for len(r.rest) == 0 {
+		n, _, err := r.conn.ReadFrom(r.buf)
+		if err != nil {
+			return 0, err
+		}
+		if n%r.sampleSize == 0 {
+			r.rest = r.buf[:n]
+		}
+	}
+	n := copy(p, r.rest)
+	r.rest = r.rest[n:]
+	return n, nil
+}
+
+func (r *udpReader) Close() error { return nil }
+
+// pcmFormat is the format of the station's PCM in ingestframe terms.
+func pcmFormat(sampleRate, channels int) ingestframe.Format {
+	return ingestframe.Format{
+		Encoding:   ingestframe.EncodingS16LE,
+		Channels:   uint8(channels),
+		SampleRate: uint32(sampleRate),
+	}
+}
+
+// rawFormat is the format of raw PCM from the generator, as given by
+// audio.input_format, input_rate and input_channels. Zero fields are the
+// station's.
+func rawFormat() ingestframe.Format {
+	f := pcmFormat(cfg.Audio.InputRate, cfg.Audio.InputChannels)
+	if cfg.Audio.InputFormat == "f32le" {
+		f.Encoding = ingestframe.EncodingF32LE
+	}
+	return f
+}
+
+// readAudio reads src and sends every full frame of PCM to frames, opening
+// it again whenever the stream breaks.
+func readAudio(src AudioSource, format ingestframe.Format, bytesPerFrame int, frames chan<- []byte) {
+	for {
+		log.Printf("Waiting for audio input from %s...", src)
+		in, err := src.Open()
+		if errors.Is(err, errSourceDone) {
+			log.Printf("Audio input %s has ended", src)
+			return
+		}
+		if err != nil {
+			log.Printf("Error opening audio input: %v. Retrying in 2s.", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		log.Printf("Connected to %s. Starting paced audio stream.", src)
+
+		r := bufio.NewReader(in)
+		var framed bool
+		if fs, ok := src.(formattedSource); ok {
+			conv := newInputConverter(src.String(), fs.Format(), format, bytesPerFrame)
+			err = readRawPCM(r, bytesPerFrame, conv, frames)
+		} else if framed, err = detectFraming(r); err == nil && framed {
+			log.Printf("Audio input %s is framed", src)
+			err = readIngestFrames(src.String(), r, format, bytesPerFrame, frames)
+		} else if err == nil {
+			conv := newInputConverter(src.String(), rawFormat(), format, bytesPerFrame)
+			err = readRawPCM(r, bytesPerFrame, conv, frames)
+		}
+		log.Printf("Error reading audio input: %v. Will attempt to reconnect.", err)
+
+		// Close the current stream and try to reopen.
+		in.Close()
+	}
+}
+
+// detectFraming reports whether the stream carries ingestframe frames, by
+// audio.framing and the first bytes the generator sends.
+func detectFraming(r *bufio.Reader) (bool, error) {
+	if cfg.Audio.Framing == "raw" {
+		return false, nil
+	}
+	magic, err := r.Peek(len(ingestframe.Magic))
+	if err != nil {
+		return false, err
+	}
+	framed := string(magic) == ingestframe.Magic
+	if !framed && cfg.Audio.Framing == "framed" {
+		return false, errors.New("audio.framing is framed but the generator sends raw PCM")
+	}
+	return framed, nil
+}
+
+// readRawPCM sends every full frame of PCM to frames until the stream
+// breaks, converting it first with conv if it isn't nil.
+func readRawPCM(r io.Reader, bytesPerFrame int, conv *inputConverter, frames chan<- []byte) error {
+	for {
+		// Read a full frame's worth of PCM data.
+		// This will block until the generator writes data, which is what we want.
+		pcmBuffer := pcmBytes.get(bytesPerFrame)
+		_, err := io.ReadFull(r, pcmBuffer)
+		if err == nil {
+			err = chaos.pipeRead()
+		}
+		if err != nil {
+			pcmBytes.put(pcmBuffer)
+			return err
+		}
+		if conv != nil {
+			// push copies what it keeps
+			conv.push(pcmBuffer, frames)
+			pcmBytes.put(pcmBuffer)
+			continue
+		}
+		frames <- pcmBuffer
+	}
+}
+
+// startAudioInput parses input and reads it on its own goroutine.
+func startAudioInput(input string, format ingestframe.Format, bytesPerFrame int, frames chan<- []byte) error {
+	src, err := newAudioSource(input)
+	if err != nil {
+		return err
+	}
+	go readAudio(src, format, bytesPerFrame, frames)
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// When the generator is gone (the pipe is missing, or being reopened) the
+// server keeps the track alive instead of going quiet on the wire, which
+// browsers take for a dead stream. After audio.standby.after without PCM it
+// sends encoded silence, or with mode "loop" a standby clip on repeat, at
+// the usual frame cadence until the generator is back. The loop then
+// crossfades into the live audio like the bootstrap loop does. Standby
+// frames don't count as generator frames, so the station still goes
+// offline after audio.offline_after.
+
+var standbyFrames = newCounter("radio_standby_frames_total", "Frames of silence or standby loop sent while the generator was missing.")
+
+// standbyFiller fills the ticks the generator misses.
+type standbyFiller struct {
+	mode   string
+	loop   *bootstrapLoop // nil unless mode is "loop"
+	after  int            // missed ticks before standby starts
+	missed int
+	active bool
+}
+
+func newStandby(c StandbyConfig, sampleRate, channels, samplesPerFrame int, frameDuration time.Duration) *standbyFiller {
+	s := &standbyFiller{mode: c.Mode, after: int(time.Duration(c.After) / frameDuration)}
+	if c.Mode != "loop" {
+		return s
+	}
+	file := c.File
+	if file == "" {
+		file = cfg.Audio.BootstrapFile
+	}
+	loop, err := loadBootstrap(file, sampleRate, channels, samplesPerFrame)
+	if err != nil {
+		log.Printf("Error loading standby loop: %v. Sending silence instead.", err)
+		s.mode = "silence"
+		return s
+	}
+	// The fade is only wanted when the generator comes back
+	loop.fadeLeft = 0
+	s.loop = loop
+	return s
+}
+
+// fill writes a standby frame to pcm for a tick without PCM. It returns
+// false while standby is off or the gap is shorter than audio.standby.after.
+func (s *standbyFiller) fill(pcm []int16) bool {
+	s.missed++
+	if s.mode == "off" || s.missed <= s.after {
+		return false
+	}
+	if s.loop != nil {
+		s.loop.next(pcm)
+	} else {
+		clear(pcm)
+	}
+	if !s.active {
+		s.active = true
+		log.Printf("No audio from the generator, sending standby %s", s.mode)
+		status.Publish("audio_source", map[string]string{"source": "standby"})
+	}
+	standbyFrames.Inc()
+	return true
+}
+
+// resume is called with every frame of live PCM, and fades out of the loop
+// once the generator is back.
+func (s *standbyFiller) resume(pcm []int16) {
+	s.missed = 0
+	if s.active {
+		s.active = false
+		log.Println("Generator audio is back, leaving standby.")
+		status.Publish("audio_source", map[string]string{"source": "live"})
+		if s.loop != nil {
+			s.loop.fadeLeft = s.loop.fadeFrames
+		}
+	}
+	if s.loop != nil {
+		s.loop.blend(pcm)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Everything the server keeps on disk can be moved to another host as one
+// bundle: GET /state/export returns a tar.gz and POST /state/import unpacks
+// one into this server's own paths. A bundle holds
+//
+//	manifest.json         format version, station and when it was made
+//	config.json           the file given with -config, if any
+//	genre_stats.json      genre.stats_file
+//	dtls.pem              dtls.cert_file, so the pinned fingerprint survives
+//	presets/<name>.json   everything in preset_dir
+//	transitions/<name>.wav  everything in genre.transitions.dir
+//
+// The archive is left out; copy archive.dir separately if it should move.
+// Presets, genre stats and transition effects take effect on import; the
+// config and DTLS certificate are read at startup, so the server has to be
+// restarted for those.
+//
+// Unless the export asks for ?secrets=true, the secrets in config.json
+// (configSecrets) are removed and dtls.pem, which holds the private key, is
+// left out. Importing such a config keeps the secrets already in this
+// server's own config file. Both routes need an admin token or the admin
+// listener, since even without secrets a bundle describes the whole station.
+
+const (
+	stateFormat    = 1
+	maxStateImport = 256 << 20
+)
+
+// configFile is the -config path the server was started with.
+var configFile string
+
+// StateManifest describes a state bundle.
+type StateManifest struct {
+	Format  int       `json:"format"`
+	Station string    `json:"station"`
+	Version string    `json:"version"`
+	Created time.Time `json:"created"`
+	// Secrets is whether config secrets and dtls.pem are in the bundle
+	Secrets bool `json:"secrets"`
+}
+
+// configSecrets are the paths of the secrets in a config file; "*" is any
+// key or element.
+var configSecrets = [][]string{
+	{"admin", "token"},
+	{"auth", "secret"},
+	{"archive", "encryption", "key"},
+	{"alerts", "notifiers", "*", "url"},
+	{"alerts", "notifiers", "*", "password"},
+	{"audio", "ingest", "sources", "*", "stream_key"},
+	{"audio", "ingest", "sources", "*", "psk"},
+}
+
+// stateFiles lists the files a bundle is made of, by name in the bundle.
+// Key material is only listed with secrets.
+func stateFiles(secrets bool) map[string]string {
+	files := make(map[string]string)
+	if configFile != "" {
+		files["config.json"] = configFile
+	}
+	if cfg.Genre.StatsFile != "" {
+		files["genre_stats.json"] = cfg.Genre.StatsFile
+	}
+	if cfg.Genre.Blocklist.File != "" {
+		files["genre_blocklist.json"] = cfg.Genre.Blocklist.File
+	}
+	if cfg.DTLS.CertFile != "" && secrets {
+		files["dtls.pem"] = cfg.DTLS.CertFile
+	}
+	dirs := map[string]string{"presets": cfg.PresetDir + "/*.json", "transitions": cfg.Genre.Transitions.Dir + "/*.wav"}
+	for prefix, pattern := range dirs {
+		if strings.HasPrefix(pattern, "/*") {
+			continue
+		}
+		matches, _ := filepath.Glob(pattern)
+		for _, m := range matches {
+			files[prefix+"/"+filepath.Base(m)] = m
+		}
+	}
+	return files
+}
+
+// statePath is where an entry of an imported bundle goes on this server, or
+// "" if it has nowhere to go.
+func statePath(name string) string {
+	dir, file := path.Split(name)
+	stem := strings.TrimSuffix(strings.TrimSuffix(file, ".json"), ".wav")
+	switch {
+	case name == "config.json":
+		return configFile
+	case name == "genre_stats.json":
+		return cfg.Genre.StatsFile
+	case name == "genre_blocklist.json":
+		return cfg.Genre.Blocklist.File
+	case name == "dtls.pem":
+		return cfg.DTLS.CertFile
+	case dir == "presets/" && strings.HasSuffix(file, ".json") && presetNamePattern.MatchString(stem):
+		return presetPath(stem)
+	case dir == "transitions/" && strings.HasSuffix(file, ".wav") && presetNamePattern.MatchString(stem) && cfg.Genre.Transitions.Dir != "":
+		return filepath.Join(cfg.Genre.Transitions.Dir, file)
+	}
+	return ""
+}
+
+func handleStateExport(w http.ResponseWriter, r *http.Request) {
+	if !adminSecured() {
+		http.Error(w, "State export needs admin.token or the admin listener", http.StatusForbidden)
+		return
+	}
+	secrets := r.URL.Query().Get("secrets") == "true"
+	name := fmt.Sprintf("radio-state-%s-%s.tar.gz", cfg.Station.ID, time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+
+	// Save the latest stats first so the bundle has them
+	if cfg.Genre.StatsFile != "" {
+		if err := genreStats.save(cfg.Genre.StatsFile); err != nil {
+			log.Printf("Error saving genre stats for export: %v", err)
+		}
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest, _ := json.MarshalIndent(StateManifest{
+		Format:  stateFormat,
+		Station: cfg.Station.ID,
+		Version: buildVersion(),
+		Created: time.Now(),
+		Secrets: secrets,
+	}, "", "  ")
+	if err := writeStateEntry(tw, "manifest.json", manifest); err != nil {
+		log.Printf("Error exporting state: %v", err)
+		return
+	}
+	for entry, file := range stateFiles(secrets) {
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil && entry == "config.json" && !secrets {
+			data, err = redactConfig(data)
+		}
+		if err == nil {
+			err = writeStateEntry(tw, entry, data)
+		}
+		if err != nil {
+			// Headers are out, so all that can be done is cut the bundle short
+			log.Printf("Error exporting state: %s: %v", file, err)
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		log.Printf("Error exporting state: %v", err)
+		return
+	}
+	gz.Close()
+	log.Printf("Exported server state to %s (secrets: %v)", r.RemoteAddr, secrets)
+}
+
+// redactConfig removes configSecrets from a config file.
+func redactConfig(data []byte) ([]byte, error) {
+	var c interface{}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	for _, p := range configSecrets {
+		deleteConfigSecret(c, p)
+	}
+	return json.MarshalIndent(c, "", "  ")
+}
+
+// keepConfigSecrets puts the secrets of the config file in current into
+// imported, which came from a bundle without them.
+func keepConfigSecrets(imported, current []byte) ([]byte, error) {
+	var dst, src interface{}
+	if err := json.Unmarshal(imported, &dst); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(current, &src); err != nil {
+		return nil, err
+	}
+	for _, p := range configSecrets {
+		copyConfigSecret(dst, src, p)
+	}
+	return json.MarshalIndent(dst, "", "  ")
+}
+
+// deleteConfigSecret removes the secret at path from c.
+func deleteConfigSecret(c interface{}, path []string) {
+	m, isMap := c.(map[string]interface{})
+	if len(path) == 1 {
+		if isMap {
+			delete(m, path[0])
+		}
+		return
+	}
+	switch {
+	case path[0] != "*":
+		if isMap {
+			deleteConfigSecret(m[path[0]], path[1:])
+		}
+	case isMap:
+		for _, v := range m {
+			deleteConfigSecret(v, path[1:])
+		}
+	default:
+		list, _ := c.([]interface{})
+		for _, v := range list {
+			deleteConfigSecret(v, path[1:])
+		}
+	}
+}
+
+// copyConfigSecret copies the secret at path from src to dst, where dst
+// has the same object but not the secret. Map keys and list positions line
+// up since both come from the same station's config.
+func copyConfigSecret(dst, src interface{}, path []string) {
+	d, dMap := dst.(map[string]interface{})
+	s, sMap := src.(map[string]interface{})
+	if len(path) == 1 {
+		if v, ok := s[path[0]]; dMap && sMap && ok {
+			if _, ok := d[path[0]]; !ok {
+				d[path[0]] = v
+			}
+		}
+		return
+	}
+	switch {
+	case path[0] != "*":
+		if dMap && sMap {
+			copyConfigSecret(d[path[0]], s[path[0]], path[1:])
+		}
+	case dMap && sMap:
+		for k, v := range s {
+			copyConfigSecret(d[k], v, path[1:])
+		}
+	default:
+		dl, _ := dst.([]interface{})
+		sl, _ := src.([]interface{})
+		for i := 0; i < len(dl) && i < len(sl); i++ {
+			copyConfigSecret(dl[i], sl[i], path[1:])
+		}
+	}
+}
+
+func writeStateEntry(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// handleStateImport unpacks a bundle from /state/export. Nothing is written
+// unless the whole bundle reads cleanly.
+func handleStateImport(w http.ResponseWriter, r *http.Request) {
+	if !adminSecured() {
+		http.Error(w, "State import needs admin.token or the admin listener", http.StatusForbidden)
+		return
+	}
+	entries, manifest, err := readStateBundle(http.MaxBytesReader(w, r.Body, maxStateImport))
+	if err != nil {
+		http.Error(w, "Invalid state bundle: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data, ok := entries["config.json"]; ok {
+		var c Config
+		if err := json.Unmarshal(data, &c); err != nil {
+			http.Error(w, "Invalid state bundle: config.json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Without secrets in the bundle, keep the ones this server has
+		if current, err := os.ReadFile(configFile); err == nil && !manifest.Secrets {
+			if entries["config.json"], err = keepConfigSecrets(data, current); err != nil {
+				http.Error(w, "Invalid config file on this server: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	imported, skipped := []string{}, []string{}
+	restart := false
+	for name, data := range entries {
+		dest := statePath(name)
+		if dest == "" {
+			skipped = append(skipped, name)
+			continue
+		}
+		if err := writeStateFile(dest, data); err != nil {
+			log.Printf("Error importing %s to %s: %v", name, dest, err)
+			http.Error(w, fmt.Sprintf("Failed to import %s", name), http.StatusInternalServerError)
+			return
+		}
+		imported = append(imported, name)
+		switch {
+		case name == "config.json" || name == "dtls.pem":
+			restart = true
+		case name == "genre_stats.json":
+			if err := genreStats.load(dest); err != nil {
+				log.Printf("Error loading imported genre stats: %v", err)
+			}
+		case strings.HasPrefix(name, "transitions/"):
+			transitions.add(strings.TrimSuffix(path.Base(name), ".wav"), data)
+		}
+	}
+	log.Printf("Imported state from station %s (%d files, %d skipped)", manifest.Station, len(imported), len(skipped))
+	status.Publish("state_imported", map[string]interface{}{"station": manifest.Station, "files": len(imported)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"manifest":         manifest,
+		"imported":         imported,
+		"skipped":          skipped,
+		"restart_required": restart,
+	})
+}
+
+// readStateBundle reads every regular file in a bundle into memory.
+func readStateBundle(r io.Reader) (map[string][]byte, *StateManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(gz)
+	entries := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries[path.Clean(hdr.Name)] = data
+	}
+
+	var manifest StateManifest
+	data, ok := entries["manifest.json"]
+	if !ok {
+		return nil, nil, errors.New("no manifest.json")
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("manifest.json: %w", err)
+	}
+	if manifest.Format != stateFormat {
+		return nil, nil, fmt.Errorf("bundle format %d, this server reads %d", manifest.Format, stateFormat)
+	}
+	delete(entries, "manifest.json")
+	return entries, &manifest, nil
+}
+
+// writeStateFile replaces a file through a temporary one next to it.
+func writeStateFile(dest string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestStateConfigSecrets(t *testing.T) {
+	old := `{
+		"station": {"id": "main"},
+		"admin": {"token": "old-admin", "listen": ""},
+		"auth": {"secret": "old-auth", "required": true},
+		"alerts": {"notifiers": {"ops": {"type": "smtp", "password": "hunter2", "to": ["ops@example.com"]}}},
+		"audio": {"ingest": {"sources": [{"name": "studio", "stream_key": "sk", "psk": "psk"}]}}
+	}`
+	redacted, err := redactConfig([]byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"old-admin", "old-auth", "hunter2", `"sk"`, `"psk"`} {
+		if strings.Contains(string(redacted), secret) {
+			t.Errorf("redacted config still holds %s", secret)
+		}
+	}
+	var c Config
+	if err := json.Unmarshal(redacted, &c); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Auth.Required || c.Alerts.Notifiers["ops"].To[0] != "ops@example.com" || c.Audio.Ingest.Sources[0].Name != "studio" {
+		t.Errorf("redacting lost settings that aren't secrets: %s", redacted)
+	}
+
+	current := `{
+		"admin": {"token": "new-admin"},
+		"auth": {"secret": "new-auth"},
+		"alerts": {"notifiers": {"ops": {"password": "new-smtp"}}},
+		"audio": {"ingest": {"sources": [{"stream_key": "new-sk"}]}}
+	}`
+	merged, err := keepConfigSecrets(redacted, []byte(current))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = Config{}
+	if err := json.Unmarshal(merged, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Admin.Token != "new-admin" || c.Auth.Secret != "new-auth" || c.Alerts.Notifiers["ops"].Password != "new-smtp" ||
+		c.Audio.Ingest.Sources[0].StreamKey != "new-sk" {
+		t.Errorf("import didn't keep this server's secrets: %s", merged)
+	}
+	if c.Station.ID != "main" || !c.Auth.Required {
+		t.Errorf("import didn't take the bundle's settings: %s", merged)
+	}
+}
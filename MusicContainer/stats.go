@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// GET /api/stats is a server-side getStats() for dashboards: the encoder's
+// state, the generator pipe, uptime, the current genre and every listener's
+// connection in one poll. It is an admin endpoint since it lists sessions;
+// the numbers come from the same places as /api/encoder, /status and
+// /sessions, so it never disagrees with them.
+
+// ServerStats is the /api/stats response.
+type ServerStats struct {
+	Time    time.Time `json:"time"`
+	Started time.Time `json:"started"`
+	UptimeS int64     `json:"uptime_s"`
+	Genre   string    `json:"genre"`
+
+	Encoder   EncoderStats    `json:"encoder"`
+	Pipe      PipeStats       `json:"pipe"`
+	Listeners ListenerCounts  `json:"listeners"`
+	Sessions  []ListenerStats `json:"sessions"`
+}
+
+// EncoderStats is the encoder's state.
+type EncoderStats struct {
+	Config        EncoderConfig `json:"config"`    // as configured
+	Effective     EncoderConfig `json:"effective"` // with any bitrate cap applied
+	FramesEncoded uint64        `json:"frames_encoded"`
+	Errors        uint64        `json:"errors"`
+}
+
+// PipeStats is the state of the audio coming from the generator.
+type PipeStats struct {
+	Online    bool    `json:"online"`
+	Generator string  `json:"generator"` // as on the metadata channel
+	LastFrame float64 `json:"last_frame_s"`
+}
+
+// ListenerStats is one session's connection, from its receiver reports.
+type ListenerStats struct {
+	ID          string     `json:"id"`
+	Listener    string     `json:"listener,omitempty"`
+	State       string     `json:"state"`
+	Feed        string     `json:"feed,omitempty"`
+	Grade       string     `json:"grade,omitempty"`
+	PacketsLost int64      `json:"packets_lost"`
+	LossPct     float64    `json:"loss_pct"`
+	JitterMs    float64    `json:"jitter_ms"`
+	RTTMs       float64    `json:"rtt_ms,omitempty"`
+	RTCP        *RTCPStats `json:"rtcp,omitempty"`
+}
+
+func currentStats() ServerStats {
+	meta := currentMetadata()
+	st := ServerStats{
+		Time:    time.Now(),
+		Started: streamStarted,
+		UptimeS: meta.UptimeS,
+		Genre:   meta.Genre,
+		Encoder: EncoderStats{
+			Config:        currentEncoderConfig(),
+			Effective:     effectiveEncoderConfig(),
+			FramesEncoded: run.framesEncoded.Load(),
+		},
+		Pipe: PipeStats{
+			Online:    stationOnline.Load(),
+			Generator: meta.Generator,
+			LastFrame: pipelineDownFor().Seconds(),
+		},
+		Listeners: currentListeners(),
+		Sessions:  []ListenerStats{},
+	}
+	run.mu.Lock()
+	st.Encoder.Errors = run.errors["encoder"]
+	run.mu.Unlock()
+	for _, info := range sessions.List() {
+		st.Sessions = append(st.Sessions, ListenerStats{
+			ID:          info.ID,
+			Listener:    info.Listener,
+			State:       info.State,
+			Feed:        info.Feed,
+			Grade:       info.Grade,
+			PacketsLost: info.PacketsLost,
+			LossPct:     info.LossPct,
+			JitterMs:    info.JitterMs,
+			RTTMs:       info.RTTMs,
+			RTCP:        info.RTCP,
+		})
+	}
+	return st
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(currentStats())
+}
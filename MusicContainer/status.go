@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StatusEvent is one message on the station's status channel.
+type StatusEvent struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// statusHub fans status events out to every subscriber and remembers the
+// latest event of each type for the /status snapshot.
+type statusHub struct {
+	mu   sync.Mutex
+	subs map[chan StatusEvent]struct{}
+	last map[string]StatusEvent
+}
+
+var status = &statusHub{
+	subs: make(map[chan StatusEvent]struct{}),
+	last: make(map[string]StatusEvent),
+}
+
+func (h *statusHub) Publish(typ string, data interface{}) {
+	ev := StatusEvent{Type: typ, Time: time.Now(), Data: data}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last[typ] = ev
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			// Slow subscribers miss events rather than stalling publishers
+		}
+	}
+}
+
+// Subscribe returns a channel of future events and a function that must be
+// called to stop receiving them.
+func (h *statusHub) Subscribe() (<-chan StatusEvent, func()) {
+	ch := make(chan StatusEvent, 16)
+
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+func (h *statusHub) Snapshot() map[string]StatusEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]StatusEvent, len(h.last))
+	for k, v := range h.last {
+		out[k] = v
+	}
+	return out
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]interface{}{
+		"station":   cfg.Station.ID,
+		"genre":     getCurrentGenre(),
+		"latency":   latency.Report(),
+		"listeners": currentListeners(),
+		"events":    status.Snapshot(),
+	}
+	if u := fds.Usage(); u.Open >= 0 {
+		resp["file_descriptors"] = u
+	}
+	if st := dtlsStatus(); st != nil {
+		resp["dtls"] = st
+	}
+	if jobs := schedule.Status(); len(jobs) > 0 {
+		resp["jobs"] = jobs
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleStatusEvents streams the status channel as Server-Sent Events.
+func handleStatusEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := status.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chobinbeats/ingestframe"
+)
+
+// The generator can deliver its output as separate stems (drums, bass,
+// melody, ...), one pipe each. readStems keeps them in lockstep and the
+// pacing loop mixes them with the gains below, so the balance can change
+// without regenerating any audio. A station without stems is treated as a
+// single stem named "main" reading from Audio.PipePath.
+
+var (
+	stemMu    sync.Mutex
+	stemState []StemConfig
+
+	// Per-stem input queues, which network ingest writes into as well
+	stemInputs map[string]chan []byte
+
+	// Linear gain per stem, in stemState order, read on every frame
+	stemLevels atomic.Pointer[[]float64]
+)
+
+// setStems installs the station's stems and their starting gains.
+func setStems(stems []StemConfig) {
+	if len(stems) == 0 {
+		stems = []StemConfig{{Name: mainFeed, PipePath: cfg.Audio.PipePath}}
+	}
+	stemMu.Lock()
+	defer stemMu.Unlock()
+	stemState = append([]StemConfig(nil), stems...)
+	storeStemLevelsLocked()
+}
+
+func storeStemLevelsLocked() {
+	levels := make([]float64, len(stemState))
+	for i, s := range stemState {
+		if !s.Muted {
+			levels[i] = math.Pow(10, s.GainDB/20)
+		}
+	}
+	stemLevels.Store(&levels)
+}
+
+func currentStems() []StemConfig {
+	stemMu.Lock()
+	defer stemMu.Unlock()
+	return append([]StemConfig(nil), stemState...)
+}
+
+// StemUpdate changes one stem's gain or mute state. Fields left out of the
+// request keep their current value.
+type StemUpdate struct {
+	Name   string   `json:"name"`
+	GainDB *float64 `json:"gain_db"`
+	Muted  *bool    `json:"muted"`
+}
+
+// updateStems applies all updates or, if any of them is invalid, none.
+func updateStems(updates []StemUpdate) error {
+	stemMu.Lock()
+	defer stemMu.Unlock()
+
+	next := append([]StemConfig(nil), stemState...)
+	for _, u := range updates {
+		i := stemIndex(next, u.Name)
+		if i < 0 {
+			return fmt.Errorf("unknown stem %q", u.Name)
+		}
+		if u.GainDB != nil {
+			if *u.GainDB < -60 || *u.GainDB > 12 {
+				return fmt.Errorf("gain_db for %s must be between -60 and 12, got %v", u.Name, *u.GainDB)
+			}
+			next[i].GainDB = *u.GainDB
+		}
+		if u.Muted != nil {
+			next[i].Muted = *u.Muted
+		}
+	}
+	stemState = next
+	storeStemLevelsLocked()
+	return nil
+}
+
+func stemIndex(stems []StemConfig, name string) int {
+	for i, s := range stems {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// readStems reads every stem's pipe and sends one frame from each, in stem
+// order, for every tick. A stem that stalls holds the others back, which
+// keeps them aligned as long as the generator writes them together.
+func readStems(stems []StemConfig, format ingestframe.Format, bytesPerFrame int, drift *driftDetector, frames *frameRing) {
+	// Buffering happens in frames, sized by the latency budget
+	inputs := make([]chan []byte, len(stems))
+	byName := make(map[string]chan []byte, len(stems))
+	for i, s := range stems {
+		inputs[i] = make(chan []byte, 1)
+		byName[s.Name] = inputs[i]
+		if s.PipePath != "" {
+			if err := startAudioInput(s.PipePath, format, bytesPerFrame, inputs[i]); err != nil {
+				log.Fatalf("Error in stem %s input: %v", s.Name, err)
+			}
+		}
+	}
+	stemMu.Lock()
+	stemInputs = byName
+	stemMu.Unlock()
+
+	for {
+		// Only the time spent waiting for the generator counts towards its
+		// rate, not the time the ingest buffer is full
+		start := time.Now()
+		frame := make([][]byte, len(inputs))
+		for i, in := range inputs {
+			frame[i] = <-in
+		}
+		drift.observe(time.Since(start))
+		for _, f := range drift.convert(frame) {
+			frames.Push(f)
+		}
+	}
+}
+
+// mixStems sums one frame from every stem into out with the given linear
+// gains, clipping the result to 16 bits.
+func mixStems(stems [][]byte, levels []float64, out []int16) {
+	if len(stems) == 1 && levels[0] == 1 {
+		for i := range out {
+			out[i] = int16(binary.LittleEndian.Uint16(stems[0][i*2:]))
+		}
+		return
+	}
+	for i := range out {
+		var v float64
+		for s, buf := range stems {
+			if levels[s] != 0 {
+				v += float64(int16(binary.LittleEndian.Uint16(buf[i*2:]))) * levels[s]
+			}
+		}
+		if v > math.MaxInt16 {
+			v = math.MaxInt16
+		} else if v < math.MinInt16 {
+			v = math.MinInt16
+		}
+		out[i] = int16(v)
+	}
+}
+
+// handleStems reports the stem mix on GET and changes it on POST.
+func handleStems(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Stems []StemUpdate `json:"stems"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := updateStems(req.Stems); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Stem mix changed: %+v", currentStems())
+		status.Publish("stem_mix", currentStems())
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"stems": currentStems()})
+}
+
+// stemInput returns the queue frames for the named stem go into.
+func stemInput(name string) chan<- []byte {
+	stemMu.Lock()
+	defer stemMu.Unlock()
+	if name == commentaryFeed && commentaryInput != nil {
+		return commentaryInput
+	}
+	return stemInputs[name]
+}
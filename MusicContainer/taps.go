@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"chobinbeats/ingestframe"
+)
+
+// Tap points let an external process see, and optionally replace, the
+// station's audio at fixed points of the chain without forking the server:
+//
+//	post_ingest  PCM right after the stems are mixed
+//	post_dsp     PCM after gain and the other DSP, as it goes to the encoder
+//	post_encode  the Opus packets of the main feed
+//
+// Each tap in audio.taps dials its process over a unix or TCP socket and
+// streams ingestframe frames to it. A "send" tap only copies the audio out.
+// An "insert" tap on a PCM point also reads the processed frame back, with
+// the same timestamp, and puts it in place of the original; if the reply
+// doesn't come within the tap's timeout the frame passes through as it was,
+// so a stuck mastering chain never stalls the station. Taps only see the
+// main mix.
+
+const (
+	tapPostIngest = "post_ingest"
+	tapPostDSP    = "post_dsp"
+	tapPostEncode = "post_encode"
+
+	tapSend   = "send"
+	tapInsert = "insert"
+
+	tapDefaultTimeout = 10 * time.Millisecond
+	tapMaxRedial      = 30 * time.Second
+)
+
+var tapFrames = newCounter("radio_tap_frames_total", "Frames through tap points, by tap and result (sent, processed, bypassed).")
+
+func (c TapConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("every tap needs a name")
+	}
+	switch c.Point {
+	case tapPostIngest, tapPostDSP, tapPostEncode:
+	default:
+		return fmt.Errorf("tap %s: point must be post_ingest, post_dsp or post_encode, got %q", c.Name, c.Point)
+	}
+	switch c.Mode {
+	case "", tapSend:
+	case tapInsert:
+		if c.Point == tapPostEncode {
+			return fmt.Errorf("tap %s: post_encode taps can only send", c.Name)
+		}
+	default:
+		return fmt.Errorf("tap %s: mode must be send or insert, got %q", c.Name, c.Mode)
+	}
+	if _, _, err := tapAddress(c.Address); err != nil {
+		return fmt.Errorf("tap %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+// tapAddress splits "unix:/run/chain.sock" or "tcp:127.0.0.1:7000".
+func tapAddress(addr string) (network, address string, err error) {
+	network, address, ok := strings.Cut(addr, ":")
+	if !ok || address == "" || (network != "unix" && network != "tcp") {
+		return "", "", fmt.Errorf("address must be unix:<path> or tcp:<host:port>, got %q", addr)
+	}
+	return network, address, nil
+}
+
+type tap struct {
+	c       TapConfig
+	format  ingestframe.Format
+	timeout time.Duration
+
+	mu      sync.Mutex
+	conn    net.Conn // nil while disconnected
+	w       *ingestframe.Writer
+	replies chan *ingestframe.Frame
+
+	position uint64 // samples sent so far
+	buf      []byte
+}
+
+// TapStatus is one tap in /taps.
+type TapStatus struct {
+	TapConfig
+	Connected bool `json:"connected"`
+}
+
+type tapSet struct {
+	all     []*tap
+	byPoint map[string][]*tap
+}
+
+var taps = &tapSet{byPoint: make(map[string][]*tap)}
+
+func startTaps(cs []TapConfig, sampleRate, channels int) error {
+	seen := make(map[string]bool)
+	for _, c := range cs {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("tap %s is listed twice", c.Name)
+		}
+		seen[c.Name] = true
+		t := &tap{
+			c:       c,
+			timeout: time.Duration(c.Timeout),
+			format: ingestframe.Format{
+				Encoding:   ingestframe.EncodingS16LE,
+				Channels:   uint8(channels),
+				SampleRate: uint32(sampleRate),
+			},
+		}
+		if t.timeout <= 0 {
+			t.timeout = tapDefaultTimeout
+		}
+		if c.Point == tapPostEncode {
+			t.format.Encoding = ingestframe.EncodingOpus
+		}
+		taps.all = append(taps.all, t)
+		taps.byPoint[c.Point] = append(taps.byPoint[c.Point], t)
+		go t.run()
+		log.Printf("Tap %s at %s (%s) to %s", c.Name, c.Point, t.mode(), c.Address)
+	}
+	return nil
+}
+
+func (t *tap) mode() string {
+	if t.c.Mode == "" {
+		return tapSend
+	}
+	return t.c.Mode
+}
+
+// run keeps the tap connected, redialling with backoff.
+func (t *tap) run() {
+	network, address, _ := tapAddress(t.c.Address)
+	backoff := time.Second
+	for {
+		conn, err := net.DialTimeout(network, address, 5*time.Second)
+		if err != nil {
+			log.Printf("Error connecting tap %s: %v", t.c.Name, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > tapMaxRedial {
+				backoff = tapMaxRedial
+			}
+			continue
+		}
+		backoff = time.Second
+		log.Printf("Tap %s connected to %s", t.c.Name, t.c.Address)
+		replies := make(chan *ingestframe.Frame, 8)
+		t.mu.Lock()
+		t.conn, t.w, t.replies = conn, ingestframe.NewWriter(conn), replies
+		t.mu.Unlock()
+		status.Publish("tap", map[string]interface{}{"tap": t.c.Name, "connected": true})
+
+		t.read(conn, replies)
+
+		t.disconnect(conn)
+		log.Printf("Tap %s disconnected", t.c.Name)
+		status.Publish("tap", map[string]interface{}{"tap": t.c.Name, "connected": false})
+	}
+}
+
+// read passes the processed frames an insert tap gets back to the audio
+// loop. A send tap's process has nothing to say; anything it sends is read
+// and dropped so it can't fill the socket.
+func (t *tap) read(conn net.Conn, replies chan *ingestframe.Frame) {
+	fr := ingestframe.NewReader(bufio.NewReader(conn))
+	for {
+		f, err := fr.ReadFrame()
+		if err == ingestframe.ErrChecksum {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if t.mode() != tapInsert {
+			continue
+		}
+		// The payload is reused by the next read
+		f.Payload = append([]byte(nil), f.Payload...)
+		select {
+		case replies <- f:
+		default:
+			// The audio loop gave up on these frames already
+		}
+	}
+}
+
+func (t *tap) disconnect(conn net.Conn) {
+	conn.Close()
+	t.mu.Lock()
+	if t.conn == conn {
+		t.conn, t.w, t.replies = nil, nil, nil
+	}
+	t.mu.Unlock()
+}
+
+// write sends one frame. It never blocks the audio loop for longer than the
+// tap's timeout; a tap that can't keep up is disconnected.
+func (t *tap) write(payload []byte, samples int) (replies chan *ingestframe.Frame, ts uint64, ok bool) {
+	t.mu.Lock()
+	conn, w := t.conn, t.w
+	replies = t.replies
+	ts = t.position
+	t.position += uint64(samples)
+	t.mu.Unlock()
+	if conn == nil {
+		return nil, ts, false
+	}
+	conn.SetWriteDeadline(time.Now().Add(t.timeout))
+	if err := w.WriteFrame(&ingestframe.Frame{Format: t.format, Timestamp: ts, Payload: payload}); err != nil {
+		log.Printf("Error writing to tap %s: %v", t.c.Name, err)
+		t.disconnect(conn)
+		return nil, ts, false
+	}
+	return replies, ts, true
+}
+
+// pcm runs the frame through the PCM taps at point.
+func (ts *tapSet) pcm(point string, pcm []int16) {
+	for _, t := range ts.byPoint[point] {
+		t.pcm(pcm)
+	}
+}
+
+func (t *tap) pcm(pcm []int16) {
+	if cap(t.buf) < len(pcm)*2 {
+		t.buf = make([]byte, len(pcm)*2)
+	}
+	b := t.buf[:len(pcm)*2]
+	for i, s := range pcm {
+		binary.LittleEndian.PutUint16(b[i*2:], uint16(s))
+	}
+	replies, ts, ok := t.write(b, len(pcm)/int(t.format.Channels))
+	if !ok {
+		return
+	}
+	if t.mode() != tapInsert {
+		tapFrames.Inc("tap", t.c.Name, "result", "sent")
+		return
+	}
+
+	deadline := time.NewTimer(t.timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case f := <-replies:
+			if f.Timestamp < ts {
+				continue // a late reply to an earlier frame
+			}
+			if f.Timestamp > ts || f.Format != t.format || len(f.Payload) != len(b) {
+				log.Printf("Tap %s sent back a frame that doesn't match, bypassing it", t.c.Name)
+				tapFrames.Inc("tap", t.c.Name, "result", "bypassed")
+				return
+			}
+			for i := range pcm {
+				pcm[i] = int16(binary.LittleEndian.Uint16(f.Payload[i*2:]))
+			}
+			tapFrames.Inc("tap", t.c.Name, "result", "processed")
+			return
+		case <-deadline.C:
+			tapFrames.Inc("tap", t.c.Name, "result", "bypassed")
+			return
+		}
+	}
+}
+
+// packet sends an encoded packet to the post_encode taps.
+func (ts *tapSet) packet(packet []byte, samples int) {
+	for _, t := range ts.byPoint[tapPostEncode] {
+		if _, _, ok := t.write(packet, samples); ok {
+			tapFrames.Inc("tap", t.c.Name, "result", "sent")
+		}
+	}
+}
+
+func (ts *tapSet) Status() []TapStatus {
+	out := make([]TapStatus, 0, len(ts.all))
+	for _, t := range ts.all {
+		t.mu.Lock()
+		out = append(out, TapStatus{TapConfig: t.c, Connected: t.conn != nil})
+		t.mu.Unlock()
+	}
+	return out
+}
+
+// handleTaps lists the tap points and whether their processes are connected.
+func handleTaps(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(taps.Status())
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// The genre taxonomy gives the genres the station knows an ID, a display
+// name, labels per language, an emoji and synonyms. Every genre request is
+// resolved through it, so with a taxonomy that lists them, "Lo-Fi",
+// "lofi hip hop" and "chillhop" are all the genre "lofi": on air, in the
+// stats, in prompt overrides and in the logs. The prompt the generator gets
+// comes from the genre's prompt. Genres the taxonomy doesn't know are passed
+// through as they were typed.
+//
+// The built-in taxonomy has the web player's preset genres, for their
+// buttons, labels and emoji. It only matches their IDs and sets no prompts,
+// so the generator is asked for exactly the genre that was requested, as
+// before there was a taxonomy. genre.taxonomy replaces it with a JSON file
+// of the same form as GET /genres/taxonomy, whose names, labels and
+// synonyms are aliases and whose prompts are used.
+
+// TaxonomyGenre is one genre in the taxonomy.
+type TaxonomyGenre struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Prompt is what the generator is asked for, the ID if empty.
+	Prompt   string            `json:"prompt,omitempty"`
+	Emoji    string            `json:"emoji,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"` // by language, e.g. "pt-BR" or "pt"
+	Synonyms []string          `json:"synonyms,omitempty"`
+}
+
+var builtinGenres = []TaxonomyGenre{
+	{ID: "lofi", Name: "Lofi Hip Hop", Emoji: "☕", Labels: map[string]string{"pt": "Lofi Hip Hop", "es": "Lofi Hip Hop"}},
+	{ID: "synthwave", Name: "Synthwave", Emoji: "🌆"},
+	{ID: "disco-funk", Name: "Disco Funk", Emoji: "🪩"},
+	{ID: "cello", Name: "Cello", Emoji: "🎻", Labels: map[string]string{"pt": "Violoncelo", "es": "Violonchelo"}},
+	{ID: "jazz", Name: "Jazz", Emoji: "🎷"},
+	{ID: "rock", Name: "Rock", Emoji: "🎸"},
+	{ID: "classical", Name: "Classical", Emoji: "🎼", Labels: map[string]string{"pt": "Clássica", "es": "Clásica"}},
+	{ID: "ambient", Name: "Ambient", Emoji: "🌌", Labels: map[string]string{"pt": "Ambiente", "es": "Ambiental"}},
+}
+
+type genreTaxonomy struct {
+	genres []TaxonomyGenre
+	byKey  map[string]*TaxonomyGenre
+}
+
+// taxonomy is replaced at startup by genre.taxonomy and read-only after.
+var taxonomy = mustTaxonomy(builtinGenres)
+
+func mustTaxonomy(genres []TaxonomyGenre) *genreTaxonomy {
+	t, err := newTaxonomy(genres, false)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// newTaxonomy indexes genres by their IDs and, with aliases, by every other
+// name they go by. Two genres may not share one.
+func newTaxonomy(genres []TaxonomyGenre, aliases bool) (*genreTaxonomy, error) {
+	t := &genreTaxonomy{genres: genres, byKey: make(map[string]*TaxonomyGenre)}
+	for i := range genres {
+		g := &genres[i]
+		if taxonomyKey(g.ID) == "" {
+			return nil, fmt.Errorf("genre %d has no id", i)
+		}
+		names := []string{g.ID}
+		if aliases {
+			names = append(names, g.Name, g.Prompt)
+			names = append(names, g.Synonyms...)
+			for _, label := range g.Labels {
+				names = append(names, label)
+			}
+		}
+		for _, name := range names {
+			key := taxonomyKey(name)
+			if key == "" {
+				continue
+			}
+			if other := t.byKey[key]; other != nil && other != g {
+				return nil, fmt.Errorf("%q is both %s and %s", name, other.ID, g.ID)
+			}
+			t.byKey[key] = g
+		}
+	}
+	return t, nil
+}
+
+// loadTaxonomy reads a taxonomy file.
+func loadTaxonomy(path string) (*genreTaxonomy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Genres []TaxonomyGenre `json:"genres"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return newTaxonomy(file.Genres, true)
+}
+
+// taxonomyKey reduces a genre name to its letters and digits, lower case,
+// so spelling variants like "Lo-Fi" and "lofi" match.
+func taxonomyKey(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// Lookup returns the genre name goes by, or nil.
+func (t *genreTaxonomy) Lookup(name string) *TaxonomyGenre {
+	return t.byKey[taxonomyKey(name)]
+}
+
+// Canonical returns the ID of the genre name goes by, or name tidied up
+// if the taxonomy doesn't know it.
+func (t *genreTaxonomy) Canonical(name string) string {
+	if g := t.Lookup(name); g != nil {
+		return g.ID
+	}
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// Prompt returns what the generator is asked for to play genre.
+func (t *genreTaxonomy) Prompt(genre string) string {
+	g := t.Lookup(genre)
+	if g == nil {
+		return genre
+	}
+	if g.Prompt != "" {
+		return g.Prompt
+	}
+	return g.ID
+}
+
+func handleTaxonomy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"genres": taxonomy.genres})
+}
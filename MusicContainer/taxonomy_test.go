@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestBuiltinTaxonomyKeepsPrompts(t *testing.T) {
+	builtin := mustTaxonomy(builtinGenres)
+	for _, genre := range []string{"lofi", "disco-funk", "Lofi Hip Hop", "chillhop", "Violoncelo"} {
+		if got := builtin.Prompt(builtin.Canonical(genre)); got != genre {
+			t.Errorf("the built-in taxonomy asks the generator for %q instead of %q", got, genre)
+		}
+	}
+
+	own, err := newTaxonomy([]TaxonomyGenre{{ID: "lofi", Name: "Lofi Hip Hop", Prompt: "lofi hip hop", Synonyms: []string{"chillhop"}}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := own.Canonical("chillhop"); got != "lofi" {
+		t.Errorf("Canonical(chillhop) = %q, want lofi", got)
+	}
+	if got := own.Prompt("lofi"); got != "lofi hip hop" {
+		t.Errorf("Prompt(lofi) = %q, want the operator's prompt", got)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Telemetry is off unless telemetry.enabled is set and telemetry.endpoint
+// names where to send it. Once a day (telemetry.interval) the server POSTs
+// a small report that tells the maintainers which features real deployments
+// use: the version, OS and architecture, the peak listener count rounded
+// into a bucket, and the names of the enabled features. It carries no
+// station names, addresses, genres, IDs or anything else that could tell
+// deployments apart. GET /telemetry shows exactly what would be sent,
+// whether or not telemetry is on.
+
+const telemetrySample = time.Minute
+
+// peakListeners is the most listeners seen since the last report.
+var peakListeners atomic.Int64
+
+// TelemetryReport is everything a telemetry report contains.
+type TelemetryReport struct {
+	Version       string   `json:"version"`
+	OS            string   `json:"os"`
+	Arch          string   `json:"arch"`
+	PeakListeners string   `json:"peak_listeners"`
+	Features      []string `json:"features"`
+}
+
+func startTelemetry(c TelemetryConfig) {
+	go func() {
+		for range time.Tick(telemetrySample) {
+			if n := int64(sessions.Count()); n > peakListeners.Load() {
+				peakListeners.Store(n)
+			}
+		}
+	}()
+	if !c.Enabled || c.Endpoint == "" {
+		return
+	}
+	every := max(time.Duration(c.Interval), time.Hour)
+	log.Printf("Sending anonymous usage telemetry to %s every %v, see GET /telemetry", c.Endpoint, every)
+	schedule.Every("telemetry", every, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := postJSON(ctx, c.Endpoint, telemetryReport()); err != nil {
+			return err
+		}
+		peakListeners.Store(int64(sessions.Count()))
+		return nil
+	})
+}
+
+func telemetryReport() TelemetryReport {
+	peak := peakListeners.Load()
+	if n := int64(sessions.Count()); n > peak {
+		peak = n
+	}
+	return TelemetryReport{
+		Version:       buildVersion(),
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		PeakListeners: listenerBucket(peak),
+		Features:      enabledFeatures(),
+	}
+}
+
+// buildVersion is the release version the binary was built with, else the
+// module version, or the VCS revision for builds from a checkout.
+func buildVersion() string {
+	if releaseVersion != "" {
+		return releaseVersion
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+			return s.Value[:12]
+		}
+	}
+	return "devel"
+}
+
+// listenerBucket rounds a listener count up to a power of ten, so the count
+// can't identify a deployment.
+func listenerBucket(n int64) string {
+	switch {
+	case n == 0:
+		return "0"
+	case n <= 10:
+		return "1-10"
+	case n <= 100:
+		return "11-100"
+	case n <= 1000:
+		return "101-1000"
+	}
+	return "1000+"
+}
+
+// enabledFeatures names the optional subsystems the config turns on.
+func enabledFeatures() []string {
+	on := map[string]bool{
+		"adaptive_bitrate":   adaptiveEnabled(),
+		"admin_listener":     cfg.Admin.Listen != "",
+		"alerts":             len(cfg.Alerts.Rules) > 0,
+		"archive":            cfg.Archive.Dir != "",
+		"archive_encryption": cfg.Archive.Dir != "" && archiveKey != nil,
+		"auto_dj":            cfg.Genre.AutoDJ.Enabled,
+		"auto_resample":      cfg.Audio.AutoResample,
+		"commentary":         commentaryEnabled(),
+		"ingest":             cfg.Audio.Ingest.Listen != "",
+		"listener_tokens":    cfg.Auth.Required,
+		"mixes":              len(cfg.Audio.Mixes) > 0,
+		"nack":               cfg.NACK.Enabled,
+		"schedule":           len(cfg.Genre.Schedule) > 0,
+		"single_udp_port":    cfg.ICE.UDPPort != 0,
+		"stems":              len(cfg.Audio.Stems) > 1,
+		"taps":               len(cfg.Audio.Taps) > 0,
+		"tiers":              len(cfg.Audio.Tiers) > 0,
+		"self_update":        cfg.Update.URL != "",
+	}
+	features := []string{}
+	for name, enabled := range on {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// handleTelemetry shows the report telemetry sends, and whether it is on.
+func handleTelemetry(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":  cfg.Telemetry.Enabled && cfg.Telemetry.Endpoint != "",
+		"endpoint": cfg.Telemetry.Endpoint,
+		"interval": cfg.Telemetry.Interval,
+		"report":   telemetryReport(),
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+
+	"chobinbeats/ingestframe"
+)
+
+// The test tone turns a station into a diagnostic one for integrators
+// checking the sync and latency of whatever sits downstream (an HLS
+// packager, an SFU, a casting receiver). With the input set to "testtone"
+// the station plays a beep at the start of every wall-clock second instead
+// of the generator:
+//
+//	toneBeepHz for toneBeep   every second
+//	toneMarkHz for toneBeep   on the minute, so a recording can be lined up
+//
+// and publishes a "test_tone" status event for each beep with the Unix
+// millisecond it belongs to. The audio is produced in real time against the
+// system clock, so the delay between beep_at and hearing the beep is the
+// whole path's latency, this server's buffering included. Sync the clocks
+// of both ends with NTP before trusting the numbers.
+
+const (
+	toneInput  = "testtone"
+	toneBeepHz = 1000
+	toneMarkHz = 2000
+	toneBeep   = 100 * time.Millisecond
+	toneLevel  = 0.5 // -6 dBFS
+	toneRate   = 48000
+)
+
+// ToneBeep is the data of a "test_tone" status event.
+type ToneBeep struct {
+	BeepAt    int64 `json:"beep_at"` // Unix milliseconds
+	Frequency int   `json:"frequency"`
+	Mark      bool  `json:"mark"` // the beep on the minute
+}
+
+// toneSource is the test tone as an AudioSource. It never ends.
+type toneSource struct{}
+
+func (toneSource) Open() (io.ReadCloser, error) {
+	return &toneReader{start: time.Now()}, nil
+}
+
+func (toneSource) String() string { return toneInput }
+
+// Format is the tone's own format, converted to the station's like any
+// other input.
+func (toneSource) Format() ingestframe.Format {
+	return pcmFormat(toneRate, 2)
+}
+
+// toneReader produces stereo s16le at toneRate, blocking on each read until
+// the audio in it is due.
+type toneReader struct {
+	start time.Time
+	pos   int64 // samples per channel produced so far
+}
+
+func (r *toneReader) Read(p []byte) (int, error) {
+	n := len(p) / 4
+	if n == 0 {
+		return 0, io.ErrShortBuffer
+	}
+	if ahead := time.Until(r.at(r.pos + int64(n))); ahead > 0 {
+		time.Sleep(ahead)
+	}
+	beepSamples := int64(toneBeep) * toneRate / int64(time.Second)
+	for i := 0; i < n; i++ {
+		t := r.at(r.pos)
+		into := t.Sub(t.Truncate(time.Second))
+		var v float64
+		if into < toneBeep {
+			hz := toneBeepHz
+			if t.Second() == 0 {
+				hz = toneMarkHz
+			}
+			if into < time.Second/toneRate {
+				status.Publish("test_tone", ToneBeep{BeepAt: t.Truncate(time.Second).UnixMilli(), Frequency: hz, Mark: hz == toneMarkHz})
+			}
+			// A short ramp at either end keeps the beep from clicking
+			k := int64(into) * toneRate / int64(time.Second)
+			env := math.Min(1, math.Min(float64(k), float64(beepSamples-k))/48)
+			v = toneLevel * env * math.Sin(2*math.Pi*float64(hz)*into.Seconds())
+		}
+		s := uint16(int16(v * math.MaxInt16))
+		binary.LittleEndian.PutUint16(p[i*4:], s)
+		binary.LittleEndian.PutUint16(p[i*4+2:], s)
+		r.pos++
+	}
+	return n * 4, nil
+}
+
+// at is the wall-clock time of sample pos.
+func (r *toneReader) at(pos int64) time.Time {
+	return r.start.Add(time.Duration(pos * int64(time.Second) / toneRate))
+}
+
+func (r *toneReader) Close() error { return nil }
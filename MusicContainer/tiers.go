@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Quality tiers serve the main mix at lower bitrates for listeners on slow
+// or metered connections. Every tier is encoded once per frame from the same
+// PCM as the main feed and published as a feed of its own ("tier-32k"), so
+// a listener changes quality by switching feeds, without renegotiating. The
+// main feed is the top tier, at the encoder's own bitrate.
+
+type qualityTier struct {
+	bitrate int
+	feed    string
+	encoder *hotEncoder
+}
+
+var (
+	tiersMu      sync.Mutex
+	tierBitrates []int // running tiers, lowest first
+)
+
+func tierFeed(bitrate int) string {
+	return fmt.Sprintf("tier-%dk", bitrate/1000)
+}
+
+// tierConfig is the encoder config for a tier: the station's, at the tier's
+// bitrate unless the station's own is lower.
+func tierConfig(bitrate int) EncoderConfig {
+	c := effectiveEncoderConfig()
+	if bitrate < c.Bitrate {
+		c.Bitrate = bitrate
+	}
+	return c
+}
+
+// startTiers starts an encoder for every configured tier. A tier that can't
+// start is logged and left out.
+func startTiers(sampleRate, channels int) []*qualityTier {
+	var tiers []*qualityTier
+	for _, bitrate := range cfg.Audio.Tiers {
+		feed := tierFeed(bitrate)
+		if err := acquireEncoder(feed); err != nil {
+			log.Printf("Error starting quality tier %s: %v", feed, err)
+			continue
+		}
+		encoder, err := newHotEncoder(sampleRate, channels, tierConfig(bitrate))
+		if err != nil {
+			log.Printf("Error starting quality tier %s: %v", feed, err)
+			continue
+		}
+		tiers = append(tiers, &qualityTier{bitrate: bitrate, feed: feed, encoder: encoder})
+		log.Printf("Serving quality tier %s", feed)
+	}
+
+	tiersMu.Lock()
+	for _, t := range tiers {
+		tierBitrates = append(tierBitrates, t.bitrate)
+	}
+	sort.Ints(tierBitrates)
+	tiersMu.Unlock()
+	return tiers
+}
+
+func (t *qualityTier) reconfigure() {
+	if err := t.encoder.Reconfigure(tierConfig(t.bitrate)); err != nil {
+		log.Printf("Error reconfiguring Opus encoder for tier %s: %v", t.feed, err)
+	}
+}
+
+// encode encodes the frame at the tier's bitrate and queues it for its
+// feed.
+func (t *qualityTier) encode(out *encodedFrame, pcm []int16, validator *opusValidator) {
+	packet, err := out.encode(t.encoder, pcm, validator)
+	if err != nil {
+		log.Printf("Error encoding tier %s: %v", t.feed, err)
+		return
+	}
+	out.send(t.feed, packet)
+}
+
+// stationBitrates lists the bitrates listeners can be given, lowest first.
+func stationBitrates() []int {
+	tiersMu.Lock()
+	bitrates := append([]int(nil), tierBitrates...)
+	tiersMu.Unlock()
+	main := effectiveEncoderConfig().Bitrate
+	var out []int
+	for _, b := range bitrates {
+		if b < main {
+			out = append(out, b)
+		}
+	}
+	return append(out, main)
+}
+
+// nearestBitrate returns the highest bitrate the station serves that is at
+// most want, or the lowest one.
+func nearestBitrate(want int) int {
+	bitrates := stationBitrates()
+	best := bitrates[0]
+	for _, b := range bitrates {
+		if b <= want {
+			best = b
+		}
+	}
+	return best
+}
+
+// qualityFeed is the feed carrying the main mix at bitrate.
+func qualityFeed(bitrate int) string {
+	if bitrate <= 0 || bitrate >= effectiveEncoderConfig().Bitrate {
+		return mainFeed
+	}
+	return tierFeed(bitrate)
+}
+
+// isQualityFeed reports whether feed is the main mix at some bitrate, as
+// opposed to another mix.
+func isQualityFeed(feed string) bool {
+	if feed == mainFeed {
+		return true
+	}
+	tiersMu.Lock()
+	defer tiersMu.Unlock()
+	for _, b := range tierBitrates {
+		if tierFeed(b) == feed {
+			return true
+		}
+	}
+	return false
+}
+
+// applyBitrateParam lets a client pick its tier with ?bitrate= on the offer,
+// overriding what its probe suggested. Adaptive bitrate keeps the listener
+// at or below it.
+func (s *session) applyBitrateParam(r *http.Request) {
+	if b, err := strconv.Atoi(r.URL.Query().Get("bitrate")); err == nil && b > 0 {
+		s.bitrate.Store(int64(nearestBitrate(b)))
+		s.maxBitrate.Store(int64(b))
+	}
+}
+
+// setBitrate moves a session to the tier closest to bitrate, unless the
+// listener has picked another mix.
+func (s *session) setBitrate(bitrate int) int {
+	bitrate = nearestBitrate(bitrate)
+	s.bitrate.Store(int64(bitrate))
+	if s.output != nil && isQualityFeed(s.output.Feed()) {
+		s.output.SetFeed(qualityFeed(bitrate))
+	}
+	return bitrate
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With auth.required set, listeners need a token to connect: the player
+// fetches one from /api/token right before it sends its offer, and passes
+// it as "Authorization: Bearer <token>" on /offer and WHEP, or as ?token= on
+// /ws, where browsers can't set headers. Tokens are signed with auth.secret
+// and expire after auth.ttl; nothing is stored per token. auth.origins
+// limits which pages may fetch them, so other sites can't embed the stream.
+// Renegotiating an existing session and handoffs from another server need
+// no token.
+
+const defaultTokenTTL = 5 * time.Minute
+
+var tokensIssued = newCounter("radio_listener_tokens_total", "Listener tokens issued, and offers refused for a missing or bad one.")
+
+type tokenIssuer struct {
+	secret []byte
+	ttl    time.Duration
+	// valid holds the expiry of tokens that passed the signature check,
+	// so a token presented on several requests is only verified once.
+	// Bad tokens aren't kept, so they can't crowd out good ones.
+	valid *ttlCache[string, time.Time]
+}
+
+var listenerTokens *tokenIssuer
+
+func setupListenerTokens(c AuthConfig) {
+	secret := []byte(c.Secret)
+	if len(secret) == 0 {
+		// Tokens from one server won't work on another, or after a restart
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+	ttl := time.Duration(c.TTL)
+	if ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+	listenerTokens = &tokenIssuer{secret: secret, ttl: ttl, valid: newTTLCache[string, time.Time]("listener_tokens", time.Minute, 4096)}
+	if c.Required {
+		log.Printf("Listeners need a token from /api/token (valid for %v)", ttl)
+	}
+}
+
+func (t *tokenIssuer) sign(payload string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue makes a token: its expiry, a nonce and the signature of both.
+func (t *tokenIssuer) Issue(ttl time.Duration) (string, time.Time) {
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	nonce := make([]byte, 9)
+	rand.Read(nonce)
+	payload := strconv.FormatInt(expires.Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString(nonce)
+	return payload + "." + t.sign(payload), expires
+}
+
+func (t *tokenIssuer) Valid(token string) bool {
+	if expires, ok := t.valid.Get(token); ok {
+		return time.Now().Before(expires)
+	}
+	expires, ok := t.verify(token)
+	if !ok {
+		return false
+	}
+	t.valid.Set(token, expires)
+	return time.Now().Before(expires)
+}
+
+// verify checks the token's signature and returns its expiry.
+func (t *tokenIssuer) verify(token string) (time.Time, bool) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	payload, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(t.sign(payload))) {
+		return time.Time{}, false
+	}
+	exp, _, _ := strings.Cut(payload, ".")
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
+
+// listenerToken returns the token a request carries, from its
+// Authorization header or its token query parameter.
+func listenerToken(r *http.Request) string {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return bearer
+	}
+	return r.URL.Query().Get("token")
+}
+
+// checkListenerToken returns the error an offer without a valid token is
+// refused with, or "" to let it through.
+func checkListenerToken(r *http.Request, handedOff bool) string {
+	if !cfg.Auth.Required || handedOff {
+		return ""
+	}
+	token := listenerToken(r)
+	switch {
+	case token == "":
+		tokensIssued.Inc("result", "missing")
+		return "token_required"
+	case listenerTokens.Valid(token):
+		return ""
+	case cfg.Admin.Token != "" && isAdmin(r):
+		return ""
+	default:
+		tokensIssued.Inc("result", "invalid")
+		return "invalid_token"
+	}
+}
+
+func writeTokenRejection(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", `Bearer realm="radio"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// allowedOrigin reports whether the page making r may fetch a token.
+func allowedOrigin(r *http.Request) bool {
+	if len(cfg.Auth.Origins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Same-origin GETs carry no Origin header, only a Referer
+		if u, err := url.Parse(r.Referer()); err == nil && u.Host != "" {
+			origin = u.Scheme + "://" + u.Host
+		}
+	}
+	for _, o := range cfg.Auth.Origins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleToken issues a listener token. Admins may ask for a longer one with
+// ?ttl=, e.g. for an external player.
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	ensureListenerCookie(w, r)
+	ttl := listenerTokens.ttl
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("Bad ttl %q", v), http.StatusBadRequest)
+			return
+		}
+		if cfg.Admin.Token == "" || !isAdmin(r) {
+			http.Error(w, "Only an admin may choose the ttl", http.StatusForbidden)
+			return
+		}
+		ttl = d
+	} else if !allowedOrigin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	token, expires := listenerTokens.Issue(ttl)
+	tokensIssued.Inc("result", "issued")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_at": expires,
+		"required":   cfg.Auth.Required,
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A short sound effect (a whoosh, a burst of static) can play over the
+// music whenever the genre changes, so a switch sounds like retuning an old
+// radio rather than a cut. The effects are WAV files in
+// genre.transitions.dir at the stream's sample rate, mono or with the
+// stream's channel count, and at most maxTransitionLength long.
+// genre.transitions.sound picks one by name, or "random".
+//
+//	GET    /transitions         the library and the selected effect
+//	PUT    /transitions         {"sound": "static", "level": 0.8}
+//	POST   /transitions/<name>  uploads a WAV file
+//	DELETE /transitions/<name>  removes one
+
+const (
+	maxTransitionLength = 10 * time.Second
+	maxTransitionUpload = 4 << 20
+)
+
+var transitionsPlayed = newCounter("radio_transitions_played_total", "Transition sound effects played on genre changes.")
+
+// transitionPlayer holds the effect library and the one playing, if any.
+type transitionPlayer struct {
+	mu         sync.Mutex
+	sampleRate int
+	channels   int
+	dir        string
+	clips      map[string][]int16 // read-only once loaded
+	sound      string
+	level      float64
+	playing    []int16 // what is left of the effect playing
+}
+
+var transitions = &transitionPlayer{clips: make(map[string][]int16)}
+
+// startTransitions loads the effects in c.Dir.
+func startTransitions(c TransitionsConfig, sampleRate, channels int) {
+	t := transitions
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sampleRate, t.channels = sampleRate, channels
+	t.dir, t.sound, t.level = c.Dir, c.Sound, c.Level
+	if c.Dir == "" {
+		return
+	}
+	matches, err := filepath.Glob(filepath.Join(c.Dir, "*.wav"))
+	if err != nil {
+		log.Printf("Error listing transition effects: %v", err)
+		return
+	}
+	for _, path := range matches {
+		name := strings.TrimSuffix(filepath.Base(path), ".wav")
+		if !presetNamePattern.MatchString(name) {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Skipping transition effect %s: %v", path, err)
+			continue
+		}
+		clip, err := t.decode(data)
+		if err != nil {
+			log.Printf("Skipping transition effect %s: %v", path, err)
+			continue
+		}
+		t.clips[name] = clip
+	}
+	if t.sound != "" && t.sound != "random" && t.clips[t.sound] == nil {
+		log.Printf("WARNING: transition effect %q not found in %s", t.sound, c.Dir)
+	}
+	log.Printf("Loaded %d transition effects from %s", len(t.clips), c.Dir)
+}
+
+// decode turns a WAV file into samples in the stream's format.
+func (t *transitionPlayer) decode(data []byte) ([]int16, error) {
+	// Check the declared size before readWAV allocates it
+	r := bytes.NewReader(data)
+	_, size, err := readWAVHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > int64(r.Len()) {
+		return nil, fmt.Errorf("truncated, %d of %d bytes of samples", r.Len(), size)
+	}
+	wav, err := readWAV(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	clip, err := wav.fit(t.sampleRate, t.channels)
+	if err != nil {
+		return nil, err
+	}
+	if len(clip) > int(maxTransitionLength.Seconds())*t.sampleRate*t.channels {
+		return nil, fmt.Errorf("longer than %v", maxTransitionLength)
+	}
+	return clip, nil
+}
+
+// trigger starts the selected effect, from the top if one is playing.
+func (t *transitionPlayer) trigger() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	name := t.sound
+	if name == "random" {
+		names := make([]string, 0, len(t.clips))
+		for n := range t.clips {
+			names = append(names, n)
+		}
+		if len(names) == 0 {
+			return
+		}
+		sort.Strings(names)
+		name = names[rand.Intn(len(names))]
+	}
+	clip := t.clips[name]
+	if clip == nil {
+		return
+	}
+	t.playing = clip
+	transitionsPlayed.Inc("sound", name)
+}
+
+// mix adds the next stretch of the effect playing to each frame. They must
+// all be the same length.
+func (t *transitionPlayer) mix(frames ...[]int16) {
+	t.mu.Lock()
+	if len(t.playing) == 0 {
+		t.mu.Unlock()
+		return
+	}
+	n := min(len(frames[0]), len(t.playing))
+	clip := t.playing[:n]
+	t.playing = t.playing[n:]
+	level := t.level
+	t.mu.Unlock()
+
+	for _, frame := range frames {
+		for i, s := range clip {
+			v := float64(frame[i]) + float64(s)*level
+			if v > math.MaxInt16 {
+				v = math.MaxInt16
+			} else if v < math.MinInt16 {
+				v = math.MinInt16
+			}
+			frame[i] = int16(v)
+		}
+	}
+}
+
+// TransitionSound is one effect in the /transitions listing.
+type TransitionSound struct {
+	Name     string  `json:"name"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+func (t *transitionPlayer) status() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sounds := make([]TransitionSound, 0, len(t.clips))
+	for name, clip := range t.clips {
+		seconds := float64(len(clip)) / float64(t.sampleRate*t.channels)
+		sounds = append(sounds, TransitionSound{Name: name, Duration: seconds})
+	}
+	sort.Slice(sounds, func(i, j int) bool { return sounds[i].Name < sounds[j].Name })
+	return map[string]interface{}{"sound": t.sound, "level": t.level, "sounds": sounds}
+}
+
+func handleTransitions(w http.ResponseWriter, r *http.Request) {
+	t := transitions
+	if name := strings.TrimPrefix(r.URL.Path, "/transitions/"); name != r.URL.Path {
+		if !presetNamePattern.MatchString(name) {
+			http.Error(w, "Invalid effect name", http.StatusBadRequest)
+			return
+		}
+		if t.dir == "" {
+			http.Error(w, "genre.transitions.dir is not set", http.StatusConflict)
+			return
+		}
+		ok := false
+		if r.Method == http.MethodDelete {
+			ok = deleteTransition(w, name)
+		} else {
+			ok = uploadTransition(w, r, name)
+		}
+		if !ok {
+			return
+		}
+	} else if r.Method == http.MethodPut {
+		var req struct {
+			Sound *string  `json:"sound"`
+			Level *float64 `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		t.mu.Lock()
+		if req.Sound != nil && *req.Sound != "" && *req.Sound != "random" && t.clips[*req.Sound] == nil {
+			t.mu.Unlock()
+			http.Error(w, "Effect not found", http.StatusNotFound)
+			return
+		}
+		if req.Level != nil && (*req.Level < 0 || *req.Level > 2) {
+			t.mu.Unlock()
+			http.Error(w, "level must be between 0 and 2", http.StatusBadRequest)
+			return
+		}
+		if req.Sound != nil {
+			t.sound = *req.Sound
+		}
+		if req.Level != nil {
+			t.level = *req.Level
+		}
+		log.Printf("Transition effect now %q at level %v", t.sound, t.level)
+		t.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.status())
+}
+
+// uploadTransition saves a WAV body as effect name, replacing any there was.
+// It writes the error response if it fails.
+func uploadTransition(w http.ResponseWriter, r *http.Request, name string) bool {
+	t := transitions
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxTransitionUpload+1))
+	if err != nil || len(data) > maxTransitionUpload {
+		http.Error(w, "Effect too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	clip, err := t.decode(data)
+	if err != nil {
+		http.Error(w, "Invalid effect: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		log.Printf("Error saving transition effect %s: %v", name, err)
+		http.Error(w, "Failed to save effect", http.StatusInternalServerError)
+		return false
+	}
+	if err := os.WriteFile(filepath.Join(t.dir, name+".wav"), data, 0644); err != nil {
+		log.Printf("Error saving transition effect %s: %v", name, err)
+		http.Error(w, "Failed to save effect", http.StatusInternalServerError)
+		return false
+	}
+	t.mu.Lock()
+	t.clips[name] = clip
+	t.mu.Unlock()
+	log.Printf("Transition effect %s uploaded", name)
+	return true
+}
+
+// add decodes a WAV file into the library as effect name. It is how
+// imported state reaches the player.
+func (t *transitionPlayer) add(name string, data []byte) {
+	clip, err := t.decode(data)
+	if err != nil {
+		log.Printf("Skipping transition effect %s: %v", name, err)
+		return
+	}
+	t.mu.Lock()
+	t.clips[name] = clip
+	t.mu.Unlock()
+}
+
+// deleteTransition removes effect name. It writes the error response if it
+// fails.
+func deleteTransition(w http.ResponseWriter, name string) bool {
+	t := transitions
+	t.mu.Lock()
+	_, found := t.clips[name]
+	delete(t.clips, name)
+	t.mu.Unlock()
+	if !found {
+		http.Error(w, "Effect not found", http.StatusNotFound)
+		return false
+	}
+	if err := os.Remove(filepath.Join(t.dir, name+".wav")); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error deleting transition effect %s: %v", name, err)
+	}
+	log.Printf("Transition effect %s deleted", name)
+	return true
+}
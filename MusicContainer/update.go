@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Self-update, for deployments without a CI/CD pipeline. A release is a
+// server binary at update.url and a manifest at update.url + ".manifest"
+// naming its version and SHA-256, signed with Ed25519. The server only
+// installs binaries whose manifest is signed by update.public_key, and only
+// versions newer than its own, so an old release can't be replayed to
+// downgrade it:
+//
+//	webrtc_server update keygen -out release      # once, keeps release.key
+//	webrtc_server update sign -key release.key -version v1.5.0 webrtc_server
+//	webrtc_server update -config station.json     # on the station
+//
+// Release binaries carry their version, set when building with
+// -ldflags "-X main.releaseVersion=v1.5.0". A build without one (a
+// development build) takes any signed release.
+//
+// The update command asks the running server to update itself through POST
+// /update, which installs the release and restarts into it; only with no
+// server running does it install the release itself.
+//
+// The restart is an exec, so only file descriptors survive it. Two are
+// handed over: the HTTP listening socket, so no request is refused, and a
+// read-write descriptor on every named pipe the generator writes into, so
+// the pipe always has a reader and the generator never sees EPIPE. The new
+// process closes a pipe's descriptor once it has opened the pipe itself.
+// Peer connections can't be handed over, since their ICE sockets and DTLS
+// and SRTP state live in this process: every session ends, listeners are
+// told to reconnect a few seconds later and hear a gap, and their sessions
+// can't be resumed. A handoff to a second server avoids that.
+
+const (
+	updateMaxSize    = 256 << 20
+	updateReconnect  = 3 * time.Second // how long listeners wait before reconnecting
+	listenFDVariable = "RADIO_LISTEN_FD"
+	pipeFDsVariable  = "RADIO_PIPE_FDS" // JSON object of pipe path -> descriptor
+)
+
+var (
+	updateMu     sync.Mutex // one update at a time
+	httpListener *net.TCPListener
+
+	heldPipesOnce sync.Once
+	heldPipesMu   sync.Mutex
+	heldPipes     map[string]*os.File // handed over by the previous process
+)
+
+// listenHTTP listens on addr, or takes over the socket a previous process
+// handed over across an exec.
+func listenHTTP(addr string) (net.Listener, error) {
+	if v := os.Getenv(listenFDVariable); v != "" {
+		os.Unsetenv(listenFDVariable)
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s %q", listenFDVariable, v)
+		}
+		f := os.NewFile(uintptr(fd), "http-listener")
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("taking over the HTTP listener: %w", err)
+		}
+		log.Printf("Took over the HTTP listener on %s from the previous process", ln.Addr())
+		if tcp, ok := ln.(*net.TCPListener); ok {
+			httpListener = tcp
+		}
+		return ln, nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	httpListener = ln.(*net.TCPListener)
+	return ln, nil
+}
+
+// releaseHeldPipe closes the descriptor the previous process kept open on
+// the named pipe at path, now that this process reads the pipe itself.
+func releaseHeldPipe(path string) {
+	heldPipesOnce.Do(func() {
+		heldPipes = make(map[string]*os.File)
+		v := os.Getenv(pipeFDsVariable)
+		if v == "" {
+			return
+		}
+		os.Unsetenv(pipeFDsVariable)
+		var fds map[string]int
+		if err := json.Unmarshal([]byte(v), &fds); err != nil {
+			log.Printf("Bad %s %q: %v", pipeFDsVariable, v, err)
+			return
+		}
+		for p, fd := range fds {
+			heldPipes[p] = os.NewFile(uintptr(fd), p)
+		}
+	})
+	heldPipesMu.Lock()
+	defer heldPipesMu.Unlock()
+	if f := heldPipes[path]; f != nil {
+		f.Close()
+		delete(heldPipes, path)
+	}
+}
+
+// audioPipes lists the named pipes the station reads audio from.
+func audioPipes() []string {
+	var inputs []string
+	stemMu.Lock()
+	for _, s := range stemState {
+		inputs = append(inputs, s.PipePath)
+	}
+	stemMu.Unlock()
+	if c := cfg.Audio.Commentary; c.Enabled {
+		inputs = append(inputs, c.PipePath)
+	}
+	var pipes []string
+	for _, in := range inputs {
+		src, err := newAudioSource(in)
+		if err != nil {
+			continue
+		}
+		if p, ok := src.(pipeSource); ok {
+			if st, err := os.Stat(string(p)); err == nil && st.Mode()&os.ModeNamedPipe != 0 {
+				pipes = append(pipes, string(p))
+			}
+		}
+	}
+	return pipes
+}
+
+// releaseVersion is the version of a release build, see above.
+var releaseVersion string
+
+// release is a downloaded and verified server binary.
+type release struct {
+	binary  []byte
+	version string
+	sha256  string
+}
+
+// releaseManifest is what a release's signature covers.
+type releaseManifest struct {
+	Version   string `json:"version"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"` // base64, of signedPayload
+}
+
+func (m releaseManifest) signedPayload() []byte {
+	return []byte("infiniteradio-release\n" + m.Version + "\n" + m.SHA256 + "\n")
+}
+
+// parseVersion parses "v1.2.3", returning ok false for anything else.
+func parseVersion(v string) (parts [3]int, ok bool) {
+	fields := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	if !strings.HasPrefix(v, "v") || len(fields) != 3 {
+		return parts, false
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// newerVersion reports whether release is a version to move to from
+// running. A running build without a release version takes any release.
+func newerVersion(release, running string) (bool, error) {
+	r, ok := parseVersion(release)
+	if !ok {
+		return false, fmt.Errorf("release version %q is not of the form v1.2.3", release)
+	}
+	cur, ok := parseVersion(running)
+	if !ok {
+		return true, nil
+	}
+	for i := range r {
+		if r[i] != cur[i] {
+			return r[i] > cur[i], nil
+		}
+	}
+	return false, nil
+}
+
+func parseUpdateKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("update.public_key must be a base64 Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func download(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", url, limit)
+	}
+	return data, nil
+}
+
+// fetchManifest downloads the release's manifest and checks its signature.
+func fetchManifest(ctx context.Context, c UpdateConfig) (releaseManifest, error) {
+	var m releaseManifest
+	if c.URL == "" {
+		return m, fmt.Errorf("update.url is not set")
+	}
+	key, err := parseUpdateKey(c.PublicKey)
+	if err != nil {
+		return m, err
+	}
+	data, err := download(ctx, c.URL+".manifest", 4096)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("reading the release manifest: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil || !ed25519.Verify(key, m.signedPayload(), sig) {
+		return m, fmt.Errorf("the release at %s is not signed by update.public_key", c.URL)
+	}
+	return m, nil
+}
+
+// fetchRelease downloads the release if it is newer than the running
+// version, checking it against its signed manifest. It returns nil without
+// an error when there is nothing newer.
+func fetchRelease(ctx context.Context, c UpdateConfig) (*release, error) {
+	m, err := fetchManifest(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	newer, err := newerVersion(m.Version, buildVersion())
+	if err != nil || !newer {
+		return nil, err
+	}
+	binary, err := download(ctx, c.URL, updateMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(binary)
+	if sha := hex.EncodeToString(sum[:]); sha != m.SHA256 {
+		return nil, fmt.Errorf("the release at %s does not match its manifest", c.URL)
+	}
+	return &release{binary: binary, version: m.Version, sha256: m.SHA256}, nil
+}
+
+func executablePath() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// runningSHA256 is the checksum of the binary on disk.
+func runningSHA256() (string, error) {
+	exe, err := executablePath()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// install replaces the binary on disk with the release, keeping the old one
+// next to it as .old.
+func (r *release) install() error {
+	exe, err := executablePath()
+	if err != nil {
+		return err
+	}
+	tmp := exe + ".new"
+	if err := os.WriteFile(tmp, r.binary, 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(exe, exe+".old"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		os.Rename(exe+".old", exe)
+		return err
+	}
+	return nil
+}
+
+// checkAndInstall installs the release if it is newer than the running
+// version and differs from the binary on disk. It returns the release it
+// installed, or nil.
+func checkAndInstall(ctx context.Context, c UpdateConfig) (*release, error) {
+	r, err := fetchRelease(ctx, c)
+	if err != nil || r == nil {
+		return nil, err
+	}
+	if current, err := runningSHA256(); err == nil && current == r.sha256 {
+		return nil, nil
+	}
+	if err := r.install(); err != nil {
+		return nil, fmt.Errorf("installing: %w", err)
+	}
+	return r, nil
+}
+
+// restartIntoUpdate tells listeners to reconnect shortly, saves what would
+// otherwise be lost and execs the new binary, handing it the HTTP socket and
+// the generator's pipes. Every listener's session ends with the exec.
+func restartIntoUpdate() error {
+	exe, err := executablePath()
+	if err != nil {
+		return err
+	}
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, listenFDVariable+"=") && !strings.HasPrefix(kv, pipeFDsVariable+"=") {
+			env = append(env, kv)
+		}
+	}
+	// The handed over files must stay open until the exec, and are closed
+	// again if it doesn't happen
+	var handed []*os.File
+	defer func() {
+		for _, f := range handed {
+			f.Close()
+		}
+	}()
+	if httpListener != nil {
+		f, err := httpListener.File()
+		if err != nil {
+			return fmt.Errorf("handing over the HTTP listener: %w", err)
+		}
+		handed = append(handed, f)
+		if err := inheritable(f); err != nil {
+			return fmt.Errorf("handing over the HTTP listener: %w", err)
+		}
+		env = append(env, fmt.Sprintf("%s=%d", listenFDVariable, f.Fd()))
+	}
+	// Opened read-write, so opening doesn't wait for a writer and the pipe
+	// keeps a reader until the new process opens it
+	pipes := make(map[string]uintptr)
+	for _, p := range audioPipes() {
+		f, err := os.OpenFile(p, os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("handing over pipe %s: %w", p, err)
+		}
+		handed = append(handed, f)
+		if err := inheritable(f); err != nil {
+			return fmt.Errorf("handing over pipe %s: %w", p, err)
+		}
+		pipes[p] = f.Fd()
+	}
+	if len(pipes) > 0 {
+		fds, _ := json.Marshal(pipes)
+		env = append(env, pipeFDsVariable+"="+string(fds))
+	}
+
+	notifyRestart()
+	if cfg.Genre.StatsFile != "" {
+		if err := genreStats.save(cfg.Genre.StatsFile); err != nil {
+			log.Printf("Error saving genre stats: %v", err)
+		}
+	}
+	log.Printf("Restarting into the updated binary")
+	// Give the control channels a moment to deliver the notification
+	time.Sleep(500 * time.Millisecond)
+	return syscall.Exec(exe, os.Args, env)
+}
+
+// notifyRestart asks every listener with a control channel to reconnect to
+// this server once the new process is up. Their sessions end with this
+// process, so they connect from scratch.
+func notifyRestart() {
+	channels := sessions.controlChannels()
+	for _, c := range channels {
+		c.Notify("reconnect", map[string]interface{}{"url": "", "token": "", "after_ms": updateReconnect.Milliseconds()})
+	}
+	status.Publish("update", map[string]interface{}{"restarting": true, "listeners": len(channels)})
+}
+
+// handleUpdate shows the running binary and the configured release on GET.
+// POST installs the release and, unless ?restart=false, restarts into it.
+func handleUpdate(w http.ResponseWriter, r *http.Request) {
+	running, _ := runningSHA256()
+	resp := map[string]interface{}{
+		"running_version": buildVersion(),
+		"running_sha256":  running,
+		"url":             cfg.Update.URL,
+	}
+	if r.Method == http.MethodPost {
+		if !updateMu.TryLock() {
+			http.Error(w, "An update is already running", http.StatusConflict)
+			return
+		}
+		defer updateMu.Unlock()
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+		defer cancel()
+		rel, err := checkAndInstall(ctx, cfg.Update)
+		if err != nil {
+			log.Printf("Error updating: %v", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		installed := rel != nil
+		if installed {
+			resp["release_version"] = rel.version
+			resp["release_sha256"] = rel.sha256
+			log.Printf("Installed release %s (%s)", rel.version, rel.sha256)
+		}
+		resp["installed"] = installed
+		restart := installed && r.URL.Query().Get("restart") != "false"
+		resp["restarting"] = restart
+		if restart {
+			go func() {
+				// Let the response go out first
+				time.Sleep(100 * time.Millisecond)
+				updateMu.Lock()
+				if err := restartIntoUpdate(); err != nil {
+					log.Printf("Error restarting into the update: %v", err)
+				}
+				updateMu.Unlock()
+			}()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runUpdate implements the "update" command.
+func runUpdate(args []string) int {
+	cmd := "install"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("update "+cmd, flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("RADIO_CONFIG"), "path to a JSON config file")
+	url := fs.String("url", "", "release URL, instead of update.url")
+	keyFile := fs.String("key", "", "private key to sign with")
+	server := fs.String("server", "", "URL of the running server's admin API, if it isn't on this host's default port")
+	certFile := fs.String("cert", "", "operator client certificate for the admin listener, from the ca command")
+	certKey := fs.String("cert-key", "", "key of the -cert certificate")
+	version := fs.String("version", "", "the release's version, e.g. v1.5.0, for sign")
+	out := fs.String("out", "release", "file name prefix for keygen")
+	fs.Parse(args)
+
+	var err error
+	switch cmd {
+	case "install":
+		var c *Config
+		if c, err = loadConfig(*configPath); err != nil {
+			break
+		}
+		if *url != "" {
+			c.Update.URL = *url
+		}
+		err = updateInstall(c, *server, *certFile, *certKey)
+	case "keygen":
+		err = updateKeygen(*out)
+	case "sign":
+		if *keyFile == "" || *version == "" || fs.NArg() != 1 {
+			err = fmt.Errorf("usage: webrtc_server update sign -key release.key -version v1.5.0 <binary>")
+			break
+		}
+		err = updateSign(*keyFile, *version, fs.Arg(0))
+	default:
+		err = fmt.Errorf("unknown update command %q", cmd)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// updateInstall has the running server install the release and restart
+// into it. With no server answering, it installs the release for the next
+// start.
+func updateInstall(c *Config, server, certFile, certKey string) error {
+	client, base, err := adminClient(c, server, certFile, certKey)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, base+"/update", nil)
+	if err != nil {
+		return err
+	}
+	if c.Admin.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Admin.Token)
+	}
+	resp, err := client.Do(req)
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		fmt.Printf("No server is answering at %s; installing the release for its next start\n", base)
+		rel, err := checkAndInstall(context.Background(), c.Update)
+		if err != nil {
+			return err
+		}
+		if rel != nil {
+			fmt.Printf("Installed release %s\n", rel.version)
+		} else {
+			fmt.Println("Already on the latest release")
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("the server answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var result struct {
+		Installed  bool   `json:"installed"`
+		Version    string `json:"release_version"`
+		Restarting bool   `json:"restarting"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	switch {
+	case result.Restarting:
+		fmt.Printf("The server installed release %s and is restarting into it\n", result.Version)
+	case result.Installed:
+		fmt.Printf("The server installed release %s\n", result.Version)
+	default:
+		fmt.Println("The server is already running the latest release")
+	}
+	return nil
+}
+
+// adminClient returns a client for the running server's admin API and its
+// base URL: the admin listener when there is one, with the operator's
+// client certificate and the listener's own certificate pinned, otherwise
+// the public port.
+func adminClient(c *Config, server, certFile, certKey string) (*http.Client, string, error) {
+	if c.Admin.Listen == "" {
+		if server == "" {
+			server = "http://127.0.0.1:8080"
+		}
+		return &http.Client{Timeout: 6 * time.Minute}, strings.TrimSuffix(server, "/"), nil
+	}
+	if server == "" {
+		_, port, err := net.SplitHostPort(c.Admin.Listen)
+		if err != nil {
+			return nil, "", fmt.Errorf("admin.listen: %w", err)
+		}
+		server = "https://127.0.0.1:" + port
+	}
+	if certFile == "" || certKey == "" {
+		return nil, "", fmt.Errorf("the admin listener needs -cert and -cert-key")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, certKey)
+	if err != nil {
+		return nil, "", err
+	}
+	pemData, err := os.ReadFile(c.Admin.TLSCert)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading the admin listener's certificate: %w", err)
+	}
+	pinned, _ := pem.Decode(pemData)
+	if pinned == nil {
+		return nil, "", fmt.Errorf("no certificate found in %s", c.Admin.TLSCert)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// The listener's name rarely matches 127.0.0.1, so check that it
+		// is the configured certificate instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 || !bytes.Equal(raw[0], pinned.Bytes) {
+				return fmt.Errorf("the admin listener's certificate is not admin.tls_cert")
+			}
+			return nil
+		},
+	}
+	client := &http.Client{Timeout: 6 * time.Minute, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return client, strings.TrimSuffix(server, "/"), nil
+}
+
+// updateKeygen writes <out>.key (keep it secret) and <out>.pub, the value
+// for update.public_key.
+func updateKeygen(out string) error {
+	if _, err := os.Stat(out + ".key"); err == nil {
+		return fmt.Errorf("%s.key already exists", out)
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(out+".key", []byte(base64.StdEncoding.EncodeToString(priv)+"\n"), 0o600); err != nil {
+		return err
+	}
+	pubText := base64.StdEncoding.EncodeToString(pub)
+	if err := os.WriteFile(out+".pub", []byte(pubText+"\n"), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s.key and %s.pub. Set update.public_key to %s\n", out, out, pubText)
+	return nil
+}
+
+// updateSign writes the signed manifest <binary>.manifest next to the
+// binary.
+func updateSign(keyFile, version, binary string) error {
+	if _, ok := parseVersion(version); !ok {
+		return fmt.Errorf("version %q is not of the form v1.2.3", version)
+	}
+	keyText, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(keyText)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%s is not an Ed25519 private key from update keygen", keyFile)
+	}
+	data, err := os.ReadFile(binary)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	m := releaseManifest{Version: version, SHA256: hex.EncodeToString(sum[:])}
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.PrivateKey(key), m.signedPayload()))
+	out, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(binary+".manifest", append(out, '\n'), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s.manifest; publish it next to the binary\n", binary)
+	return nil
+}
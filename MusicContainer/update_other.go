@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// inheritable fails: this platform can't hand a socket across an exec, so
+// the server can't restart into an update in place.
+func inheritable(f *os.File) error {
+	return errors.New("restarting in place is not supported on this platform")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewerVersion(t *testing.T) {
+	for _, tc := range []struct {
+		release, running string
+		want             bool
+	}{
+		{"v1.5.0", "v1.4.9", true},
+		{"v1.10.0", "v1.9.0", true},
+		{"v2.0.0", "v1.99.99", true},
+		{"v1.4.0", "v1.4.0", false},
+		{"v1.3.9", "v1.4.0", false},
+		{"v0.9.0", "v1.0.0", false},
+		{"v1.0.0", "devel", true},
+		{"v1.0.0", "0123456789ab", true},
+	} {
+		got, err := newerVersion(tc.release, tc.running)
+		if err != nil {
+			t.Errorf("newerVersion(%q, %q): %v", tc.release, tc.running, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("newerVersion(%q, %q) = %v, want %v", tc.release, tc.running, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"", "1.2.3", "v1.2", "v1.2.x", "v1.2.3-rc1"} {
+		if _, err := newerVersion(bad, "v1.0.0"); err == nil {
+			t.Errorf("newerVersion(%q, ...) accepted a malformed version", bad)
+		}
+	}
+}
+
+// releaseServer serves binary at /webrtc_server with a manifest for version
+// signed by priv, and counts downloads of the binary.
+func releaseServer(t *testing.T, priv ed25519.PrivateKey, version string, binary []byte, signed []byte) (*httptest.Server, *int) {
+	t.Helper()
+	sum := sha256.Sum256(signed)
+	m := releaseManifest{Version: version, SHA256: hex.EncodeToString(sum[:])}
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, m.signedPayload()))
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/webrtc_server":
+			downloads++
+			w.Write(binary)
+		case "/webrtc_server.manifest":
+			w.Write(manifest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &downloads
+}
+
+func TestFetchReleaseRefusesDowngrade(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(v string) { releaseVersion = v }(releaseVersion)
+	releaseVersion = "v1.5.0"
+	binary := []byte("a server binary")
+
+	for _, version := range []string{"v1.4.0", "v1.5.0"} {
+		srv, downloads := releaseServer(t, priv, version, binary, binary)
+		c := UpdateConfig{URL: srv.URL + "/webrtc_server", PublicKey: base64.StdEncoding.EncodeToString(pub)}
+		rel, err := fetchRelease(context.Background(), c)
+		if err != nil {
+			t.Fatalf("%s: %v", version, err)
+		}
+		if rel != nil {
+			t.Errorf("%s: fetched a release that isn't newer than v1.5.0", version)
+		}
+		if *downloads != 0 {
+			t.Errorf("%s: downloaded the binary of a release that isn't newer", version)
+		}
+	}
+
+	srv, _ := releaseServer(t, priv, "v1.6.0", binary, binary)
+	c := UpdateConfig{URL: srv.URL + "/webrtc_server", PublicKey: base64.StdEncoding.EncodeToString(pub)}
+	rel, err := fetchRelease(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel == nil || rel.version != "v1.6.0" || string(rel.binary) != string(binary) {
+		t.Fatalf("fetchRelease = %+v, want v1.6.0", rel)
+	}
+}
+
+func TestFetchReleaseChecksManifest(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(v string) { releaseVersion = v }(releaseVersion)
+	releaseVersion = "v1.5.0"
+	key := base64.StdEncoding.EncodeToString(pub)
+
+	// Signed by a key other than update.public_key
+	srv, _ := releaseServer(t, other, "v1.6.0", []byte("binary"), []byte("binary"))
+	if _, err := fetchRelease(context.Background(), UpdateConfig{URL: srv.URL + "/webrtc_server", PublicKey: key}); err == nil {
+		t.Error("accepted a manifest signed by another key")
+	}
+
+	// A binary that isn't the one the manifest was signed for
+	srv, _ = releaseServer(t, priv, "v1.6.0", []byte("tampered"), []byte("binary"))
+	if _, err := fetchRelease(context.Background(), UpdateConfig{URL: srv.URL + "/webrtc_server", PublicKey: key}); err == nil {
+		t.Error("accepted a binary that doesn't match its manifest")
+	}
+}
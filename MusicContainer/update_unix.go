@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// inheritable keeps f open across an exec. File returns close-on-exec
+// copies, and the new process needs the socket open.
+func inheritable(f *os.File) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
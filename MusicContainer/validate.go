@@ -0,0 +1,772 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runValidate implements the "validate" command. It loads the config and
+// checks everything the server would trip over at startup or later, without
+// starting anything:
+//
+//	webrtc_server validate -config station.json
+//
+// It exits non-zero if any check fails; warnings don't affect the exit code.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("RADIO_CONFIG"), "path to a JSON config file")
+	fs.Parse(args)
+
+	rep := &validationReport{}
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		rep.fail("config", "%v", err)
+		rep.print()
+		return 1
+	}
+	if *configPath == "" {
+		rep.warn("config", "no config file given, checking the defaults")
+	} else {
+		rep.ok("config", "loaded %s", *configPath)
+	}
+	cfg = c
+
+	validateAudio(rep, c)
+	validateICE(rep, c)
+	validateTLS(rep, c)
+	validateCodec(rep, c)
+	validateFlags(rep, c)
+	validateGenre(rep, c)
+	validateStorage(rep, c)
+	validateAlerts(rep, c)
+	validateAPI(rep, c)
+	validateAuth(rep, c)
+	if err := c.RateLimit.validate(); err != nil {
+		rep.fail("rate_limit", "%v", err)
+	}
+	validateUpdate(rep, c)
+	validateHandoff(rep, c)
+	validateTelemetry(rep, c)
+	validateChaos(rep, c)
+	validateLights(rep, c)
+
+	rep.print()
+	if rep.failed {
+		return 1
+	}
+	return 0
+}
+
+type validationReport struct {
+	lines  []string
+	failed bool
+}
+
+func (r *validationReport) add(level, area, format string, args ...interface{}) {
+	r.lines = append(r.lines, fmt.Sprintf("%-4s  %-8s  %s", level, area, fmt.Sprintf(format, args...)))
+}
+
+func (r *validationReport) ok(area, format string, args ...interface{}) {
+	r.add("OK", area, format, args...)
+}
+
+func (r *validationReport) warn(area, format string, args ...interface{}) {
+	r.add("WARN", area, format, args...)
+}
+
+func (r *validationReport) fail(area, format string, args ...interface{}) {
+	r.failed = true
+	r.add("FAIL", area, format, args...)
+}
+
+func (r *validationReport) print() {
+	for _, l := range r.lines {
+		fmt.Println(l)
+	}
+	if r.failed {
+		fmt.Println("Config has errors.")
+	} else {
+		fmt.Println("Config looks good.")
+	}
+}
+
+// checkPipe reports on a path the generator is expected to write into.
+func checkPipe(rep *validationReport, what, path string) {
+	src, err := newAudioSource(path)
+	if err != nil {
+		rep.fail("audio", "%s: %v", what, err)
+		return
+	}
+	if _, ok := src.(pipeSource); !ok {
+		rep.ok("audio", "%s from %s", what, src)
+		return
+	}
+	info, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		// The generator creates its pipe when it starts
+		rep.warn("audio", "%s %s does not exist yet", what, path)
+	case err != nil:
+		rep.fail("audio", "%s %s: %v", what, path, err)
+	case info.Mode()&os.ModeNamedPipe == 0:
+		rep.warn("audio", "%s %s is not a named pipe", what, path)
+	default:
+		rep.ok("audio", "%s %s", what, path)
+	}
+}
+
+func validateAudio(rep *validationReport, c *Config) {
+	stems := c.Audio.Stems
+	if len(stems) == 0 {
+		checkPipe(rep, "pipe", c.Audio.PipePath)
+	}
+	switch c.Audio.Framing {
+	case "auto", "framed", "raw":
+	default:
+		rep.fail("audio", "framing must be auto, framed or raw, got %q", c.Audio.Framing)
+	}
+	switch c.Audio.InputFormat {
+	case "s16le", "f32le":
+	default:
+		rep.fail("audio", "input_format must be s16le or f32le, got %q", c.Audio.InputFormat)
+	}
+	if r := c.Audio.InputRate; r != 0 && (r < 8000 || r > 192000) {
+		rep.fail("audio", "input_rate %d is outside 8000 to 192000", r)
+	}
+	if f := time.Duration(c.Audio.FadeIn); f < 0 || f > 10*time.Second {
+		rep.fail("audio", "fade_in %v is outside 0 to 10s", f)
+	}
+	switch d := time.Duration(c.Audio.FrameDuration); d {
+	case 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond:
+	default:
+		rep.fail("audio", "frame_duration must be 10ms, 20ms, 40ms or 60ms, got %v", d)
+	}
+	if ch := c.Audio.Channels; ch != 1 && ch != 2 {
+		rep.fail("audio", "channels must be 1 or 2, got %d", ch)
+	}
+	if ch := c.Audio.InputChannels; ch < 0 || ch > 2 {
+		rep.fail("audio", "input_channels must be 0, 1 or 2, got %d", ch)
+	}
+	switch sb := c.Audio.Standby; sb.Mode {
+	case "silence", "off":
+	case "loop":
+		if sb.File == "" && c.Audio.BootstrapFile == "" {
+			rep.fail("audio", "standby mode loop needs standby.file or bootstrap_file")
+		}
+	default:
+		rep.fail("audio", "standby mode must be silence, loop or off, got %q", sb.Mode)
+	}
+	seen := make(map[string]bool)
+	for _, s := range stems {
+		if s.Name == "" || seen[s.Name] {
+			rep.fail("audio", "stem names must be unique and not empty (%q)", s.Name)
+		}
+		seen[s.Name] = true
+		if s.GainDB < -60 || s.GainDB > 12 {
+			rep.fail("audio", "stem %s gain_db must be between -60 and 12", s.Name)
+		}
+		if s.PipePath != "" {
+			checkPipe(rep, "stem "+s.Name, s.PipePath)
+		}
+	}
+	if len(stems) == 0 {
+		stems = []StemConfig{{Name: mainFeed}}
+	}
+	for _, m := range c.Audio.Mixes {
+		if m.Name == "" || m.Name == mainFeed {
+			rep.fail("audio", "mix needs a name other than %q", mainFeed)
+		}
+		for _, name := range append(m.Mute, m.Solo...) {
+			if stemIndex(stems, name) < 0 {
+				rep.fail("audio", "mix %s refers to unknown stem %q", m.Name, name)
+			}
+		}
+	}
+
+	tiers := make(map[string]bool)
+	for _, b := range c.Audio.Tiers {
+		feed := tierFeed(b)
+		switch {
+		case b < 6000 || b > 510000:
+			rep.fail("audio", "tier %d must be between 6000 and 510000", b)
+		case b >= c.Encoder.Bitrate:
+			rep.fail("audio", "tier %d must be below the encoder bitrate %d", b, c.Encoder.Bitrate)
+		case tiers[feed]:
+			rep.fail("audio", "tier %d is listed twice", b)
+		}
+		tiers[feed] = true
+	}
+
+	if cm := c.Audio.Commentary; cm.Enabled {
+		if cm.Bitrate < 6000 || cm.Bitrate > 510000 {
+			rep.fail("audio", "commentary bitrate must be between 6000 and 510000")
+		}
+		if stemIndex(stems, commentaryFeed) >= 0 {
+			rep.fail("audio", "no stem may be called %q while commentary is enabled", commentaryFeed)
+		}
+		if cm.PipePath != "" {
+			checkPipe(rep, "commentary pipe", cm.PipePath)
+		}
+	}
+
+	tapNames := make(map[string]bool)
+	for _, t := range c.Audio.Taps {
+		if err := t.validate(); err != nil {
+			rep.fail("audio", "%v", err)
+		} else if tapNames[t.Name] {
+			rep.fail("audio", "tap %s is listed twice", t.Name)
+		} else {
+			rep.ok("audio", "tap %s at %s", t.Name, t.Point)
+		}
+		tapNames[t.Name] = true
+	}
+
+	if c.Audio.BootstrapFile != "" {
+		f, err := os.Open(c.Audio.BootstrapFile)
+		if err == nil {
+			_, _, err = readWAVHeader(f)
+			f.Close()
+		}
+		if err != nil {
+			rep.fail("audio", "bootstrap_file %s: %v", c.Audio.BootstrapFile, err)
+		} else {
+			rep.ok("audio", "bootstrap_file %s", c.Audio.BootstrapFile)
+		}
+	}
+
+	switch c.Audio.PacketValidation {
+	case "", validateOff, validateLog, validateDrop, validateRepair:
+	default:
+		rep.fail("audio", "unknown packet_validation mode %q", c.Audio.PacketValidation)
+	}
+	if time.Duration(c.Audio.LatencyBudget) < 60*time.Millisecond {
+		rep.warn("audio", "latency_budget %v is below the 60ms minimum and will be raised", time.Duration(c.Audio.LatencyBudget))
+	}
+	if c.Audio.Prebuffer < 0 {
+		rep.fail("audio", "prebuffer must not be negative")
+	} else if c.Audio.Prebuffer >= c.Audio.LatencyBudget && c.Audio.Prebuffer > 0 {
+		rep.warn("audio", "prebuffer %v does not fit in latency_budget %v, which will be raised", time.Duration(c.Audio.Prebuffer), time.Duration(c.Audio.LatencyBudget))
+	}
+
+	if c.Audio.Ingest.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Audio.Ingest.Listen); err != nil {
+			rep.fail("ingest", "listen %q: %v", c.Audio.Ingest.Listen, err)
+		}
+		for _, src := range c.Audio.Ingest.Sources {
+			switch {
+			case src.StreamKey == "" && src.PSK == "" && src.CertCN == "":
+				rep.fail("ingest", "source %s has no credentials", src.Name)
+			case src.Station != c.Station.ID:
+				rep.warn("ingest", "source %s is bound to station %q, not this one", src.Name, src.Station)
+			default:
+				rep.ok("ingest", "source %s", src.Name)
+			}
+		}
+	}
+}
+
+func validateICE(rep *validationReport, c *Config) {
+	for _, server := range c.ICE.Servers {
+		turn := false
+		for _, u := range server.URLs {
+			scheme, rest, ok := strings.Cut(u, ":")
+			switch {
+			case !ok || (scheme != "stun" && scheme != "stuns" && scheme != "turn" && scheme != "turns"):
+				rep.fail("ice", "ICE server URL %q must start with stun:, stuns:, turn: or turns:", u)
+			case rest == "":
+				rep.fail("ice", "ICE server URL %q has no host", u)
+			default:
+				rep.ok("ice", "ICE server %s", u)
+			}
+			turn = turn || strings.HasPrefix(u, "turn")
+		}
+		if turn && server.Secret == "" && (server.Username == "" || server.Credential == "") {
+			rep.fail("ice", "TURN server %v needs a username and credential, or a secret", server.URLs)
+		}
+		if server.Secret != "" && (server.Username != "" || server.Credential != "") {
+			rep.warn("ice", "TURN server %v has a secret, its username and credential are ignored", server.URLs)
+		}
+	}
+	for _, cidr := range c.ICE.Prune.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			rep.fail("ice", "prune CIDR %q: %v", cidr, err)
+		}
+	}
+	p, err := newGatherPolicy(c.ICE)
+	if err != nil {
+		rep.fail("ice", "%v", err)
+	} else if len(p.interfaces) > 0 || len(p.skip) > 0 {
+		if ifaces, err := net.Interfaces(); err == nil {
+			used := 0
+			for _, iface := range ifaces {
+				if p.allowInterface(iface.Name) {
+					used++
+				}
+			}
+			if used == 0 {
+				rep.fail("ice", "no local interface is left to gather candidates on")
+			}
+		}
+	}
+	if err == nil && p.types != nil {
+		stun, turn := false, false
+		for _, server := range c.ICE.Servers {
+			for _, u := range server.URLs {
+				stun = stun || strings.HasPrefix(u, "stun")
+				turn = turn || strings.HasPrefix(u, "turn")
+			}
+		}
+		switch {
+		case p.types["relay"] && !turn && !p.types["host"] && !p.types["srflx"]:
+			rep.fail("ice", "candidate_types only allows relay, but no TURN server is configured")
+		case p.types["srflx"] && !stun && !p.types["host"] && !p.types["relay"]:
+			rep.fail("ice", "candidate_types only allows srflx, but no STUN server is configured")
+		case p.types["relay"] && !turn:
+			rep.warn("ice", "candidate_types allows relay, but no TURN server is configured")
+		case p.types["srflx"] && !stun:
+			rep.warn("ice", "candidate_types allows srflx, but no STUN server is configured")
+		default:
+			rep.ok("ice", "offering %s candidates", strings.Join(c.ICE.CandidateTypes, ", "))
+		}
+	}
+	if port := c.ICE.UDPPort; port != 0 {
+		if port < 1 || port > 65535 {
+			rep.fail("ice", "udp_port %d is not a port number", port)
+		} else if conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port)); err != nil {
+			rep.warn("ice", "udp_port %d: %v", port, err)
+		} else {
+			conn.Close()
+			rep.ok("ice", "ICE traffic goes through UDP port %d", port)
+		}
+	}
+}
+
+// checkKeyPair loads a certificate and key and warns about expiry.
+func checkKeyPair(rep *validationReport, area, certFile, keyFile string) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		rep.fail(area, "certificate %s / key %s: %v", certFile, keyFile, err)
+		return
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		rep.fail(area, "certificate %s: %v", certFile, err)
+		return
+	}
+	checkExpiry(rep, area, certFile, leaf)
+}
+
+func checkExpiry(rep *validationReport, area, file string, cert *x509.Certificate) {
+	left := time.Until(cert.NotAfter)
+	switch {
+	case left <= 0:
+		rep.fail(area, "certificate %s expired on %s", file, cert.NotAfter.Format(time.DateOnly))
+	case left < 30*24*time.Hour:
+		rep.warn(area, "certificate %s expires on %s", file, cert.NotAfter.Format(time.DateOnly))
+	default:
+		rep.ok(area, "certificate %s valid until %s", file, cert.NotAfter.Format(time.DateOnly))
+	}
+}
+
+func checkCA(rep *validationReport, area, file string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		rep.fail(area, "client CA %s: %v", file, err)
+		return
+	}
+	found := false
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			rep.fail(area, "client CA %s: %v", file, err)
+			return
+		}
+		found = true
+		checkExpiry(rep, area, file, cert)
+	}
+	if !found {
+		rep.fail(area, "client CA %s holds no certificates", file)
+	}
+}
+
+func validateTLS(rep *validationReport, c *Config) {
+	if a := c.Admin; a.Listen != "" {
+		if a.TLSCert == "" || a.TLSKey == "" || a.ClientCA == "" {
+			rep.fail("admin", "admin listener needs tls_cert, tls_key and client_ca")
+		} else {
+			checkKeyPair(rep, "admin", a.TLSCert, a.TLSKey)
+			checkCA(rep, "admin", a.ClientCA)
+		}
+	} else if a.Token == "" {
+		rep.warn("admin", "no admin token set, admin endpoints only answer requests from localhost")
+	}
+
+	in := c.Audio.Ingest
+	if in.TLSCert != "" {
+		checkKeyPair(rep, "ingest", in.TLSCert, in.TLSKey)
+	} else if in.Listen != "" {
+		rep.warn("ingest", "network ingest is not encrypted")
+	}
+	if in.ClientCA != "" {
+		checkCA(rep, "ingest", in.ClientCA)
+	}
+
+	if d := c.DTLS; d.CertFile != "" {
+		if time.Duration(d.Rotate) < time.Hour {
+			rep.fail("dtls", "rotate must be at least 1h")
+		}
+		cert, err := loadDTLSCert(d.CertFile)
+		switch {
+		case os.IsNotExist(err):
+			rep.ok("dtls", "%s will be created on startup", d.CertFile)
+		case err != nil:
+			rep.fail("dtls", "%v", err)
+		case dtlsDue(cert):
+			rep.warn("dtls", "certificate %s is due for rotation and will be replaced on startup", d.CertFile)
+		default:
+			rep.ok("dtls", "certificate %s rotates on %s", d.CertFile, cert.Expires().Add(-dtlsGrace).Format(time.DateOnly))
+		}
+	}
+}
+
+func validateCodec(rep *validationReport, c *Config) {
+	if err := c.Encoder.validate(); err != nil {
+		rep.fail("encoder", "%v", err)
+	} else {
+		rep.ok("encoder", "%d bps %s, complexity %d, %s", c.Encoder.Bitrate, c.Encoder.RateControl, c.Encoder.Complexity, c.Encoder.Application)
+	}
+	if err := c.DSP.validate(); err != nil {
+		rep.fail("dsp", "%v", err)
+	}
+	if err := c.Answer.validate(); err != nil {
+		rep.fail("answer", "%v", err)
+	}
+	if n := c.NACK; n.Enabled && (n.Buffer < 1 || n.Buffer > 32768 || n.Buffer&(n.Buffer-1) != 0) {
+		rep.fail("nack", "buffer must be a power of two up to 32768, got %d", n.Buffer)
+	}
+
+	q := c.Station.Quota
+	switch q.OverQuota {
+	case overQuotaReject, overQuotaDegrade, overQuotaWaitlist:
+	default:
+		rep.fail("quota", "unknown over_quota mode %q", q.OverQuota)
+	}
+	if q.MaxEncoders > 0 && 1+len(c.Audio.Mixes) > q.MaxEncoders {
+		rep.warn("quota", "max_encoders %d leaves some of the %d mixes without an encoder", q.MaxEncoders, len(c.Audio.Mixes))
+	}
+	if q.MaxEgressBitsPerSec > 0 && int64(perListenerBps(q.MinBitrate)) > q.MaxEgressBitsPerSec {
+		rep.fail("quota", "max_egress_bits_per_sec is too small for a single listener at min_bitrate")
+	}
+}
+
+func validateFlags(rep *validationReport, c *Config) {
+	for name, f := range c.Flags {
+		if _, ok := knownFlags[name]; !ok {
+			rep.warn("flags", "flag %s is not used by this version", name)
+		}
+		if err := f.validate(); err != nil {
+			rep.fail("flags", "flag %s: %v", name, err)
+		}
+	}
+}
+
+func validateGenre(rep *validationReport, c *Config) {
+	if c.Station.Timezone != "" {
+		if _, err := time.LoadLocation(c.Station.Timezone); err != nil {
+			rep.fail("station", "timezone %q: %v", c.Station.Timezone, err)
+		}
+	}
+	if c.Genre.Taxonomy != "" {
+		if t, err := loadTaxonomy(c.Genre.Taxonomy); err != nil {
+			rep.fail("genre", "taxonomy %s: %v", c.Genre.Taxonomy, err)
+		} else {
+			rep.ok("genre", "taxonomy has %d genres", len(t.genres))
+		}
+	}
+	for i, b := range c.Genre.Schedule {
+		if err := b.validate(); err != nil {
+			rep.fail("genre", "schedule block %d: %v", i+1, err)
+		}
+	}
+	for i, b := range c.Genre.LocalTime {
+		if err := b.validate(); err != nil {
+			rep.fail("genre", "local_time block %d: %v", i+1, err)
+		}
+	}
+	if c.Archive.Retention > 0 {
+		if _, _, err := parseClock(c.Archive.CleanupAt); err != nil {
+			rep.fail("archive", "cleanup_at: %v", err)
+		}
+	}
+
+	if t := c.Genre.Transitions; t.Dir != "" {
+		checkWritableDir(rep, "genre", t.Dir)
+		if t.Sound != "" && t.Sound != "random" {
+			if _, err := os.Stat(filepath.Join(t.Dir, t.Sound+".wav")); err != nil {
+				rep.fail("genre", "transitions.sound %q: %v", t.Sound, err)
+			}
+		}
+		if t.Level < 0 || t.Level > 2 {
+			rep.fail("genre", "transitions.level must be between 0 and 2, got %v", t.Level)
+		}
+	} else if c.Genre.Transitions.Sound != "" {
+		rep.fail("genre", "transitions.sound is set but transitions.dir is not")
+	}
+
+	bl := c.Genre.Blocklist
+	if bl.Votes < 0 {
+		rep.fail("genre", "blocklist.votes must not be negative, got %d", bl.Votes)
+	} else if bl.Votes > 0 && !c.Auth.ListenerIDs.Enabled {
+		rep.warn("genre", "blocklist.votes does nothing without auth.listener_ids, only admins can blocklist")
+	}
+	for _, g := range bl.Genres {
+		if normalizeGenre(g) == normalizeGenre(c.Genre.Default) {
+			rep.fail("genre", "the default genre %q is blocklisted", g)
+		}
+	}
+
+	a := c.Genre.AutoDJ
+	if !a.Enabled {
+		return
+	}
+	if a.Idle <= 0 {
+		rep.fail("genre", "auto_dj.idle must be positive")
+	}
+	if a.Top < 1 {
+		rep.fail("genre", "auto_dj.top must be at least 1")
+	}
+	if c.Genre.StatsFile == "" {
+		rep.warn("genre", "auto_dj without a stats_file starts from scratch on every restart")
+	}
+}
+
+func validateStorage(rep *validationReport, c *Config) {
+	checkWritableDir(rep, "presets", c.PresetDir)
+	if presets, err := listPresets(); err == nil {
+		for _, p := range presets {
+			if err := p.validate(); err != nil {
+				rep.fail("presets", "preset %s: %v", p.Name, err)
+			}
+		}
+		rep.ok("presets", "%d presets in %s", len(presets), c.PresetDir)
+	}
+	if c.Archive.Dir != "" {
+		checkWritableDir(rep, "archive", c.Archive.Dir)
+		switch key, err := loadArchiveKey(c.Archive.Encryption); {
+		case err != nil:
+			rep.fail("archive", "%v", err)
+		case key != nil && c.Admin.Token == "":
+			rep.fail("archive", "encrypted segments can only be downloaded with admin.token set")
+		case key != nil:
+			rep.ok("archive", "segments are encrypted")
+		}
+	}
+	if c.Genre.StatsFile != "" {
+		checkWritableDir(rep, "genre", filepath.Dir(c.Genre.StatsFile))
+	}
+}
+
+// checkWritableDir checks that the server can create files in dir, creating
+// it if needed just like the server would.
+func checkWritableDir(rep *validationReport, area, dir string) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		rep.fail(area, "%s: %v", dir, err)
+		return
+	}
+	f, err := os.CreateTemp(dir, ".validate-*")
+	if err != nil {
+		rep.fail(area, "%s is not writable: %v", dir, err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+	rep.ok(area, "%s is writable", filepath.Clean(dir))
+}
+
+func validateAlerts(rep *validationReport, c *Config) {
+	for name, nc := range c.Alerts.Notifiers {
+		if _, err := newNotifier(nc); err != nil {
+			rep.fail("alerts", "notifier %s: %v", name, err)
+			continue
+		}
+		if nc.URL != "" {
+			if u, err := url.Parse(nc.URL); err != nil || u.Scheme != "https" {
+				rep.warn("alerts", "notifier %s does not use an https URL", name)
+			}
+		}
+	}
+	for _, r := range c.Alerts.Rules {
+		for _, n := range r.Notifiers {
+			if _, ok := c.Alerts.Notifiers[n]; !ok {
+				rep.fail("alerts", "rule %s uses unknown notifier %s", r.Name, n)
+			}
+		}
+	}
+	for _, n := range c.Shutdown.Report {
+		if _, ok := c.Alerts.Notifiers[n]; !ok {
+			rep.fail("alerts", "shutdown.report uses unknown notifier %s", n)
+		}
+	}
+	routes := make(map[string]bool)
+	for _, rt := range apiRoutes() {
+		routes[rt.pattern] = true
+	}
+	for _, slo := range c.Alerts.SLOs {
+		switch err := slo.validate(); {
+		case err != nil:
+			rep.fail("alerts", "%v", err)
+		case !routes[slo.Route]:
+			rep.fail("alerts", "SLO %s watches unknown route %s", slo.Name, slo.Route)
+		default:
+			rep.ok("alerts", "SLO %s: %g%% of %s over %v", slo.Name, slo.Objective*100, slo.Route, time.Duration(slo.Window))
+		}
+	}
+}
+
+func validateAPI(rep *validationReport, c *Config) {
+	if c.API.V1Sunset == "" {
+		return
+	}
+	sunset, err := time.Parse(time.DateOnly, c.API.V1Sunset)
+	switch {
+	case err != nil:
+		rep.fail("api", "v1_sunset %q is not a YYYY-MM-DD date", c.API.V1Sunset)
+	case sunset.Before(time.Now()):
+		rep.warn("api", "v1_sunset %s has passed, but the v1 routes are still served", c.API.V1Sunset)
+	default:
+		rep.ok("api", "v1 routes announce a sunset on %s", c.API.V1Sunset)
+	}
+}
+
+func validateAuth(rep *validationReport, c *Config) {
+	a := c.Auth
+	validateListenerIDs(rep, c)
+	if !a.Required {
+		return
+	}
+	if a.Secret == "" {
+		rep.warn("auth", "no secret set: tokens stop working when the server restarts")
+	} else if len(a.Secret) < 16 {
+		rep.fail("auth", "secret must be at least 16 characters")
+	}
+	for _, o := range a.Origins {
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			rep.fail("auth", "origin %q must be a scheme and host, like https://radio.example.com", o)
+		}
+	}
+	rep.ok("auth", "listeners need a token")
+}
+
+func validateListenerIDs(rep *validationReport, c *Config) {
+	ids := c.Auth.ListenerIDs
+	if !ids.Enabled {
+		if c.RateLimit.PerListener {
+			rep.warn("auth", "rate_limit.per_listener does nothing without auth.listener_ids")
+		}
+		return
+	}
+	if r := time.Duration(ids.Rotation); r < 0 || (r > 0 && r < time.Hour) {
+		rep.fail("auth", "listener_ids.rotation must be at least 1h, got %v", r)
+	}
+	if c.Auth.Secret == "" {
+		rep.warn("auth", "no secret set: listener pseudonyms change when the server restarts")
+	}
+	rep.ok("auth", "listener IDs rotate every %v", listenerRotationOf(ids))
+}
+
+func validateUpdate(rep *validationReport, c *Config) {
+	u := c.Update
+	if u.URL == "" && u.PublicKey == "" {
+		return
+	}
+	if _, err := parseUpdateKey(u.PublicKey); err != nil {
+		rep.fail("update", "%v", err)
+	}
+	if parsed, err := url.Parse(u.URL); err != nil || parsed.Scheme != "https" {
+		rep.warn("update", "update.url %q does not use https", u.URL)
+	} else {
+		rep.ok("update", "releases come from %s", u.URL)
+	}
+}
+
+func validateHandoff(rep *validationReport, c *Config) {
+	if len(c.Handoff.Peers) == 0 {
+		return
+	}
+	if c.Admin.Token == "" && c.Admin.Listen == "" {
+		rep.warn("handoff", "handoff.peers is set but handoffs need admin.token or the admin listener")
+	}
+	for _, p := range c.Handoff.Peers {
+		if u, err := url.Parse(p); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			rep.fail("handoff", "peer %q is not an http(s) URL", p)
+		} else if u.Scheme != "https" {
+			rep.warn("handoff", "peer %s does not use https, the admin token would be sent in the clear", p)
+		}
+	}
+}
+
+func validateTelemetry(rep *validationReport, c *Config) {
+	t := c.Telemetry
+	if !t.Enabled {
+		return
+	}
+	if parsed, err := url.Parse(t.Endpoint); err != nil || parsed.Host == "" {
+		rep.fail("telemetry", "telemetry is enabled but endpoint %q is not a URL", t.Endpoint)
+		return
+	}
+	if time.Duration(t.Interval) < time.Hour {
+		rep.fail("telemetry", "telemetry.interval must be at least 1h, got %v", time.Duration(t.Interval))
+		return
+	}
+	rep.ok("telemetry", "anonymous usage reports go to %s every %v", t.Endpoint, time.Duration(t.Interval))
+}
+
+func validateLights(rep *validationReport, c *Config) {
+	l := c.Lights
+	if l.Hue == nil && l.ArtNet == nil {
+		return
+	}
+	if h := l.Hue; h != nil {
+		if h.Bridge == "" || h.Username == "" || len(h.Lights) == 0 {
+			rep.fail("lights", "hue needs bridge, username and lights")
+		}
+	}
+	if a := l.ArtNet; a != nil {
+		if _, err := artNetAddr(a.Address); err != nil {
+			rep.fail("lights", "artnet address: %v", err)
+		}
+		if a.Universe < 0 || a.Universe > 0x7fff {
+			rep.fail("lights", "artnet universe %d is outside 0 to 32767", a.Universe)
+		}
+		for _, f := range a.Fixtures {
+			if width := fixtureWidth(f.Type); width == 0 {
+				rep.fail("lights", "fixture %s: type must be dimmer, rgb or rgbw, got %q", f.Name, f.Type)
+			} else if f.Channel < 1 || f.Channel+width-1 > 512 {
+				rep.fail("lights", "fixture %s: channels %d to %d are outside 1 to 512", f.Name, f.Channel, f.Channel+width-1)
+			}
+		}
+	}
+	for genre, s := range l.Scenes {
+		if _, err := parseScene(s); err != nil {
+			rep.fail("lights", "scene %s: %v", genre, err)
+		} else if genre != "default" && taxonomy.Lookup(genre) == nil {
+			rep.warn("lights", "scene %s is for a genre the taxonomy doesn't know", genre)
+		}
+	}
+	rep.ok("lights", "light show configured")
+}
+
+func validateChaos(rep *validationReport, c *Config) {
+	if c.Chaos.Enabled {
+		rep.warn("chaos", "the fault injector is enabled; faults armed through /chaos will disrupt listeners")
+	}
+}
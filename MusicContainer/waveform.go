@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The waveform worker keeps waveform previews available without touching
+// the pacing loop: it fills in missing waveforms for archive segments (the
+// recorder writes them for segments it finishes itself, but not for older
+// or copied-in files) and keeps peaks for a rolling window of the live
+// broadcast, served on /waveform/live.
+
+const waveformScanInterval = time.Minute
+
+// liveWaveform holds the peaks of the last LiveWindow of broadcast audio.
+type liveWaveform struct {
+	frames chan []int16
+
+	mu       sync.Mutex
+	builder  *peakBuilder
+	peaks    []int8
+	maxPeaks int
+	end      time.Time // when the newest peak ended
+}
+
+var waveforms *liveWaveform
+
+func startWaveformWorker(c ArchiveConfig, sampleRate, channels int) {
+	if c.Dir != "" {
+		schedule.Every("waveform_backfill", waveformScanInterval, func() error {
+			return backfillWaveforms(c.Dir)
+		})
+	}
+	window := time.Duration(c.LiveWindow)
+	if window <= 0 {
+		return
+	}
+	peaksPerSecond := sampleRate / waveformSamplesPerPeak
+	waveforms = &liveWaveform{
+		frames:   make(chan []int16, 256),
+		builder:  newPeakBuilder(sampleRate, channels),
+		maxPeaks: 2 * int(window.Seconds()) * peaksPerSecond,
+	}
+	go waveforms.run()
+}
+
+// Record queues a broadcast frame. Like the archive it never blocks.
+func (l *liveWaveform) Record(pcm []int16) {
+	if l == nil {
+		return
+	}
+	frame := pcmSamples.clone(pcm)
+	select {
+	case l.frames <- frame:
+	default:
+		pcmSamples.put(frame)
+	}
+}
+
+func (l *liveWaveform) run() {
+	for pcm := range l.frames {
+		l.mu.Lock()
+		l.builder.add(pcm)
+		if n := len(l.builder.wf.Peaks); n > 0 {
+			l.peaks = append(l.peaks, l.builder.wf.Peaks...)
+			l.builder.wf.Peaks = l.builder.wf.Peaks[:0]
+			if len(l.peaks) > l.maxPeaks {
+				l.peaks = append(l.peaks[:0], l.peaks[len(l.peaks)-l.maxPeaks:]...)
+			}
+			l.end = time.Now()
+		}
+		l.mu.Unlock()
+		pcmSamples.put(pcm)
+	}
+}
+
+// LiveWaveform is the /waveform/live response.
+type LiveWaveform struct {
+	Waveform
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func (l *liveWaveform) Snapshot() LiveWaveform {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	wf := l.builder.wf
+	wf.Peaks = append([]int8(nil), l.peaks...)
+	seconds := float64(len(wf.Peaks)/2*wf.SamplesPerPeak) / float64(wf.SampleRate)
+	return LiveWaveform{
+		Waveform: wf,
+		Start:    l.end.Add(-time.Duration(seconds * float64(time.Second))),
+		End:      l.end,
+	}
+}
+
+// backfillWaveforms writes waveforms for archive segments that don't have
+// one yet.
+func backfillWaveforms(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name, encrypted := strings.CutSuffix(e.Name(), archiveEncSuffix)
+		if !strings.HasSuffix(name, ".wav") || (encrypted && archiveKey == nil) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path + waveformSuffix); err == nil {
+			continue
+		}
+		if err := writeWaveform(path, encrypted); err != nil {
+			log.Printf("Error computing waveform for %s: %v", name, err)
+			continue
+		}
+		log.Printf("Computed waveform for %s", name)
+	}
+	return nil
+}
+
+// writeWaveform streams a WAV file through a peakBuilder, so even hour-long
+// segments are never held in memory. An encrypted segment is read from
+// path + ".enc".
+func writeWaveform(path string, encrypted bool) error {
+	var src io.Reader
+	if encrypted {
+		f, err := os.Open(path + archiveEncSuffix)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if src, err = archiveKey.open(f, info.Size()); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+
+	r := bufio.NewReader(src)
+	wav, size, err := readWAVHeader(r)
+	if err != nil {
+		return err
+	}
+	p := newPeakBuilder(wav.sampleRate, wav.channels)
+
+	buf := make([]byte, 64*1024)
+	pcm := make([]int16, len(buf)/2)
+	lr := io.LimitReader(r, size)
+	for {
+		n, err := io.ReadFull(lr, buf)
+		for i := 0; i < n/2; i++ {
+			pcm[i] = int16(binary.LittleEndian.Uint16(buf[i*2:]))
+		}
+		p.add(pcm[:n/2])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return p.save(path + waveformSuffix)
+}
+
+func handleLiveWaveform(w http.ResponseWriter, r *http.Request) {
+	if waveforms == nil {
+		http.Error(w, "Live waveform disabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(waveforms.Snapshot())
+}
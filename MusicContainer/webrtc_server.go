@@ -1,259 +1,488 @@
 package main
 
 import (
-	"encoding/binary"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
-	"github.com/pion/webrtc/v4/pkg/media"
-	"gopkg.in/hraban/opus.v2"
 )
 
 type offer struct {
-	Type string `json:"type"`
-	SDP  string `json:"sdp"`
+	Type    string       `json:"type"`
+	SDP     string       `json:"sdp"`
+	Ticket  string       `json:"ticket,omitempty"`  // waitlist ticket from an earlier attempt
+	Session string       `json:"session,omitempty"` // set to restart ICE on an existing session
+	Probe   *ProbeResult `json:"probe,omitempty"`   // the client's /probe measurements
+	Handoff string       `json:"handoff,omitempty"` // token from a server handing off the station
+	// The listener's clock, for genre.local_time
+	TZ        string `json:"tz,omitempty"`         // IANA name, e.g. "Europe/Berlin"
+	UTCOffset *int   `json:"utc_offset,omitempty"` // minutes east of UTC, if tz is unknown
 }
 
 type answer struct {
-	Type string `json:"type"`
-	SDP  string `json:"sdp"`
+	Type    string `json:"type"`
+	SDP     string `json:"sdp"`
+	Session string `json:"session,omitempty"` // for ICE restarts
+	Bitrate int    `json:"bitrate,omitempty"` // picked from the probe
+	Resume  string `json:"resume,omitempty"`  // for /reconnect, see resume.go
+	// Audio says whether the generator is on air yet, see readiness.go
+	Audio *AudioReadiness `json:"audio,omitempty"`
 }
 
-var audioTrack *webrtc.TrackLocalStaticSample
-var currentGenre string = "lofi hip hop"
+var answerFilter *candidateFilter
 
 func contains(s, substr string) bool {
 	return strings.Contains(s, substr)
 }
 
-
 func main() {
-	// Create an audio track with Opus codec
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		os.Exit(runCA(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "update" {
+		os.Exit(runUpdate(os.Args[2:]))
+	}
+
+	configPath := flag.String("config", os.Getenv("RADIO_CONFIG"), "path to a JSON config file")
+	certDir := flag.String("cert-dir", os.Getenv("RADIO_CERT_DIR"), "directory to keep the DTLS certificate in across restarts")
+	input := flag.String("input", os.Getenv("RADIO_INPUT"), "where the generator's audio comes from: a named pipe, - for stdin, tcp://addr or udp://addr")
+	envRate, _ := strconv.Atoi(os.Getenv("RADIO_INPUT_RATE"))
+	inputRate := flag.Int("input-rate", envRate, "sample rate of the generator's raw PCM, if it isn't the station's")
+	inputFormat := flag.String("input-format", os.Getenv("RADIO_INPUT_FORMAT"), "sample format of the generator's raw PCM: s16le or f32le")
+	flag.Parse()
+	log.SetOutput(io.MultiWriter(os.Stderr, glitches))
+
 	var err error
-	audioTrack, err = webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{
-			MimeType:    webrtc.MimeTypeOpus,
-			ClockRate:   48000,
-			Channels:    2,
-			// More descriptive SDP line for stereo music
-			SDPFmtpLine: "minptime=10;useinbandfec=1;stereo=1;sprop-stereo=1;maxaveragebitrate=128000",
-		},
-		"audio",
-		"pion",
-	)
+	cfg, err = loadConfig(*configPath)
+	configFile = *configPath
 	if err != nil {
-		panic(err)
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if *certDir != "" {
+		cfg.DTLS.CertFile = filepath.Join(*certDir, dtlsCertName)
+	}
+	if *input != "" {
+		cfg.Audio.PipePath = *input
+	}
+	if *inputRate != 0 {
+		cfg.Audio.InputRate = *inputRate
+	}
+	if *inputFormat != "" {
+		cfg.Audio.InputFormat = *inputFormat
+	}
+	setOpusChannels(cfg.Audio.Channels)
+	if gathering, err = newGatherPolicy(cfg.ICE); err != nil {
+		log.Fatalf("Error in ICE config: %v", err)
+	}
+	answerFilter = newCandidateFilter(cfg.ICE.Prune, gathering)
+	gathering.logInterfaces()
+	if err := gathering.listenUDP(cfg.ICE.UDPPort); err != nil {
+		log.Fatalf("Error setting up ICE: %v", err)
+	}
+	if err := setupAnswerHooks(cfg.Answer); err != nil {
+		log.Fatalf("Error setting up answer hooks: %v", err)
+	}
+	if cfg.Genre.Taxonomy != "" {
+		if taxonomy, err = loadTaxonomy(cfg.Genre.Taxonomy); err != nil {
+			log.Fatalf("Error loading genre taxonomy: %v", err)
+		}
+	}
+	setPromptConfig(cfg.Station.Prompt)
+	setEncoderConfig(cfg.Encoder)
+	setupListenerTokens(cfg.Auth)
+	listenerCap.Store(int64(cfg.Station.Quota.MaxListeners))
+	if err := setupRateLimits(cfg.RateLimit); err != nil {
+		log.Fatalf("Error setting up rate limits: %v", err)
+	}
+	setDSPConfig(cfg.DSP)
+	setStems(cfg.Audio.Stems)
+
+	arbiter.genre = taxonomy.Canonical(cfg.Genre.Default)
+	if err := arbiter.Reapply(); err != nil {
+		log.Printf("Error writing genre file: %v", err)
+	}
+	if err := setupStationTimezone(cfg.Station.Timezone); err != nil {
+		log.Fatalf("Error setting up station: %v", err)
+	}
+	startGenreStats(cfg.Genre)
+	startBlocklist(cfg.Genre.Blocklist)
+	startGuide(cfg.Genre.Schedule)
+	genreStats.Switched(arbiter.genre)
+	go runGenreExpiry()
+	go capacity.run()
+	go fds.run()
+	go runBreaker()
+	go sessions.runReaper(cfg.Sessions)
+	go runListenerCount()
+	go runMetadata()
+	go runAdaptive()
+	startQuality(cfg.Quality)
+	startTelemetry(cfg.Telemetry)
+	startChaos(cfg.Chaos)
+	if err := startLights(cfg.Lights); err != nil {
+		log.Printf("Error starting the light show: %v", err)
+	}
+	if err := setupDTLS(cfg.DTLS); err != nil {
+		log.Fatalf("Error setting up DTLS certificate: %v", err)
+	}
+	if err := setupSLOs(cfg.Alerts.SLOs); err != nil {
+		log.Fatalf("Error setting up SLOs: %v", err)
+	}
+	if err := runAlerts(cfg.Alerts); err != nil {
+		log.Fatalf("Error setting up alerts: %v", err)
 	}
 
 	// Start audio generation in a separate goroutine
 	go generateAudio()
 
 	// Set up HTTP server
-	http.HandleFunc("/", serveHome)
-	http.HandleFunc("/offer", handleOffer)
-	http.HandleFunc("/genre", handleGenreChange)
-	http.HandleFunc("/current-genre", handleCurrentGenre)
+	registerRoutes(http.DefaultServeMux, adminMux)
+
+	if cfg.Admin.Listen != "" {
+		go func() {
+			log.Fatal(serveAdmin())
+		}()
+	}
 
+	ln, err := listenHTTP(":8080")
+	if err != nil {
+		log.Fatalf("Error listening: %v", err)
+	}
 	fmt.Println("WebRTC server started on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(serveHTTP(ln))
 }
 
 func generateAudio() {
-	pipePath := "/tmp/audio_pipe"
 	sampleRate := 48000
-	channels := 2
-	frameDuration := 20 * time.Millisecond // 20ms frame size
+	channels := cfg.Audio.Channels
+	frameDuration := audioFrame()                                         // 20ms unless audio.frame_duration says otherwise
 	samplesPerFrame := int(float64(sampleRate) * frameDuration.Seconds()) // 48000 * 0.020 = 960
-	bytesPerFrame := samplesPerFrame * channels * 2 // 960 * 2 * 2 = 3840 bytes
+	bytesPerFrame := samplesPerFrame * channels * 2                       // 960 * 2 * 2 = 3840 bytes
+	log.Printf("Encoding %v frames of %d samples", frameDuration, samplesPerFrame)
 
 	// Create Opus encoder with optimized settings
-	encoder, err := opus.NewEncoder(sampleRate, channels, opus.AppAudio)
+	// Defaults are 128kbps, complexity 8 and in-band FEC, see defaultConfig
+	encoder, err := newHotEncoder(sampleRate, channels, effectiveEncoderConfig())
 	if err != nil {
 		log.Fatalf("Error creating Opus encoder: %v", err)
 	}
 
-	// Increase bitrate to 128kbps for high-quality stereo
-	encoder.SetBitrate(128000)
-	// Increase complexity for better encoding quality
-	// 8 is a good balance for music
-	encoder.SetComplexity(8)
-	encoder.SetInBandFEC(true) // Forward Error Correction is great for WebRTC
-	encoder.SetPacketLossPerc(5)
+	if err := startTaps(cfg.Audio.Taps, sampleRate, channels); err != nil {
+		log.Fatalf("Error setting up tap points: %v", err)
+	}
+
+	var validator *opusValidator
+	switch mode := cfg.Audio.PacketValidation; mode {
+	case "", validateOff:
+	case validateLog, validateDrop, validateRepair:
+		silence, err := encodeSilence(sampleRate, channels, samplesPerFrame)
+		if err != nil {
+			log.Fatalf("Error encoding silence frame: %v", err)
+		}
+		validator = newOpusValidator(mode, frameDuration, channels, silence)
+		log.Printf("Validating Opus packets (mode %s)", mode)
+	default:
+		log.Printf("Unknown packet_validation mode %q, not validating", mode)
+	}
+
+	// Played until the generator delivers its first frame
+	var boot *bootstrapLoop
+	if cfg.Audio.BootstrapFile != "" {
+		boot, err = loadBootstrap(cfg.Audio.BootstrapFile, sampleRate, channels, samplesPerFrame)
+		if err != nil {
+			log.Printf("Error loading bootstrap audio: %v. Starting silent.", err)
+		} else {
+			log.Printf("Serving bootstrap audio from %s until the generator starts", cfg.Audio.BootstrapFile)
+			status.Publish("audio_source", map[string]string{"source": "bootstrap"})
+		}
+	}
+
+	// The latency budget decides how much audio may queue up in between
+	plan := planLatency(time.Duration(cfg.Audio.LatencyBudget), time.Duration(cfg.Audio.Prebuffer), frameDuration)
+	latency.setPlan(plan, frameDuration)
+	log.Printf("Latency budget %v: %d frame ingest buffer, %d frame pre-roll, %v pacer slack",
+		plan.Budget, plan.IngestFrames, plan.PrerollFrames, plan.PacerSlack)
+
+	// Read the pipe on its own goroutine so the pacing loop can keep serving
+	// the bootstrap loop while the generator is still warming up, and so a
+	// slow frame from the generator is absorbed by the ring buffer.
+	frames := newFrameRing(plan.IngestFrames)
+	drift := newDriftDetector(sampleRate, channels, bytesPerFrame, cfg.Audio.AutoResample)
+	go readStems(currentStems(), pcmFormat(sampleRate, channels), bytesPerFrame, drift, frames)
+	if err := startIngest(cfg.Audio.Ingest, sampleRate, channels, bytesPerFrame); err != nil {
+		log.Fatalf("Error starting network ingest: %v", err)
+	}
+	enableWHIP(sampleRate, channels, samplesPerFrame)
 
-	// Buffers for processing
-	pcmBuffer := make([]byte, bytesPerFrame)
-	pcmInt16 := make([]int16, samplesPerFrame*channels)
-	opusBuffer := make([]byte, 4000) // A safe, large buffer for Opus data
+	if err := acquireEncoder(mainFeed); err != nil {
+		log.Fatalf("Error starting encoder: %v", err)
+	}
+	// Everything after the pacer runs in stages of its own, see pipeline.go
+	pipe := &pipeline{
+		channels:        channels,
+		samplesPerFrame: samplesPerFrame,
+		frameDuration:   frameDuration,
+		dsp:             newDSPChain(mainFeed, sampleRate, channels),
+		loudness:        newLoudnessMeter(channels),
+		beats:           newBeatTracker(sampleRate, channels),
+		encoder:         encoder,
+		variants:        startMixVariants(sampleRate, channels),
+		tiers:           startTiers(sampleRate, channels),
+		fades:           startFadeIns(sampleRate, channels, samplesPerFrame, frameDuration),
+		commentary:      startCommentary(sampleRate, channels, samplesPerFrame, bytesPerFrame),
+		validator:       validator,
+		dtx:             &silenceGate{enabled: effectiveEncoderConfig().DTX},
+	}
+	if err := startArchive(cfg.Archive, sampleRate, channels); err != nil {
+		log.Printf("Error starting archive: %v", err)
+	}
+	startWaveformWorker(cfg.Archive, sampleRate, channels)
+	startTransitions(cfg.Genre.Transitions, sampleRate, channels)
+	pipe.start()
 
-	// The Ticker is our pacemaker. It will fire every 20ms.
+	live := false
+	prerolling := true
+	standby := newStandby(cfg.Audio.Standby, sampleRate, channels, samplesPerFrame, frameDuration)
+	pacing := newPacingCorrector(cfg.Audio.DriftCorrection, plan, frameDuration)
+
+	// The Ticker is our pacemaker. It will fire once a frame.
 	ticker := time.NewTicker(frameDuration)
 	defer ticker.Stop()
 
-	// Loop to connect and read from the pipe
-	for {
-		log.Printf("Waiting for audio pipe at %s...", pipePath)
-		pipe, err := os.Open(pipePath)
-		if err != nil {
-			log.Printf("Error opening pipe: %v. Retrying in 2s.", err)
-			time.Sleep(2 * time.Second)
-			continue
+	// The main paced loop. It waits for the ticker to fire.
+	for tick := range ticker.C {
+		start := time.Now()
+
+		// Let the pre-roll build up before playing live audio
+		queued := frames.Len()
+		if prerolling && queued >= plan.PrerollFrames {
+			prerolling = false
 		}
-		defer pipe.Close()
-
-		log.Println("Connected to audio pipe. Starting paced audio stream.")
-
-		// The main paced loop. It waits for the ticker to fire.
-		for range ticker.C {
-			// Read a full frame's worth of PCM data.
-			// This will block until the Python script writes data, which is what we want.
-			// If the Python script is slow, this loop will wait for it.
-			_, err := io.ReadFull(pipe, pcmBuffer)
-			if err != nil {
-				log.Printf("Error reading from pipe: %v. Will attempt to reconnect.", err)
-				break // Break inner loop to trigger reconnection
-			}
 
-			// Convert raw bytes (Little Endian) to int16 samples
-			for i := 0; i < len(pcmInt16); i++ {
-				pcmInt16[i] = int16(binary.LittleEndian.Uint16(pcmBuffer[i*2:]))
+		var stems [][]byte
+		if !prerolling {
+			// If the pacer fell behind by more than its slack, drop the
+			// audio listeners would otherwise hear late
+			for late := time.Since(tick) - plan.PacerSlack; late > 0 && frames.Len() > 1; late -= frameDuration {
+				putFrame(frames.Pop())
+				latency.drop()
+			}
+			if stems = frames.Pop(); stems != nil {
+				latency.observe(queued, time.Since(tick))
+				if period := pacing.observe(queued); period != 0 {
+					ticker.Reset(period)
+				}
+			} else {
+				// Underrun: build the pre-roll up again
+				prerolling = true
+				pacing.reset()
+				if live {
+					latency.underrun()
+				}
 			}
+		}
+
+		observeReadiness(stems != nil, !live && boot != nil, queued, plan.PrerollFrames, frameDuration)
 
-			// Encode the PCM data to Opus
-			n, err := encoder.Encode(pcmInt16, opusBuffer)
-			if err != nil {
-				log.Printf("Error encoding to Opus: %v", err)
+		f := pipe.newFrame()
+		if stems != nil {
+			// Convert raw bytes (Little Endian) to int16 samples, mixing
+			// the stems if the generator sends more than one
+			levels := *stemLevels.Load()
+			mixStems(stems, levels, f.pcm)
+			for i, v := range pipe.variants {
+				v.mix(stems, levels, f.mixes[i])
+			}
+			putFrame(stems)
+			if !live {
+				live = true
+				log.Println("Received first frame from the generator.")
+				status.Publish("audio_source", map[string]string{"source": "live"})
+			}
+			// Fade from the bootstrap loop into the live stream
+			if boot != nil && !boot.blend(f.pcm) {
+				boot = nil
+			}
+			standby.resume(f.pcm)
+		} else {
+			// If the Python script is slow, skip this tick and wait for it,
+			// unless it hasn't started yet and there's a bootstrap loop to
+			// play, or it has been gone long enough for standby.
+			switch {
+			case !live && boot != nil:
+				boot.next(f.pcm)
+			case standby.fill(f.pcm):
+				f.standby = true
+			default:
+				// The commentary keeps going without the music
+				f.release()
+				if pipe.commentary != nil {
+					pipe.queue(&pipelineFrame{})
+				}
 				continue
 			}
-
-			// Write the encoded Opus sample to our WebRTC track
-			// The Pion library handles the RTP timestamping based on the sample duration.
-			if err := audioTrack.WriteSample(media.Sample{
-				Data:     opusBuffer[:n],
-				Duration: frameDuration,
-			}); err != nil {
-				// This error can happen if the peer connection is closed.
-				// It's often not critical, but we log it.
-				// log.Printf("Warning: Error writing sample: %v", err)
+			for _, m := range f.mixes {
+				copy(m, f.pcm)
 			}
 		}
-
-		// If we broke out of the inner loop, close the current pipe and try to reopen.
-		pipe.Close()
+		pipelineStageTime.Observe(time.Since(start).Seconds(), "stage", "pacer")
+		pipe.queue(f)
 	}
 }
 
-
-func handleOffer(w http.ResponseWriter, r *http.Request) {
-	// Handle CORS preflight
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-	
-	log.Printf("Received %s request from %s", r.Method, r.RemoteAddr)
-	
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-	
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Read the offer from the request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	var o offer
-	if err := json.Unmarshal(body, &o); err != nil {
-		log.Printf("Error unmarshaling offer: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	
-	log.Printf("Received offer type: %s", o.Type)
-	log.Printf("SDP length: %d characters", len(o.SDP))
-	
-	// Check if SDP contains ice-ufrag
-	if !contains(o.SDP, "ice-ufrag") {
-		log.Printf("WARNING: SDP missing ice-ufrag, this might be a Safari issue")
-	}
-
+// newPeerConnection creates a peer connection with the station's ICE and
+// DTLS settings. With estimate set it also runs send-side bandwidth
+// estimation from the client's transport-wide congestion control feedback
+// and returns the estimator, see adaptive.go.
+func newPeerConnection(estimate bool) (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
 	// Prepare the configuration
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+		ICEServers:   iceServers(),
+		Certificates: dtlsCertificates(),
 	}
-	
+	gathering.configure(&config)
+
 	// Create a SettingEngine to allow non-localhost connections
 	settingEngine := webrtc.SettingEngine{}
-	settingEngine.SetNetworkTypes([]webrtc.NetworkType{
-		webrtc.NetworkTypeUDP4,
-		webrtc.NetworkTypeUDP6,
-		webrtc.NetworkTypeTCP4,
-		webrtc.NetworkTypeTCP6,
-	})
-	
+	gathering.apply(&settingEngine)
+
 	// Set NAT1To1IPs to help with connectivity
 	// Let WebRTC figure out the IPs
 	settingEngine.SetNAT1To1IPs([]string{}, webrtc.ICECandidateTypeHost)
-	
+
 	// Configure larger receive buffer for smoother playback
 	settingEngine.SetReceiveMTU(1600) // Larger MTU for better throughput
-	
+
 	// Create API with settings
 	m := &webrtc.MediaEngine{}
 	if err := m.RegisterDefaultCodecs(); err != nil {
-		log.Printf("Error registering codecs: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, nil, fmt.Errorf("registering codecs: %w", err)
+	}
+
+	interceptors := &interceptor.Registry{}
+	// Sender reports let clients fill in the round trip time, see rtcpstats.go
+	reports, err := report.NewSenderInterceptor()
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating sender reports: %w", err)
 	}
-	
+	interceptors.Add(reports)
+	if cfg.NACK.Enabled {
+		if err := configureNACK(m, interceptors, cfg.NACK); err != nil {
+			return nil, nil, err
+		}
+	}
+	estimators := make(chan cc.BandwidthEstimator, 1)
+	if estimate {
+		congestion, err := cc.NewInterceptor(newBandwidthEstimator)
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating congestion controller: %w", err)
+		}
+		congestion.OnNewPeerConnection(func(_ string, e cc.BandwidthEstimator) {
+			estimators <- e
+		})
+		interceptors.Add(congestion)
+		if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, interceptors); err != nil {
+			return nil, nil, fmt.Errorf("registering TWCC: %w", err)
+		}
+	}
+
 	api := webrtc.NewAPI(
 		webrtc.WithMediaEngine(m),
 		webrtc.WithSettingEngine(settingEngine),
+		webrtc.WithInterceptorRegistry(interceptors),
 	)
 
 	// Create a new RTCPeerConnection for this request
 	peerConnection, err := api.NewPeerConnection(config)
+	if err != nil || !estimate {
+		return peerConnection, nil, err
+	}
+	return peerConnection, <-estimators, nil
+}
+
+// drainRTCP reads a sender's incoming RTCP so pion's interceptors see it
+// (the NACK responder answers from there), and so the session knows its
+// client is still there. Receiver reports go to onReport, if set.
+func drainRTCP(sender *webrtc.RTPSender, sess *session, onReport func(rtcp.ReceptionReport)) {
+	for {
+		packets, _, rtcpErr := sender.ReadRTCP()
+		if rtcpErr != nil {
+			return
+		}
+		sess.touch()
+		for _, p := range packets {
+			switch p := p.(type) {
+			case *rtcp.ReceiverReport:
+				if onReport == nil {
+					continue
+				}
+				for _, report := range p.Reports {
+					onReport(report)
+				}
+			case *rtcp.TransportLayerNack:
+				countNACK(p)
+			}
+		}
+	}
+}
+
+// newListenerPeer creates the peer connection for an admitted listener and
+// attaches its audio output. Signaling is left to the caller.
+func newListenerPeer(sess *session) (*webrtc.PeerConnection, error) {
+	peerConnection, estimator, err := newPeerConnection(adaptiveEnabled())
 	if err != nil {
-		log.Printf("Error creating peer connection: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("creating peer connection: %w", err)
+	}
+	sess.pc = peerConnection
+	sess.estimator = estimator
+
+	// Give the listener its own output on the main mix, at its quality
+	output, err := newRTPOutput(qualityFeed(int(sess.bitrate.Load())))
+	if err != nil {
+		return nil, fmt.Errorf("creating track: %w", err)
 	}
 
 	// Add the audio track to the peer connection
-	rtpSender, err := peerConnection.AddTrack(audioTrack)
+	rtpSender, err := peerConnection.AddTrack(output.track)
 	if err != nil {
-		log.Printf("Error adding track: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("adding track: %w", err)
 	}
+	sess.output = output
+	broadcast.Add(output)
 
 	// Read incoming RTCP packets
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
-				return
-			}
+	go drainRTCP(rtpSender, sess, sess.receptionReport)
+
+	// Offer the commentary track as well; nothing is sent on it until the
+	// listener enables it
+	if commentaryEnabled() {
+		commentary, err := newCommentaryOutput()
+		if err != nil {
+			return nil, fmt.Errorf("creating commentary track: %w", err)
 		}
-	}()
+		commentarySender, err := peerConnection.AddTrack(commentary.track)
+		if err != nil {
+			return nil, fmt.Errorf("adding commentary track: %w", err)
+		}
+		sess.commentary = commentary
+		go drainRTCP(commentarySender, sess, nil)
+	}
 
 	// Set the handler for ICE connection state
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
@@ -263,31 +492,40 @@ func handleOffer(w http.ResponseWriter, r *http.Request) {
 	// Set the handler for Peer connection state
 	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
 		fmt.Printf("Peer Connection State has changed: %s\n", s.String())
+		sessions.SetState(sess.id, s)
 	})
-	
-	// Log ICE candidates for debugging
-	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate != nil {
-			log.Printf("ICE candidate: %s", candidate.String())
+
+	// The server opens a "metadata" DataChannel to push station updates
+	if err := openMetadataChannel(sess, peerConnection); err != nil {
+		return nil, fmt.Errorf("creating metadata channel: %w", err)
+	}
+
+	// Clients open a "control" DataChannel for the control protocol
+	peerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() != controlLabel {
+			return
 		}
+		sessions.setControl(sess, attachControlChannel(sess, dc))
 	})
 
+	return peerConnection, nil
+}
+
+// answerOffer applies a client's offer and returns the answer once ICE
+// gathering is complete, so it carries every usable candidate.
+func answerOffer(peerConnection *webrtc.PeerConnection, offerSDP string) (string, error) {
 	// Set the remote SessionDescription
 	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
-		SDP:  o.SDP,
+		SDP:  offerSDP,
 	}); err != nil {
-		log.Printf("Error setting remote description: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("setting remote description: %w", err)
 	}
 
 	// Create an answer
 	answerSDP, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
-		log.Printf("Error creating answer: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("creating answer: %w", err)
 	}
 
 	// Create channel that is blocked until ICE Gathering is complete
@@ -295,20 +533,112 @@ func handleOffer(w http.ResponseWriter, r *http.Request) {
 
 	// Sets the LocalDescription, and starts our UDP listeners
 	if err := peerConnection.SetLocalDescription(answerSDP); err != nil {
-		log.Printf("Error setting local description: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("setting local description: %w", err)
 	}
 
 	// Block until ICE Gathering is complete, disabling trickle ICE
 	<-gatherComplete
 
+	return applyAnswerHooks(peerConnection.LocalDescription().SDP), nil
+}
+
+func handleOffer(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Received %s request from %s", r.Method, r.RemoteAddr)
+
+	// Read the offer from the request body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var o offer
+	if err := json.Unmarshal(body, &o); err != nil {
+		log.Printf("Error unmarshaling offer: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Received offer type: %s", o.Type)
+	log.Printf("SDP length: %d characters", len(o.SDP))
+
+	// Check if SDP contains ice-ufrag
+	if !contains(o.SDP, "ice-ufrag") {
+		log.Printf("WARNING: SDP missing ice-ufrag, this might be a Safari issue")
+	}
+
+	// A listener whose network changed renegotiates its existing session
+	if o.Session != "" {
+		if ok, retry := allowRequest("offer", r); !ok {
+			writeRateLimited(w, retry)
+			return
+		}
+		answerSDP, err := restartICE(o.Session, o.SDP)
+		if err == errNoSession {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "session_not_found"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error restarting ICE for %s: %v", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(answer{Type: "answer", SDP: answerSDP, Session: o.Session})
+		return
+	}
+
+	admitted, code := admit(r, o.Handoff, o.Ticket)
+	if code != "" {
+		writeAdmissionRejection(w, admitted, code)
+		return
+	}
+	sess := admitted.session
+	sess.setProbe(o.Probe)
+	sess.setLocalClock(o.TZ, o.UTCOffset)
+	established := false
+	defer func() {
+		if !established {
+			sessions.Remove(sess.id)
+		}
+	}()
+
+	peerConnection, err := newListenerPeer(sess)
+	if err != nil {
+		log.Printf("Error setting up peer connection: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Log ICE candidates for debugging
+	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			log.Printf("ICE candidate: %s", candidate.String())
+		}
+	})
+
+	answerSDP, err := answerOffer(peerConnection, o.SDP)
+	if err != nil {
+		log.Printf("Error answering offer: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Send the answer
 	response := answer{
-		Type: "answer",
-		SDP:  peerConnection.LocalDescription().SDP,
+		Type:    "answer",
+		SDP:     answerSDP,
+		Session: sess.id,
+		Bitrate: int(sess.bitrate.Load()),
+		Resume:  resumeToken(sess.id),
+		Audio:   currentReadiness(),
 	}
 
+	established = true
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Printf("Error encoding response: %v", err)
@@ -318,82 +648,91 @@ func handleOffer(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleGenreChange(w http.ResponseWriter, r *http.Request) {
-	// Handle CORS
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-	
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-	
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	
 	// Parse the request body
 	var req struct {
-		Genre  string `json:"genre"`
+		Genre  string            `json:"genre"`
+		Vars   map[string]string `json:"vars"`
+		Source string            `json:"source"`
 	}
-	
+
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	
+
+	// Only admins may speak for the vote, schedule or admin sources
+	if req.Source == "" {
+		req.Source = sourceListener
+	}
+	if _, ok := cfg.Genre.Priorities[req.Source]; !ok {
+		http.Error(w, "Unknown source", http.StatusBadRequest)
+		return
+	}
+	if req.Source != sourceListener && !isAdmin(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	log.Printf("Genre change requested: %s", req.Genre)
 	fmt.Printf("POST request received - New genre: %s\n", req.Genre)
-	
-	// Update the current genre
-	currentGenre = req.Genre
-	
-	// Write genre to a file that Python will monitor
-	genreFile := "/tmp/genre_request.txt"
-	// Always use smooth transitions
-	content := "SMOOTH:" + req.Genre
-	if err := os.WriteFile(genreFile, []byte(content), 0644); err != nil {
+
+	decision, err := arbiter.Submit(GenreRequest{
+		Genre:  req.Genre,
+		Vars:   req.Vars,
+		Source: req.Source,
+	})
+	if err == errGenreBlocked {
+		http.Error(w, "Genre is blocklisted", http.StatusForbidden)
+		return
+	}
+	if err != nil {
 		log.Printf("Error writing genre file: %v", err)
 		http.Error(w, "Failed to change genre", http.StatusInternalServerError)
 		return
 	}
-	
-	// Send success response
+
 	w.Header().Set("Content-Type", "application/json")
+	if !decision.Accepted {
+		// The request stays queued and takes over if it outlives the current one
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "queued",
+			"genre":  req.Genre,
+			"reason": decision.Reason,
+		})
+		return
+	}
+
+	// Send success response
 	json.NewEncoder(w).Encode(map[string]string{
 		"status": "success",
-		"genre": req.Genre,
+		"genre":  req.Genre,
+		"prompt": decision.Prompt,
 	})
 }
 
+// writeGenreRequest hands a prompt to the Python generator, which watches the
+// genre file for changes.
+func writeGenreRequest(prompt string) error {
+	genreFile := "/tmp/genre_request.txt"
+	// Always use smooth transitions
+	content := "SMOOTH:" + prompt
+	return os.WriteFile(genreFile, []byte(content), 0644)
+}
+
 func handleCurrentGenre(w http.ResponseWriter, r *http.Request) {
-	// Handle CORS
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-	
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-	
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	
 	// Return current genre
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
-		"genre": currentGenre,
+		"genre": getCurrentGenre(),
 	})
 }
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "text/html")
-    // Using a raw string literal `` makes embedding large HTML blocks much easier
-    fmt.Fprint(w, `<!DOCTYPE html>
+	ensureListenerCookie(w, r)
+	w.Header().Set("Content-Type", "text/html")
+	// Using a raw string literal `` makes embedding large HTML blocks much easier
+	fmt.Fprint(w, `<!DOCTYPE html>
 <html lang="en">
 <head>
     <meta charset="UTF-8">
@@ -584,6 +923,28 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
             opacity: 0.9;
         }
 
+        .player-option {
+            margin-top: 10px;
+            font-size: 0.9rem;
+            color: var(--text-color);
+            opacity: 0.8;
+            cursor: pointer;
+        }
+
+        .quality-badge {
+            margin-top: 10px;
+            padding: 2px 8px;
+            border-radius: 4px;
+            font-size: 0.8rem;
+            font-weight: 600;
+            color: var(--bg-color);
+            background-color: var(--secondary-color);
+        }
+
+        .quality-badge.poor {
+            background-color: #cf6679;
+        }
+
         /* Hide the default audio player */
         audio {
             display: none;
@@ -601,21 +962,25 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
         <main>
             <button id="playPauseBtn"><i class="fas fa-play"></i></button>
             <div id="status">Ready to Stream</div>
+            <label class="player-option"><input type="checkbox" id="nightMode"> Night mode</label>
+            <label class="player-option" id="commentaryLabel" hidden><input type="checkbox" id="commentary"> DJ commentary</label>
+            <span class="quality-badge" id="qualityBadge" hidden></span>
         </main>
         
         <audio id="remoteAudio" autoplay></audio>
+        <audio id="commentaryAudio" autoplay></audio>
         
         <div class="genre-section">
             <h2>Select a Genre</h2>
             <div class="genre-grid">
-                <button class="genre-btn active" onclick="changeGenre('lofi hip hop', event)">Lofi Hip Hop</button>
-                <button class="genre-btn" onclick="changeGenre('synthwave', event)">Synthwave</button>
-                <button class="genre-btn" onclick="changeGenre('disco funk', event)">Disco Funk</button>
-                <button class="genre-btn" onclick="changeGenre('cello', event)">Cello</button>
-                <button class="genre-btn" onclick="changeGenre('jazz', event)">Jazz</button>
-                <button class="genre-btn" onclick="changeGenre('rock', event)">Rock</button>
-                <button class="genre-btn" onclick="changeGenre('classical', event)">Classical</button>
-                <button class="genre-btn" onclick="changeGenre('ambient', event)">Ambient</button>
+                <button class="genre-btn active" data-genre="lofi" onclick="changeGenre('lofi', event)">Lofi Hip Hop</button>
+                <button class="genre-btn" data-genre="synthwave" onclick="changeGenre('synthwave', event)">Synthwave</button>
+                <button class="genre-btn" data-genre="disco-funk" onclick="changeGenre('disco-funk', event)">Disco Funk</button>
+                <button class="genre-btn" data-genre="cello" onclick="changeGenre('cello', event)">Cello</button>
+                <button class="genre-btn" data-genre="jazz" onclick="changeGenre('jazz', event)">Jazz</button>
+                <button class="genre-btn" data-genre="rock" onclick="changeGenre('rock', event)">Rock</button>
+                <button class="genre-btn" data-genre="classical" onclick="changeGenre('classical', event)">Classical</button>
+                <button class="genre-btn" data-genre="ambient" onclick="changeGenre('ambient', event)">Ambient</button>
             </div>
             <div class="custom-genre-container">
                  <div class="custom-genre-form">
@@ -637,7 +1002,180 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
         let pc;
         let isPlaying = false;
         let isConnecting = false;
-        let currentGenre = 'lofi hip hop';
+        let currentGenre = 'lofi';
+        let waitlistTicket = null;
+        let listenerToken = null;
+        let sessionId = null; // for ICE restarts
+        let metadataReady = false;
+        let probeResult = null; // what /probe measured before the last offer
+        // The listener's clock, so a station of their own can play for their time of day
+        const localClock = {tz: Intl.DateTimeFormat().resolvedOptions().timeZone, utc_offset: -new Date().getTimezoneOffset()};
+        let restarting = false;
+        let serverBase = ''; // set when the station is handed off to another server
+        let handoffToken = null;
+
+        // Control protocol over the "control" DataChannel (see README)
+        let control = null;
+        let controlReady = false;
+        let controlNextId = 1;
+        const controlPending = {};
+
+        function controlCall(method, params) {
+            return new Promise((resolve, reject) => {
+                const id = controlNextId++;
+                controlPending[id] = { resolve, reject };
+                control.send(JSON.stringify({ id, method, params }));
+            });
+        }
+
+        function openControlChannel() {
+            control = pc.createDataChannel('control');
+            control.onmessage = (event) => {
+                const msg = JSON.parse(event.data);
+                if (msg.id !== undefined && controlPending[msg.id]) {
+                    const pending = controlPending[msg.id];
+                    delete controlPending[msg.id];
+                    if (msg.error) pending.reject(msg.error);
+                    else pending.resolve(msg.result);
+                    return;
+                }
+                if (msg.method === 'status.event') handleStatusEvent(msg.params);
+                if (msg.method === 'loudness') handleLoudness(msg.params);
+                if (msg.method === 'reconnect') moveStation(msg.params);
+                if (msg.method === 'quality.grade') showQualityGrade(msg.params);
+            };
+            control.onopen = async () => {
+                try {
+                    const hello = await controlCall('hello', { version: 1 });
+                    controlReady = true;
+                    if (hello.receipt_url) {
+                        localStorage.setItem(receiptKey, JSON.stringify({url: serverBase + hello.receipt_url, at: Date.now()}));
+                    }
+                    if (hello.capabilities.includes('status')) {
+                        await controlCall('status.subscribe');
+                    }
+                    if (nightAudio) {
+                        await controlCall('loudness.subscribe');
+                    }
+                    if (hello.capabilities.includes('commentary')) {
+                        commentaryLabel.hidden = false;
+                        if (commentaryToggle.checked) {
+                            await controlCall('commentary.set', { enabled: true });
+                        }
+                    }
+                } catch (error) {
+                    console.error('Control channel error:', error);
+                }
+            };
+            control.onclose = () => {
+                controlReady = false;
+                control = null;
+                commentaryLabel.hidden = true;
+                qualityBadge.hidden = true;
+            };
+        }
+
+        // The server grades the connection from A to F
+        const qualityBadge = document.getElementById('qualityBadge');
+
+        function showQualityGrade(q) {
+            qualityBadge.textContent = 'Connection ' + q.grade;
+            qualityBadge.title = q.loss_pct.toFixed(1) + '% loss, ' + Math.round(q.jitter_ms) + 'ms jitter';
+            qualityBadge.classList.toggle('poor', q.grade === 'D' || q.grade === 'F');
+            qualityBadge.hidden = false;
+        }
+
+        // The station may offer a second, spoken track next to the music
+        const commentaryLabel = document.getElementById('commentaryLabel');
+        const commentaryToggle = document.getElementById('commentary');
+        const commentaryAudio = document.getElementById('commentaryAudio');
+
+        commentaryToggle.onchange = () => {
+            commentaryAudio.muted = !commentaryToggle.checked;
+            if (controlReady) controlCall('commentary.set', { enabled: commentaryToggle.checked });
+        };
+
+        // Night mode rides the volume locally towards a steady level using
+        // the station's loudness hints; the broadcast itself is untouched.
+        const nightModeToggle = document.getElementById('nightMode');
+        const nightModeTarget = -23; // LUFS
+        let nightAudio = null;
+
+        nightModeToggle.onchange = () => setNightMode(nightModeToggle.checked);
+
+        function setNightMode(on) {
+            if (on && !nightAudio && remoteAudio.srcObject) {
+                const ctx = new AudioContext();
+                const gain = ctx.createGain();
+                ctx.createMediaStreamSource(remoteAudio.srcObject).connect(gain).connect(ctx.destination);
+                remoteAudio.muted = true;
+                nightAudio = { ctx, gain };
+                if (controlReady) controlCall('loudness.subscribe');
+            } else if (!on && nightAudio) {
+                nightAudio.ctx.close();
+                nightAudio = null;
+                remoteAudio.muted = false;
+                if (controlReady) controlCall('loudness.unsubscribe');
+            }
+        }
+
+        function handleLoudness(event) {
+            const lufs = event.data.short_term_lufs;
+            // Leave near-silence alone rather than boosting the noise floor
+            if (!nightAudio || lufs < -50) return;
+            const db = Math.max(-12, Math.min(6, nightModeTarget - lufs));
+            nightAudio.gain.gain.setTargetAtTime(Math.pow(10, db / 20), nightAudio.ctx.currentTime, 2);
+        }
+
+        function handleStatusEvent(event) {
+            if (event.type === 'genre_decision' && event.data.accepted) {
+                currentGenre = event.data.genre;
+                if (isPlaying) {
+                    showNowPlaying();
+                }
+            }
+            if (event.type === 'audio_source' && event.data.source === 'live' && audioWait) {
+                audioWait = null;
+                if (isPlaying) showNowPlaying();
+            }
+        }
+
+        // The answer says whether the generator is on air yet. Until it is,
+        // the status shows that the station is warming up, and for how long
+        let audioWait = null;
+        let audioWaitTimer = null;
+
+        function noteReadiness(answer) {
+            const audio = answer.audio;
+            audioWait = audio && !audio.flowing ? {
+                source: audio.source,
+                until: audio.eta_ms ? Date.now() + audio.eta_ms : 0
+            } : null;
+            clearInterval(audioWaitTimer);
+            if (audioWait) {
+                audioWaitTimer = setInterval(() => {
+                    if (!audioWait) clearInterval(audioWaitTimer);
+                    else if (isPlaying) showNowPlaying();
+                }, 1000);
+            }
+        }
+
+        function showNowPlaying() {
+            if (!audioWait) {
+                updateStatus('Now Playing: ' + genreLabel(currentGenre));
+                return;
+            }
+            let message = audioWait.source === 'bootstrap'
+                ? 'Playing the intro while the station warms up'
+                : 'Connected, the station is warming up';
+            const left = Math.ceil((audioWait.until - Date.now()) / 1000);
+            if (audioWait.until && left > 0) {
+                message += ', music in about ' + left + 's';
+            } else if (audioWait.until) {
+                message += ', music any moment now';
+            }
+            updateStatus(message + '...');
+        }
 
 
         playPauseBtn.onclick = () => {
@@ -653,14 +1191,16 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
         function togglePlayPause() {
             if (isPlaying) {
                 remoteAudio.pause();
+                commentaryAudio.pause();
                 isPlaying = false;
                 playPauseIcon.className = 'fas fa-play';
                 updateStatus('Paused');
             } else {
                 remoteAudio.play();
+                commentaryAudio.play();
                 isPlaying = true;
                 playPauseIcon.className = 'fas fa-pause';
-                updateStatus('Now Playing: ' + currentGenre);
+                showNowPlaying();
             }
         }
 
@@ -670,70 +1210,127 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
             playPauseIcon.className = 'fas fa-spinner';
             updateStatus('Connecting...');
 
+            const resume = takeResume();
             try {
-                pc = new RTCPeerConnection({
-                    iceServers: [{urls: 'stun:stun.l.google.com:19302'}]
-                });
+                if (!resume) probeResult = await runProbe();
+                pc = new RTCPeerConnection({ iceServers: await fetchIceServers() });
 
                 pc.ontrack = (event) => {
-                    if (event.track.kind === 'audio') {
+                    if (event.track.kind !== 'audio') return;
+                    if (event.streams[0] && event.streams[0].id === 'commentary') {
+                        commentaryAudio.srcObject = event.streams[0];
+                        commentaryAudio.muted = !commentaryToggle.checked;
+                    } else {
                         remoteAudio.srcObject = event.streams[0];
                     }
                 };
 
+                // The server pushes genre and listener updates on "metadata"
+                pc.ondatachannel = (event) => {
+                    if (event.channel.label !== 'metadata') return;
+                    const channel = event.channel;
+                    channel.onopen = () => { metadataReady = true; };
+                    channel.onclose = () => { metadataReady = false; };
+                    channel.onmessage = (msg) => handleMetadata(JSON.parse(msg.data));
+                };
+
                 remoteAudio.onplaying = () => {
                     isConnecting = false;
                     isPlaying = true;
                     playPauseBtn.disabled = false;
                     playPauseIcon.className = 'fas fa-pause';
+                    showNowPlaying();
                     // Fetch current genre from server for accurate display
                     fetchCurrentGenre();
+                    setNightMode(nightModeToggle.checked);
                 };
 
                 pc.oniceconnectionstatechange = () => {
-                    if (pc.iceConnectionState === 'failed' || pc.iceConnectionState === 'disconnected' || pc.iceConnectionState === 'closed') {
-                        isConnecting = false;
-                        isPlaying = false;
-                        playPauseBtn.disabled = false;
-                        playPauseIcon.className = 'fas fa-play';
-                        updateStatus('Connection lost. Please try again.');
-                        if (pc) {
-                            pc.close();
-                            pc = null;
-                        }
+                    const state = pc.iceConnectionState;
+                    if (state === 'failed' || state === 'disconnected') {
+                        // The network probably changed; keep the session and restart ICE
+                        restartIce().then(ok => { if (!ok) resumeOrGiveUp(); });
+                    } else if (state === 'closed') {
+                        connectionLost();
+                    } else if (state === 'connected' && isPlaying) {
+                        showNowPlaying();
                     }
                 };
 
                 pc.addTransceiver('audio', { direction: 'recvonly' });
-                
-                const offer = await pc.createOffer();
-                await pc.setLocalDescription(offer);
-                
-                await new Promise(resolve => {
-                    if (pc.iceGatheringState === 'complete') {
-                        resolve();
-                    } else {
-                        pc.addEventListener('icegatheringstatechange', () => {
-                            if (pc.iceGatheringState === 'complete') {
-                                resolve();
-                            }
-                        }, { once: true });
-                        // Also resolve after a timeout to avoid hanging
-                        setTimeout(resolve, 1000);
+                pc.addTransceiver('audio', { direction: 'recvonly' }); // commentary, if the station has it
+                openControlChannel();
+
+                if (resume) {
+                    // Get our session back without the probe, token or waitlist
+                    if (await postReconnect(resume)) return;
+                    pc.close();
+                    pc = null;
+                    return startConnection();
+                }
+
+                listenerToken = await fetchListenerToken();
+
+                // Trickle ICE over a WebSocket, or long polling where
+                // WebSockets are blocked, falling back to a plain POST
+                let rejection;
+                try {
+                    rejection = await signalWebSocket();
+                } catch (error) {
+                    console.warn('WebSocket signaling unavailable, using /poll:', error);
+                    try {
+                        rejection = await signalLongPoll();
+                    } catch (error) {
+                        console.warn('Long-poll signaling unavailable, using /offer:', error);
+                        rejection = await postOffer();
                     }
-                });
-                
-                const response = await fetch('/offer', {
-                    method: 'POST',
-                    headers: {'Content-Type': 'application/json'},
-                    body: JSON.stringify(pc.localDescription)
-                });
+                }
 
-                if (!response.ok) throw new Error('Server failed to provide an answer.');
+                if (rejection) {
+                    // Station is offline or over its listener quota; wait our turn if it keeps a waitlist
+                    pc.close();
+                    pc = null;
+                    if (rejection.error === 'station_moved') {
+                        moveStation(rejection);
+                        return;
+                    }
+                    if (rejection.error === 'shutting_down') {
+                        updateStatus('Server restarting, retrying in ' + rejection.retry_after + 's...');
+                        setTimeout(startConnection, rejection.retry_after * 1000);
+                        return;
+                    }
+                    if (rejection.error === 'rate_limited') {
+                        updateStatus('Too many attempts, retrying in ' + rejection.retry_after + 's...');
+                        setTimeout(startConnection, rejection.retry_after * 1000);
+                        return;
+                    }
+                    if (rejection.error === 'server_busy') {
+                        updateStatus('Server busy, retrying in ' + rejection.retry_after + 's...');
+                        setTimeout(startConnection, rejection.retry_after * 1000);
+                        return;
+                    }
+                    if (rejection.error === 'station_offline') {
+                        updateStatus('Station offline, retrying in ' + rejection.retry_after + 's...');
+                        setTimeout(startConnection, rejection.retry_after * 1000);
+                        return;
+                    }
+                    if (rejection.waitlist_ticket) {
+                        waitlistTicket = rejection.waitlist_ticket;
+                        updateStatus('Station full, you are #' + rejection.position + ' in line...');
+                        setTimeout(startConnection, rejection.retry_after * 1000);
+                        return;
+                    }
+                    if (rejection.error === 'station_full') {
+                        throw new Error('Station is full, please try again later.');
+                    }
+                    if (rejection.error === 'token_required' || rejection.error === 'invalid_token') {
+                        throw new Error('This station did not let the player in.');
+                    }
+                    throw new Error('Server failed to provide an answer.');
+                }
+                waitlistTicket = null;
+                handoffToken = null;
 
-                const answer = await response.json();
-                await pc.setRemoteDescription(new RTCSessionDescription(answer));
-                
             } catch (error) {
                 console.error('Connection Error:', error);
                 updateStatus('Error: ' + error.message);
@@ -744,19 +1341,415 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
             }
         }
 
+        // The station was handed off to another server: reconnect there
+        function moveStation(target) {
+            sessionStorage.removeItem(resumeKey);
+            serverBase = target.url;
+            handoffToken = target.token;
+            updateStatus(target.url ? 'Station moved, reconnecting...' : 'Server restarting, reconnecting...');
+            if (pc) {
+                pc.close();
+                pc = null;
+            }
+            sessionId = null;
+            // A restarting server asks us to wait until the new process is up
+            setTimeout(startConnection, target.after_ms || 0);
+        }
+
+        // Used when ICE can't be restarted: while the server still holds the
+        // session, reconnect to it right away instead of giving up.
+        function resumeOrGiveUp() {
+            const resumable = sessionStorage.getItem(resumeKey) !== null;
+            connectionLost();
+            if (resumable) startConnection();
+        }
+
+        function connectionLost() {
+            isConnecting = false;
+            isPlaying = false;
+            playPauseBtn.disabled = false;
+            playPauseIcon.className = 'fas fa-play';
+            updateStatus('Connection lost. Please try again.');
+            if (nightAudio) {
+                nightAudio.ctx.close();
+                nightAudio = null;
+                remoteAudio.muted = false;
+            }
+            if (pc) {
+                pc.close();
+                pc = null;
+            }
+            sessionId = null;
+        }
+
+        // Creates an offer that asks for NACKs on Opus. Browsers leave them
+        // out for audio, but honour them when the offer has them, so lost
+        // packets can be resent instead of concealed.
+        async function createOffer(options) {
+            const offer = await pc.createOffer(options);
+            if (/a=rtcp-fb:\d+ nack\r\n/.test(offer.sdp)) return offer;
+            const sdp = offer.sdp.replace(/(a=rtpmap:(\d+) opus\/48000[^\r\n]*\r\n)/i, '$1a=rtcp-fb:$2 nack\r\n');
+            return {type: offer.type, sdp: sdp};
+        }
+
+        // Renegotiates ICE for the current session without dropping the
+        // audio track. Resolves to false if the session can't be recovered.
+        async function restartIce() {
+            if (restarting) return true;
+            if (!pc || !sessionId) return false;
+            restarting = true;
+            updateStatus('Reconnecting...');
+            try {
+                await pc.setLocalDescription(await createOffer({ iceRestart: true }));
+                await waitForGathering();
+                const response = await fetch(serverBase + '/offer', {
+                    method: 'POST',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({
+                        type: pc.localDescription.type,
+                        sdp: pc.localDescription.sdp,
+                        session: sessionId
+                    })
+                });
+                if (!response.ok) return false;
+                const answer = await response.json();
+                await pc.setRemoteDescription(new RTCSessionDescription({type: answer.type, sdp: answer.sdp}));
+                return true;
+            } catch (error) {
+                console.warn('ICE restart failed:', error);
+                return false;
+            } finally {
+                restarting = false;
+            }
+        }
+
+        function waitForGathering() {
+            return new Promise(resolve => {
+                if (pc.iceGatheringState === 'complete') {
+                    resolve();
+                } else {
+                    pc.addEventListener('icegatheringstatechange', () => {
+                        if (pc.iceGatheringState === 'complete') {
+                            resolve();
+                        }
+                    }, { once: true });
+                    // Also resolve after a timeout to avoid hanging
+                    setTimeout(resolve, 1000);
+                }
+            });
+        }
+
+        // Measures round trip time and bandwidth so the server can pick a
+        // quality, and warns when the connection is too slow for any of them
+        async function runProbe() {
+            try {
+                let info;
+                let rtt = Infinity;
+                for (let i = 0; i < 3; i++) {
+                    const start = performance.now();
+                    info = await (await fetch(serverBase + '/probe', { cache: 'no-store' })).json();
+                    rtt = Math.min(rtt, performance.now() - start);
+                }
+                const start = performance.now();
+                const body = await (await fetch(serverBase + '/probe?size=262144', { cache: 'no-store' })).arrayBuffer();
+                const seconds = Math.max((performance.now() - start - rtt) / 1000, 0.001);
+                const result = { down_kbps: body.byteLength * 8 / 1000 / seconds, rtt_ms: rtt };
+                if (result.down_kbps < info.min_kbps) {
+                    updateStatus('Connecting... your connection looks too slow for this station, playback may stutter');
+                }
+                return result;
+            } catch (error) {
+                console.warn('Connection probe failed:', error);
+                return null;
+            }
+        }
+
+        // A token for /offer and /ws. Stations that don't require one still
+        // issue it, so a failure only matters on those that do.
+        async function fetchListenerToken() {
+            try {
+                const response = await fetch(serverBase + '/api/token', { method: 'POST', cache: 'no-store' });
+                if (!response.ok) return null;
+                return (await response.json()).token;
+            } catch (error) {
+                console.warn('Could not get a listener token:', error);
+                return null;
+            }
+        }
+
+        // The station's STUN/TURN servers, with fresh TURN credentials
+        async function fetchIceServers() {
+            try {
+                const response = await fetch(serverBase + '/ice-servers');
+                if (response.ok) return (await response.json()).iceServers;
+            } catch (error) {
+                console.warn('Could not fetch ICE servers:', error);
+            }
+            return [{urls: 'stun:stun.l.google.com:19302'}];
+        }
+
+        // Sends the offer over /ws and trickles candidates both ways. Resolves
+        // once the answer is applied, or with the server's rejection.
+        function signalWebSocket() {
+            return new Promise((resolve, reject) => {
+                const scheme = location.protocol === 'https:' ? 'wss://' : 'ws://';
+                const base = serverBase ? serverBase.replace(/^http/, 'ws') : scheme + location.host;
+                const ws = new WebSocket(base + '/ws' + (listenerToken ? '?token=' + encodeURIComponent(listenerToken) : ''));
+                let settled = false;
+                let queue = Promise.resolve();
+
+                ws.onopen = async () => {
+                    pc.onicecandidate = (event) => {
+                        if (event.candidate && ws.readyState === WebSocket.OPEN) {
+                            ws.send(JSON.stringify({type: 'candidate', candidate: event.candidate.toJSON()}));
+                        }
+                    };
+                    const offer = await createOffer();
+                    await pc.setLocalDescription(offer);
+                    ws.send(JSON.stringify({type: 'offer', sdp: offer.sdp, ticket: waitlistTicket, probe: probeResult, handoff: handoffToken, ...localClock}));
+                };
+
+                // Handle messages in order so no candidate is added before the answer
+                ws.onmessage = (event) => {
+                    const msg = JSON.parse(event.data);
+                    queue = queue.then(async () => {
+                        if (msg.type === 'answer') {
+                            sessionId = msg.session;
+                            saveResume(msg);
+                            noteReadiness(msg);
+                            await pc.setRemoteDescription(new RTCSessionDescription({type: msg.type, sdp: msg.sdp}));
+                            settled = true;
+                            resolve(null);
+                        } else if (msg.type === 'candidate' && msg.candidate && pc) {
+                            await pc.addIceCandidate(msg.candidate);
+                        } else if (msg.type === 'error') {
+                            settled = true;
+                            ws.close();
+                            resolve(msg);
+                        }
+                    }).catch(error => console.error('Signaling error:', error));
+                };
+
+                ws.onclose = () => {
+                    if (pc) pc.onicecandidate = null;
+                    if (!settled) {
+                        settled = true;
+                        reject(new Error('signaling socket closed'));
+                    }
+                };
+            });
+        }
+
+        // Sends the offer to /poll and trickles candidates over plain HTTP:
+        // ours are POSTed as they come, the server's are long-polled for.
+        // Resolves once the answer is applied, or with the server's rejection.
+        async function signalLongPoll() {
+            let channel = null;
+            let early = [];
+            const sendCandidates = (candidates) => {
+                fetch(serverBase + '/poll/' + channel, {
+                    method: 'POST',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({candidates: candidates})
+                }).catch(error => console.warn('Could not send ICE candidates:', error));
+            };
+            pc.onicecandidate = (event) => {
+                if (!event.candidate) return;
+                if (channel) sendCandidates([event.candidate.toJSON()]);
+                else early.push(event.candidate.toJSON());
+            };
+
+            const offer = await createOffer();
+            await pc.setLocalDescription(offer);
+            const headers = {'Content-Type': 'application/json'};
+            if (listenerToken) headers['Authorization'] = 'Bearer ' + listenerToken;
+            const response = await fetch(serverBase + '/poll', {
+                method: 'POST',
+                headers: headers,
+                body: JSON.stringify({type: 'offer', sdp: offer.sdp, ticket: waitlistTicket, probe: probeResult, handoff: handoffToken, ...localClock})
+            });
+            if (response.status === 503 || response.status === 401 || response.status === 429) return await response.json();
+            if (!response.ok) throw new Error('long-poll signaling failed with ' + response.status);
+
+            const answer = await response.json();
+            sessionId = answer.session;
+            saveResume(answer);
+            noteReadiness(answer);
+            await pc.setRemoteDescription(new RTCSessionDescription({type: answer.type, sdp: answer.sdp}));
+            channel = answer.channel;
+            if (early.length) sendCandidates(early);
+            early = [];
+            pollServerCandidates(pc, channel);
+            return null;
+        }
+
+        // Long-polls for the server's candidates until it has sent them all
+        // or the connection is replaced.
+        async function pollServerCandidates(target, channel) {
+            let after = 0;
+            while (pc === target) {
+                let batch;
+                try {
+                    const response = await fetch(serverBase + '/poll/' + channel + '?after=' + after, {cache: 'no-store'});
+                    if (!response.ok) return;
+                    batch = await response.json();
+                } catch (error) {
+                    console.warn('Long-poll signaling error:', error);
+                    return;
+                }
+                for (const msg of batch.messages) {
+                    if (!msg.candidate) return;
+                    await target.addIceCandidate(msg.candidate);
+                }
+                after = batch.next;
+            }
+        }
+
+        async function postOffer() {
+            pc.onicecandidate = null;
+            if (!pc.localDescription) {
+                await pc.setLocalDescription(await createOffer());
+            }
+
+            await waitForGathering();
+
+            const headers = {'Content-Type': 'application/json'};
+            if (listenerToken) headers['Authorization'] = 'Bearer ' + listenerToken;
+            const response = await fetch(serverBase + '/offer', {
+                method: 'POST',
+                headers: headers,
+                body: JSON.stringify({
+                    type: pc.localDescription.type,
+                    sdp: pc.localDescription.sdp,
+                    ticket: waitlistTicket,
+                    probe: probeResult,
+                    handoff: handoffToken,
+                    ...localClock
+                })
+            });
+            if (response.status === 503 || response.status === 401 || response.status === 429) return await response.json();
+            if (!response.ok) throw new Error('Server failed to provide an answer.');
+
+            const answer = await response.json();
+            sessionId = answer.session;
+            saveResume(answer);
+            noteReadiness(answer);
+            await pc.setRemoteDescription(new RTCSessionDescription({type: answer.type, sdp: answer.sdp}));
+            return null;
+        }
+
+        // The session and its resume token outlive a page reload in
+        // sessionStorage, so /reconnect can pick the session back up.
+        const resumeKey = 'radioResume';
+
+        function saveResume(answer) {
+            if (!answer.resume) return;
+            sessionStorage.setItem(resumeKey, JSON.stringify({server: serverBase, session: answer.session, resume: answer.resume}));
+        }
+
+        function takeResume() {
+            const saved = sessionStorage.getItem(resumeKey);
+            sessionStorage.removeItem(resumeKey);
+            return saved ? JSON.parse(saved) : null;
+        }
+
+        // Sends the offer to /reconnect without waiting for ICE gathering and
+        // trickles candidates both ways over the long-poll channel in the
+        // answer. Resolves to false if the session can't be resumed.
+        async function postReconnect(saved) {
+            let channel = null;
+            let early = [];
+            const sendCandidates = (candidates) => {
+                fetch(serverBase + '/poll/' + channel, {
+                    method: 'POST',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({candidates: candidates})
+                }).catch(error => console.warn('Could not send ICE candidates:', error));
+            };
+            pc.onicecandidate = (event) => {
+                if (!event.candidate) return;
+                if (channel) sendCandidates([event.candidate.toJSON()]);
+                else early.push(event.candidate.toJSON());
+            };
+            try {
+                await pc.setLocalDescription(await createOffer());
+                const response = await fetch(saved.server + '/reconnect', {
+                    method: 'POST',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({
+                        type: pc.localDescription.type,
+                        sdp: pc.localDescription.sdp,
+                        session: saved.session,
+                        resume: saved.resume
+                    })
+                });
+                if (!response.ok) return false;
+                const answer = await response.json();
+                serverBase = saved.server;
+                sessionId = answer.session;
+                saveResume(answer);
+                noteReadiness(answer);
+                await pc.setRemoteDescription(new RTCSessionDescription({type: answer.type, sdp: answer.sdp}));
+                channel = answer.channel;
+                if (early.length) sendCandidates(early);
+                early = [];
+                pollServerCandidates(pc, channel);
+                return true;
+            } catch (error) {
+                console.warn('Could not resume the session:', error);
+                return false;
+            }
+        }
+
         function updateStatus(message) {
             statusDiv.textContent = message;
         }
 
+        // The server writes a receipt when a session ends. The next visit
+        // fetches the last one, which only works once, for a recap.
+        const receiptKey = 'radioReceipt';
+
+        async function showLastReceipt() {
+            const saved = JSON.parse(localStorage.getItem(receiptKey) || 'null');
+            if (!saved) return;
+            try {
+                const response = await fetch(saved.url);
+                // A session the server hasn't noticed ending yet has no
+                // receipt for a while; receipts are kept for a day
+                if (response.status === 404 && Date.now() - saved.at < 24 * 3600 * 1000) return;
+                localStorage.removeItem(receiptKey);
+                if (!response.ok) return;
+                const receipt = await response.json();
+                const minutes = Math.round(receipt.duration_s / 60);
+                if (minutes < 1 || pc) return;
+                const hours = Math.floor(minutes / 60);
+                const listened = hours > 0 ? hours + 'h ' + (minutes % 60) + 'm' : minutes + 'm';
+                const genres = receipt.genres.length > 0 ? ' of ' + receipt.genres.map(genreLabel).join(', ') : '';
+                updateStatus('Last time you listened for ' + listened + genres);
+            } catch (error) {
+                console.warn('Could not fetch the last receipt:', error);
+            }
+        }
+
+        function handleMetadata(meta) {
+            currentGenre = meta.genre;
+            if (isPlaying) {
+                const listening = meta.listeners === 1 ? '1 listener' : meta.listeners + ' listeners';
+                updateStatus('Now Playing: ' + genreLabel(currentGenre) + ' (' + listening + ')');
+            }
+        }
+
         async function fetchCurrentGenre() {
+            // The control and metadata channels push genre changes as they happen
+            if (controlReady || metadataReady) return;
             try {
-                const response = await fetch('/current-genre');
+                const response = await fetch(serverBase + '/current-genre');
                 if (response.ok) {
                     const data = await response.json();
                     currentGenre = data.genre;
                     // Update status if currently playing
                     if (isPlaying) {
-                        updateStatus('Now Playing: ' + currentGenre);
+                        showNowPlaying();
                     }
                 }
             } catch (error) {
@@ -764,6 +1757,43 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
             }
         }
 
+        // The preset buttons come from the station's genre taxonomy, and
+        // genres are shown by their label in the listener's language
+        let genreTaxonomy = [];
+
+        function genreLabel(genre) {
+            const key = genre.toLowerCase();
+            const g = genreTaxonomy.find(g => g.id === key || (g.prompt || g.id) === key || g.name.toLowerCase() === key);
+            if (!g) return genre;
+            const labels = g.labels || {};
+            for (const lang of navigator.languages || [navigator.language]) {
+                const label = labels[lang] || labels[lang.split('-')[0]];
+                if (label) return label;
+            }
+            return g.name;
+        }
+
+        async function loadTaxonomy() {
+            try {
+                const response = await fetch(serverBase + '/genres/taxonomy');
+                if (!response.ok) return;
+                genreTaxonomy = (await response.json()).genres;
+            } catch (error) {
+                console.warn('Could not load the genre taxonomy:', error);
+                return;
+            }
+            const grid = document.querySelector('.genre-grid');
+            grid.replaceChildren(...genreTaxonomy.map(g => {
+                const btn = document.createElement('button');
+                btn.className = 'genre-btn';
+                btn.classList.toggle('active', g.id === currentGenre);
+                btn.dataset.genre = g.id;
+                btn.textContent = (g.emoji ? g.emoji + ' ' : '') + genreLabel(g.id);
+                btn.onclick = (event) => changeGenre(g.id, event);
+                return btn;
+            }));
+        }
+
         async function changeGenre(genre, event) {
             // Update UI for preset buttons
             if (event) {
@@ -795,21 +1825,39 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
         }
 
         async function sendGenreRequest(genre) {
+            if (controlReady) {
+                try {
+                    const decision = await controlCall('genre.set', { genre });
+                    if (!decision.accepted) {
+                        updateStatus('Queued: ' + decision.reason);
+                    }
+                } catch (error) {
+                    console.error('Error changing genre:', error);
+                    updateStatus('Failed to change genre.');
+                }
+                return;
+            }
             try {
-                const response = await fetch('/genre', {
+                const response = await fetch(serverBase + '/genre', {
                     method: 'POST',
                     headers: {'Content-Type': 'application/json'},
                     body: JSON.stringify({ 
                         genre: genre
                     })
                 });
+                if (response.status === 409) {
+                    // A higher-priority request (schedule, vote, admin) holds the station
+                    const data = await response.json();
+                    updateStatus('Queued: ' + data.reason);
+                    return;
+                }
                 if (!response.ok) throw new Error('Server request failed.');
                 console.log('Genre change request sent for:', genre);
                 
                 // Update local genre and status after successful request
                 currentGenre = genre;
                 if (isPlaying) {
-                    updateStatus('Now Playing: ' + genre);
+                    updateStatus('Now Playing: ' + genreLabel(genre));
                 }
             } catch (error) {
                 console.error('Error changing genre:', error);
@@ -819,6 +1867,8 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 
         // Initialize - fetch current genre on page load
         fetchCurrentGenre();
+        loadTaxonomy();
+        showLastReceipt();
         
         // Periodically check for external genre changes (every 3 seconds)
         setInterval(fetchCurrentGenre, 3000);
@@ -826,4 +1876,4 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
     </script>
 </body>
 </html>`)
-}
\ No newline at end of file
+}
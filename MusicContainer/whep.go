@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// WHEP (WebRTC-HTTP Egress Protocol, draft-ietf-wish-whep) lets standard players
+// such as OBS or GStreamer's whepsrc pull the stream:
+//
+//	POST   /whep       SDP offer in, 201 with the SDP answer and a Location
+//	PATCH  /whep/<id>  trickled candidates as an application/trickle-ice-sdpfrag,
+//	                   or new ICE credentials to restart ICE
+//	DELETE /whep/<id>  hang up
+//
+// The answer already carries all of the server's candidates.
+
+const (
+	whepPath           = "/whep"
+	sdpContentType     = "application/sdp"
+	sdpfragContentType = "application/trickle-ice-sdpfrag"
+)
+
+func handleWHEP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, whepPath), "/")
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Accept-Post", sdpContentType)
+		w.WriteHeader(http.StatusNoContent)
+	case id == "" && r.Method == http.MethodPost:
+		whepOffer(w, r)
+	case id != "" && r.Method == http.MethodPatch:
+		whepTrickle(w, r, id)
+	case id != "" && r.Method == http.MethodDelete:
+		whepHangUp(w, r, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func whepOffer(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), sdpContentType) {
+		http.Error(w, "Expected "+sdpContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading WHEP offer: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	admitted, code := admit(r, r.URL.Query().Get("handoff"), "")
+	if code != "" {
+		writeAdmissionRejection(w, admitted, code)
+		return
+	}
+	sess := admitted.session
+
+	peerConnection, err := newListenerPeer(sess)
+	if err != nil {
+		log.Printf("Error setting up peer connection: %v", err)
+		sessions.Remove(sess.id)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	answerSDP, err := answerOffer(peerConnection, string(body))
+	if err != nil {
+		log.Printf("Error answering WHEP offer: %v", err)
+		sessions.Remove(sess.id)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("Location", whepPath+"/"+sess.id)
+	setICEServerLinks(w)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answerSDP)
+	log.Printf("WHEP session %s started for %s", sess.id, r.RemoteAddr)
+}
+
+func whepTrickle(w http.ResponseWriter, r *http.Request, id string) {
+	sess := sessions.Get(id)
+	if sess == nil || sess.pc == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), sdpfragContentType) {
+		http.Error(w, "Expected "+sdpfragContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	frag := parseSDPFrag(r.Body)
+	if remote := sess.pc.RemoteDescription(); frag.ufrag != "" && remote != nil && !strings.Contains(remote.SDP, "a=ice-ufrag:"+frag.ufrag) {
+		// New credentials ask for an ICE restart
+		whepRestart(w, sess, remote.SDP, frag)
+		return
+	}
+	candidates := frag.candidates
+	for _, c := range candidates {
+		if err := sess.pc.AddICECandidate(c); err != nil {
+			log.Printf("Error adding WHEP candidate for %s: %v", id, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func whepHangUp(w http.ResponseWriter, r *http.Request, id string) {
+	sess := sessions.Get(id)
+	if sess == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	sessions.close(id, "hangup")
+	log.Printf("WHEP session %s ended by %s", id, r.RemoteAddr)
+	w.WriteHeader(http.StatusOK)
+}
+
+// whepRestart restarts ICE with the credentials from a PATCH and replies
+// with the server's new credentials and candidates as an sdpfrag. The offer
+// is the client's previous one with its ICE lines swapped for the new ones.
+func whepRestart(w http.ResponseWriter, sess *session, previous string, frag sdpFrag) {
+	if frag.pwd == "" {
+		http.Error(w, "ICE restart without a password", http.StatusBadRequest)
+		return
+	}
+	var offer strings.Builder
+	for _, line := range strings.Split(previous, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			line = "a=ice-ufrag:" + frag.ufrag
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			line = "a=ice-pwd:" + frag.pwd
+		case strings.HasPrefix(line, "a=candidate:"), line == "a=end-of-candidates":
+			continue
+		}
+		offer.WriteString(line + "\r\n")
+	}
+
+	answerSDP, err := restartICE(sess.id, offer.String())
+	if err == errNoSession {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error restarting ICE for WHEP session %s: %v", sess.id, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, c := range frag.candidates {
+		if err := sess.pc.AddICECandidate(c); err != nil {
+			log.Printf("Error adding WHEP candidate for %s: %v", sess.id, err)
+		}
+	}
+
+	// Session-level lines first, then each media section's mid and candidates
+	var out, media strings.Builder
+	var ufrag, pwd bool
+	for _, line := range strings.Split(answerSDP, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			if !ufrag {
+				out.WriteString(line + "\r\n")
+			}
+			ufrag = true
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			if !pwd {
+				out.WriteString(line + "\r\n")
+			}
+			pwd = true
+		case strings.HasPrefix(line, "m="), strings.HasPrefix(line, "a=mid:"),
+			strings.HasPrefix(line, "a=candidate:"), line == "a=end-of-candidates":
+			media.WriteString(line + "\r\n")
+		}
+	}
+	w.Header().Set("Content-Type", sdpfragContentType)
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, out.String()+media.String())
+}
+
+// sdpFrag is a parsed trickle-ice-sdpfrag.
+type sdpFrag struct {
+	candidates []webrtc.ICECandidateInit
+	ufrag, pwd string // the client's ICE credentials, if it sent them
+}
+
+// parseSDPFrag reads the candidates and ICE credentials out of a
+// trickle-ice-sdpfrag (RFC 8840).
+func parseSDPFrag(r io.Reader) sdpFrag {
+	var (
+		frag  sdpFrag
+		mid   *string
+		mline = -1
+	)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case strings.HasPrefix(line, "m="):
+			mline++
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			m := strings.TrimPrefix(line, "a=mid:")
+			mid = &m
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			frag.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			frag.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			c := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a="), SDPMid: mid}
+			if mid == nil && mline >= 0 {
+				index := uint16(mline)
+				c.SDPMLineIndex = &index
+			}
+			frag.candidates = append(frag.candidates, c)
+		}
+	}
+	return frag
+}
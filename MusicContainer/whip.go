@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+	"gopkg.in/hraban/opus.v2"
+)
+
+// WHIP (WebRTC-HTTP Ingestion Protocol, RFC 9725) lets an external WebRTC
+// encoder such as OBS publish an Opus track in place of the pipe:
+//
+//	POST   /whip       SDP offer in, 201 with the SDP answer and a Location
+//	DELETE /whip/<id>  stop publishing
+//
+// Publishers authenticate with "Authorization: Bearer <stream key>", using
+// the stream key of one of the audio.ingest.sources. The decoded audio feeds
+// that source's stem, and a source publishing over WHIP replaces any TCP
+// connection it had open, and vice versa.
+
+const whipPath = "/whip"
+
+var (
+	whipMu      sync.Mutex
+	whipFormat  struct{ sampleRate, channels, samplesPerFrame int } // zero until the pipeline runs
+	whipStreams = make(map[string]*webrtc.PeerConnection)           // resource ID -> publisher
+)
+
+// enableWHIP starts accepting publishers once the pipeline knows its format.
+func enableWHIP(sampleRate, channels, samplesPerFrame int) {
+	whipMu.Lock()
+	defer whipMu.Unlock()
+	whipFormat.sampleRate = sampleRate
+	whipFormat.channels = channels
+	whipFormat.samplesPerFrame = samplesPerFrame
+}
+
+func handleWHIP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, whipPath), "/")
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Accept-Post", sdpContentType)
+		w.WriteHeader(http.StatusNoContent)
+	case id == "" && r.Method == http.MethodPost:
+		whipPublish(w, r)
+	case id != "" && r.Method == http.MethodDelete:
+		whipMu.Lock()
+		pc := whipStreams[id]
+		whipMu.Unlock()
+		if pc == nil {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+		pc.Close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// whipSource returns the ingest source whose stream key is the bearer token.
+func whipSource(r *http.Request) *IngestSource {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil
+	}
+	sources := cfg.Audio.Ingest.Sources
+	for i := range sources {
+		src := &sources[i]
+		if src.StreamKey != "" && src.Station == cfg.Station.ID &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(src.StreamKey)) == 1 {
+			return src
+		}
+	}
+	return nil
+}
+
+func whipPublish(w http.ResponseWriter, r *http.Request) {
+	src := whipSource(r)
+	if src == nil {
+		ingestAuthFailures.Inc("source", "whip")
+		log.Printf("Error authenticating WHIP publisher %s", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), sdpContentType) {
+		http.Error(w, "Expected "+sdpContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	whipMu.Lock()
+	format := whipFormat
+	whipMu.Unlock()
+	stem := src.Stem
+	if stem == "" {
+		stem = currentStems()[0].Name
+	}
+	input := stemInput(stem)
+	if format.sampleRate == 0 || input == nil {
+		http.Error(w, "Station is not ready for ingest", http.StatusServiceUnavailable)
+		return
+	}
+
+	peerConnection, _, err := newPeerConnection(false)
+	if err != nil {
+		log.Printf("Error creating WHIP peer connection: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		log.Printf("Error adding WHIP transceiver: %v", err)
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id := newSessionID()
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if !strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeOpus) {
+			log.Printf("Ignoring %s track from WHIP source %s", track.Codec().MimeType, src.Name)
+			return
+		}
+		readWHIPTrack(track, src.Name, format.sampleRate, format.channels, format.samplesPerFrame, input)
+	})
+	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		switch s {
+		case webrtc.PeerConnectionStateFailed:
+			peerConnection.Close()
+		case webrtc.PeerConnectionStateConnected:
+			claimIngest(src.Name, peerConnection)
+			log.Printf("WHIP source %s connected from %s, feeding stem %s", src.Name, r.RemoteAddr, stem)
+			status.Publish("ingest", map[string]string{"source": src.Name, "state": "connected", "transport": "whip"})
+		case webrtc.PeerConnectionStateClosed:
+			whipMu.Lock()
+			delete(whipStreams, id)
+			whipMu.Unlock()
+			releaseIngest(src.Name, peerConnection)
+			log.Printf("WHIP source %s disconnected", src.Name)
+			status.Publish("ingest", map[string]string{"source": src.Name, "state": "disconnected", "transport": "whip"})
+		}
+	})
+
+	answerSDP, err := answerOffer(peerConnection, string(body))
+	if err != nil {
+		log.Printf("Error answering WHIP offer: %v", err)
+		peerConnection.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	whipMu.Lock()
+	whipStreams[id] = peerConnection
+	whipMu.Unlock()
+
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("Location", whipPath+"/"+id)
+	setICEServerLinks(w)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answerSDP)
+}
+
+// readWHIPTrack decodes the publisher's Opus packets and feeds the PCM to
+// the stem in pipeline-sized frames. Short gaps are filled by the decoder's
+// packet loss concealment.
+func readWHIPTrack(track *webrtc.TrackRemote, source string, sampleRate, channels, samplesPerFrame int, input chan<- []byte) {
+	dec, err := opus.NewDecoder(sampleRate, channels)
+	if err != nil {
+		log.Printf("Error creating decoder for WHIP source %s: %v", source, err)
+		return
+	}
+	bytesPerFrame := samplesPerFrame * channels * 2
+	pcm := make([]int16, sampleRate*channels*120/1000) // the longest Opus packet
+	var pending []byte
+	emit := func(samples []int16) {
+		for _, s := range samples {
+			pending = binary.LittleEndian.AppendUint16(pending, uint16(s))
+		}
+		for len(pending) >= bytesPerFrame {
+			input <- pcmBytes.clone(pending[:bytesPerFrame])
+			pending = pending[bytesPerFrame:]
+		}
+	}
+
+	var lastSeq uint16
+	started := false
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if gap := pkt.SequenceNumber - lastSeq - 1; started && gap > 0 && gap < 5 {
+			for i := uint16(0); i < gap; i++ {
+				plc := pcm[:samplesPerFrame*channels]
+				if dec.DecodePLC(plc) == nil {
+					emit(plc)
+				}
+			}
+		}
+		lastSeq, started = pkt.SequenceNumber, true
+
+		n, err := dec.Decode(pkt.Payload, pcm)
+		if err != nil {
+			log.Printf("Error decoding WHIP audio from %s: %v", source, err)
+			continue
+		}
+		emit(pcm[:n*channels])
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// /ws is the WebSocket alternative to /offer. Instead of waiting for ICE
+// gathering to finish, the answer is sent straight away and candidates are
+// trickled in both directions as they are found, so connections come up in
+// about one round trip.
+//
+// The client sends {"type":"offer","sdp":...,"ticket":...} first, then any
+// number of {"type":"candidate","candidate":{...}}. The server replies with
+// {"type":"answer","sdp":...,"session":...}, its own candidates, and a candidate of null
+// once gathering is done. Rejections arrive as {"type":"error",...} with the
+// same fields /offer puts in its 503 body.
+
+const wsSignalTimeout = 30 * time.Second // to finish signaling once connected
+
+var wsUpgrader = websocket.Upgrader{
+	// Signaling is as open as /offer, which allows any origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type wsMessage struct {
+	Type      string                   `json:"type"`
+	SDP       string                   `json:"sdp,omitempty"`
+	Ticket    string                   `json:"ticket,omitempty"`
+	Probe     *ProbeResult             `json:"probe,omitempty"`
+	Handoff   string                   `json:"handoff,omitempty"`
+	TZ        string                   `json:"tz,omitempty"`
+	UTCOffset *int                     `json:"utc_offset,omitempty"`
+	Candidate *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+}
+
+// wsSignaler serializes writes to the socket and holds back local candidates
+// until the answer has been sent.
+type wsSignaler struct {
+	conn     *websocket.Conn
+	mu       sync.Mutex
+	answered bool
+	pending  []interface{}
+}
+
+func (s *wsSignaler) send(v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.write(v)
+}
+
+func (s *wsSignaler) write(v interface{}) {
+	if err := s.conn.WriteJSON(v); err != nil {
+		log.Printf("Error writing to signaling socket: %v", err)
+	}
+}
+
+// candidate sends a local candidate, or the end-of-candidates marker for nil.
+func (s *wsSignaler) candidate(c *webrtc.ICECandidate) {
+	msg := map[string]interface{}{"type": "candidate", "candidate": nil}
+	if c != nil {
+		if answerFilter.dropCandidate(c) {
+			return
+		}
+		msg["candidate"] = c.ToJSON()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.answered {
+		s.pending = append(s.pending, msg)
+		return
+	}
+	s.write(msg)
+}
+
+// answer sends the answer followed by any candidates found before it.
+func (s *wsSignaler) answer(sdp string, sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.write(answer{Type: "answer", SDP: sdp, Session: sess.id, Bitrate: int(sess.bitrate.Load()), Resume: resumeToken(sess.id), Audio: currentReadiness()})
+	for _, msg := range s.pending {
+		s.write(msg)
+	}
+	s.answered = true
+	s.pending = nil
+}
+
+func (s *wsSignaler) reject(body map[string]interface{}) {
+	body["type"] = "error"
+	s.send(body)
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading signaling socket: %v", err)
+		return
+	}
+	defer conn.Close()
+	sig := &wsSignaler{conn: conn}
+
+	conn.SetReadDeadline(time.Now().Add(wsSignalTimeout))
+	var o wsMessage
+	if err := conn.ReadJSON(&o); err != nil || o.Type != "offer" {
+		log.Printf("Error reading offer from %s: expected an offer first", r.RemoteAddr)
+		sig.reject(map[string]interface{}{"error": "expected_offer"})
+		return
+	}
+	log.Printf("Received WebSocket offer from %s", r.RemoteAddr)
+
+	admitted, code := admit(r, o.Handoff, o.Ticket)
+	if code != "" {
+		sig.reject(admissionRejection(admitted, code))
+		return
+	}
+	sess := admitted.session
+	sess.setProbe(o.Probe)
+	sess.setLocalClock(o.TZ, o.UTCOffset)
+
+	peerConnection, err := newListenerPeer(sess)
+	if err != nil {
+		log.Printf("Error setting up peer connection: %v", err)
+		sessions.Remove(sess.id)
+		sig.reject(map[string]interface{}{"error": "internal"})
+		return
+	}
+	peerConnection.OnICECandidate(sig.candidate)
+
+	fail := func(what string, err error) {
+		log.Printf("Error %s: %v", what, err)
+		sessions.Remove(sess.id)
+		sig.reject(map[string]interface{}{"error": "internal"})
+	}
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  o.SDP,
+	}); err != nil {
+		fail("setting remote description", err)
+		return
+	}
+	answerSDP, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		fail("creating answer", err)
+		return
+	}
+	if err := peerConnection.SetLocalDescription(answerSDP); err != nil {
+		fail("setting local description", err)
+		return
+	}
+	sig.answer(applyAnswerHooks(answerSDP.SDP), sess)
+	log.Printf("Sent trickle answer to %s", r.RemoteAddr)
+
+	// Take remote candidates until the client hangs up; the peer connection
+	// lives on without the socket.
+	for {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Type != "candidate" || msg.Candidate == nil {
+			continue
+		}
+		if err := peerConnection.AddICECandidate(*msg.Candidate); err != nil {
+			log.Printf("Error adding ICE candidate from %s: %v", r.RemoteAddr, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(wsSignalTimeout))
+	}
+}